@@ -7,12 +7,13 @@ package main
 import (
 	"crypto/sha1"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/henyouqian/ssdbgo"
 )
 
 func _battlelog() {
@@ -33,16 +34,34 @@ const (
 )
 
 type Battle struct {
-	state      BattleState
-	readyConn  *Connection
-	secret     string
-	createTime time.Time
-	room       BattleRoom
-}
-
-type BattleRoom struct {
-	Name    string
-	BetCoin int
+	state       BattleState
+	ready       map[*Connection]bool
+	left        map[*Connection]bool
+	secret      string
+	createTime  time.Time
+	startTime   time.Time
+	room        BattleRoom
+	packId      int64
+	sliderNum   int
+	imageNum    int
+	isBot       bool
+	rematchConn *Connection
+	rematched   bool
+	id          string
+	players     []*Connection
+	playerInfos []*PlayerInfo //races, as paired
+	finishNum   int
+	finishes    map[*Connection]raceFinishRec //races, written on the hub
+
+	//spectators and what they need to catch up, guarded by specMu
+	specMu     sync.Mutex
+	spectators map[*Connection]bool
+	progress   map[*Connection]int
+
+	//talk transcript and who reported, guarded by chatMu
+	chatMu    sync.Mutex
+	chat      []ChatLine
+	reporters map[int64]bool
 }
 
 type BattleResult struct {
@@ -56,115 +75,128 @@ type BattleResult struct {
 	BattlePoint    int
 	WinStreak      int
 	WinstreakMax   int
+	SeasonId       int64
+	SeasonPoint    int
+	IsBot          bool
+	PayoutHeld     bool //coins wait for a collusion review
 }
 
-var (
-	BATTLE_ROOM_MAP = map[string]BattleRoom{
-		"free":   {"free", 0},
-		"coin1":  {"coin1", 1},
-		"coin2":  {"coin2", 2},
-		"coin5":  {"coin5", 5},
-		"coin10": {"coin10", 10},
-		"coin20": {"coin20", 20},
-	}
-)
-
 func makeBattle() *Battle {
 	battle := new(Battle)
 	battle.state = PREPARE
-	battle.readyConn = nil
+	battle.ready = make(map[*Connection]bool)
+	battle.left = make(map[*Connection]bool)
 	battle.secret = genUUID()
 	battle.createTime = time.Now()
+	battle.id = genUUID()
+	battle.spectators = make(map[*Connection]bool)
+	battle.progress = make(map[*Connection]int)
+	battle.finishes = make(map[*Connection]raceFinishRec)
 	return battle
 }
 
+func (battle *Battle) isRace() bool {
+	return len(battle.players) > 2
+}
+
+//players who left before the start don't hold up the rest
+func (battle *Battle) allReady() bool {
+	for _, c := range battle.players {
+		if !battle.left[c] && !battle.ready[c] {
+			return false
+		}
+	}
+	return true
+}
+
 func battleReady(conn *Connection, msg []byte) {
 	battle := conn.battle
 	if battle == nil || battle.state != PREPARE {
 		conn.sendErr("err_state")
 		return
 	}
-	if battle.readyConn == nil {
-		battle.readyConn = conn
+	if battle.ready[conn] {
+		return
+	}
+	battle.ready[conn] = true
+	if !battle.allReady() {
 		conn.sendType("ready")
-	} else if battle.readyConn == conn.foe {
-		dt := time.Now().Sub(battle.createTime)
-		waitTime := WAIT_TIME_SEC * time.Second
-		startMatch := func() {
-			battle.state = MATCHING
-			msg := []byte(`{"Type":"start"}`)
-			conn.send <- msg
-			conn.foe.send <- msg
+	} else {
+		battle.start()
+	}
+}
+
+//gives everyone at least WAIT_TIME_SEC from pairing to load the pack
+func (battle *Battle) start() {
+	dt := time.Now().Sub(battle.createTime)
+	waitTime := WAIT_TIME_SEC * time.Second
+	startMatch := func() {
+		battle.state = MATCHING
+		battle.startTime = time.Now()
+		msg := []byte(`{"Type":"start"}`)
+		for _, c := range battle.players {
+			if !battle.left[c] {
+				c.send <- msg
+			}
 		}
-		if dt < waitTime {
-			go func() {
-				time.Sleep(waitTime - dt)
-				startMatch()
-			}()
-		} else {
+		battle.sendSpectators(struct{ Type string }{"start"})
+	}
+	if dt < waitTime {
+		go func() {
+			time.Sleep(waitTime - dt)
 			startMatch()
-		}
+		}()
+	} else {
+		startMatch()
 	}
 }
 
 func battleProgress(conn *Connection, msg []byte) {
 	if conn.battle == nil {
-		conn.sendErr("need pair")
+		conn.sendErr("err_need_pair")
 		return
 	}
 	if conn.battle.state != MATCHING && conn.battle.state != FINISH {
-		conn.sendErr("battle state error")
+		conn.sendErr("err_state")
 		return
 	}
 
-	var in struct {
-		CompleteNum int
-	}
-
-	err := json.Unmarshal(msg, &in)
-	if err != nil {
-		conn.sendErr("json error")
+	var in MsgProgress
+	if !decodeMsg(conn, msg, &in) {
 		return
 	}
 
-	if in.CompleteNum <= 0 {
-		conn.sendErr("in.CompleteNum")
-		return
+	//bots play on their own clock and stop reading at their result
+	if conn.battle.isRace() {
+		raceProgress(conn, in.CompleteNum)
+	} else if foe := conn.foe; foe != nil && !foe.isBot {
+		foe.send <- msg
 	}
 
-	conn.foe.send <- msg
+	spectatorProgress(conn.battle, conn, in.CompleteNum)
 }
 
 func battleFinish(conn *Connection, msg []byte) {
 	if conn.battle == nil {
-		conn.sendErr("need pair")
+		conn.sendErr("err_need_pair")
 		return
 	}
 	if conn.battle.state == FINISH {
 		return
 	}
 	if conn.battle.state != MATCHING {
-		conn.sendErr("battle state error")
+		conn.sendErr("err_state")
 		return
 	}
 
 	//in
-	var in struct {
-		Msec     int
-		Checksum string
-	}
-
-	err := json.Unmarshal(msg, &in)
-	if err != nil {
-		conn.sendErr("json error")
+	var in MsgFinish
+	if !decodeMsg(conn, msg, &in) {
 		return
 	}
 
 	//checksum
-	checksum := fmt.Sprintf("%s+%d9d7a", conn.battle.secret, in.Msec+8703)
-	hasher := sha1.New()
-	hasher.Write([]byte(checksum))
-	checksum = hex.EncodeToString(hasher.Sum(nil))
+	checksum := makeBattleChecksum(conn.battle.secret, in.Msec)
 	if in.Checksum != checksum {
 		conn.sendErr("err_checksum")
 		return
@@ -172,10 +204,28 @@ func battleFinish(conn *Connection, msg []byte) {
 
 	//check exist
 	if conn.result != 0 {
-		conn.sendErr("result exist")
+		conn.sendErr("err_result_exist")
 		return
 	}
 	conn.result = in.Msec
+	spectatorFinish(conn.battle, conn, in.Msec)
+
+	if conn.battle.isRace() {
+		raceFinish(conn, in.Msec)
+		return
+	}
+
+	//finish time samples for bots
+	if !conn.isBot {
+		ssdbc, err := ssdbMatchPool.Get()
+		if err == nil {
+			err = addBattleFinishSample(ssdbc, conn.battle.packId, conn.battle.sliderNum, in.Msec)
+			ssdbc.Close()
+		}
+		if err != nil {
+			glog.Errorf("addBattleFinishSample error:%v", err)
+		}
+	}
 
 	//end
 	if conn.foe.result != 0 {
@@ -193,18 +243,35 @@ func battleFinish(conn *Connection, msg []byte) {
 		}
 		conn.foe.sendMsg(out)
 
-		go func() {
-			time.Sleep(5 * time.Second)
-			if conn.battle != nil && conn.battle.state != FINISH {
-				errstr := makeBattleResult(conn, false)
-				if errstr != "" {
-					conn.sendErr(errstr)
-				}
-			}
-		}()
+		waitFoeFinish(conn)
 	}
 }
 
+//the foe has a few more seconds, then the result is made without him
+func waitFoeFinish(conn *Connection) {
+	b := conn.battle
+	go func() {
+		time.Sleep(5 * time.Second)
+		h.call(func() {
+			//a rematch or a new pair since then isn't this battle
+			if conn.battle != b || b.state == FINISH {
+				return
+			}
+			errstr := makeBattleResult(conn, false)
+			if errstr != "" {
+				conn.sendErr(errstr)
+			}
+		})
+	}()
+}
+
+func makeBattleChecksum(secret string, msec int) string {
+	checksum := fmt.Sprintf("%s+%d9d7a", secret, msec+8703)
+	hasher := sha1.New()
+	hasher.Write([]byte(checksum))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
 func makeBattleResult(conn *Connection, isDisconnect bool) string {
 	if conn.battle == nil {
 		return "err_no_battle"
@@ -217,6 +284,13 @@ func makeBattleResult(conn *Connection, isDisconnect bool) string {
 	}
 	conn.battle.state = FINISH
 
+	//still live while the bets are paid, so the escrow sweeper leaves them alone
+	defer h.removeLiveBattle(conn.battle)
+
+	if conn.battle.isBot {
+		return makeBotBattleResult(conn, isDisconnect)
+	}
+
 	//ssdb
 	ssdbc, err := ssdbMatchPool.Get()
 	if err != nil {
@@ -262,18 +336,23 @@ func makeBattleResult(conn *Connection, isDisconnect bool) string {
 	out.FoeMsec = foeMsec
 	out.RewardCoin = getCoin
 
-	//add coin to ssdb
-	key := makePlayerInfoKey(conn.playerInfo.UserId)
-	resp, err := ssdbc.Do("hincr", key, PLAYER_GOLD_COIN, out.RewardCoin)
-	if err != nil || resp[0] != "ok" {
-		return "err_ssdb"
+	//season
+	seasonId, err := getActiveBattleSeasonId(ssdbc)
+	if err != nil {
+		glog.Errorf("getActiveBattleSeasonId error:%v", err)
+		seasonId = 0
 	}
+	out.SeasonId = seasonId
 
-	coinNum, err := strconv.Atoi(resp[1])
-	if err != nil {
-		return "err_strconv"
+	//pay both out of escrow before anything else can fail
+	key := makePlayerInfoKey(conn.playerInfo.UserId)
+	coinNum, held, err := settleBet(ssdbc, conn.battle, conn.playerInfo.UserId, out.RewardCoin)
+	foeCoinNum, foeHeld, foeErr := settleBet(ssdbc, conn.battle, conn.foe.playerInfo.UserId, -out.RewardCoin)
+	if err != nil || foeErr != nil {
+		return "err_ssdb"
 	}
 	out.TotalCoin = coinNum
+	out.PayoutHeld = held
 
 	//
 	myPlayer := conn.playerInfo
@@ -286,7 +365,7 @@ func makeBattleResult(conn *Connection, isDisconnect bool) string {
 	battlePoint := myPlayer.BattlePoint
 	if isWin {
 		winStreak = myPlayer.BattleWinStreak + 1
-		resp, err = ssdbc.Do("hincr", key, PLAYER_BATTLE_WIN_STREAK, 1)
+		resp, err := ssdbc.Do("hincr", key, PLAYER_BATTLE_WIN_STREAK, 1)
 		if err != nil || resp[0] != "ok" {
 			return "err_ssdb"
 		}
@@ -294,7 +373,7 @@ func makeBattleResult(conn *Connection, isDisconnect bool) string {
 		if out.RewardCoin > 0 {
 			battlePointAdd += foePlayer.BattleWinStreak
 		}
-		resp, err := ssdbc.Do("hincr", key, PLAYER_BATTLE_POINT, battlePointAdd)
+		resp, err = ssdbc.Do("hincr", key, PLAYER_BATTLE_POINT, battlePointAdd)
 		if err != nil || resp[0] != "ok" {
 			return "err_ssdb"
 		}
@@ -310,6 +389,15 @@ func makeBattleResult(conn *Connection, isDisconnect bool) string {
 				return "err_ssdb"
 			}
 		}
+
+		//achievement
+		err = pushAchievementEvent(ssdbc, myPlayer.UserId, ACHV_STAT_BATTLE_WIN, 1, false)
+		if err == nil {
+			err = pushAchievementEvent(ssdbc, myPlayer.UserId, ACHV_STAT_BATTLE_WIN_STREAK, winStreak, true)
+		}
+		if err != nil {
+			glog.Errorf("pushAchievementEvent error:%v", err)
+		}
 	} else {
 		if myPlayer.BattleWinStreak > 0 {
 			winStreak = 0
@@ -325,8 +413,22 @@ func makeBattleResult(conn *Connection, isDisconnect bool) string {
 	out.WinStreak = winStreak
 	out.WinstreakMax = winStreakMax
 
+	//season
+	if seasonId != 0 {
+		out.SeasonPoint, err = addBattleSeasonPoint(ssdbc, seasonId, myPlayer.UserId, battlePointAdd)
+		if err != nil {
+			glog.Errorf("addBattleSeasonPoint error:%v", err)
+		}
+	}
+
+	//mission
+	pushBattleMissionEvents(ssdbc, myPlayer.UserId, isWin, betCoin)
+
+	records := []BattleRecordPlayer{makeBattleRecordPlayer(myPlayer, &out, isDisconnect)}
+
 	//send to me
 	conn.sendMsg(out)
+	spectatorResult(conn.battle, conn, &out)
 
 	//foe
 	key = makePlayerInfoKey(foePlayer.UserId)
@@ -354,7 +456,7 @@ func makeBattleResult(conn *Connection, isDisconnect bool) string {
 	if isWin {
 		//
 		winStreak = foePlayer.BattleWinStreak + 1
-		resp, err = ssdbc.Do("hincr", key, PLAYER_BATTLE_WIN_STREAK, 1)
+		resp, err := ssdbc.Do("hincr", key, PLAYER_BATTLE_WIN_STREAK, 1)
 		if err != nil || resp[0] != "ok" {
 			return "err_ssdb"
 		}
@@ -362,7 +464,7 @@ func makeBattleResult(conn *Connection, isDisconnect bool) string {
 		if out.RewardCoin > 0 {
 			battlePointAdd += myPlayer.BattleWinStreak
 		}
-		resp, err := ssdbc.Do("hincr", key, PLAYER_BATTLE_POINT, battlePointAdd)
+		resp, err = ssdbc.Do("hincr", key, PLAYER_BATTLE_POINT, battlePointAdd)
 		if err != nil || resp[0] != "ok" {
 			return "err_ssdb"
 		}
@@ -379,6 +481,15 @@ func makeBattleResult(conn *Connection, isDisconnect bool) string {
 				return "err_ssdb"
 			}
 		}
+
+		//achievement
+		err = pushAchievementEvent(ssdbc, foePlayer.UserId, ACHV_STAT_BATTLE_WIN, 1, false)
+		if err == nil {
+			err = pushAchievementEvent(ssdbc, foePlayer.UserId, ACHV_STAT_BATTLE_WIN_STREAK, winStreak, true)
+		}
+		if err != nil {
+			glog.Errorf("pushAchievementEvent error:%v", err)
+		}
 	} else {
 		if foePlayer.BattleWinStreak > 0 {
 			winStreak = 0
@@ -393,36 +504,44 @@ func makeBattleResult(conn *Connection, isDisconnect bool) string {
 	out.WinStreak = winStreak
 	out.WinstreakMax = winStreakMax
 
-	//ssdb
-	resp, err = ssdbc.Do("hincr", key, PLAYER_GOLD_COIN, out.RewardCoin)
-	if err != nil || resp[0] != "ok" {
-		return "err_ssdb"
+	//season
+	if seasonId != 0 {
+		out.SeasonPoint, err = addBattleSeasonPoint(ssdbc, seasonId, foePlayer.UserId, battlePointAdd)
+		if err != nil {
+			glog.Errorf("addBattleSeasonPoint error:%v", err)
+		}
 	}
 
-	coinNum, err = strconv.Atoi(resp[1])
-	if err != nil {
-		return "err_strconv"
-	}
-	out.TotalCoin = coinNum
+	//mission
+	pushBattleMissionEvents(ssdbc, foePlayer.UserId, isWin, betCoin)
+
+	out.TotalCoin = foeCoinNum
+	out.PayoutHeld = foeHeld
 
 	//send to foe
 	conn.foe.sendMsg(out)
+	spectatorResult(conn.battle, conn.foe, &out)
+
+	//history
+	records = append(records, makeBattleRecordPlayer(foePlayer, &out, false))
+	err = saveBattleRecord(ssdbc, conn.battle, records)
+	if err != nil {
+		glog.Errorf("saveBattleRecord error:%v", err)
+	}
 
 	return ""
 }
 
-func talk(conn *Connection, msg []byte) {
-	var in struct {
-		Text string
+func pushBattleMissionEvents(ssdbc *ssdbgo.Client, userId int64, isWin bool, betCoin int) {
+	err := pushMissionEvent(ssdbc, userId, MISSION_EVENT_BATTLE_PLAY, 1)
+	if err == nil && isWin {
+		err = pushMissionEvent(ssdbc, userId, MISSION_EVENT_BATTLE_WIN, 1)
+		if err == nil && betCoin > 0 {
+			err = pushMissionEvent(ssdbc, userId, MISSION_EVENT_BATTLE_COIN_WIN, 1)
+		}
 	}
-
-	err := json.Unmarshal(msg, &in)
 	if err != nil {
-		conn.sendErr("json error")
-		return
-	}
-	if len(in.Text) > 0 && conn.foe != nil {
-		conn.foe.send <- msg
+		glog.Errorf("pushMissionEvent error:%v", err)
 	}
 }
 
@@ -430,5 +549,4 @@ func regBattle() {
 	regHandler("ready", MsgHandler(battleReady))
 	regHandler("progress", MsgHandler(battleProgress))
 	regHandler("finish", MsgHandler(battleFinish))
-	regHandler("talk", MsgHandler(talk))
 }
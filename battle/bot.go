@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/ssdbgo"
+)
+
+//a bot steps in when nobody else turns up in the matchmaking queue.
+//it replays a real finish time recorded for the same pack and slider num.
+//bot battles move no coins, give no battle point and skip seasons, achievements and missions, so they only run in free rooms.
+const (
+	Q_BATTLE_FINISH_MSEC = "Q_BATTLE_FINISH_MSEC" //key:Q_BATTLE_FINISH_MSEC/packId/sliderNum value:msec
+
+	BOT_MSEC_SAMPLE_MAX      = 200
+	BOT_MSEC_PER_IMAGE_DEF   = 8000
+	BOT_READY_DELAY_MSEC_MAX = 1500
+	BOT_PROGRESS_JITTER      = 0.2
+	BOT_RATING_SPREAD        = 100
+)
+
+var (
+	BOT_NICK_NAMES = []string{
+		"小蜜蜂", "拼图侠", "夜猫子", "慢半拍", "路人甲", "阿木", "橘子汽水", "小火车",
+	}
+)
+
+func makeQBattleFinishMsecKey(packId int64, sliderNum int) string {
+	return fmt.Sprintf("%s/%d/%d", Q_BATTLE_FINISH_MSEC, packId, sliderNum)
+}
+
+func addBattleFinishSample(ssdbc *ssdbgo.Client, packId int64, sliderNum int, msec int) error {
+	key := makeQBattleFinishMsecKey(packId, sliderNum)
+	resp, err := ssdbc.Do("qpush_back", key, msec)
+	if err != nil || resp[0] != "ok" {
+		return fmt.Errorf("qpush_back error:%v", err)
+	}
+	size, err := strconv.Atoi(resp[1])
+	if err != nil {
+		return err
+	}
+	if size > BOT_MSEC_SAMPLE_MAX {
+		_, err = ssdbc.Do("qtrim_front", key, size-BOT_MSEC_SAMPLE_MAX)
+	}
+	return err
+}
+
+//a random recorded finish time, else the pack difficulty, else a plain guess
+func pickBotFinishMsec(ssdbc *ssdbgo.Client, battle *Battle) int {
+	key := makeQBattleFinishMsecKey(battle.packId, battle.sliderNum)
+	resp, err := ssdbc.Do("qsize", key)
+	if err == nil && resp[0] == "ok" {
+		size, _ := strconv.Atoi(resp[1])
+		if size > 0 {
+			resp, err = ssdbc.Do("qget", key, rand.Intn(size))
+			if err == nil && resp[0] == "ok" {
+				msec, err := strconv.Atoi(resp[1])
+				if err == nil && msec > 0 {
+					return msec
+				}
+			}
+		}
+	}
+
+	msecPerImage := BOT_MSEC_PER_IMAGE_DEF
+	resp, err = ssdbc.Do("zget", Z_PACK_DIFFICULTY, battle.packId)
+	if err == nil && resp[0] == "ok" {
+		difficulty, err := strconv.Atoi(resp[1])
+		if err == nil && difficulty > 0 {
+			msecPerImage = scalePackDifficulty(difficulty, battle.sliderNum)
+		}
+	}
+	jitter := 1.0 + (rand.Float64()*2-1)*BOT_PROGRESS_JITTER
+	return int(float64(msecPerImage*battle.imageNum) * jitter)
+}
+
+func makeBotConnection(human *PlayerInfo) *Connection {
+	bot := &Connection{
+		send:  make(chan []byte, 256),
+		isBot: true,
+	}
+	bot.playerInfo = &PlayerInfo{
+		NickName:      BOT_NICK_NAMES[rand.Intn(len(BOT_NICK_NAMES))],
+		BattlePoint:   human.BattlePoint,
+		Rating:        float64(battleRating(human) + rand.Intn(BOT_RATING_SPREAD*2+1) - BOT_RATING_SPREAD),
+		RatedMatchNum: 1,
+	}
+	go botRun(bot)
+	return bot
+}
+
+//reads what the hub and the human send to the bot
+func botRun(bot *Connection) {
+	for msg := range bot.send {
+		var in struct {
+			Type string
+		}
+		err := json.Unmarshal(msg, &in)
+		if err != nil {
+			continue
+		}
+
+		switch in.Type {
+		case "paired":
+			time.Sleep(time.Duration(rand.Intn(BOT_READY_DELAY_MSEC_MAX)) * time.Millisecond)
+			battleReady(bot, nil)
+		case "start":
+			go botPlay(bot, bot.battle)
+		case "result", "err", "foeDisconnect":
+			return
+		}
+	}
+}
+
+func botPlay(bot *Connection, battle *Battle) {
+	if battle == nil {
+		return
+	}
+
+	ssdbc, err := ssdbMatchPool.Get()
+	if err != nil {
+		glog.Errorf("ssdbMatchPool.Get error:%v", err)
+		return
+	}
+	finishMsec := pickBotFinishMsec(ssdbc, battle)
+	ssdbc.Close()
+
+	playing := func() bool {
+		return bot.battle == battle && battle.state == MATCHING && bot.foe != nil
+	}
+
+	//progress, one message per finished image
+	begin := time.Now()
+	for i := 1; i < battle.imageNum; i++ {
+		at := float64(finishMsec) * float64(i) / float64(battle.imageNum)
+		at *= 1.0 + (rand.Float64()*2-1)*BOT_PROGRESS_JITTER/float64(battle.imageNum)
+		time.Sleep(begin.Add(time.Duration(at) * time.Millisecond).Sub(time.Now()))
+		if !playing() {
+			return
+		}
+		battleProgress(bot, []byte(fmt.Sprintf(`{"Type":"progress","CompleteNum":%d}`, i)))
+	}
+
+	//finish
+	time.Sleep(begin.Add(time.Duration(finishMsec) * time.Millisecond).Sub(time.Now()))
+	if !playing() {
+		return
+	}
+	checksum := makeBattleChecksum(battle.secret, finishMsec)
+	battleFinish(bot, []byte(fmt.Sprintf(`{"Type":"finish","Msec":%d,"Checksum":"%s"}`, finishMsec, checksum)))
+}
+
+func makeBotBattleResult(conn *Connection, isDisconnect bool) string {
+	human := conn
+	if conn.isBot {
+		human = conn.foe
+	}
+	bot := human.foe
+
+	//ssdb
+	ssdbc, err := ssdbMatchPool.Get()
+	if err != nil {
+		return "err_ssdb_pool"
+	}
+	defer ssdbc.Close()
+
+	myMsec := human.result
+	botMsec := bot.result
+
+	result := "lose"
+	if !isDisconnect && myMsec != 0 {
+		if botMsec == 0 || myMsec < botMsec {
+			result = "win"
+		} else if myMsec == botMsec {
+			result = "draw"
+		}
+	}
+
+	out := BattleResult{}
+	out.Type = "result"
+	out.Result = result
+	out.MyMsec = myMsec
+	out.FoeMsec = botMsec
+	out.IsBot = true
+
+	myPlayer := human.playerInfo
+	key := makePlayerInfoKey(myPlayer.UserId)
+
+	resp, err := ssdbc.Do("hget", key, PLAYER_GOLD_COIN)
+	if err != nil || resp[0] != "ok" {
+		return "err_ssdb"
+	}
+	out.TotalCoin, err = strconv.Atoi(resp[1])
+	if err != nil {
+		return "err_strconv"
+	}
+
+	out.BattlePoint = myPlayer.BattlePoint
+	out.WinStreak = myPlayer.BattleWinStreak
+	out.WinstreakMax = myPlayer.BattleWinStreakMax
+
+	human.sendMsg(out)
+	spectatorResult(human.battle, human, &out)
+	bot.sendType("result")
+
+	//history
+	botResult := "draw"
+	if result == "win" {
+		botResult = "lose"
+	} else if result == "lose" {
+		botResult = "win"
+	}
+	records := []BattleRecordPlayer{
+		makeBattleRecordPlayer(myPlayer, &out, isDisconnect),
+		{NickName: bot.playerInfo.NickName, Msec: botMsec, Result: botResult},
+	}
+	err = saveBattleRecord(ssdbc, human.battle, records)
+	if err != nil {
+		glog.Errorf("saveBattleRecord error:%v", err)
+	}
+
+	return ""
+}
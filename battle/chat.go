@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/ssdbgo"
+)
+
+//battle talk goes through a filter before the foe sees it.
+//the blocklist is edited on the match server, words and patterns are matched against normalized text:
+//full width folded, lower case, traditional chinese mapped to simplified, anything but letters and digits dropped,
+//so "傻 逼", "傻*逼" and "傻逼" are the same. quick chat phrases skip the filter, they are all the
+//safe mode and chat banned players get. transcripts are kept with the battle record and with reports.
+const (
+	K_BATTLE_CHAT_FILTER      = "K_BATTLE_CHAT_FILTER"      //value:chatFilterJson, written by match server
+	H_BATTLE_CHAT             = "H_BATTLE_CHAT"             //subkey:battleId value:chatLinesJson
+	H_BATTLE_CHAT_REPORT      = "H_BATTLE_CHAT_REPORT"      //subkey:reportId value:chatReportJson
+	Z_BATTLE_CHAT_REPORT      = "Z_BATTLE_CHAT_REPORT"      //subkey:reportId score:time, open reports only
+	BATTLE_CHAT_REPORT_SERIAL = "BATTLE_CHAT_REPORT_SERIAL" //in H_SERIAL
+
+	CHAT_FILTER_RELOAD_PERIOD = 30 * time.Second
+	CHAT_RATE_BURST           = 3
+	CHAT_RATE_PER_SEC         = 0.5
+	CHAT_BATTLE_LINE_MAX      = 100 //lines kept per battle
+)
+
+var (
+	CHAT_QUICK_PHRASES = map[string]string{
+		"hi":     "你好",
+		"gl":     "祝你好运",
+		"hurry":  "快点快点",
+		"wow":    "厉害",
+		"oops":   "手滑了",
+		"gg":     "打得好",
+		"thanks": "谢谢",
+		"again":  "再来一局",
+	}
+
+	//traditional to simplified for what the blocklist usually holds, the filter config can add more
+	CHAT_VARIANT_RUNES = map[rune]rune{
+		'幹': '干', '媽': '妈', '雞': '鸡', '賤': '贱', '爛': '烂', '滾': '滚',
+		'殺': '杀', '豬': '猪', '腦': '脑', '殘': '残', '廢': '废', '雜': '杂', '種': '种',
+		'買': '买', '賣': '卖', '錢': '钱', '號': '号', '網': '网', '點': '点', '賭': '赌', '場': '场',
+		'貸': '贷', '換': '换', '幣': '币', '儲': '储', '値': '值', '團': '团', '約': '约',
+		'麼': '么', '們': '们', '個': '个', '這': '这', '裡': '里', '說': '说', '話': '话', '來': '来',
+		'發': '发', '開': '开', '機': '机', '愛': '爱', '東': '东', '門': '门', '衛': '卫', '聯': '联',
+		'係': '系', '繫': '系', '線': '线', '價': '价', '優': '优', '掛': '挂', '騙': '骗',
+	}
+)
+
+type ChatFilter struct {
+	Words    []string
+	Patterns []string
+	Variants map[string]string //single runes, variant to canonical
+}
+
+type ChatLine struct {
+	UserId int64
+	Text   string
+	Quick  string `json:",omitempty"`
+	Note   string `json:",omitempty"` //blocked, muted, safe: the foe didn't see it
+	Time   int64
+}
+
+type ChatReport struct {
+	Id         int64
+	BattleId   string
+	UserId     int64
+	FoeUserId  int64
+	Reason     string
+	Time       int64
+	Transcript []ChatLine
+}
+
+type chatFilter struct {
+	words    []string
+	patterns []*regexp.Regexp
+	variants map[rune]rune
+}
+
+var (
+	currentChatFilter   = &chatFilter{variants: CHAT_VARIANT_RUNES}
+	currentChatFilterMu sync.RWMutex
+)
+
+func normalizeChatText(text string, variants map[rune]rune) string {
+	runes := make([]rune, 0, len(text))
+	for _, r := range text {
+		if r >= 0xff01 && r <= 0xff5e {
+			r -= 0xfee0
+		}
+		if v, ok := variants[r]; ok {
+			r = v
+		}
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			runes = append(runes, unicode.ToLower(r))
+		}
+	}
+	return string(runes)
+}
+
+func makeChatFilter(conf *ChatFilter) (*chatFilter, error) {
+	f := &chatFilter{variants: make(map[rune]rune, len(CHAT_VARIANT_RUNES)+len(conf.Variants))}
+	for k, v := range CHAT_VARIANT_RUNES {
+		f.variants[k] = v
+	}
+	for k, v := range conf.Variants {
+		kr, vr := []rune(k), []rune(v)
+		if len(kr) != 1 || len(vr) != 1 {
+			return nil, fmt.Errorf("variant %q:%q not single runes", k, v)
+		}
+		f.variants[kr[0]] = vr[0]
+	}
+
+	for _, word := range conf.Words {
+		word = normalizeChatText(word, f.variants)
+		if word != "" {
+			f.words = append(f.words, word)
+		}
+	}
+	for _, pattern := range conf.Patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		f.patterns = append(f.patterns, re)
+	}
+	return f, nil
+}
+
+//the word or pattern hit, "" if the text is clean
+func (f *chatFilter) match(text string) string {
+	norm := normalizeChatText(text, f.variants)
+	for _, word := range f.words {
+		if strings.Contains(norm, word) {
+			return word
+		}
+	}
+	for _, re := range f.patterns {
+		if re.MatchString(norm) {
+			return re.String()
+		}
+	}
+	return ""
+}
+
+func matchChatFilter(text string) string {
+	currentChatFilterMu.RLock()
+	f := currentChatFilter
+	currentChatFilterMu.RUnlock()
+	return f.match(text)
+}
+
+func loadChatFilter() error {
+	ssdbc, err := ssdbMatchPool.Get()
+	if err != nil {
+		return err
+	}
+	defer ssdbc.Close()
+
+	resp, err := ssdbc.Do("get", K_BATTLE_CHAT_FILTER)
+	if err != nil {
+		return err
+	}
+	var conf ChatFilter
+	if resp[0] == "ok" {
+		err = json.Unmarshal([]byte(resp[1]), &conf)
+		if err != nil {
+			return err
+		}
+	}
+	f, err := makeChatFilter(&conf)
+	if err != nil {
+		return err
+	}
+
+	currentChatFilterMu.Lock()
+	currentChatFilter = f
+	currentChatFilterMu.Unlock()
+	return nil
+}
+
+//keeps the last good filter if ssdb can't be reached or the config is broken
+func reloadChatFilter() {
+	for {
+		if err := loadChatFilter(); err != nil {
+			glog.Errorf("loadChatFilter error:%v", err)
+		}
+		time.Sleep(CHAT_FILTER_RELOAD_PERIOD)
+	}
+}
+
+//token bucket, only touched by the connection's own reader
+func (c *Connection) takeChatToken(now time.Time) bool {
+	if c.chatTime.IsZero() {
+		c.chatTokens = CHAT_RATE_BURST
+	} else {
+		c.chatTokens += now.Sub(c.chatTime).Seconds() * CHAT_RATE_PER_SEC
+		if c.chatTokens > CHAT_RATE_BURST {
+			c.chatTokens = CHAT_RATE_BURST
+		}
+	}
+	c.chatTime = now
+	if c.chatTokens < 1 {
+		return false
+	}
+	c.chatTokens--
+	return true
+}
+
+func chatBanned(playerInfo *PlayerInfo, now time.Time) bool {
+	return playerInfo != nil && playerInfo.BattleChatBanUntil > now.Unix()
+}
+
+func (battle *Battle) logChat(conn *Connection, text string, quick string, note string) {
+	battle.chatMu.Lock()
+	defer battle.chatMu.Unlock()
+	if len(battle.chat) >= CHAT_BATTLE_LINE_MAX {
+		return
+	}
+	battle.chat = append(battle.chat, ChatLine{conn.playerInfo.UserId, text, quick, note, time.Now().Unix()})
+}
+
+func (battle *Battle) chatTranscript() []ChatLine {
+	battle.chatMu.Lock()
+	defer battle.chatMu.Unlock()
+	return append([]ChatLine{}, battle.chat...)
+}
+
+//with the battle record, nothing if nobody talked
+func saveBattleChat(ssdbc *ssdbgo.Client, battle *Battle) error {
+	lines := battle.chatTranscript()
+	if len(lines) == 0 {
+		return nil
+	}
+	js, err := json.Marshal(lines)
+	if err != nil {
+		return err
+	}
+	_, err = ssdbc.Do("hset", H_BATTLE_CHAT, battle.id, js)
+	return err
+}
+
+func talk(conn *Connection, msg []byte) {
+	var in MsgTalk
+	if !decodeMsg(conn, msg, &in) {
+		return
+	}
+	battle := conn.battle
+	foe := conn.foe
+	if battle == nil || foe == nil || conn.playerInfo == nil {
+		return
+	}
+
+	now := time.Now()
+	text := in.Text
+	if in.Quick != "" {
+		phrase, ok := CHAT_QUICK_PHRASES[in.Quick]
+		if !ok {
+			conn.sendErr("err_quick_chat")
+			return
+		}
+		text = phrase
+	} else {
+		if len(text) == 0 {
+			return
+		}
+		if conn.safeChat || chatBanned(conn.playerInfo, now) {
+			conn.sendErr("err_chat_safe")
+			return
+		}
+	}
+
+	if !conn.takeChatToken(now) {
+		conn.sendErr("err_chat_rate")
+		return
+	}
+
+	if in.Quick == "" {
+		if hit := matchChatFilter(text); hit != "" {
+			battle.logChat(conn, text, "", "blocked")
+			conn.sendErr("err_chat_blocked")
+			return
+		}
+	}
+
+	//the sender isn't told, so muting doesn't start a fight
+	if foe.mutedFoe {
+		battle.logChat(conn, text, in.Quick, "muted")
+		return
+	}
+	if foe.safeChat && in.Quick == "" {
+		battle.logChat(conn, text, in.Quick, "safe")
+		return
+	}
+	battle.logChat(conn, text, in.Quick, "")
+
+	out := struct {
+		Type  string
+		Text  string
+		Quick string
+	}{
+		"talk",
+		text,
+		in.Quick,
+	}
+	foe.sendMsg(out)
+}
+
+//lasts until the next battle with another foe
+func muteFoe(conn *Connection, msg []byte) {
+	var in MsgMuteFoe
+	if !decodeMsg(conn, msg, &in) {
+		return
+	}
+	conn.mutedFoe = in.Mute
+
+	out := struct {
+		Type string
+		Mute bool
+	}{
+		"muteFoe",
+		in.Mute,
+	}
+	conn.sendMsg(out)
+}
+
+//the transcript so far goes with the report, one report per battle
+func reportFoe(conn *Connection, msg []byte) {
+	var in MsgReportFoe
+	if !decodeMsg(conn, msg, &in) {
+		return
+	}
+	battle := conn.battle
+	foe := conn.foe
+	if battle == nil || foe == nil || conn.playerInfo == nil || foe.playerInfo == nil {
+		conn.sendErr("err_need_pair")
+		return
+	}
+	if foe.isBot {
+		conn.sendType("reported")
+		return
+	}
+
+	battle.chatMu.Lock()
+	if battle.reporters == nil {
+		battle.reporters = make(map[int64]bool)
+	}
+	reported := battle.reporters[conn.playerInfo.UserId]
+	battle.reporters[conn.playerInfo.UserId] = true
+	battle.chatMu.Unlock()
+	if reported {
+		conn.sendErr("err_reported")
+		return
+	}
+
+	ssdbc, err := ssdbMatchPool.Get()
+	if err != nil {
+		conn.sendErr("err_ssdb_pool")
+		return
+	}
+	defer ssdbc.Close()
+
+	resp, err := ssdbc.Do("hincr", H_SERIAL, BATTLE_CHAT_REPORT_SERIAL, 1)
+	if err != nil || resp[0] != "ok" {
+		conn.sendErr("err_ssdb")
+		return
+	}
+	var report ChatReport
+	fmt.Sscan(resp[1], &report.Id)
+	report.BattleId = battle.id
+	report.UserId = conn.playerInfo.UserId
+	report.FoeUserId = foe.playerInfo.UserId
+	report.Reason = in.Reason
+	report.Time = time.Now().Unix()
+	report.Transcript = battle.chatTranscript()
+
+	js, err := json.Marshal(report)
+	if err == nil {
+		_, err = ssdbc.Do("hset", H_BATTLE_CHAT_REPORT, report.Id, js)
+	}
+	if err == nil {
+		_, err = ssdbc.Do("zset", Z_BATTLE_CHAT_REPORT, report.Id, report.Time)
+	}
+	if err != nil {
+		glog.Errorf("reportFoe error:%v", err)
+		conn.sendErr("err_ssdb")
+		return
+	}
+	conn.sendType("reported")
+}
+
+func regChat() {
+	regHandler("talk", MsgHandler(talk))
+	regHandler("muteFoe", MsgHandler(muteFoe))
+	regHandler("reportFoe", MsgHandler(reportFoe))
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/glog"
+)
+
+//several battle nodes can run behind nginx, sharing the 1v1 matchmaking queues in redis.
+//one node at a time holds K_BATTLE_MATCHMAKER and pairs everyone, the pair goes to the first player's node.
+//a foe connected to another node is a proxy connection there: what the hub sends to the proxy is published
+//to the foe's node, what the foe sends is published back. races, private rooms and resume stay on one node.
+const (
+	BATTLE_NODE_SET     = "BATTLE_NODE_SET"     //members:nodeId
+	K_BATTLE_NODE_ALIVE = "K_BATTLE_NODE_ALIVE" //key:K_BATTLE_NODE_ALIVE/nodeId, expires when the node stops beating
+	BATTLE_NODE_CHANNEL = "BATTLE_NODE_CHANNEL" //channel:BATTLE_NODE_CHANNEL/nodeId value:nodeMsgJson
+	H_BATTLE_QUEUE      = "H_BATTLE_QUEUE"      //key:H_BATTLE_QUEUE/roomName subkey:userId value:queueRecordJson
+	H_BATTLE_QUEUE_WAIT = "H_BATTLE_QUEUE_WAIT" //subkey:roomName value:avgWaitSec
+	K_BATTLE_MATCHMAKER = "K_BATTLE_MATCHMAKER" //value:nodeId
+
+	NODE_HEARTBEAT_PERIOD = 3 * time.Second
+	NODE_ALIVE_TTL_SEC    = 10
+	MATCHMAKER_TTL_MSEC   = 2000
+	NODE_RESUBSCRIBE_WAIT = time.Second
+)
+
+var (
+	//what a player on another node may send to the battle's node
+	REMOTE_MSG_TYPES = map[string]bool{
+		"ready":     true,
+		"progress":  true,
+		"finish":    true,
+		"talk":      true,
+		"muteFoe":   true,
+		"reportFoe": true,
+		"rematch":   true,
+	}
+)
+
+type queueRecord struct {
+	NodeId     string
+	ConnId     string
+	UserId     int64
+	Rating     int
+	EnqueuedAt int64 //msec
+	PlayerInfo *PlayerInfo
+	Version    int
+	SafeChat   bool
+}
+
+type nodeMsg struct {
+	Cmd      string //pair, bot, attach, send, recv, drop, release
+	FromNode string
+	ConnId   string
+	Msg      string       `json:",omitempty"`
+	RoomName string       `json:",omitempty"`
+	Entry    *queueRecord `json:",omitempty"`
+	Foe      *queueRecord `json:",omitempty"`
+}
+
+func makeHBattleQueueKey(roomName string) string {
+	return fmt.Sprintf("%s/%s", H_BATTLE_QUEUE, roomName)
+}
+
+func makeKBattleNodeAliveKey(node string) string {
+	return fmt.Sprintf("%s/%s", K_BATTLE_NODE_ALIVE, node)
+}
+
+func makeBattleNodeChannel(node string) string {
+	return fmt.Sprintf("%s/%s", BATTLE_NODE_CHANNEL, node)
+}
+
+func (rec *queueRecord) toEntry() *queueEntry {
+	return &queueEntry{
+		rec:        rec,
+		userId:     rec.UserId,
+		rating:     rec.Rating,
+		enqueuedAt: time.Unix(0, rec.EnqueuedAt*int64(time.Millisecond)),
+	}
+}
+
+func loadQueue(rc redis.Conn, roomName string) ([]*queueRecord, error) {
+	strs, err := redis.Strings(rc.Do("HGETALL", makeHBattleQueueKey(roomName)))
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]*queueRecord, 0, len(strs)/2)
+	for i := 1; i < len(strs); i += 2 {
+		var rec queueRecord
+		err = json.Unmarshal([]byte(strs[i]), &rec)
+		if err != nil {
+			glog.Errorf("queueRecord unmarshal error:%v", err)
+			continue
+		}
+		recs = append(recs, &rec)
+	}
+	return recs, nil
+}
+
+//one entry per user across all nodes
+func enqueue(rec *queueRecord, roomName string) (expectedWaitSec int, err error) {
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	js, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	added, err := redis.Int(rc.Do("HSETNX", makeHBattleQueueKey(roomName), rec.UserId, js))
+	if err != nil {
+		return 0, err
+	}
+	if added == 0 {
+		return 0, fmt.Errorf("err_same_user")
+	}
+
+	//expected wait against whoever is waiting now
+	recs, err := loadQueue(rc, roomName)
+	if err != nil {
+		return 0, err
+	}
+	q := &matchQueue{}
+	q.avgWaitSec, _ = redis.Float64(rc.Do("HGET", H_BATTLE_QUEUE_WAIT, roomName))
+	var entry *queueEntry
+	for _, r := range recs {
+		e := r.toEntry()
+		if r.UserId == rec.UserId {
+			entry = e
+		}
+		q.push(e)
+	}
+	if entry == nil {
+		entry = rec.toEntry()
+	}
+	return q.expectedWaitSec(entry, time.Now()), nil
+}
+
+//false if someone else took it first
+func dequeue(rc redis.Conn, roomName string, rec *queueRecord) bool {
+	n, err := redis.Int(rc.Do("HDEL", makeHBattleQueueKey(roomName), rec.UserId))
+	if err != nil {
+		glog.Errorf("HDEL error:%v", err)
+		return false
+	}
+	return n == 1
+}
+
+func requeue(roomName string, rec *queueRecord) bool {
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	js, err := json.Marshal(rec)
+	if err == nil {
+		_, err = rc.Do("HSETNX", makeHBattleQueueKey(roomName), rec.UserId, js)
+	}
+	if err != nil {
+		glog.Errorf("requeue error:%v", err)
+		return false
+	}
+	return true
+}
+
+//only the connection's own entry, the user may be queued from somewhere else
+func dequeueConn(c *Connection) {
+	room, exist := getBattleRoom(c.roomName)
+	if (exist && room.PlayerMax > 2) || c.playerInfo == nil {
+		return
+	}
+
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	key := makeHBattleQueueKey(c.roomName)
+	js, err := redis.Bytes(rc.Do("HGET", key, c.playerInfo.UserId))
+	if err != nil {
+		return
+	}
+	var rec queueRecord
+	if json.Unmarshal(js, &rec) == nil && rec.ConnId == c.id {
+		rc.Do("HDEL", key, c.playerInfo.UserId)
+	}
+}
+
+func publishNodeMsg(node string, msg *nodeMsg) {
+	msg.FromNode = *nodeId
+	js, err := json.Marshal(msg)
+	if err != nil {
+		glog.Errorf("nodeMsg marshal error:%v", err)
+		return
+	}
+
+	rc := redisPool.Get()
+	defer rc.Close()
+	_, err = rc.Do("PUBLISH", makeBattleNodeChannel(node), js)
+	if err != nil {
+		glog.Errorf("PUBLISH error:%v", err)
+	}
+}
+
+//runs on the matchmaker goroutine
+func (h *Hub) sendToNode(node string, connId string, msg []byte) {
+	if node == *nodeId {
+		h.call(func() {
+			if c := h.connIds[connId]; c != nil {
+				trySend(c, msg)
+			}
+		})
+		return
+	}
+	publishNodeMsg(node, &nodeMsg{Cmd: "send", ConnId: connId, Msg: string(msg)})
+}
+
+//runs on the hub goroutine, with msg from this node or another one
+func (h *Hub) handleNodeMsg(msg *nodeMsg) {
+	switch msg.Cmd {
+	case "pair":
+		h.pairFromQueue(msg.RoomName, msg.Entry, msg.Foe)
+	case "bot":
+		h.botFromQueue(msg.RoomName, msg.Entry)
+	case "attach":
+		c := h.connIds[msg.ConnId]
+		if c == nil {
+			publishNodeMsg(msg.FromNode, &nodeMsg{Cmd: "drop", ConnId: msg.ConnId})
+			return
+		}
+		c.hostNodeId = msg.FromNode
+	case "send":
+		if c := h.connIds[msg.ConnId]; c != nil {
+			trySend(c, []byte(msg.Msg))
+		}
+	case "release":
+		//the other node let go of the player before the battle started, Msg is the error unless they were requeued
+		c := h.connIds[msg.ConnId]
+		if c == nil || c.hostNodeId != msg.FromNode {
+			return
+		}
+		c.hostNodeId = ""
+		if msg.Msg != "" {
+			c.playerInfo = nil
+			c.sendErr(msg.Msg)
+		}
+	case "drop":
+		h.clusterMu.Lock()
+		proxy := h.proxies[msg.ConnId]
+		h.clusterMu.Unlock()
+		if proxy != nil {
+			h.disconnect(proxy)
+		}
+	}
+}
+
+//still waiting in the queue: connected, authed and not in a battle that's going on
+func queueWaiting(c *Connection) bool {
+	if c == nil || c.playerInfo == nil {
+		return false
+	}
+	return c.battle == nil || c.battle.state == FINISH || c.battle.state == ONELEFT
+}
+
+//any bail-out puts back whoever is still waiting
+func (h *Hub) pairFromQueue(roomName string, a, b *queueRecord) {
+	c := h.connIds[a.ConnId]
+	var foe *Connection
+	if b.NodeId == *nodeId {
+		foe = h.connIds[b.ConnId]
+	}
+	foeWaiting := b.NodeId != *nodeId || queueWaiting(foe)
+
+	room, exist := getBattleRoom(roomName)
+	if !queueWaiting(c) || !foeWaiting || !exist {
+		if queueWaiting(c) {
+			requeue(roomName, a)
+		}
+		if foeWaiting {
+			requeue(roomName, b)
+		}
+		return
+	}
+	if h.isDraining() {
+		c.playerInfo = nil
+		c.sendErr("err_draining")
+		requeue(roomName, b)
+		return
+	}
+
+	if foe == nil {
+		foe = h.addProxy(b, roomName)
+	}
+	go func() {
+		err := h.startBattle(c, foe, room)
+		if err != nil {
+			glog.Errorf("startBattle error:%v", err)
+			h.call(func() {
+				h.failStart([]*Connection{c, foe}, err, func(p *Connection) bool {
+					rec := a
+					if p == foe {
+						rec = b
+					}
+					return requeue(roomName, rec)
+				})
+			})
+		}
+	}()
+}
+
+func (h *Hub) botFromQueue(roomName string, rec *queueRecord) {
+	c := h.connIds[rec.ConnId]
+	if !queueWaiting(c) {
+		return
+	}
+	room, exist := getBattleRoom(roomName)
+	if !exist {
+		requeue(roomName, rec)
+		return
+	}
+	if h.isDraining() {
+		c.playerInfo = nil
+		c.sendErr("err_draining")
+		return
+	}
+	bot := makeBotConnection(c.playerInfo)
+	go func() {
+		err := h.startBattle(c, bot, room)
+		if err != nil {
+			glog.Errorf("startBattle with bot error:%v", err)
+			bot.sendType("err")
+			h.call(func() {
+				h.failStart([]*Connection{c, bot}, err, nil)
+			})
+		}
+	}()
+}
+
+//stands in for a player connected to another node
+func (h *Hub) addProxy(rec *queueRecord, roomName string) *Connection {
+	proxy := &Connection{
+		id:           rec.ConnId,
+		send:         make(chan []byte, 256),
+		remoteNodeId: rec.NodeId,
+		playerInfo:   rec.PlayerInfo,
+		roomName:     roomName,
+		protoVersion: rec.Version,
+		safeChat:     rec.SafeChat,
+	}
+	h.connections[proxy] = true
+	h.clusterMu.Lock()
+	h.proxies[rec.ConnId] = proxy
+	h.clusterMu.Unlock()
+
+	publishNodeMsg(rec.NodeId, &nodeMsg{Cmd: "attach", ConnId: rec.ConnId})
+	go func() {
+		for msg := range proxy.send {
+			publishNodeMsg(rec.NodeId, &nodeMsg{Cmd: "send", ConnId: rec.ConnId, Msg: string(msg)})
+		}
+	}()
+	return proxy
+}
+
+//the player's battle runs on another node
+func forwardToHost(c *Connection, host string, msg []byte) {
+	publishNodeMsg(host, &nodeMsg{Cmd: "recv", ConnId: c.id, Msg: string(msg)})
+}
+
+//runs on the hub goroutine, the player leaves the battle on the other node
+func (h *Hub) detachFromHost(c *Connection) {
+	if c.hostNodeId == "" {
+		return
+	}
+	publishNodeMsg(c.hostNodeId, &nodeMsg{Cmd: "drop", ConnId: c.id})
+	c.hostNodeId = ""
+}
+
+//messages from the proxied player run on the subscriber goroutine like a readPump,
+//everything else is serialized on the hub goroutine
+func (h *Hub) subscribeNode() {
+	for {
+		psc := redis.PubSubConn{Conn: redisPool.Get()}
+		err := psc.Subscribe(makeBattleNodeChannel(*nodeId))
+		for err == nil {
+			switch v := psc.Receive().(type) {
+			case redis.Message:
+				var msg nodeMsg
+				if e := json.Unmarshal(v.Data, &msg); e != nil {
+					glog.Errorf("nodeMsg unmarshal error:%v", e)
+					continue
+				}
+				if msg.Cmd == "recv" {
+					h.recvFromNode(&msg)
+				} else {
+					h.call(func() {
+						h.handleNodeMsg(&msg)
+					})
+				}
+			case error:
+				err = v
+			}
+		}
+		glog.Errorf("subscribeNode error:%v", err)
+		psc.Close()
+		time.Sleep(NODE_RESUBSCRIBE_WAIT)
+	}
+}
+
+func (h *Hub) recvFromNode(msg *nodeMsg) {
+	h.clusterMu.Lock()
+	proxy := h.proxies[msg.ConnId]
+	h.clusterMu.Unlock()
+	if proxy == nil {
+		return
+	}
+
+	var in struct {
+		Type string
+	}
+	err := json.Unmarshal([]byte(msg.Msg), &in)
+	if err != nil || !REMOTE_MSG_TYPES[in.Type] {
+		return
+	}
+	if handler, e := _msgHandlerMap[in.Type]; e {
+		handler(proxy, []byte(msg.Msg))
+	}
+}
+
+//runs on the hub goroutine, keeps this node alive and lets go of players on nodes that died
+func (h *Hub) nodeHeartbeat() {
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	_, err := rc.Do("SET", makeKBattleNodeAliveKey(*nodeId), time.Now().Unix(), "EX", NODE_ALIVE_TTL_SEC)
+	if err == nil {
+		_, err = rc.Do("SADD", BATTLE_NODE_SET, *nodeId)
+	}
+	if err != nil {
+		glog.Errorf("nodeHeartbeat error:%v", err)
+		return
+	}
+
+	alive := nodeAliveChecker(rc)
+
+	h.clusterMu.Lock()
+	deadProxies := []*Connection{}
+	for _, proxy := range h.proxies {
+		if !alive(proxy.remoteNodeId) {
+			deadProxies = append(deadProxies, proxy)
+		}
+	}
+	h.clusterMu.Unlock()
+	for _, proxy := range deadProxies {
+		h.disconnect(proxy)
+	}
+
+	for _, c := range h.connIds {
+		if c.hostNodeId != "" && !alive(c.hostNodeId) {
+			c.hostNodeId = ""
+			c.playerInfo = nil
+			c.sendErr("err_node_down")
+		}
+	}
+
+	h.reportRoomCounts(rc)
+}
+
+//remembers answers for one round
+func nodeAliveChecker(rc redis.Conn) func(node string) bool {
+	cache := map[string]bool{*nodeId: true}
+	return func(node string) bool {
+		alive, ok := cache[node]
+		if !ok {
+			n, err := redis.Int(rc.Do("EXISTS", makeKBattleNodeAliveKey(node)))
+			alive = err != nil || n == 1 //don't drop players on a redis hiccup
+			cache[node] = alive
+		}
+		return alive
+	}
+}
+
+//takes or keeps the lock, only one node pairs
+func isMatchmaker(rc redis.Conn) bool {
+	ok, err := redis.String(rc.Do("SET", K_BATTLE_MATCHMAKER, *nodeId, "NX", "PX", MATCHMAKER_TTL_MSEC))
+	if err == nil && ok == "OK" {
+		return true
+	}
+	holder, err := redis.String(rc.Do("GET", K_BATTLE_MATCHMAKER))
+	if err != nil || holder != *nodeId {
+		return false
+	}
+	rc.Do("PEXPIRE", K_BATTLE_MATCHMAKER, MATCHMAKER_TTL_MSEC)
+	return true
+}
+
+//runs on the matchmaker goroutine of the matchmaker node, players of this node are paired on the hub
+func (h *Hub) matchmakeQueues(rc redis.Conn, now time.Time) {
+	alive := nodeAliveChecker(rc)
+
+	//nodes that stopped beating
+	nodes, err := redis.Strings(rc.Do("SMEMBERS", BATTLE_NODE_SET))
+	if err == nil {
+		for _, node := range nodes {
+			if !alive(node) {
+				rc.Do("SREM", BATTLE_NODE_SET, node)
+				glog.Infof("battle node gone: %s", node)
+			}
+		}
+	}
+
+	botWait := time.Duration(*botWaitSec) * time.Second
+	//closed rooms still pair whoever queued before closing time
+	for _, room := range listBattleRooms() {
+		if room.PlayerMax > 2 {
+			continue
+		}
+		roomName := room.Name
+		recs, err := loadQueue(rc, roomName)
+		if err != nil {
+			glog.Errorf("loadQueue error:%v", err)
+			continue
+		}
+
+		q := h.queues[roomName]
+		if q == nil {
+			q = &matchQueue{}
+			h.queues[roomName] = q
+		}
+		q.entries = make([]*queueEntry, 0, len(recs))
+		for _, rec := range recs {
+			if !alive(rec.NodeId) {
+				dequeue(rc, roomName, rec)
+				continue
+			}
+			q.push(rec.toEntry())
+		}
+		sort.Sort(ByEnqueuedAt(q.entries))
+
+		//pairs
+		for _, pair := range q.takePairs(now, h.recentFoes) {
+			a, b := pair.a.rec, pair.b.rec
+			okA := dequeue(rc, roomName, a)
+			okB := dequeue(rc, roomName, b)
+			if !okA || !okB {
+				if okA {
+					requeue(roomName, a)
+				}
+				if okB {
+					requeue(roomName, b)
+				}
+				continue
+			}
+			msg := &nodeMsg{Cmd: "pair", RoomName: roomName, Entry: a, Foe: b}
+			if a.NodeId == *nodeId {
+				h.call(func() {
+					h.handleNodeMsg(msg)
+				})
+			} else {
+				publishNodeMsg(a.NodeId, msg)
+			}
+		}
+		if q.avgWaitSec > 0 {
+			rc.Do("HSET", H_BATTLE_QUEUE_WAIT, roomName, q.avgWaitSec)
+		}
+
+		for _, e := range q.entries {
+			waited := now.Sub(e.enqueuedAt)
+
+			//nobody came, hand the longest waiters to bots, bets need a real foe
+			if *botWaitSec > 0 && room.BetCoin == 0 && waited >= botWait {
+				if dequeue(rc, roomName, e.rec) {
+					msg := &nodeMsg{Cmd: "bot", RoomName: roomName, Entry: e.rec}
+					if e.rec.NodeId == *nodeId {
+						h.call(func() {
+							h.handleNodeMsg(msg)
+						})
+					} else {
+						publishNodeMsg(e.rec.NodeId, msg)
+					}
+				}
+				continue
+			}
+
+			//keep waiting players posted
+			if reportDue(waited) {
+				out := struct {
+					Type            string
+					ExpectedWaitSec int
+				}{
+					"pairing",
+					q.expectedWaitSec(e, now),
+				}
+				js, err := json.Marshal(out)
+				if err == nil {
+					h.sendToNode(e.rec.NodeId, e.rec.ConnId, js)
+				}
+			}
+		}
+	}
+	pruneRecentFoes(h.recentFoes, now)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/ssdbgo"
+)
+
+//the match server looks for win trading in coin battles and puts suspects under review.
+//battle nodes leave what it needs: the devices players battle from, and coin battles in time order.
+//payouts of players on hold are kept aside until an admin pays or voids them, bets and refunds go on as usual.
+const (
+	Z_BATTLE_DEVICE_USER   = "Z_BATTLE_DEVICE_USER"   //key:Z_BATTLE_DEVICE_USER/deviceId subkey:userId score:time
+	Z_PLAYER_BATTLE_DEVICE = "Z_PLAYER_BATTLE_DEVICE" //key:Z_PLAYER_BATTLE_DEVICE/userId subkey:deviceId score:time
+	Z_BATTLE_COIN_RECORD   = "Z_BATTLE_COIN_RECORD"   //subkey:battleId score:time, coin battles between players
+	H_BATTLE_PAYOUT_HOLD   = "H_BATTLE_PAYOUT_HOLD"   //subkey:userId value:caseId, written by match server
+	H_BATTLE_HELD_PAYOUT   = "H_BATTLE_HELD_PAYOUT"   //subkey:battleId/userId value:escrowJson
+	Z_BATTLE_HELD_PAYOUT   = "Z_BATTLE_HELD_PAYOUT"   //subkey:battleId/userId score:time
+
+	BATTLE_DEVICE_KEEP_SEC = 90 * 24 * 3600
+)
+
+func makeZBattleDeviceUserKey(deviceId string) string {
+	return fmt.Sprintf("%s/%s", Z_BATTLE_DEVICE_USER, deviceId)
+}
+
+func makeZPlayerBattleDeviceKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", Z_PLAYER_BATTLE_DEVICE, userId)
+}
+
+//best effort, a missing device only weakens the review
+func markBattleDevice(userId int64, deviceId string) {
+	if deviceId == "" || userId == 0 {
+		return
+	}
+	ssdbc, err := ssdbMatchPool.Get()
+	if err != nil {
+		glog.Errorf("ssdbMatchPool.Get error:%v", err)
+		return
+	}
+	defer ssdbc.Close()
+
+	now := time.Now().Unix()
+	key := makeZBattleDeviceUserKey(deviceId)
+	_, err = ssdbc.Do("zset", key, userId, now)
+	if err == nil {
+		_, err = ssdbc.Do("zremrangebyscore", key, 0, now-BATTLE_DEVICE_KEEP_SEC)
+	}
+	key = makeZPlayerBattleDeviceKey(userId)
+	if err == nil {
+		_, err = ssdbc.Do("zset", key, deviceId, now)
+	}
+	if err == nil {
+		_, err = ssdbc.Do("zremrangebyscore", key, 0, now-BATTLE_DEVICE_KEEP_SEC)
+	}
+	if err != nil {
+		glog.Errorf("markBattleDevice error:%v", err)
+	}
+}
+
+func isPayoutHeld(ssdbc *ssdbgo.Client, userId int64) bool {
+	resp, err := ssdbc.Do("hexists", H_BATTLE_PAYOUT_HOLD, userId)
+	if err != nil {
+		//pay rather than hold everyone's coins while ssdb hiccups
+		glog.Errorf("isPayoutHeld error:%v", err)
+		return false
+	}
+	return resp[0] == "ok" && resp[1] == "1"
+}
+
+//moves the entry aside with what it would have paid, false if it was paid already or never made
+func holdBet(ssdbc *ssdbgo.Client, battleId string, userId int64, coin int) bool {
+	escrowKey := makeEscrowKey(battleId, userId)
+
+	//the hold is written first, a claimed entry without one would lose the coins
+	now := time.Now().Unix()
+	js, err := json.Marshal(escrow{battleId, userId, coin, *nodeId, now})
+	if err == nil {
+		_, err = ssdbc.Do("hset", H_BATTLE_HELD_PAYOUT, escrowKey, js)
+	}
+	if err == nil {
+		_, err = ssdbc.Do("zset", Z_BATTLE_HELD_PAYOUT, escrowKey, now)
+	}
+	if err != nil {
+		glog.Errorf("holdBet error:%v, userId:%d, coin:%d", err, userId, coin)
+		ssdbc.Do("hdel", H_BATTLE_HELD_PAYOUT, escrowKey)
+		return false
+	}
+
+	if _, ok := claimBet(ssdbc, escrowKey); !ok {
+		ssdbc.Do("hdel", H_BATTLE_HELD_PAYOUT, escrowKey)
+		ssdbc.Do("zdel", Z_BATTLE_HELD_PAYOUT, escrowKey)
+		return false
+	}
+	glog.Infof("payout held: battleId:%s userId:%d coin:%d", battleId, userId, coin)
+	return true
+}
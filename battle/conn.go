@@ -33,9 +33,6 @@ const (
 
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
 )
 
 var upgrader = websocket.Upgrader{
@@ -52,12 +49,35 @@ type Connection struct {
 	// Buffered channel of outbound messages.
 	send chan []byte
 
+	// Unique across nodes.
+	id string
+
+	// Set when the battle runs on another node, or when this is a proxy for a player on another node.
+	hostNodeId   string
+	remoteNodeId string
+
 	foe    *Connection
 	battle *Battle
 
 	playerInfo *PlayerInfo
 	roomName   string
 	result     int
+	isBot      bool
+
+	// Negotiated in authPair, 0 and "" until then.
+	protoVersion int
+	encoding     string
+
+	resumeToken string
+
+	spectating    *Battle
+	lastReactTime time.Time
+
+	// Chat settings for this pairing, and the talk rate limit bucket.
+	safeChat   bool
+	mutedFoe   bool
+	chatTokens float64
+	chatTime   time.Time
 }
 
 func init() {
@@ -74,14 +94,21 @@ func (c *Connection) readPump() {
 		h.unregister <- c
 		c.ws.Close()
 	}()
-	c.ws.SetReadLimit(maxMessageSize)
+	c.ws.SetReadLimit(PROTOCOL_MAX_MESSAGE_SIZE)
 	c.ws.SetReadDeadline(time.Now().Add(pongWait))
 	c.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
 	for {
-		_, message, err := c.ws.ReadMessage()
+		mt, message, err := c.ws.ReadMessage()
 		if err != nil {
 			break
 		}
+		if mt == websocket.BinaryMessage {
+			message, err = msgpackToJSON(message)
+			if err != nil {
+				c.sendErr("err_json")
+				continue
+			}
+		}
 		msg := struct {
 			Type string
 		}{}
@@ -91,12 +118,24 @@ func (c *Connection) readPump() {
 			break
 		}
 
+		since, known := MSG_SINCE[msg.Type]
+		if !known {
+			c.sendErr("err_msg_type")
+			continue
+		}
+		if since > c.version() {
+			c.sendErr("err_version")
+			continue
+		}
+
 		if msg.Type == "authPair" {
 			err = h.authPair(c, message)
 			if err != nil {
 				c.sendErr(err.Error())
 				// break
 			}
+		} else if host := c.hostNodeId; host != "" && REMOTE_MSG_TYPES[msg.Type] {
+			forwardToHost(c, host, message)
 		} else {
 			handler, e := _msgHandlerMap[msg.Type]
 			if e {
@@ -134,7 +173,14 @@ func (c *Connection) writePump() {
 				c.write(websocket.CloseMessage, []byte{})
 				return
 			}
-			if err := c.write(websocket.TextMessage, message); err != nil {
+			mt := websocket.TextMessage
+			if c.encoding == "msgpack" {
+				if b, err := jsonToMsgpack(message); err == nil {
+					mt = websocket.BinaryMessage
+					message = b
+				}
+			}
+			if err := c.write(mt, message); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -149,8 +195,7 @@ func (c *Connection) writePump() {
 }
 
 func (c *Connection) sendErr(str string) {
-	msg := fmt.Sprintf(`{"Type":"err", "String":"%s"}`, str)
-	c.send <- []byte(msg)
+	c.send <- makeErrMsg(c.version(), str)
 }
 
 func (c *Connection) sendMsg(msg interface{}) {
@@ -170,13 +215,17 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if h.isDraining() {
+		http.Error(w, "Draining", 503)
+		return
+	}
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		glog.Error(err)
 		return
 	}
 
-	c := &Connection{send: make(chan []byte, 256), ws: ws}
+	c := &Connection{send: make(chan []byte, 256), ws: ws, id: genUUID()}
 	h.register <- c
 	go c.writePump()
 	c.readPump()
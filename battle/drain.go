@@ -0,0 +1,162 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/glog"
+)
+
+//a node told to stop drains first: it takes no new players, leaves the queues and the matchmaker lock
+//to other nodes, and tells everyone connected so clients reconnect elsewhere once their battle is over.
+//running battles get drainSec to end. what is still running then is settled: a 1v1 with one finisher goes
+//to the finisher, a race with finishers is ranked as it stands, anything else is called off and refunded.
+const (
+	DRAIN_POLL_PERIOD = time.Second
+	DRAIN_CLOSE_WAIT  = 5 * time.Second
+)
+
+func (h *Hub) isDraining() bool {
+	return atomic.LoadInt32(&h.draining) == 1
+}
+
+func (h *Hub) liveBattleNum() int {
+	h.liveMu.Lock()
+	defer h.liveMu.Unlock()
+	return len(h.liveBattles)
+}
+
+func (h *Hub) drain(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&h.draining, 0, 1) {
+		return
+	}
+	glog.Infof("draining, %d live battles", h.liveBattleNum())
+
+	h.call(func() {
+		h.leaveCluster()
+		h.dropWaiting(int(timeout / time.Second))
+	})
+
+	deadline := time.Now().Add(timeout)
+	for h.liveBattleNum() > 0 && time.Now().Before(deadline) {
+		time.Sleep(DRAIN_POLL_PERIOD)
+	}
+
+	h.call(func() {
+		h.settleLiveBattles()
+	})
+	h.closeConnections()
+
+	//other nodes let go of players here at their next heartbeat
+	rc := redisPool.Get()
+	defer rc.Close()
+	rc.Do("DEL", makeKBattleNodeAliveKey(*nodeId))
+	rc.Do("SREM", BATTLE_NODE_SET, *nodeId)
+	rc.Do("DEL", makeHBattleRoomCountKey(*nodeId))
+	glog.Info("drained")
+}
+
+//runs on the hub goroutine
+func (h *Hub) leaveCluster() {
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	holder, err := redis.String(rc.Do("GET", K_BATTLE_MATCHMAKER))
+	if err == nil && holder == *nodeId {
+		rc.Do("DEL", K_BATTLE_MATCHMAKER)
+	}
+}
+
+//runs on the hub goroutine, whoever isn't playing here is told to go elsewhere
+func (h *Hub) dropWaiting(waitSec int) {
+	out := struct {
+		Type    string
+		WaitSec int
+	}{
+		"draining",
+		waitSec,
+	}
+	for c := range h.connections {
+		if c.battle == nil && c.hostNodeId == "" && c.remoteNodeId == "" {
+			dequeueConn(c)
+			c.playerInfo = nil
+		}
+		c.sendMsg(out)
+	}
+
+	h.queueMu.Lock()
+	h.lobbies = make(map[string]*raceLobby)
+	h.queueMu.Unlock()
+	h.privateRooms = make(map[string]*privateRoom)
+}
+
+//runs on the hub goroutine
+func (h *Hub) settleLiveBattles() {
+	h.liveMu.Lock()
+	battles := make([]*Battle, 0, len(h.liveBattles))
+	for _, battle := range h.liveBattles {
+		battles = append(battles, battle)
+	}
+	h.liveMu.Unlock()
+
+	for _, battle := range battles {
+		if battle.state == FINISH {
+			h.removeLiveBattle(battle)
+			continue
+		}
+		glog.Infof("settling battle on drain: battleId:%s", battle.id)
+
+		if battle.isRace() {
+			if battle.state == MATCHING && battle.finishNum > 0 {
+				makeRaceResult(battle)
+				continue
+			}
+		} else if battle.state == MATCHING {
+			var finished, unfinished *Connection
+			for _, c := range battle.players {
+				if c.result != 0 {
+					finished = c
+				} else {
+					unfinished = c
+				}
+			}
+			if finished != nil && unfinished != nil && unfinished.foe != nil {
+				if errstr := makeBattleResult(unfinished, true); errstr != "" {
+					glog.Errorf("makeBattleResult on drain error:%s", errstr)
+				}
+				continue
+			}
+		}
+
+		battle.state = FINISH
+		h.removeLiveBattle(battle)
+		refundBattleBets(battle)
+		for _, c := range battle.players {
+			if !battle.left[c] {
+				c.sendErr("err_draining")
+			}
+		}
+	}
+}
+
+//closed websockets unregister like any dropped player, seats aren't held on a draining node
+func (h *Hub) closeConnections() {
+	h.call(func() {
+		for _, c := range h.connIds {
+			c.ws.Close()
+		}
+	})
+
+	deadline := time.Now().Add(DRAIN_CLOSE_WAIT)
+	for time.Now().Before(deadline) {
+		num := 0
+		h.callWait(func() {
+			num = len(h.connIds)
+		})
+		if num == 0 {
+			return
+		}
+		time.Sleep(DRAIN_POLL_PERIOD)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/glog"
+	"github.com/henyouqian/ssdbgo"
+)
+
+//bets are taken when a battle is paired and held in escrow, one entry per player, until the result.
+//the result pays each entry out by the player's share of the pot, a battle ending without one refunds them.
+//whoever pays an entry claims it in redis first, so a late result and the sweeper can't both pay it.
+//the sweeper refunds entries of battles that aren't live anymore: each node sweeps its own,
+//entries of dead nodes are swept by anyone. a node coming back after a crash has no live battle.
+const (
+	H_BATTLE_ESCROW       = "H_BATTLE_ESCROW"       //subkey:battleId/userId value:escrowJson
+	Z_BATTLE_ESCROW       = "Z_BATTLE_ESCROW"       //subkey:battleId/userId score:time
+	K_BATTLE_ESCROW_CLAIM = "K_BATTLE_ESCROW_CLAIM" //redis, key:K_BATTLE_ESCROW_CLAIM/battleId/userId
+
+	ESCROW_SWEEP_PERIOD  = time.Minute
+	ESCROW_SWEEP_AGE_SEC = 120 //younger entries may still be being paid
+	ESCROW_SWEEP_LIMIT   = 100
+	ESCROW_CLAIM_TTL_SEC = 24 * 3600
+)
+
+type escrow struct {
+	BattleId string
+	UserId   int64
+	Coin     int
+	NodeId   string
+	Time     int64
+}
+
+func makeEscrowKey(battleId string, userId int64) string {
+	return fmt.Sprintf("%s/%d", battleId, userId)
+}
+
+func reserveBet(ssdbc *ssdbgo.Client, battleId string, userId int64, coin int) (int, error) {
+	key := makePlayerInfoKey(userId)
+	resp, err := ssdbc.Do("hincr", key, PLAYER_GOLD_COIN, -coin)
+	if err != nil || resp[0] != "ok" {
+		return 0, fmt.Errorf("err_ssdb")
+	}
+	total, err := strconv.Atoi(resp[1])
+	if err != nil || total < 0 {
+		ssdbc.Do("hincr", key, PLAYER_GOLD_COIN, coin)
+		return 0, fmt.Errorf("err_coin")
+	}
+
+	//nothing could refund coins taken without an entry
+	now := time.Now().Unix()
+	escrowKey := makeEscrowKey(battleId, userId)
+	js, err := json.Marshal(escrow{battleId, userId, coin, *nodeId, now})
+	if err == nil {
+		_, err = ssdbc.Do("hset", H_BATTLE_ESCROW, escrowKey, js)
+	}
+	if err == nil {
+		_, err = ssdbc.Do("zset", Z_BATTLE_ESCROW, escrowKey, now)
+	}
+	if err != nil {
+		ssdbc.Do("hincr", key, PLAYER_GOLD_COIN, coin)
+		ssdbc.Do("hdel", H_BATTLE_ESCROW, escrowKey)
+		return 0, fmt.Errorf("err_ssdb")
+	}
+
+	if err = addEcoRecord(ssdbc, userId, coin, ECO_FORWHAT_BATTLE_BET); err != nil {
+		glog.Errorf("addEcoRecord error:%v", err)
+	}
+	return total, nil
+}
+
+//all or nothing, bots and free rooms don't bet. a player short of coins is named in a startErr
+func reserveBattleBets(ssdbc *ssdbgo.Client, battle *Battle, conns []*Connection) error {
+	betCoin := battle.room.BetCoin
+	if betCoin == 0 || battle.isBot {
+		return nil
+	}
+
+	reserved := make([]int64, 0, len(conns))
+	for _, c := range conns {
+		total, err := reserveBet(ssdbc, battle.id, c.playerInfo.UserId, betCoin)
+		if err != nil {
+			for _, userId := range reserved {
+				releaseBet(ssdbc, battle.id, userId, betCoin, ECO_FORWHAT_BATTLE_REFUND)
+			}
+			if err.Error() == "err_coin" {
+				return &startErr{c, "err_coin"}
+			}
+			return err
+		}
+		c.playerInfo.GoldCoin = total
+		reserved = append(reserved, c.playerInfo.UserId)
+	}
+	return nil
+}
+
+//closes the entry and returns it, false if it was paid already or never made.
+//the claim is given back if the entry can't be closed, so it can still be paid
+func claimBet(ssdbc *ssdbgo.Client, escrowKey string) (string, bool) {
+	rc := redisPool.Get()
+	defer rc.Close()
+	ok, err := redis.String(rc.Do("SET", makeEscrowClaimKey(escrowKey), *nodeId, "NX", "EX", ESCROW_CLAIM_TTL_SEC))
+	if err != nil || ok != "OK" {
+		return "", false
+	}
+
+	resp, err := ssdbc.Do("hget", H_BATTLE_ESCROW, escrowKey)
+	if err == nil && resp[0] == "ok" {
+		js := resp[1]
+		_, err = ssdbc.Do("hdel", H_BATTLE_ESCROW, escrowKey)
+		if err == nil {
+			ssdbc.Do("zdel", Z_BATTLE_ESCROW, escrowKey)
+			return js, true
+		}
+	}
+	rc.Do("DEL", makeEscrowClaimKey(escrowKey))
+	return "", false
+}
+
+//puts a claimed entry back when paying it failed, the sweeper refunds it later
+func unclaimBet(ssdbc *ssdbgo.Client, escrowKey string, js string) {
+	_, err := ssdbc.Do("hset", H_BATTLE_ESCROW, escrowKey, js)
+	if err == nil {
+		_, err = ssdbc.Do("zset", Z_BATTLE_ESCROW, escrowKey, time.Now().Unix())
+	}
+	if err != nil {
+		glog.Errorf("unclaimBet error:%v, escrow:%s", err, js)
+		return
+	}
+
+	rc := redisPool.Get()
+	defer rc.Close()
+	rc.Do("DEL", makeEscrowClaimKey(escrowKey))
+}
+
+func makeEscrowClaimKey(escrowKey string) string {
+	return fmt.Sprintf("%s/%s", K_BATTLE_ESCROW_CLAIM, escrowKey)
+}
+
+//pays coin out of the entry and closes it, false if it was paid already, never made or the pay failed
+func releaseBet(ssdbc *ssdbgo.Client, battleId string, userId int64, coin int, forWhat string) bool {
+	escrowKey := makeEscrowKey(battleId, userId)
+	js, ok := claimBet(ssdbc, escrowKey)
+	if !ok {
+		return false
+	}
+
+	if coin > 0 {
+		resp, err := ssdbc.Do("hincr", makePlayerInfoKey(userId), PLAYER_GOLD_COIN, coin)
+		if err != nil || resp[0] != "ok" {
+			glog.Errorf("escrow pay error:%v, userId:%d, coin:%d", err, userId, coin)
+			unclaimBet(ssdbc, escrowKey, js)
+			return false
+		}
+		if err = addEcoRecord(ssdbc, userId, coin, forWhat); err != nil {
+			glog.Errorf("addEcoRecord error:%v", err)
+		}
+	}
+	return true
+}
+
+//the player's stake plus rewardCoin, which is negative for losers, returns the coins they have now.
+//payouts of players under review are held instead, held is true then.
+func settleBet(ssdbc *ssdbgo.Client, battle *Battle, userId int64, rewardCoin int) (total int, held bool, err error) {
+	if battle.room.BetCoin > 0 && !battle.isBot {
+		coin := battle.room.BetCoin + rewardCoin
+		if coin > 0 && isPayoutHeld(ssdbc, userId) {
+			held = holdBet(ssdbc, battle.id, userId, coin)
+			if !held {
+				return 0, false, fmt.Errorf("err_ssdb")
+			}
+		} else if !releaseBet(ssdbc, battle.id, userId, coin, ECO_FORWHAT_BATTLE_PAYOUT) {
+			return 0, false, fmt.Errorf("err_ssdb")
+		}
+	}
+
+	resp, err := ssdbc.Do("hget", makePlayerInfoKey(userId), PLAYER_GOLD_COIN)
+	if err != nil || resp[0] != "ok" {
+		return 0, held, fmt.Errorf("err_ssdb")
+	}
+	total, err = strconv.Atoi(resp[1])
+	return total, held, err
+}
+
+//the battle ended without a result
+func refundBattleBets(battle *Battle) {
+	if battle.room.BetCoin == 0 || battle.isBot {
+		return
+	}
+
+	ssdbc, err := ssdbMatchPool.Get()
+	if err != nil {
+		glog.Errorf("ssdbMatchPool.Get error:%v", err)
+		return
+	}
+	defer ssdbc.Close()
+
+	for _, c := range battle.players {
+		if !c.isBot && c.playerInfo != nil {
+			releaseBet(ssdbc, battle.id, c.playerInfo.UserId, battle.room.BetCoin, ECO_FORWHAT_BATTLE_REFUND)
+		}
+	}
+}
+
+func (h *Hub) sweepEscrows() {
+	for {
+		time.Sleep(ESCROW_SWEEP_PERIOD)
+		err := h.sweepEscrowsOnce()
+		if err != nil {
+			glog.Errorf("sweepEscrows error:%v", err)
+		}
+	}
+}
+
+func (h *Hub) sweepEscrowsOnce() error {
+	ssdbc, err := ssdbMatchPool.Get()
+	if err != nil {
+		return err
+	}
+	defer ssdbc.Close()
+
+	rc := redisPool.Get()
+	defer rc.Close()
+	alive := nodeAliveChecker(rc)
+
+	//pages on from the last entry seen, entries left behind don't hold up older ones
+	scoreEnd := time.Now().Unix() - ESCROW_SWEEP_AGE_SEC
+	keyStart, scoreStart := "", ""
+	for {
+		resp, err := ssdbc.Do("zscan", Z_BATTLE_ESCROW, keyStart, scoreStart, scoreEnd, ESCROW_SWEEP_LIMIT)
+		if err != nil {
+			return err
+		}
+		resp = resp[1:]
+
+		num := len(resp) / 2
+		for i := 0; i < num; i++ {
+			escrowKey := resp[i*2]
+			keyStart, scoreStart = escrowKey, resp[i*2+1]
+			if err = h.sweepEscrow(ssdbc, alive, escrowKey); err != nil {
+				return err
+			}
+		}
+		if num < ESCROW_SWEEP_LIMIT {
+			return nil
+		}
+	}
+}
+
+func (h *Hub) sweepEscrow(ssdbc *ssdbgo.Client, alive func(string) bool, escrowKey string) error {
+	r, err := ssdbc.Do("hget", H_BATTLE_ESCROW, escrowKey)
+	if err != nil {
+		return err
+	}
+	if r[0] != "ok" {
+		ssdbc.Do("zdel", Z_BATTLE_ESCROW, escrowKey)
+		return nil
+	}
+
+	//nothing can pay a broken entry, it's parked out of the sweep with the log as its record
+	var e escrow
+	if err = json.Unmarshal([]byte(r[1]), &e); err != nil {
+		glog.Errorf("escrow %s json error:%v, dropped:%s", escrowKey, err, r[1])
+		ssdbc.Do("zdel", Z_BATTLE_ESCROW, escrowKey)
+		return nil
+	}
+
+	if e.NodeId == *nodeId {
+		h.liveMu.Lock()
+		_, live := h.liveBattles[e.BattleId]
+		h.liveMu.Unlock()
+		if live {
+			return nil
+		}
+	} else if alive(e.NodeId) {
+		return nil
+	}
+
+	if releaseBet(ssdbc, e.BattleId, e.UserId, e.Coin, ECO_FORWHAT_BATTLE_REFUND) {
+		glog.Infof("escrow refunded: battleId:%s userId:%d coin:%d", e.BattleId, e.UserId, e.Coin)
+	}
+	return nil
+}
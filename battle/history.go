@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/henyouqian/ssdbgo"
+)
+
+//every finished battle is kept for the players' history and for support.
+//per room stats and head to head counters are updated with the record, the match server only reads them.
+const (
+	H_BATTLE_RECORD        = "H_BATTLE_RECORD"        //subkey:battleId value:battleRecordJson
+	Z_PLAYER_BATTLE_RECORD = "Z_PLAYER_BATTLE_RECORD" //key:Z_PLAYER_BATTLE_RECORD/userId subkey:battleId score:time
+	H_PLAYER_BATTLE_STAT   = "H_PLAYER_BATTLE_STAT"   //key:H_PLAYER_BATTLE_STAT/userId subkey:roomName/stat value:count
+	H_PLAYER_BATTLE_VS     = "H_PLAYER_BATTLE_VS"     //key:H_PLAYER_BATTLE_VS/userId subkey:foeUserId/result value:count
+
+	BATTLE_STAT_PLAY       = "Play"
+	BATTLE_STAT_WIN        = "Win"
+	BATTLE_STAT_DRAW       = "Draw"
+	BATTLE_STAT_FINISH     = "Finish"
+	BATTLE_STAT_MSEC_SUM   = "MsecSum"
+	BATTLE_STAT_DISCONNECT = "Disconnect"
+)
+
+type BattleRecordPlayer struct {
+	UserId       int64 //0 for bots
+	NickName     string
+	Msec         int //0 if not finished
+	Result       string
+	Rank         int //races only
+	CoinAdd      int
+	PointAdd     int
+	Disconnected bool
+}
+
+type BattleRecord struct {
+	Id        string
+	RoomName  string
+	BetCoin   int
+	PackId    int64
+	SliderNum int
+	IsBot     bool
+	Time      int64
+	PlayMsec  int //from start to the result, 0 if it never started
+	Players   []BattleRecordPlayer
+}
+
+func makeBattleRecordPlayer(player *PlayerInfo, out *BattleResult, disconnected bool) BattleRecordPlayer {
+	return BattleRecordPlayer{
+		UserId:       player.UserId,
+		NickName:     player.NickName,
+		Msec:         out.MyMsec,
+		Result:       out.Result,
+		CoinAdd:      out.RewardCoin,
+		PointAdd:     out.BattlePointAdd,
+		Disconnected: disconnected,
+	}
+}
+
+func saveBattleRecord(ssdbc *ssdbgo.Client, battle *Battle, players []BattleRecordPlayer) error {
+	record := BattleRecord{
+		Id:        battle.id,
+		RoomName:  battle.room.Name,
+		BetCoin:   battle.room.BetCoin,
+		PackId:    battle.packId,
+		SliderNum: battle.sliderNum,
+		IsBot:     battle.isBot,
+		Time:      time.Now().Unix(),
+		Players:   players,
+	}
+	if !battle.startTime.IsZero() {
+		record.PlayMsec = int(time.Since(battle.startTime) / time.Millisecond)
+	}
+	js, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	resp, err := ssdbc.Do("hset", H_BATTLE_RECORD, record.Id, js)
+	if err != nil || resp[0] != "ok" {
+		return fmt.Errorf("hset error:%v", err)
+	}
+	if err = saveBattleChat(ssdbc, battle); err != nil {
+		return err
+	}
+
+	//for the collusion review
+	if record.BetCoin > 0 && !record.IsBot {
+		resp, err = ssdbc.Do("zset", Z_BATTLE_COIN_RECORD, record.Id, record.Time)
+		if err != nil || resp[0] != "ok" {
+			return fmt.Errorf("zset error:%v", err)
+		}
+	}
+
+	for _, p := range players {
+		if p.UserId == 0 {
+			continue
+		}
+		key := fmt.Sprintf("%s/%d", Z_PLAYER_BATTLE_RECORD, p.UserId)
+		resp, err = ssdbc.Do("zset", key, record.Id, record.Time)
+		if err != nil || resp[0] != "ok" {
+			return fmt.Errorf("zset error:%v", err)
+		}
+
+		//stats
+		stats := map[string]int{BATTLE_STAT_PLAY: 1}
+		if p.Result == "win" {
+			stats[BATTLE_STAT_WIN] = 1
+		} else if p.Result == "draw" {
+			stats[BATTLE_STAT_DRAW] = 1
+		}
+		if p.Msec > 0 {
+			stats[BATTLE_STAT_FINISH] = 1
+			stats[BATTLE_STAT_MSEC_SUM] = p.Msec
+		}
+		if p.Disconnected {
+			stats[BATTLE_STAT_DISCONNECT] = 1
+		}
+		key = fmt.Sprintf("%s/%d", H_PLAYER_BATTLE_STAT, p.UserId)
+		for stat, add := range stats {
+			resp, err = ssdbc.Do("hincr", key, fmt.Sprintf("%s/%s", record.RoomName, stat), add)
+			if err != nil || resp[0] != "ok" {
+				return fmt.Errorf("hincr error:%v", err)
+			}
+		}
+
+		//head to head, real foes only
+		if len(players) != 2 || record.IsBot {
+			continue
+		}
+		foe := players[0]
+		if foe.UserId == p.UserId {
+			foe = players[1]
+		}
+		key = fmt.Sprintf("%s/%d", H_PLAYER_BATTLE_VS, p.UserId)
+		resp, err = ssdbc.Do("hincr", key, fmt.Sprintf("%d/%s", foe.UserId, p.Result), 1)
+		if err != nil || resp[0] != "ok" {
+			return fmt.Errorf("hincr error:%v", err)
+		}
+	}
+	return nil
+}
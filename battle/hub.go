@@ -6,12 +6,12 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	// "math/rand"
 	"sync"
 	"time"
 
-	"github.com/garyburd/redigo/redis"
 	"github.com/golang/glog"
 	"github.com/henyouqian/ssdbgo"
 )
@@ -21,9 +21,8 @@ func _hublog() {
 }
 
 const (
-	H_SESSION         = "H_SESSION" //key:token, value:session
-	H_PACK            = "H_PACK"    //subkey:packId value:packJson
-	BATTLE_PACKID_SET = "BATTLE_PACKID_SET"
+	H_SESSION = "H_SESSION" //key:token, value:session
+	H_PACK    = "H_PACK"    //subkey:packId value:packJson
 )
 
 type Session struct {
@@ -42,6 +41,11 @@ type PlayerInfo struct {
 	BattleWinStreak     int
 	BattleWinStreakMax  int
 	BattleHeartZeroTime int64
+	BattleSeasonId      int64
+	BattleSeasonPoint   int
+	Rating              float64
+	RatedMatchNum       int
+	BattleChatBanUntil  int64
 }
 
 type Image struct {
@@ -73,47 +77,93 @@ type Hub struct {
 	// Unregister requests from connections.
 	unregister chan *Connection
 
-	pendingConnMap map[string]*Connection
-	pendingConnMu  sync.Mutex
+	// This node's websockets by connection id, only touched on the hub goroutine.
+	connIds map[string]*Connection
+
+	// Players on other nodes whose battles run here, by their connection id.
+	proxies   map[string]*Connection
+	clusterMu sync.Mutex
+
+	// Snapshots of the redis queues by room name, and who played whom lately.
+	// Only the matchmaker node keeps them, on its matchmaker goroutine.
+	queues     map[string]*matchQueue
+	recentFoes map[int64]recentFoe
+
+	// Functions to run on the hub goroutine, serialized with unregister.
+	calls chan func()
+
+	// Private rooms by invite code, only touched on the hub goroutine.
+	privateRooms map[string]*privateRoom
+
+	// Race lobbies by room name, guarded by queueMu.
+	lobbies map[string]*raceLobby
+	queueMu sync.Mutex
+
+	// Battles open to spectators, by battle id.
+	liveBattles map[string]*Battle
+	liveMu      sync.Mutex
+
+	// Seats of dropped players by resume token, only touched on the hub goroutine.
+	heldSeats map[string]*heldSeat
+
+	// Set once when the node starts shutting down, read with atomic.
+	draining int32
 }
 
 var h = Hub{
-	broadcast:      make(chan []byte),
-	register:       make(chan *Connection),
-	unregister:     make(chan *Connection),
-	connections:    make(map[*Connection]bool),
-	pendingConnMap: make(map[string]*Connection),
+	broadcast:    make(chan []byte),
+	register:     make(chan *Connection),
+	unregister:   make(chan *Connection),
+	connections:  make(map[*Connection]bool),
+	connIds:      make(map[string]*Connection),
+	proxies:      make(map[string]*Connection),
+	queues:       make(map[string]*matchQueue),
+	recentFoes:   make(map[int64]recentFoe),
+	calls:        make(chan func()),
+	privateRooms: make(map[string]*privateRoom),
+	liveBattles:  make(map[string]*Battle),
+	lobbies:      make(map[string]*raceLobby),
+	heldSeats:    make(map[string]*heldSeat),
+}
+
+func (h *Hub) call(f func()) {
+	h.calls <- f
+}
+
+//like call but returns once f has run, never from the hub goroutine
+func (h *Hub) callWait(f func()) {
+	done := make(chan bool)
+	h.calls <- func() {
+		f()
+		close(done)
+	}
+	<-done
 }
 
 func (h *Hub) run() {
+	go h.runMatchmaker()
+
+	pruneTicker := time.NewTicker(MATCHMAKING_TICK)
+	defer pruneTicker.Stop()
+	nodeTicker := time.NewTicker(NODE_HEARTBEAT_PERIOD)
+	defer nodeTicker.Stop()
+	h.nodeHeartbeat()
 	for {
 		select {
+		case <-pruneTicker.C:
+			prunePrivateRooms(h.privateRooms, time.Now())
+		case <-nodeTicker.C:
+			h.nodeHeartbeat()
+		case f := <-h.calls:
+			f()
 		case c := <-h.register:
 			h.connections[c] = true
+			h.connIds[c.id] = c
 			// c.sendType("connected")
 		case c := <-h.unregister:
-			if c.battle != nil && c.battle.state == MATCHING {
-				makeBattleResult(c, true)
-			}
-
-			if c.foe != nil {
-				c.foe.sendType("foeDisconnect")
-				c.foe.foe = nil
-				c.battle.state = ONELEFT
-			}
-			c.foe = nil
-			c.battle = nil
-
-			if _, ok := h.connections[c]; ok {
-				delete(h.connections, c)
-				close(c.send)
-			}
-
-			h.pendingConnMu.Lock()
-			if c == h.pendingConnMap[c.roomName] {
-				h.pendingConnMap[c.roomName] = nil
+			if h.isDraining() || !h.holdSeat(c) {
+				h.disconnect(c)
 			}
-			h.pendingConnMu.Unlock()
 
 			// case m := <-h.broadcast:
 
@@ -129,186 +179,477 @@ func (h *Hub) run() {
 	}
 }
 
-func (h *Hub) authPair(c *Connection, msg []byte) error {
-	//check already pair
-	if c.playerInfo != nil {
-		if !(c.battle != nil && c.battle.state == ONELEFT) {
-			return fmt.Errorf("err_already_pair")
+//runs on the hub goroutine, a player still in a battle loses it
+func (h *Hub) disconnect(c *Connection) {
+	if c.battle != nil && c.battle.isRace() {
+		raceLeave(c)
+	} else if c.battle != nil {
+		if c.battle.state == MATCHING {
+			makeBattleResult(c, true)
+		} else if c.battle.state == PREPARE {
+			refundBattleBets(c.battle)
 		}
+		h.removeLiveBattle(c.battle)
+	}
+	if c.spectating != nil {
+		c.spectating.removeSpectator(c)
+		c.spectating = nil
 	}
 
-	//ssdb
-	authdb, err := ssdbAuthPool.Get()
-	if err != nil {
-		return err
+	if c.foe != nil {
+		c.foe.sendType("foeDisconnect")
+		c.foe.foe = nil
+		c.battle.state = ONELEFT
 	}
-	defer authdb.Close()
+	c.foe = nil
+	c.battle = nil
 
-	matchdb, err := ssdbMatchPool.Get()
-	if err != nil {
-		return err
+	if c.remoteNodeId != "" {
+		h.clusterMu.Lock()
+		delete(h.proxies, c.id)
+		h.clusterMu.Unlock()
+	} else {
+		h.detachFromHost(c)
+		dequeueConn(c)
+		if h.connIds[c.id] == c {
+			delete(h.connIds, c.id)
+		}
 	}
-	defer matchdb.Close()
 
-	//
-	in := struct {
-		Token    string
-		RoomName string
-	}{}
-	if err = json.Unmarshal(msg, &in); err != nil {
-		return err
+	h.queueMu.Lock()
+	if lobby := h.lobbies[c.roomName]; lobby != nil && removeFromRaceLobby(lobby, c) {
+		if room, exist := getBattleRoom(c.roomName); exist {
+			sendRaceLobby(lobby, room)
+		}
 	}
+	h.queueMu.Unlock()
 
-	//
-	sessionKey := fmt.Sprintf("%s/%s", H_SESSION, in.Token)
-	resp, err := authdb.Do("get", sessionKey)
-	if err != nil {
-		return err
+	removePrivateRoomsOf(h.privateRooms, c)
+
+	if _, ok := h.connections[c]; ok {
+		delete(h.connections, c)
+		close(c.send)
 	}
-	if resp[0] != "ok" {
-		return fmt.Errorf("ssdb err:%s", resp[0])
+}
+
+func (h *Hub) authPair(c *Connection, msg []byte) error {
+	//leaving a battle on another node
+	if c.hostNodeId != "" {
+		h.call(func() {
+			h.detachFromHost(c)
+		})
+		c.playerInfo = nil
 	}
 
-	var session Session
-	err = json.Unmarshal([]byte(resp[1]), &session)
-	if err != nil {
+	if h.isDraining() {
+		return fmt.Errorf("err_draining")
+	}
+
+	//check already pair
+	if c.playerInfo != nil {
+		if !(c.battle != nil && c.battle.state == ONELEFT) {
+			return fmt.Errorf("err_already_pair")
+		}
+	}
+
+	//
+	var in MsgAuthPair
+	if err := json.Unmarshal(msg, &in); err != nil {
+		return fmt.Errorf("err_json")
+	}
+	if e := in.validate(c.version()); e != "" {
+		return errors.New(e)
+	}
+	if err := negotiateProtocol(c, in.Version, in.Encoding); err != nil {
 		return err
 	}
 
 	//
-	c.playerInfo, err = getPlayerInfo(matchdb, session.Userid)
+	session, err := authPlayer(c, in.Token)
 	if err != nil {
 		return err
 	}
-	c.playerInfo.UserId = session.Userid
+	go markBattleDevice(session.Userid, in.DeviceId)
 
 	//
-	room, exist := BATTLE_ROOM_MAP[in.RoomName]
+	room, exist := getBattleRoom(in.RoomName)
 	if !exist {
 		c.playerInfo = nil
 		return fmt.Errorf("err_room_name")
 	}
+	if !room.isOpen(time.Now()) {
+		c.playerInfo = nil
+		return fmt.Errorf("err_room_closed")
+	}
 
-	//check heart
-	if room.BetCoin == 0 {
-		heartNum := getBattleHeartNum(c.playerInfo)
-		if heartNum == 0 {
-			return fmt.Errorf("err_heart")
+	if err = checkBattleCost(c.playerInfo, room); err != nil {
+		c.playerInfo = nil
+		return err
+	}
+
+	c.roomName = in.RoomName
+	c.result = 0
+	c.safeChat = in.SafeChat
+	c.mutedFoe = false
+
+	//race lobby
+	if room.PlayerMax > 2 {
+		h.queueMu.Lock()
+		err = h.joinRaceLobby(c, room)
+		h.queueMu.Unlock()
+		if err != nil {
+			c.playerInfo = nil
 		}
+		return err
 	}
 
-	//check coin
-	if c.playerInfo.GoldCoin < room.BetCoin {
-		glog.Info(c.playerInfo.UserId)
+	//queue, shared by all nodes
+	rec := &queueRecord{
+		NodeId:     *nodeId,
+		ConnId:     c.id,
+		UserId:     session.Userid,
+		Rating:     battleRating(c.playerInfo),
+		EnqueuedAt: time.Now().UnixNano() / int64(time.Millisecond),
+		PlayerInfo: c.playerInfo,
+		Version:    c.protoVersion,
+		SafeChat:   c.safeChat,
+	}
+	expectedWaitSec, err := enqueue(rec, in.RoomName)
+	if err != nil {
 		c.playerInfo = nil
-		return fmt.Errorf("err_coin")
+		return err
 	}
 
-	//
-	h.pendingConnMu.Lock()
-	defer func() {
-		h.pendingConnMu.Unlock()
-	}()
-	pendingConn := h.pendingConnMap[in.RoomName]
-	if pendingConn != nil {
-		//check userId
-		if pendingConn.playerInfo.UserId == session.Userid {
-			return fmt.Errorf("err_same_user")
-		}
+	sendPairing(c, expectedWaitSec)
 
-		h.pendingConnMap[in.RoomName] = nil
+	return nil
+}
 
-		//
-		c.foe = pendingConn
-		pendingConn.foe = c
+func sendPairing(c *Connection, expectedWaitSec int) {
+	out := struct {
+		Type            string
+		ExpectedWaitSec int
+	}{
+		"pairing",
+		expectedWaitSec,
+	}
+	c.sendMsg(out)
+}
 
-		battle := makeBattle()
-		c.battle = battle
-		c.foe.battle = battle
-		battle.room = room
+//pairing does its db work on its own goroutine, so the hub keeps registering and dropping players meanwhile
+func (h *Hub) runMatchmaker() {
+	ticker := time.NewTicker(MATCHMAKING_TICK)
+	defer ticker.Stop()
+	for _ = range ticker.C {
+		h.matchmake()
+	}
+}
 
-		//get pack, fixme
-		rc := redisPool.Get()
-		defer rc.Close()
+//runs on the matchmaker goroutine
+func (h *Hub) matchmake() {
+	now := time.Now()
 
-		packId, err := redis.Int64(rc.Do("SRANDMEMBER", BATTLE_PACKID_SET))
-		if err != nil {
-			return err
-		}
+	//races gather on this node only
+	h.queueMu.Lock()
+	races := h.takeRaceLobbies(now)
+	h.queueMu.Unlock()
 
-		pack, err := getPack(matchdb, packId)
+	for _, conns := range races {
+		room, exist := getBattleRoom(conns[0].roomName)
+		err := fmt.Errorf("err_room_name")
+		if exist {
+			err = h.startRace(conns, room)
+		}
 		if err != nil {
-			return err
+			glog.Errorf("startRace error:%v", err)
+			race := conns
+			h.call(func() {
+				h.failStart(race, err, nil)
+			})
 		}
+	}
+
+	//1v1 queues, a draining node leaves them to the others
+	if h.isDraining() {
+		return
+	}
+	rc := redisPool.Get()
+	defer rc.Close()
+	if isMatchmaker(rc) {
+		h.matchmakeQueues(rc, now)
+	}
+}
 
-		//heart
-		if room.BetCoin == 0 {
-			heartNum := getBattleHeartNum(c.playerInfo)
-			if heartNum == BATTLE_HEART_TOTAL {
-				c.playerInfo.BattleHeartZeroTime = time.Now().Unix() - BATTLE_HEART_ADD_SEC*(BATTLE_HEART_TOTAL-1)
+//a start failed because of this player alone, the others may be paired again
+type startErr struct {
+	conn *Connection
+	err  string
+}
+
+func (e *startErr) Error() string {
+	return e.err
+}
+
+//runs on the hub goroutine after a start failed. the player the error names, or everyone if it names nobody,
+//gets the error and is let go. the others are put back where they waited if requeue does so, or let go too.
+func (h *Hub) failStart(conns []*Connection, err error, requeue func(c *Connection) bool) {
+	var fault *Connection
+	if e, ok := err.(*startErr); ok {
+		fault = e.conn
+	}
+	for _, c := range conns {
+		if c.isBot || !h.connections[c] || c.playerInfo == nil {
+			continue
+		}
+		errstr := err.Error()
+		if fault != nil && c != fault {
+			if requeue != nil && requeue(c) {
+				errstr = ""
 			} else {
-				c.playerInfo.BattleHeartZeroTime += BATTLE_HEART_ADD_SEC
+				errstr = "err_no_foe"
 			}
-			playerKey := makePlayerInfoKey(c.playerInfo.UserId)
-			matchdb.Do("hset", playerKey, PLAYER_BATTLE_HEART_ZERO_TIME, c.playerInfo.BattleHeartZeroTime)
 		}
 
-		//
-		out := struct {
-			Type          string
-			Pack          *Pack
-			SliderNum     int
-			FoePlayer     *PlayerInfo
-			Secret        string
-			HeartZeroTime int64
-		}{
-			"paired",
-			pack,
-			3, //rand.Intn(3) + 4, //fixme
-			c.foe.playerInfo,
-			battle.secret,
-			c.playerInfo.BattleHeartZeroTime,
+		//proxies are let go by their own node, a requeued player may pair anywhere next time
+		if c.remoteNodeId != "" {
+			publishNodeMsg(c.remoteNodeId, &nodeMsg{Cmd: "release", ConnId: c.id, Msg: errstr})
+			h.disconnect(c)
+		} else if errstr != "" {
+			c.playerInfo = nil
+			c.sendErr(errstr)
 		}
-		c.sendMsg(out)
+	}
+}
 
-		//foe
-		out.FoePlayer = c.playerInfo
+//the db work runs on the calling goroutine, which can't be the hub's, then the players are attached on the hub.
+//a player who can't pay or left meanwhile fails the start, callers let go of or requeue the others with failStart.
+func (h *Hub) startBattle(c *Connection, foe *Connection, room BattleRoom) error {
+	//ssdb
+	matchdb, err := ssdbMatchPool.Get()
+	if err != nil {
+		return err
+	}
+	defer matchdb.Close()
 
-		//heart
-		if room.BetCoin == 0 {
-			heartNum := getBattleHeartNum(c.foe.playerInfo)
-			if heartNum == BATTLE_HEART_TOTAL {
-				c.foe.playerInfo.BattleHeartZeroTime = time.Now().Unix() - BATTLE_HEART_ADD_SEC*(BATTLE_HEART_TOTAL-1)
-			} else {
-				c.foe.playerInfo.BattleHeartZeroTime += BATTLE_HEART_ADD_SEC
+	//pack
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	conns := []*Connection{c, foe}
+	userIds := humanUserIds(conns)
+	sliderNum := pickSliderNum(room, conns)
+	packId, err := pickBattlePackId(rc, matchdb, userIds, sliderNum)
+	if err != nil {
+		return err
+	}
+
+	pack, err := getPack(matchdb, packId)
+	if err != nil {
+		return err
+	}
+
+	if err = markBattlePackSeen(rc, userIds, packId); err != nil {
+		glog.Errorf("markBattlePackSeen error:%v", err)
+	}
+
+	//
+	battle := makeBattle()
+	battle.room = room
+	battle.packId = pack.Id
+	battle.sliderNum = sliderNum
+	battle.imageNum = len(pack.Images)
+	battle.isBot = c.isBot || foe.isBot
+	battle.players = conns
+
+	//bets
+	if err = reserveBattleBets(matchdb, battle, conns); err != nil {
+		return err
+	}
+
+	//attach, unless someone left or the node began draining meanwhile
+	h.callWait(func() {
+		for _, p := range conns {
+			if !p.isBot && !h.connections[p] {
+				err = &startErr{p, "err_no_foe"}
+				return
 			}
-			playerKey := makePlayerInfoKey(c.foe.playerInfo.UserId)
-			matchdb.Do("hset", playerKey, PLAYER_BATTLE_HEART_ZERO_TIME, c.foe.playerInfo.BattleHeartZeroTime)
+		}
+		if h.isDraining() {
+			err = fmt.Errorf("err_draining")
+			return
 		}
 
-		out.HeartZeroTime = c.foe.playerInfo.BattleHeartZeroTime
-		c.foe.sendMsg(out)
+		c.foe = foe
+		foe.foe = c
+		c.battle = battle
+		foe.battle = battle
+		h.addLiveBattle(battle)
+
+		//resume tokens, bots don't drop
+		c.resumeToken = ""
+		if !c.isBot {
+			c.resumeToken = genUUID()
+		}
+		foe.resumeToken = ""
+		if !foe.isBot {
+			foe.resumeToken = genUUID()
+		}
+	})
+	if err != nil {
+		refundBattleBets(battle)
+		return err
+	}
 
-		//timeout
-		go func() {
-			time.Sleep(20 * time.Second)
-			if c.battle != nil && c.battle.state == PREPARE {
-				c.sendErr("err_timeout")
-				c.foe.sendErr("err_timeout")
+	//heart
+	if room.HeartCost > 0 && !c.isBot {
+		useBattleHeart(matchdb, c.playerInfo, room.HeartCost)
+	}
+	if room.HeartCost > 0 && !foe.isBot {
+		useBattleHeart(matchdb, foe.playerInfo, room.HeartCost)
+	}
+
+	//
+	out := struct {
+		Type          string
+		Pack          *Pack
+		SliderNum     int
+		FoePlayer     *PlayerInfo
+		FoeIsBot      bool
+		Secret        string
+		HeartZeroTime int64
+		ResumeToken   string
+	}{
+		"paired",
+		pack,
+		battle.sliderNum,
+		foe.playerInfo,
+		foe.isBot,
+		battle.secret,
+		c.playerInfo.BattleHeartZeroTime,
+		c.resumeToken,
+	}
+	h.call(func() {
+		if c.isBot || h.connections[c] {
+			c.sendMsg(out)
+		}
+
+		//foe
+		out.FoePlayer = c.playerInfo
+		out.FoeIsBot = c.isBot
+		out.HeartZeroTime = foe.playerInfo.BattleHeartZeroTime
+		out.ResumeToken = foe.resumeToken
+		if foe.isBot || h.connections[foe] {
+			foe.sendMsg(out)
+		}
+	})
+
+	//timeout
+	go func() {
+		time.Sleep(20 * time.Second)
+		h.call(func() {
+			if c.battle != battle || battle.state != PREPARE {
+				return
 			}
-		}()
-	} else {
-		h.pendingConnMap[in.RoomName] = c
+			battle.state = FINISH
+			refundBattleBets(battle)
+			h.removeLiveBattle(battle)
+
+			//both may pair again
+			for _, p := range battle.players {
+				if p.battle != battle {
+					continue
+				}
+				p.battle = nil
+				p.foe = nil
+				p.resumeToken = ""
+				if p.isBot {
+					p.sendType("err")
+				} else if p.remoteNodeId != "" {
+					publishNodeMsg(p.remoteNodeId, &nodeMsg{Cmd: "release", ConnId: p.id, Msg: "err_timeout"})
+					h.disconnect(p)
+				} else {
+					p.playerInfo = nil
+					p.sendErr("err_timeout")
+				}
+			}
+		})
+	}()
+
+	return nil
+}
 
-		c.sendType("pairing")
+//validates the session token and loads the player into c.playerInfo
+func authPlayer(c *Connection, token string) (*Session, error) {
+	//ssdb
+	authdb, err := ssdbAuthPool.Get()
+	if err != nil {
+		return nil, err
 	}
+	defer authdb.Close()
 
-	c.roomName = in.RoomName
-	c.result = 0
+	matchdb, err := ssdbMatchPool.Get()
+	if err != nil {
+		return nil, err
+	}
+	defer matchdb.Close()
 
+	//
+	sessionKey := fmt.Sprintf("%s/%s", H_SESSION, token)
+	resp, err := authdb.Do("get", sessionKey)
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != "ok" {
+		return nil, fmt.Errorf("err_auth")
+	}
+
+	var session Session
+	err = json.Unmarshal([]byte(resp[1]), &session)
+	if err != nil {
+		return nil, err
+	}
+
+	//
+	c.playerInfo, err = getPlayerInfo(matchdb, session.Userid)
+	if err != nil {
+		return nil, err
+	}
+	c.playerInfo.UserId = session.Userid
+
+	return &session, nil
+}
+
+//rooms may cost hearts, coin rooms need the bet in hand
+func checkBattleCost(playerInfo *PlayerInfo, room BattleRoom) error {
+	//check heart
+	if room.HeartCost > 0 {
+		heartNum := getBattleHeartNum(playerInfo)
+		if heartNum < room.HeartCost {
+			return fmt.Errorf("err_heart")
+		}
+	}
+
+	//check coin
+	if playerInfo.GoldCoin < room.BetCoin {
+		glog.Info(playerInfo.UserId)
+		return fmt.Errorf("err_coin")
+	}
 	return nil
 }
 
+func useBattleHeart(matchdb *ssdbgo.Client, playerInfo *PlayerInfo, cost int) {
+	for i := 0; i < cost; i++ {
+		heartNum := getBattleHeartNum(playerInfo)
+		if heartNum == BATTLE_HEART_TOTAL {
+			playerInfo.BattleHeartZeroTime = time.Now().Unix() - BATTLE_HEART_ADD_SEC*(BATTLE_HEART_TOTAL-1)
+		} else {
+			playerInfo.BattleHeartZeroTime += BATTLE_HEART_ADD_SEC
+		}
+	}
+	playerKey := makePlayerInfoKey(playerInfo.UserId)
+	matchdb.Do("hset", playerKey, PLAYER_BATTLE_HEART_ZERO_TIME, playerInfo.BattleHeartZeroTime)
+}
+
 func getPlayerInfo(ssdbc *ssdbgo.Client, userId int64) (*PlayerInfo, error) {
 	key := makePlayerInfoKey(userId)
 
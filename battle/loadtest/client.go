@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+type serverMsg struct {
+	Type        string
+	String      string //err
+	Code        int    //err
+	Secret      string //paired
+	FoePlayer   *struct{ UserId int64 }
+	FoeIsBot    bool
+	CompleteNum int //foe's progress
+}
+
+type client struct {
+	userId int64
+	rng    *rand.Rand
+	stats  *stats
+
+	ws     *websocket.Conn
+	msgs   chan *serverMsg
+	foeId  int64
+	secret string
+}
+
+//progress send times by userId/completeNum, the foe's reader looks them up
+var progressSent sync.Map
+
+func makeProgressKey(userId int64, completeNum int) string {
+	return fmt.Sprintf("%d/%d", userId, completeNum)
+}
+
+//the server's formula
+func makeBattleChecksum(secret string, msec int) string {
+	checksum := fmt.Sprintf("%s+%d9d7a", secret, msec+8703)
+	hasher := sha1.New()
+	hasher.Write([]byte(checksum))
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+//one battle on a fresh connection, every failure is counted by stage
+func (c *client) play() {
+	dialer := &websocket.Dialer{HandshakeTimeout: time.Duration(*timeoutSec) * time.Second}
+	ws, _, err := dialer.Dial(fmt.Sprintf("ws://%s/ws", *addr), nil)
+	if err != nil {
+		c.stats.fail("dial", err.Error())
+		return
+	}
+	c.ws = ws
+	c.msgs = make(chan *serverMsg, 16)
+	c.stats.connOpened()
+	defer func() {
+		ws.Close()
+		c.stats.connClosed()
+	}()
+	go c.readPump()
+
+	//pair
+	begin := time.Now()
+	err = c.send(map[string]interface{}{
+		"Type":     "authPair",
+		"Token":    makeToken(c.userId),
+		"RoomName": *roomName,
+		"Version":  *version,
+	})
+	if err != nil {
+		c.stats.fail("authPair", err.Error())
+		return
+	}
+	msg, err := c.expect("paired")
+	if err != nil {
+		c.stats.fail("authPair", err.Error())
+		return
+	}
+	c.stats.add(STAT_PAIRING, time.Since(begin))
+	c.secret = msg.Secret
+	if msg.FoePlayer != nil {
+		c.foeId = msg.FoePlayer.UserId
+	}
+	if msg.FoeIsBot {
+		c.stats.count("foeIsBot")
+	}
+
+	//ready
+	if err = c.send(map[string]string{"Type": "ready"}); err != nil {
+		c.stats.fail("ready", err.Error())
+		return
+	}
+	if _, err = c.expect("start"); err != nil {
+		c.stats.fail("ready", err.Error())
+		return
+	}
+
+	//progress, one per image
+	start := time.Now()
+	for i := 1; i <= *imageNum; i++ {
+		step := time.Duration(*stepMsec/2+c.rng.Intn(*stepMsec+1)) * time.Millisecond
+		time.Sleep(step)
+		progressSent.Store(makeProgressKey(c.userId, i), time.Now())
+		if err = c.send(map[string]interface{}{"Type": "progress", "CompleteNum": i}); err != nil {
+			c.stats.fail("progress", err.Error())
+			return
+		}
+	}
+
+	//finish
+	msec := int(time.Since(start) / time.Millisecond)
+	if msec < 1 {
+		msec = 1
+	}
+	begin = time.Now()
+	err = c.send(map[string]interface{}{
+		"Type":     "finish",
+		"Msec":     msec,
+		"Checksum": makeBattleChecksum(c.secret, msec),
+	})
+	if err != nil {
+		c.stats.fail("finish", err.Error())
+		return
+	}
+	if _, err = c.expect("result"); err != nil {
+		c.stats.fail("finish", err.Error())
+		return
+	}
+	c.stats.add(STAT_RESULT, time.Since(begin))
+	c.stats.count("battle")
+}
+
+func (c *client) send(msg interface{}) error {
+	js, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.ws.SetWriteDeadline(time.Now().Add(time.Duration(*timeoutSec) * time.Second))
+	err = c.ws.WriteMessage(websocket.TextMessage, js)
+	if err == nil {
+		c.stats.count("sent")
+	}
+	return err
+}
+
+//skips what the flow doesn't wait for, an err message fails the stage
+func (c *client) expect(msgType string) (*serverMsg, error) {
+	timeout := time.After(time.Duration(*timeoutSec) * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.msgs:
+			if !ok {
+				return nil, fmt.Errorf("closed")
+			}
+			if msg.Type == msgType {
+				return msg, nil
+			}
+			if msg.Type == "err" {
+				return nil, fmt.Errorf("%d %s", msg.Code, msg.String)
+			}
+			if msg.Type == "foeDisconnect" {
+				return nil, fmt.Errorf("foeDisconnect")
+			}
+		case <-timeout:
+			return nil, fmt.Errorf("timeout waiting %s", msgType)
+		}
+	}
+}
+
+//foe progress is timed here, everything else goes to the flow
+func (c *client) readPump() {
+	defer close(c.msgs)
+	for {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		c.stats.count("received")
+
+		var msg serverMsg
+		if err = json.Unmarshal(data, &msg); err != nil {
+			c.stats.fail("decode", err.Error())
+			continue
+		}
+		if msg.Type == "progress" {
+			if sent, ok := progressSent.Load(makeProgressKey(c.foeId, msg.CompleteNum)); ok {
+				c.stats.add(STAT_MESSAGE, now.Sub(sent.(time.Time)))
+				progressSent.Delete(makeProgressKey(c.foeId, msg.CompleteNum))
+			}
+			continue
+		}
+		select {
+		case c.msgs <- &msg:
+		default:
+			c.stats.fail("overflow", msg.Type)
+		}
+	}
+}
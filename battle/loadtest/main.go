@@ -0,0 +1,125 @@
+// Load generator for the battle server: thousands of websocket clients pair up
+// and play authPair, ready, progress and finish with valid checksums, then it
+// reports pairing and message latency, errors and memory per connection.
+//
+// It seeds sessions, players, a room and packs into the ssdb and redis the
+// server uses, so both run against throwaway instances on their own ports,
+// copies of ssdb/*/ssdb.conf and redis/redis.conf with the port changed.
+// The live ports are refused. -clean takes back what was seeded and what the
+// server wrote for the seeded players, except the achievement and mission
+// event queues and the daily eco counters, which are shared.
+//
+//	cd battle && ./battle -ssdbAuthPort 19875 -ssdbMatchPort 19876 -redisAddr localhost:16379
+//	cd battle/loadtest && go run *.go -clients 2000 -serverPid $(pgrep -n battle)
+//	cd battle/loadtest && go run *.go -clean
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"runtime"
+	"sync"
+	"time"
+)
+
+var (
+	addr          = flag.String("addr", "localhost:9977", "battle server address")
+	clientNum     = flag.Int("clients", 1000, "simulated players, pairs play each other")
+	roundNum      = flag.Int("rounds", 1, "battles each player plays, on a new connection each")
+	rampSec       = flag.Int("rampSec", 10, "seconds over which the clients connect")
+	stepMsec      = flag.Int("stepMsec", 800, "mean msec between progress messages")
+	timeoutSec    = flag.Int("timeoutSec", 60, "seconds a client waits for any one reply")
+	version       = flag.Int("version", 2, "protocol version sent in authPair")
+	randSeed      = flag.Int64("seed", 1, "seed for the clients' timing, runs with the same seed play alike")
+	userIdBase    = flag.Int64("userIdBase", 900000000, "seeded players get ids from here on")
+	roomName      = flag.String("room", "loadtest", "room seeded and played in")
+	betCoin       = flag.Int("betCoin", 0, "bet of the seeded room, 0 for a free room")
+	packNum       = flag.Int("packs", 20, "packs seeded into the battle pool")
+	imageNum      = flag.Int("images", 6, "images per seeded pack, one progress message each")
+	doSeed        = flag.Bool("seedDb", true, "seed ssdb and redis before the run")
+	reloadWait    = flag.Int("reloadWaitSec", 11, "seconds to let the server reload its room catalog after seeding")
+	doClean       = flag.Bool("clean", false, "remove the seeded data and what the runs wrote, then exit")
+	serverPid     = flag.Int("serverPid", 0, "pid of a local battle server to sample memory of, 0 to skip")
+	ssdbAuthPort  = flag.Int("ssdbAuthPort", 19875, "port of the throwaway auth ssdb the server uses")
+	ssdbMatchPort = flag.Int("ssdbMatchPort", 19876, "port of the throwaway match ssdb the server uses")
+	redisAddr     = flag.String("redisAddr", "localhost:16379", "address of the throwaway redis the server uses")
+	sampleEvery   = time.Second
+)
+
+func main() {
+	flag.Parse()
+	if *clientNum < 2 {
+		log.Fatal("need at least 2 clients")
+	}
+
+	seeder, err := newSeeder()
+	if err != nil {
+		log.Fatal("connect db: ", err)
+	}
+	if *doClean {
+		if err = seeder.clean(); err != nil {
+			log.Fatal("clean: ", err)
+		}
+		log.Print("seeded and run data removed")
+		return
+	}
+	if *doSeed {
+		if err = seeder.seed(); err != nil {
+			log.Fatal("seed: ", err)
+		}
+		log.Printf("seeded %d players, %d packs and room %s, waiting %ds for the server to reload", *clientNum, *packNum, *roomName, *reloadWait)
+		time.Sleep(time.Duration(*reloadWait) * time.Second)
+	}
+
+	stats := newStats()
+	mem := newMemSampler(*serverPid)
+	mem.baseline()
+	stopSampling := make(chan bool)
+	go mem.run(stats, stopSampling)
+
+	//every client gets its own rand, seeded from the run seed
+	rng := rand.New(rand.NewSource(*randSeed))
+	ramp := time.Duration(*rampSec) * time.Second / time.Duration(*clientNum)
+
+	begin := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < *clientNum; i++ {
+		c := &client{
+			userId: *userIdBase + int64(i),
+			rng:    rand.New(rand.NewSource(rng.Int63())),
+			stats:  stats,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < *roundNum; round++ {
+				c.play()
+			}
+		}()
+		time.Sleep(ramp)
+	}
+	wg.Wait()
+	close(stopSampling)
+
+	stats.report(time.Since(begin), mem)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+func harnessHeap() int64 {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapAlloc)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/henyouqian/ssdbgo"
+)
+
+//keys as the battle server has them. the live ports are refused, a run writes more than it can take back from shared aggregates
+const (
+	SSDB_HOST            = "localhost"
+	LIVE_SSDB_AUTH_PORT  = 9875
+	LIVE_SSDB_MATCH_PORT = 9876
+	LIVE_REDIS_PORT      = "6379"
+
+	H_SESSION         = "H_SESSION"
+	H_PLAYER_INFO     = "H_PLAYER_INFO"
+	H_PACK            = "H_PACK"
+	H_BATTLE_ROOM     = "H_BATTLE_ROOM"
+	BATTLE_PACKID_SET = "BATTLE_PACKID_SET"
+
+	//written by the server during the run
+	H_BATTLE_RECORD        = "H_BATTLE_RECORD"
+	Z_PLAYER_BATTLE_RECORD = "Z_PLAYER_BATTLE_RECORD"
+	H_PLAYER_BATTLE_STAT   = "H_PLAYER_BATTLE_STAT"
+	H_PLAYER_BATTLE_VS     = "H_PLAYER_BATTLE_VS"
+	H_BATTLE_CHAT          = "H_BATTLE_CHAT"
+	Z_BATTLE_COIN_RECORD   = "Z_BATTLE_COIN_RECORD"
+	H_BATTLE_ESCROW        = "H_BATTLE_ESCROW"
+	Z_BATTLE_ESCROW        = "Z_BATTLE_ESCROW"
+	H_BATTLE_HELD_PAYOUT   = "H_BATTLE_HELD_PAYOUT"
+	Z_BATTLE_HELD_PAYOUT   = "Z_BATTLE_HELD_PAYOUT"
+	K_BATTLE_ESCROW_CLAIM  = "K_BATTLE_ESCROW_CLAIM"
+	Z_BATTLE_PACK_SEEN     = "Z_BATTLE_PACK_SEEN"
+	Q_BATTLE_FINISH_MSEC   = "Q_BATTLE_FINISH_MSEC"
+	Z_PLAYER_BATTLE_DEVICE = "Z_PLAYER_BATTLE_DEVICE"
+	Z_ECO_PLAYER_MON       = "Z_ECO_PLAYER_MON"
+	H_ECO_RECORD           = "H_ECO_RECORD"
+	K_BATTLE_SEASON_ACTIVE = "K_BATTLE_SEASON_ACTIVE"
+	Z_BATTLE_SEASON_POINT  = "Z_BATTLE_SEASON_POINT"
+	H_BATTLE_QUEUE         = "H_BATTLE_QUEUE"
+	H_BATTLE_QUEUE_WAIT    = "H_BATTLE_QUEUE_WAIT"
+	H_BATTLE_ROOM_COUNT    = "H_BATTLE_ROOM_COUNT"
+	BATTLE_NODE_SET        = "BATTLE_NODE_SET"
+
+	SEED_GOLD_COIN  = 1000000
+	SEED_SLIDER_NUM = 3
+	CLEAN_PAGE      = 1000
+)
+
+type seeder struct {
+	authPool  *ssdbgo.Pool
+	matchPool *ssdbgo.Pool
+	redisPool *redis.Pool
+}
+
+func newSeeder() (*seeder, error) {
+	if *ssdbAuthPort == LIVE_SSDB_AUTH_PORT || *ssdbMatchPort == LIVE_SSDB_MATCH_PORT || strings.HasSuffix(*redisAddr, ":"+LIVE_REDIS_PORT) {
+		return nil, fmt.Errorf("refusing the live db ports, start throwaway instances on other ones")
+	}
+	s := &seeder{
+		authPool:  ssdbgo.NewPool(SSDB_HOST, *ssdbAuthPort, 4, 60),
+		matchPool: ssdbgo.NewPool(SSDB_HOST, *ssdbMatchPort, 4, 60),
+		redisPool: &redis.Pool{
+			MaxIdle: 4,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", *redisAddr)
+			},
+		},
+	}
+	rc := s.redisPool.Get()
+	defer rc.Close()
+	_, err := rc.Do("PING")
+	return s, err
+}
+
+func makeToken(userId int64) string {
+	return fmt.Sprintf("loadtest-%d", userId)
+}
+
+//pack ids share the player id range, nothing real lives there
+func makePackId(i int) int64 {
+	return *userIdBase + int64(i)
+}
+
+func (s *seeder) seed() error {
+	authdb, err := s.authPool.Get()
+	if err != nil {
+		return err
+	}
+	defer authdb.Close()
+	matchdb, err := s.matchPool.Get()
+	if err != nil {
+		return err
+	}
+	defer matchdb.Close()
+
+	//players with a session, coins for the bets and full hearts
+	for i := 0; i < *clientNum; i++ {
+		userId := *userIdBase + int64(i)
+		js, _ := json.Marshal(struct{ Userid int64 }{userId})
+		resp, err := authdb.Do("set", fmt.Sprintf("%s/%s", H_SESSION, makeToken(userId)), js)
+		if err = checkSsdb(resp, err); err != nil {
+			return err
+		}
+		resp, err = matchdb.Do("multi_hset", fmt.Sprintf("%s/%d", H_PLAYER_INFO, userId),
+			"NickName", fmt.Sprintf("load%d", i),
+			"GoldCoin", SEED_GOLD_COIN,
+			"BattleHeartZeroTime", 0,
+		)
+		if err = checkSsdb(resp, err); err != nil {
+			return err
+		}
+	}
+
+	//room
+	room := map[string]interface{}{
+		"Name":         *roomName,
+		"Title":        "load test",
+		"BetCoin":      *betCoin,
+		"HeartCost":    0,
+		"SliderNumMin": SEED_SLIDER_NUM,
+		"SliderNumMax": SEED_SLIDER_NUM,
+		"PlayerMin":    2,
+		"PlayerMax":    2,
+	}
+	js, _ := json.Marshal(room)
+	resp, err := matchdb.Do("hset", H_BATTLE_ROOM, *roomName, js)
+	if err = checkSsdb(resp, err); err != nil {
+		return err
+	}
+
+	//packs
+	rc := s.redisPool.Get()
+	defer rc.Close()
+	for i := 0; i < *packNum; i++ {
+		packId := makePackId(i)
+		images := make([]map[string]string, 0, *imageNum)
+		for j := 0; j < *imageNum; j++ {
+			images = append(images, map[string]string{"Key": fmt.Sprintf("loadtest/%d/%d.jpg", packId, j)})
+		}
+		js, _ := json.Marshal(map[string]interface{}{
+			"Id":     packId,
+			"Title":  fmt.Sprintf("load test %d", i),
+			"Images": images,
+		})
+		resp, err = matchdb.Do("hset", H_PACK, packId, js)
+		if err = checkSsdb(resp, err); err != nil {
+			return err
+		}
+		if _, err = rc.Do("SADD", BATTLE_PACKID_SET, packId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isSeededUser(userId int64) bool {
+	return userId >= *userIdBase && userId < *userIdBase+int64(*clientNum)
+}
+
+//battleId/userId keys of escrow and held payouts
+func isSeededEscrowKey(key string) bool {
+	i := strings.LastIndex(key, "/")
+	if i < 0 {
+		return false
+	}
+	userId, err := strconv.ParseInt(key[i+1:], 10, 64)
+	return err == nil && isSeededUser(userId)
+}
+
+//what was seeded and everything the server wrote for the seeded players, their battles and packs
+func (s *seeder) clean() error {
+	authdb, err := s.authPool.Get()
+	if err != nil {
+		return err
+	}
+	defer authdb.Close()
+	matchdb, err := s.matchPool.Get()
+	if err != nil {
+		return err
+	}
+	defer matchdb.Close()
+	rc := s.redisPool.Get()
+	defer rc.Close()
+
+	seasonId := ""
+	resp, err := matchdb.Do("get", K_BATTLE_SEASON_ACTIVE)
+	if err == nil && len(resp) > 1 && resp[0] == "ok" {
+		seasonId = resp[1]
+	}
+
+	//players
+	battleIds := map[string]bool{}
+	for i := 0; i < *clientNum; i++ {
+		userId := *userIdBase + int64(i)
+		if _, err = authdb.Do("del", fmt.Sprintf("%s/%s", H_SESSION, makeToken(userId))); err != nil {
+			return err
+		}
+
+		key := fmt.Sprintf("%s/%d", Z_PLAYER_BATTLE_RECORD, userId)
+		ids, err := zsetKeys(matchdb, key)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			battleIds[id] = true
+		}
+
+		key = fmt.Sprintf("%s/%d", Z_ECO_PLAYER_MON, userId)
+		ids, err = zsetKeys(matchdb, key)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if _, err = matchdb.Do("hdel", H_ECO_RECORD, id); err != nil {
+				return err
+			}
+		}
+
+		cmds := [][]interface{}{
+			{"hclear", fmt.Sprintf("%s/%d", H_PLAYER_INFO, userId)},
+			{"hclear", fmt.Sprintf("%s/%d", H_PLAYER_BATTLE_STAT, userId)},
+			{"hclear", fmt.Sprintf("%s/%d", H_PLAYER_BATTLE_VS, userId)},
+			{"zclear", fmt.Sprintf("%s/%d", Z_PLAYER_BATTLE_RECORD, userId)},
+			{"zclear", fmt.Sprintf("%s/%d", Z_ECO_PLAYER_MON, userId)},
+			{"zclear", fmt.Sprintf("%s/%d", Z_PLAYER_BATTLE_DEVICE, userId)},
+		}
+		if seasonId != "" {
+			cmds = append(cmds, []interface{}{"zdel", fmt.Sprintf("%s/%s", Z_BATTLE_SEASON_POINT, seasonId), userId})
+		}
+		for _, cmd := range cmds {
+			if _, err = matchdb.Do(cmd...); err != nil {
+				return err
+			}
+		}
+		if _, err = rc.Do("DEL", fmt.Sprintf("%s/%d", Z_BATTLE_PACK_SEEN, userId)); err != nil {
+			return err
+		}
+	}
+
+	//battles
+	for battleId := range battleIds {
+		for _, cmd := range [][]interface{}{
+			{"hdel", H_BATTLE_RECORD, battleId},
+			{"hdel", H_BATTLE_CHAT, battleId},
+			{"zdel", Z_BATTLE_COIN_RECORD, battleId},
+		} {
+			if _, err = matchdb.Do(cmd...); err != nil {
+				return err
+			}
+		}
+	}
+
+	//escrow, also of battles that ended without a record
+	for _, names := range [][2]string{{H_BATTLE_ESCROW, Z_BATTLE_ESCROW}, {H_BATTLE_HELD_PAYOUT, Z_BATTLE_HELD_PAYOUT}} {
+		keys, err := hashKeys(matchdb, names[0])
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if !isSeededEscrowKey(key) {
+				continue
+			}
+			if _, err = matchdb.Do("hdel", names[0], key); err != nil {
+				return err
+			}
+			if _, err = matchdb.Do("zdel", names[1], key); err != nil {
+				return err
+			}
+		}
+	}
+	cursor := 0
+	for {
+		reply, err := redis.Values(rc.Do("SCAN", cursor, "MATCH", K_BATTLE_ESCROW_CLAIM+"/*", "COUNT", CLEAN_PAGE))
+		if err != nil {
+			return err
+		}
+		cursor, _ = redis.Int(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+		for _, key := range keys {
+			if isSeededEscrowKey(key) {
+				if _, err = rc.Do("DEL", key); err != nil {
+					return err
+				}
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+
+	//room
+	if _, err = matchdb.Do("hdel", H_BATTLE_ROOM, *roomName); err != nil {
+		return err
+	}
+	if _, err = rc.Do("DEL", fmt.Sprintf("%s/%s", H_BATTLE_QUEUE, *roomName)); err != nil {
+		return err
+	}
+	if _, err = rc.Do("HDEL", H_BATTLE_QUEUE_WAIT, *roomName); err != nil {
+		return err
+	}
+	nodes, err := redis.Strings(rc.Do("SMEMBERS", BATTLE_NODE_SET))
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		key := fmt.Sprintf("%s/%s", H_BATTLE_ROOM_COUNT, node)
+		if _, err = rc.Do("HDEL", key, *roomName+"/Waiting", *roomName+"/Playing"); err != nil {
+			return err
+		}
+	}
+
+	//packs
+	for i := 0; i < *packNum; i++ {
+		packId := makePackId(i)
+		if _, err = matchdb.Do("hdel", H_PACK, packId); err != nil {
+			return err
+		}
+		if _, err = matchdb.Do("qclear", fmt.Sprintf("%s/%d/%d", Q_BATTLE_FINISH_MSEC, packId, SEED_SLIDER_NUM)); err != nil {
+			return err
+		}
+		if _, err = rc.Do("SREM", BATTLE_PACKID_SET, packId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hashKeys(ssdbc *ssdbgo.Client, name string) ([]string, error) {
+	keys := []string{}
+	start := ""
+	for {
+		resp, err := ssdbc.Do("hkeys", name, start, "", CLEAN_PAGE)
+		if err = checkSsdb(resp, err); err != nil {
+			return nil, err
+		}
+		page := resp[1:]
+		keys = append(keys, page...)
+		if len(page) < CLEAN_PAGE {
+			return keys, nil
+		}
+		start = page[len(page)-1]
+	}
+}
+
+func zsetKeys(ssdbc *ssdbgo.Client, name string) ([]string, error) {
+	keys := []string{}
+	keyStart, scoreStart := "", ""
+	for {
+		resp, err := ssdbc.Do("zscan", name, keyStart, scoreStart, "", CLEAN_PAGE)
+		if err = checkSsdb(resp, err); err != nil {
+			return nil, err
+		}
+		page := resp[1:]
+		for i := 0; i+1 < len(page); i += 2 {
+			keys = append(keys, page[i])
+		}
+		if len(page)/2 < CLEAN_PAGE {
+			return keys, nil
+		}
+		keyStart, scoreStart = page[len(page)-2], page[len(page)-1]
+	}
+}
+
+func checkSsdb(resp []string, err error) error {
+	if err != nil {
+		return err
+	}
+	if len(resp) == 0 || resp[0] != "ok" {
+		return fmt.Errorf("ssdb error:%v", resp)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	STAT_PAIRING = "pairing" //authPair to paired
+	STAT_MESSAGE = "message" //progress sent to the foe getting it
+	STAT_RESULT  = "result"  //finish to result, includes waiting for the foe to finish
+
+	FAIL_SAMPLE_MAX = 5
+)
+
+type stats struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	counts    map[string]int
+	fails     map[string]int
+	samples   map[string][]string
+	conns     int
+	connsPeak int
+}
+
+func newStats() *stats {
+	return &stats{
+		latencies: map[string][]time.Duration{},
+		counts:    map[string]int{},
+		fails:     map[string]int{},
+		samples:   map[string][]string{},
+	}
+}
+
+func (s *stats) add(name string, d time.Duration) {
+	s.mu.Lock()
+	s.latencies[name] = append(s.latencies[name], d)
+	s.mu.Unlock()
+}
+
+func (s *stats) count(name string) {
+	s.mu.Lock()
+	s.counts[name]++
+	s.mu.Unlock()
+}
+
+//by stage, with a few messages kept for the report
+func (s *stats) fail(stage string, detail string) {
+	s.mu.Lock()
+	s.fails[stage]++
+	if len(s.samples[stage]) < FAIL_SAMPLE_MAX {
+		s.samples[stage] = append(s.samples[stage], detail)
+	}
+	s.mu.Unlock()
+}
+
+func (s *stats) connOpened() {
+	s.mu.Lock()
+	s.conns++
+	if s.conns > s.connsPeak {
+		s.connsPeak = s.conns
+	}
+	s.mu.Unlock()
+}
+
+func (s *stats) connClosed() {
+	s.mu.Lock()
+	s.conns--
+	s.mu.Unlock()
+}
+
+func (s *stats) openConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i]
+}
+
+func (s *stats) report(elapsed time.Duration, mem *memSampler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	attempts := *clientNum * *roundNum
+	failNum := 0
+	for _, n := range s.fails {
+		failNum += n
+	}
+
+	fmt.Printf("\n%d clients x %d rounds in %v, peak %d open connections\n", *clientNum, *roundNum, elapsed.Truncate(time.Millisecond), s.connsPeak)
+	fmt.Printf("battles finished: %d/%d, against bots: %d\n", s.counts["battle"], attempts, s.counts["foeIsBot"])
+	fmt.Printf("messages sent: %d, received: %d\n", s.counts["sent"], s.counts["received"])
+
+	fmt.Printf("\n%-10s %8s %10s %10s %10s %10s\n", "latency", "n", "p50", "p90", "p99", "max")
+	for _, name := range []string{STAT_PAIRING, STAT_MESSAGE, STAT_RESULT} {
+		ds := s.latencies[name]
+		sort.Sort(byDuration(ds))
+		max := time.Duration(0)
+		if len(ds) > 0 {
+			max = ds[len(ds)-1]
+		}
+		fmt.Printf("%-10s %8d %10v %10v %10v %10v\n", name, len(ds),
+			percentile(ds, 0.5).Truncate(time.Microsecond*100),
+			percentile(ds, 0.9).Truncate(time.Microsecond*100),
+			percentile(ds, 0.99).Truncate(time.Microsecond*100),
+			max.Truncate(time.Microsecond*100))
+	}
+
+	fmt.Printf("\nerrors: %d, %.2f%% of battles\n", failNum, float64(failNum)*100/float64(attempts))
+	stages := make([]string, 0, len(s.fails))
+	for stage := range s.fails {
+		stages = append(stages, stage)
+	}
+	sort.Strings(stages)
+	for _, stage := range stages {
+		fmt.Printf("  %-10s %6d  e.g. %s\n", stage, s.fails[stage], strings.Join(s.samples[stage], " | "))
+	}
+
+	fmt.Printf("\nmemory\n")
+	if s.connsPeak > 0 {
+		fmt.Printf("  harness heap at peak: %s, %s per connection\n", formatBytes(mem.harnessPeak), formatBytes(mem.harnessPeak/int64(s.connsPeak)))
+	}
+	if mem.pid == 0 {
+		fmt.Printf("  server: not sampled, pass -serverPid\n")
+	} else if mem.serverPeak > 0 && mem.serverConns > 0 {
+		grown := mem.serverPeak - mem.serverBase
+		fmt.Printf("  server rss: %s before, %s at peak with %d connections, %s per connection\n",
+			formatBytes(mem.serverBase), formatBytes(mem.serverPeak), mem.serverConns, formatBytes(grown/int64(mem.serverConns)))
+	}
+}
+
+type byDuration []time.Duration
+
+func (a byDuration) Len() int           { return len(a) }
+func (a byDuration) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byDuration) Less(i, j int) bool { return a[i] < a[j] }
+
+//server rss from /proc, so only for a server on this machine
+type memSampler struct {
+	pid         int
+	serverBase  int64
+	serverPeak  int64
+	serverConns int //open connections when the peak was taken
+	harnessPeak int64
+}
+
+func newMemSampler(pid int) *memSampler {
+	return &memSampler{pid: pid}
+}
+
+func (m *memSampler) baseline() {
+	if m.pid != 0 {
+		m.serverBase, _ = readRss(m.pid)
+	}
+}
+
+func (m *memSampler) run(s *stats, stop chan bool) {
+	ticker := time.NewTicker(sampleEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			conns := s.openConns()
+			if heap := harnessHeap(); heap > m.harnessPeak {
+				m.harnessPeak = heap
+			}
+			if m.pid == 0 {
+				continue
+			}
+			rss, err := readRss(m.pid)
+			if err == nil && rss > m.serverPeak {
+				m.serverPeak = rss
+				m.serverConns = conns
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func readRss(pid int) (int64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kb, err := strconv.ParseInt(fields[1], 10, 64)
+			return kb * 1024, err
+		}
+	}
+	return 0, fmt.Errorf("no VmRSS for pid %d", pid)
+}
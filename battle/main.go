@@ -5,15 +5,27 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"text/template"
+	"time"
 
 	"github.com/golang/glog"
 )
 
 var addr = flag.String("addr", ":9977", "http service address")
+var botWaitSec = flag.Int("botWaitSec", 20, "seconds in the matchmaking queue before a bot steps in, 0 to disable")
+var resumeGraceSec = flag.Int("resumeGraceSec", 30, "seconds a dropped player may reconnect and resume the battle, 0 to disable")
+var nodeId = flag.String("nodeId", "", "unique name of this battle node, hostname and addr by default")
+var drainSec = flag.Int("drainSec", 120, "seconds running battles get to end on shutdown before they are settled")
+var ssdbAuthPort = flag.Int("ssdbAuthPort", SSDB_AUTH_PORT, "port of the auth ssdb on localhost")
+var ssdbMatchPort = flag.Int("ssdbMatchPort", SSDB_MATCH_PORT, "port of the match ssdb on localhost")
+var redisAddr = flag.String("redisAddr", REDIS_HOST, "redis address")
 var homeTempl = template.Must(template.ParseFiles("home.html"))
 
 func serveHome(w http.ResponseWriter, r *http.Request) {
@@ -33,14 +45,46 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 
 func main() {
 	flag.Parse()
+	if *nodeId == "" {
+		hostname, _ := os.Hostname()
+		*nodeId = hostname + *addr
+	}
 	glog.Info("Running----------")
 	initRedisAndSsdb()
+	if err := loadBattleRooms(); err != nil {
+		log.Fatal("loadBattleRooms: ", err)
+	}
+	go reloadBattleRooms()
+	go reloadChatFilter()
 	regBattle()
+	regChat()
+	regPrivateRoom()
+	regSpectate()
+	regResume()
 	go h.run()
+	go h.subscribeNode()
+	go h.sweepEscrows()
 	http.HandleFunc("/", serveHome)
 	http.HandleFunc("/ws", serveWs)
-	err := http.ListenAndServe(*addr, nil)
-	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+
+	server := &http.Server{Addr: *addr}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("ListenAndServe: ", err)
+		}
+	}()
+
+	//keep serving while draining, new websockets get a 503
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	glog.Infof("shutting down on %v", <-sig)
+	h.drain(time.Duration(*drainSec) * time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		glog.Errorf("server.Shutdown error:%v", err)
 	}
+	glog.Flush()
 }
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"time"
+)
+
+//players wait in a queue per room and are paired by rating.
+//the search window widens the longer a player waits, so everyone gets a foe eventually.
+//nothing here touches websockets or the db, the hub feeds it entries loaded from redis and a clock.
+const (
+	MATCHMAKING_TICK                = 500 * time.Millisecond
+	MATCHMAKING_WINDOW_BASE         = 100 //rating
+	MATCHMAKING_WINDOW_GROW_PER_SEC = 25
+	MATCHMAKING_WINDOW_MAX          = 3000 //wide enough to take anyone
+	MATCHMAKING_REMATCH_COOLDOWN    = 5 * time.Minute
+	MATCHMAKING_REMATCH_WAIT_MAX    = 30 * time.Second //after this long, a rematch beats waiting
+	MATCHMAKING_REPORT_PERIOD       = 5 * time.Second
+	MATCHMAKING_WAIT_SMOOTH         = 0.2
+	MATCHMAKING_WAIT_DEFAULT_SEC    = 10
+
+	RATING_DEFAULT = 1500
+)
+
+type queueEntry struct {
+	rec        *queueRecord //where the player waits
+	userId     int64
+	rating     int
+	enqueuedAt time.Time
+}
+
+type recentFoe struct {
+	foeId    int64
+	pairedAt time.Time
+}
+
+type matchQueue struct {
+	entries    []*queueEntry //oldest first
+	avgWaitSec float64       //smoothed wait of paired players, 0 before the first pair
+}
+
+type queuePair struct {
+	a *queueEntry
+	b *queueEntry
+}
+
+type ByEnqueuedAt []*queueEntry
+
+func (a ByEnqueuedAt) Len() int           { return len(a) }
+func (a ByEnqueuedAt) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByEnqueuedAt) Less(i, j int) bool { return a[i].enqueuedAt.Before(a[j].enqueuedAt) }
+
+func battleRating(playerInfo *PlayerInfo) int {
+	if playerInfo.RatedMatchNum == 0 {
+		return RATING_DEFAULT
+	}
+	return int(playerInfo.Rating)
+}
+
+func searchWindow(waited time.Duration) int {
+	window := MATCHMAKING_WINDOW_BASE + int(waited.Seconds()*MATCHMAKING_WINDOW_GROW_PER_SEC)
+	if window > MATCHMAKING_WINDOW_MAX {
+		window = MATCHMAKING_WINDOW_MAX
+	}
+	return window
+}
+
+func ratingGap(a, b *queueEntry) int {
+	gap := a.rating - b.rating
+	if gap < 0 {
+		gap = -gap
+	}
+	return gap
+}
+
+//the more patient of the two decides the window
+func canPair(a, b *queueEntry, now time.Time, recent map[int64]recentFoe) bool {
+	if a.userId == b.userId {
+		return false
+	}
+
+	waitA := now.Sub(a.enqueuedAt)
+	waitB := now.Sub(b.enqueuedAt)
+	window := searchWindow(waitA)
+	if w := searchWindow(waitB); w > window {
+		window = w
+	}
+	if ratingGap(a, b) > window {
+		return false
+	}
+
+	//no instant rematch unless both have waited long enough
+	if waitA < MATCHMAKING_REMATCH_WAIT_MAX || waitB < MATCHMAKING_REMATCH_WAIT_MAX {
+		if isRecentFoe(a.userId, b.userId, now, recent) || isRecentFoe(b.userId, a.userId, now, recent) {
+			return false
+		}
+	}
+	return true
+}
+
+func isRecentFoe(userId, foeId int64, now time.Time, recent map[int64]recentFoe) bool {
+	foe, ok := recent[userId]
+	return ok && foe.foeId == foeId && now.Sub(foe.pairedAt) < MATCHMAKING_REMATCH_COOLDOWN
+}
+
+func (q *matchQueue) push(e *queueEntry) {
+	q.entries = append(q.entries, e)
+}
+
+//every MATCHMAKING_REPORT_PERIOD of waiting, true on one tick only
+func reportDue(waited time.Duration) bool {
+	return waited >= MATCHMAKING_REPORT_PERIOD && waited%MATCHMAKING_REPORT_PERIOD < MATCHMAKING_TICK
+}
+
+//oldest players pick first, each takes the closest rating it may pair with
+func (q *matchQueue) takePairs(now time.Time, recent map[int64]recentFoe) []queuePair {
+	pairs := []queuePair{}
+	taken := make([]bool, len(q.entries))
+	for i, a := range q.entries {
+		if taken[i] {
+			continue
+		}
+		best := -1
+		for j := i + 1; j < len(q.entries); j++ {
+			b := q.entries[j]
+			if taken[j] || !canPair(a, b, now, recent) {
+				continue
+			}
+			if best < 0 || ratingGap(a, b) < ratingGap(a, q.entries[best]) {
+				best = j
+			}
+		}
+		if best < 0 {
+			continue
+		}
+
+		b := q.entries[best]
+		taken[i] = true
+		taken[best] = true
+		pairs = append(pairs, queuePair{a, b})
+
+		recent[a.userId] = recentFoe{b.userId, now}
+		recent[b.userId] = recentFoe{a.userId, now}
+		q.addWaitSample(now.Sub(a.enqueuedAt))
+		q.addWaitSample(now.Sub(b.enqueuedAt))
+	}
+
+	if len(pairs) > 0 {
+		entries := make([]*queueEntry, 0, len(q.entries)-len(pairs)*2)
+		for i, e := range q.entries {
+			if !taken[i] {
+				entries = append(entries, e)
+			}
+		}
+		q.entries = entries
+	}
+	return pairs
+}
+
+func (q *matchQueue) addWaitSample(waited time.Duration) {
+	if q.avgWaitSec == 0 {
+		q.avgWaitSec = waited.Seconds()
+	} else {
+		q.avgWaitSec += (waited.Seconds() - q.avgWaitSec) * MATCHMAKING_WAIT_SMOOTH
+	}
+}
+
+//seconds until the window reaches the closest player already waiting,
+//or the room's recent average when nobody else is around
+func (q *matchQueue) expectedWaitSec(e *queueEntry, now time.Time) int {
+	waited := now.Sub(e.enqueuedAt)
+
+	minGap := -1
+	for _, o := range q.entries {
+		if o == e || o.userId == e.userId {
+			continue
+		}
+		if gap := ratingGap(e, o); minGap < 0 || gap < minGap {
+			minGap = gap
+		}
+	}
+
+	sec := 0.0
+	if minGap >= 0 {
+		sec = float64(minGap-MATCHMAKING_WINDOW_BASE)/MATCHMAKING_WINDOW_GROW_PER_SEC - waited.Seconds()
+	} else if q.avgWaitSec > 0 {
+		sec = q.avgWaitSec - waited.Seconds()
+	} else {
+		sec = MATCHMAKING_WAIT_DEFAULT_SEC - waited.Seconds()
+	}
+	if sec < 1 {
+		sec = 1
+	}
+	return int(sec + 0.5)
+}
+
+func pruneRecentFoes(recent map[int64]recentFoe, now time.Time) {
+	for userId, foe := range recent {
+		if now.Sub(foe.pairedAt) >= MATCHMAKING_REMATCH_COOLDOWN {
+			delete(recent, userId)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+var testNow = time.Unix(1700000000, 0)
+
+func makeTestEntry(userId int64, rating int, waited time.Duration) *queueEntry {
+	return &queueEntry{
+		rec:        &queueRecord{UserId: userId},
+		userId:     userId,
+		rating:     rating,
+		enqueuedAt: testNow.Add(-waited),
+	}
+}
+
+func TestCanPairSameUser(t *testing.T) {
+	a := makeTestEntry(1, 1500, time.Minute)
+	b := makeTestEntry(1, 1500, time.Minute)
+	if canPair(a, b, testNow, map[int64]recentFoe{}) {
+		t.Errorf("paired a user with itself")
+	}
+}
+
+func TestCanPairWindowGrows(t *testing.T) {
+	recent := map[int64]recentFoe{}
+
+	//just joined, only the base window
+	a := makeTestEntry(1, 1500, 0)
+	b := makeTestEntry(2, 1500+MATCHMAKING_WINDOW_BASE, 0)
+	if !canPair(a, b, testNow, recent) {
+		t.Errorf("gap at the base window not paired")
+	}
+	c := makeTestEntry(3, 1500+MATCHMAKING_WINDOW_BASE+1, 0)
+	if canPair(a, c, testNow, recent) {
+		t.Errorf("gap past the base window paired")
+	}
+
+	//the more patient one widens it for both
+	patient := makeTestEntry(4, 1500+MATCHMAKING_WINDOW_BASE+MATCHMAKING_WINDOW_GROW_PER_SEC*4, 4*time.Second)
+	if !canPair(a, patient, testNow, recent) || !canPair(patient, a, testNow, recent) {
+		t.Errorf("window didn't grow with the wait")
+	}
+
+	//never past the max
+	if w := searchWindow(time.Hour); w != MATCHMAKING_WINDOW_MAX {
+		t.Errorf("searchWindow(1h) = %d, want %d", w, MATCHMAKING_WINDOW_MAX)
+	}
+	far := makeTestEntry(5, 1500+MATCHMAKING_WINDOW_MAX+1, time.Hour)
+	if canPair(a, far, testNow, recent) {
+		t.Errorf("gap past the max window paired")
+	}
+}
+
+func TestCanPairRecentFoe(t *testing.T) {
+	recent := map[int64]recentFoe{
+		1: {2, testNow.Add(-time.Minute)},
+		2: {1, testNow.Add(-time.Minute)},
+	}
+
+	a := makeTestEntry(1, 1500, time.Second)
+	b := makeTestEntry(2, 1500, time.Second)
+	if canPair(a, b, testNow, recent) {
+		t.Errorf("rematched within the cooldown")
+	}
+
+	//only one side remembers it
+	delete(recent, 2)
+	if canPair(b, a, testNow, recent) {
+		t.Errorf("rematched when only one side is recent")
+	}
+
+	//both waited long enough
+	a = makeTestEntry(1, 1500, MATCHMAKING_REMATCH_WAIT_MAX)
+	b = makeTestEntry(2, 1500, MATCHMAKING_REMATCH_WAIT_MAX)
+	if !canPair(a, b, testNow, recent) {
+		t.Errorf("rematch refused after waiting %v", MATCHMAKING_REMATCH_WAIT_MAX)
+	}
+
+	//cooldown over
+	recent[1] = recentFoe{2, testNow.Add(-MATCHMAKING_REMATCH_COOLDOWN)}
+	a = makeTestEntry(1, 1500, time.Second)
+	b = makeTestEntry(2, 1500, time.Second)
+	if !canPair(a, b, testNow, recent) {
+		t.Errorf("rematch refused after the cooldown")
+	}
+}
+
+func TestTakePairs(t *testing.T) {
+	q := &matchQueue{}
+	q.push(makeTestEntry(1, 1500, 10*time.Second))
+	q.push(makeTestEntry(2, 1600, 8*time.Second))
+	q.push(makeTestEntry(3, 1520, 6*time.Second))
+	q.push(makeTestEntry(4, 1610, 4*time.Second))
+	q.push(makeTestEntry(5, 3000, 2*time.Second))
+	recent := map[int64]recentFoe{}
+
+	pairs := q.takePairs(testNow, recent)
+
+	//the oldest picks the closest rating, not the next in line
+	want := [][2]int64{{1, 3}, {2, 4}}
+	if len(pairs) != len(want) {
+		t.Fatalf("got %d pairs, want %d", len(pairs), len(want))
+	}
+	for i, p := range pairs {
+		if p.a.userId != want[i][0] || p.b.userId != want[i][1] {
+			t.Errorf("pair %d = %d/%d, want %d/%d", i, p.a.userId, p.b.userId, want[i][0], want[i][1])
+		}
+	}
+
+	if len(q.entries) != 1 || q.entries[0].userId != 5 {
+		t.Errorf("left in queue: %d entries, want only user 5", len(q.entries))
+	}
+
+	for _, ids := range want {
+		if recent[ids[0]].foeId != ids[1] || recent[ids[1]].foeId != ids[0] {
+			t.Errorf("recent foes of %d/%d not recorded", ids[0], ids[1])
+		}
+		if !recent[ids[0]].pairedAt.Equal(testNow) {
+			t.Errorf("recent foe of %d paired at %v, want %v", ids[0], recent[ids[0]].pairedAt, testNow)
+		}
+	}
+	if q.avgWaitSec <= 0 {
+		t.Errorf("no wait sample taken")
+	}
+
+	//nothing left to pair
+	if pairs = q.takePairs(testNow, recent); len(pairs) != 0 {
+		t.Errorf("paired a lone player")
+	}
+}
+
+func TestExpectedWaitSec(t *testing.T) {
+	q := &matchQueue{}
+	e := makeTestEntry(1, 1500, 0)
+	q.push(e)
+
+	//alone, nothing known about the room
+	if sec := q.expectedWaitSec(e, testNow); sec != MATCHMAKING_WAIT_DEFAULT_SEC {
+		t.Errorf("default wait = %d, want %d", sec, MATCHMAKING_WAIT_DEFAULT_SEC)
+	}
+
+	//alone, the room's average less what was already waited
+	q.avgWaitSec = 20
+	e.enqueuedAt = testNow.Add(-5 * time.Second)
+	if sec := q.expectedWaitSec(e, testNow); sec != 15 {
+		t.Errorf("average wait = %d, want 15", sec)
+	}
+
+	//the nearest player decides, until the window reaches them
+	e.enqueuedAt = testNow
+	q.push(makeTestEntry(2, 1500+MATCHMAKING_WINDOW_BASE+MATCHMAKING_WINDOW_GROW_PER_SEC*8, 0))
+	q.push(makeTestEntry(3, 1500-MATCHMAKING_WINDOW_BASE-MATCHMAKING_WINDOW_GROW_PER_SEC*3, 0))
+	if sec := q.expectedWaitSec(e, testNow); sec != 3 {
+		t.Errorf("wait to the nearest = %d, want 3", sec)
+	}
+
+	//someone already in reach still says at least a second
+	q.push(makeTestEntry(4, 1500, 0))
+	if sec := q.expectedWaitSec(e, testNow); sec != 1 {
+		t.Errorf("wait with a foe in reach = %d, want 1", sec)
+	}
+}
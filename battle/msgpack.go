@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+)
+
+//just enough MessagePack for what JSON can hold, so handlers keep working on JSON.
+//clients that negotiated msgpack get binary frames, text frames stay JSON either way.
+
+func jsonToMsgpack(js []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	err = encodeMsgpack(&buf, v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func msgpackToJSON(b []byte) ([]byte, error) {
+	r := bytes.NewReader(b)
+	v, err := decodeMsgpack(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("msgpack: trailing bytes")
+	}
+	return json.Marshal(v)
+}
+
+func encodeMsgpack(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			encodeMsgpackInt(buf, n)
+		} else {
+			f, err := v.Float64()
+			if err != nil {
+				return err
+			}
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		n := len(v)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(v)
+	case []interface{}:
+		n := len(v)
+		switch {
+		case n < 16:
+			buf.WriteByte(0x90 | byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xdc)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdd)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		for _, e := range v {
+			if err := encodeMsgpack(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		n := len(v)
+		switch {
+		case n < 16:
+			buf.WriteByte(0x80 | byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xde)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdf)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		for k, e := range v {
+			if err := encodeMsgpack(buf, k); err != nil {
+				return err
+			}
+			if err := encodeMsgpack(buf, e); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: can't encode %T", v)
+	}
+	return nil
+}
+
+func encodeMsgpackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= 127:
+		buf.WriteByte(byte(n))
+	case n < 0 && n >= -32:
+		buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(n)))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func decodeMsgpack(r *bytes.Reader) (interface{}, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b&0xe0 == 0xa0:
+		return readMsgpackStr(r, int(b&0x1f))
+	case b&0xf0 == 0x90:
+		return readMsgpackArray(r, int(b&0x0f))
+	case b&0xf0 == 0x80:
+		return readMsgpackMap(r, int(b&0x0f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		n, err := readMsgpackLen(r, 1)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackStr(r, n)
+	case 0xc5, 0xda:
+		n, err := readMsgpackLen(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackStr(r, n)
+	case 0xc6, 0xdb:
+		n, err := readMsgpackLen(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackStr(r, n)
+	case 0xca:
+		var bits uint32
+		err = binary.Read(r, binary.BigEndian, &bits)
+		return float64(math.Float32frombits(bits)), err
+	case 0xcb:
+		var bits uint64
+		err = binary.Read(r, binary.BigEndian, &bits)
+		return math.Float64frombits(bits), err
+	case 0xcc:
+		var n uint8
+		err = binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xcd:
+		var n uint16
+		err = binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xce:
+		var n uint32
+		err = binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xcf:
+		var n uint64
+		err = binary.Read(r, binary.BigEndian, &n)
+		return n, err
+	case 0xd0:
+		var n int8
+		err = binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xd1:
+		var n int16
+		err = binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xd2:
+		var n int32
+		err = binary.Read(r, binary.BigEndian, &n)
+		return int64(n), err
+	case 0xd3:
+		var n int64
+		err = binary.Read(r, binary.BigEndian, &n)
+		return n, err
+	case 0xdc:
+		n, err := readMsgpackLen(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, n)
+	case 0xdd:
+		n, err := readMsgpackLen(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, n)
+	case 0xde:
+		n, err := readMsgpackLen(r, 2)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, n)
+	case 0xdf:
+		n, err := readMsgpackLen(r, 4)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, n)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%x", b)
+}
+
+func readMsgpackLen(r *bytes.Reader, size int) (int, error) {
+	var err error
+	n := 0
+	switch size {
+	case 1:
+		var l uint8
+		err = binary.Read(r, binary.BigEndian, &l)
+		n = int(l)
+	case 2:
+		var l uint16
+		err = binary.Read(r, binary.BigEndian, &l)
+		n = int(l)
+	default:
+		var l uint32
+		err = binary.Read(r, binary.BigEndian, &l)
+		n = int(l)
+	}
+	if err == nil && n > r.Len() {
+		err = fmt.Errorf("msgpack: length %d past the end", n)
+	}
+	return n, err
+}
+
+func readMsgpackStr(r *bytes.Reader, n int) (interface{}, error) {
+	if n > r.Len() {
+		return nil, fmt.Errorf("msgpack: length %d past the end", n)
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return string(b), err
+}
+
+func readMsgpackArray(r *bytes.Reader, n int) (interface{}, error) {
+	if n > r.Len() {
+		return nil, fmt.Errorf("msgpack: length %d past the end", n)
+	}
+	a := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+func readMsgpackMap(r *bytes.Reader, n int) (interface{}, error) {
+	if n*2 > r.Len() {
+		return nil, fmt.Errorf("msgpack: length %d past the end", n)
+	}
+	m := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map key %T", k)
+		}
+		v, err := decodeMsgpack(r)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//compares as decoded JSON, key order and number formatting don't matter
+func sameJSON(t *testing.T, a, b []byte) bool {
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("bad json %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("bad json %s: %v", b, err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	many := make([]string, 20)
+	for i := range many {
+		many[i] = "1"
+	}
+	cases := []string{
+		`null`,
+		`true`,
+		`false`,
+		`0`,
+		`127`,
+		`128`,
+		`-1`,
+		`-32`,
+		`-33`,
+		`-129`,
+		`65536`,
+		`-40000`,
+		`4294967296`,
+		`-9007199254740993`,
+		`1.5`,
+		`-0.25`,
+		`""`,
+		`"abc"`,
+		`"中文"`,
+		`"` + long + `"`,
+		`[]`,
+		`{}`,
+		`[1,"a",null,true]`,
+		`[` + strings.Join(many, ",") + `]`,
+		`{"Type":"authPair","Token":"t","RoomName":"r","Version":2,"Encoding":"msgpack"}`,
+		`{"Type":"progress","CompleteNum":3,"Empty":""}`,
+		`{"Type":"paired","FoePlayer":{"UserId":123456789,"NickName":"a"},"Pack":{"Images":[{"Key":"k1"},{"Key":"k2"}]}}`,
+	}
+	for _, js := range cases {
+		mp, err := jsonToMsgpack([]byte(js))
+		if err != nil {
+			t.Errorf("jsonToMsgpack(%s): %v", js, err)
+			continue
+		}
+		back, err := msgpackToJSON(mp)
+		if err != nil {
+			t.Errorf("msgpackToJSON(%s): %v", js, err)
+			continue
+		}
+		if !sameJSON(t, []byte(js), back) {
+			t.Errorf("round trip %s gave %s", js, back)
+		}
+	}
+}
+
+func TestMsgpackBigMap(t *testing.T) {
+	m := map[string]int{}
+	for i := 0; i < 20; i++ {
+		m[string(rune('a'+i))] = i
+	}
+	js, _ := json.Marshal(m)
+	mp, err := jsonToMsgpack(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mp[0] != 0xde {
+		t.Errorf("map16 header 0x%x", mp[0])
+	}
+	back, err := msgpackToJSON(mp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameJSON(t, js, back) {
+		t.Errorf("round trip %s gave %s", js, back)
+	}
+}
+
+//what other msgpack encoders write, not only what jsonToMsgpack does
+func TestMsgpackDecode(t *testing.T) {
+	f32 := math.Float32bits(2.5)
+	cases := []struct {
+		in   []byte
+		want string
+	}{
+		{[]byte{0xcc, 0xff}, `255`},
+		{[]byte{0xcd, 0x01, 0x00}, `256`},
+		{[]byte{0xce, 0x00, 0x01, 0x00, 0x00}, `65536`},
+		{[]byte{0xcf, 0, 0, 0, 1, 0, 0, 0, 0}, `4294967296`},
+		{[]byte{0xca, byte(f32 >> 24), byte(f32 >> 16), byte(f32 >> 8), byte(f32)}, `2.5`},
+		{[]byte{0xc4, 0x02, 'h', 'i'}, `"hi"`},
+		{[]byte{0x81, 0xa1, 'a', 0xa0}, `{"a":""}`},
+		{[]byte{0xdc, 0x00, 0x02, 0x01, 0x02}, `[1,2]`},
+	}
+	for _, c := range cases {
+		got, err := msgpackToJSON(c.in)
+		if err != nil {
+			t.Errorf("msgpackToJSON(% x): %v", c.in, err)
+			continue
+		}
+		if !sameJSON(t, []byte(c.want), got) {
+			t.Errorf("msgpackToJSON(% x) = %s, want %s", c.in, got, c.want)
+		}
+	}
+}
+
+func TestMsgpackBad(t *testing.T) {
+	cases := [][]byte{
+		{},
+		{0xc1},
+		{0xa3, 'a'},
+		{0xd9, 0x10, 'a'},
+		{0x92, 0x01},
+		{0x81, 0x01, 0x01},
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0xd2, 0x00},
+		{0x01, 0x02},
+	}
+	for _, in := range cases {
+		if _, err := msgpackToJSON(in); err == nil {
+			t.Errorf("msgpackToJSON(% x) should fail", in)
+		}
+	}
+}
+
+func TestMsgpackEncodeUnsupported(t *testing.T) {
+	var buf bytes.Buffer
+	if err := encodeMsgpack(&buf, struct{}{}); err == nil {
+		t.Error("encoding a struct should fail")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/henyouqian/ssdbgo"
+)
+
+//the battle pool is curated on the match server. packs are picked from a random sample of it:
+//first those none of the players saw lately, then those of measured fair difficulty closest to the target.
+//if everything was seen, the one seen longest ago goes.
+const (
+	BATTLE_PACKID_SET  = "BATTLE_PACKID_SET"  //redis, members:packId, curated on match server
+	Z_PACK_DIFFICULTY  = "Z_PACK_DIFFICULTY"  //subkey:packId score:difficulty(msec per image at PACK_DIFFICULTY_SLIDER_BASE sliders), written by match server
+	Z_BATTLE_PACK_SEEN = "Z_BATTLE_PACK_SEEN" //redis, key:Z_BATTLE_PACK_SEEN/userId member:packId score:unixTime
+
+	BATTLE_PACK_CANDIDATE_NUM     = 16
+	BATTLE_PACK_DIFFICULTY_TARGET = 8000
+	BATTLE_PACK_DIFFICULTY_MIN    = 4000 //fair band, packs outside it are only a fallback
+	BATTLE_PACK_DIFFICULTY_MAX    = 15000
+	BATTLE_PACK_SEEN_MAX          = 100
+	BATTLE_PACK_SEEN_TTL_SEC      = 14 * 24 * 3600
+
+	BATTLE_SLIDER_RATING_STEP = 200 //one more slider per step above the default rating
+
+	PACK_DIFFICULTY_SLIDER_BASE = 5 //as the match server scales it, solve time taken as linear in sliders
+)
+
+type packCandidate struct {
+	packId     int64
+	difficulty int   //at the battle's slider count, 0 if not measured yet
+	seenAt     int64 //last time one of the players saw it, 0 if none did
+}
+
+func makeZBattlePackSeenKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", Z_BATTLE_PACK_SEEN, userId)
+}
+
+func (p *packCandidate) isFair() bool {
+	return p.difficulty >= BATTLE_PACK_DIFFICULTY_MIN && p.difficulty <= BATTLE_PACK_DIFFICULTY_MAX
+}
+
+func (p *packCandidate) betterThan(o *packCandidate) bool {
+	if (p.seenAt == 0) != (o.seenAt == 0) {
+		return p.seenAt == 0
+	}
+	if p.seenAt != o.seenAt {
+		return p.seenAt < o.seenAt
+	}
+	if p.isFair() != o.isFair() {
+		return p.isFair()
+	}
+	if (p.difficulty > 0) != (o.difficulty > 0) {
+		return p.difficulty > 0
+	}
+	return absInt(p.difficulty-BATTLE_PACK_DIFFICULTY_TARGET) < absInt(o.difficulty-BATTLE_PACK_DIFFICULTY_TARGET)
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+//bots don't remember packs
+func humanUserIds(conns []*Connection) []int64 {
+	userIds := make([]int64, 0, len(conns))
+	for _, c := range conns {
+		if !c.isBot && c.playerInfo != nil && c.playerInfo.UserId != 0 {
+			userIds = append(userIds, c.playerInfo.UserId)
+		}
+	}
+	return userIds
+}
+
+//msec per image at sliderNum sliders
+func scalePackDifficulty(difficulty int, sliderNum int) int {
+	return difficulty * sliderNum / PACK_DIFFICULTY_SLIDER_BASE
+}
+
+func pickBattlePackId(rc redis.Conn, ssdbc *ssdbgo.Client, userIds []int64, sliderNum int) (int64, error) {
+	packIds, err := redis.Strings(rc.Do("SRANDMEMBER", BATTLE_PACKID_SET, BATTLE_PACK_CANDIDATE_NUM))
+	if err != nil {
+		return 0, err
+	}
+	if len(packIds) == 0 {
+		return 0, fmt.Errorf("err_no_battle_pack")
+	}
+
+	candidates := make(map[string]*packCandidate, len(packIds))
+	for _, str := range packIds {
+		packId, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			continue
+		}
+		candidates[str] = &packCandidate{packId: packId}
+	}
+	if len(candidates) == 0 {
+		return 0, fmt.Errorf("err_no_battle_pack")
+	}
+
+	//difficulty
+	cmds := make([]interface{}, 0, len(packIds)+2)
+	cmds = append(cmds, "multi_zget", Z_PACK_DIFFICULTY)
+	for _, packId := range packIds {
+		cmds = append(cmds, packId)
+	}
+	resp, err := ssdbc.Do(cmds...)
+	if err != nil {
+		return 0, err
+	}
+	resp = resp[1:]
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		p := candidates[resp[i*2]]
+		if p == nil {
+			continue
+		}
+		difficulty, _ := strconv.Atoi(resp[i*2+1])
+		p.difficulty = scalePackDifficulty(difficulty, sliderNum)
+	}
+
+	//seen
+	for _, userId := range userIds {
+		strs, err := redis.Strings(rc.Do("ZRANGE", makeZBattlePackSeenKey(userId), 0, -1, "WITHSCORES"))
+		if err != nil {
+			return 0, err
+		}
+		for i := 0; i+1 < len(strs); i += 2 {
+			p := candidates[strs[i]]
+			if p == nil {
+				continue
+			}
+			seenAt, err := strconv.ParseInt(strs[i+1], 10, 64)
+			if err == nil && seenAt > p.seenAt {
+				p.seenAt = seenAt
+			}
+		}
+	}
+
+	var best *packCandidate
+	for _, p := range candidates {
+		if best == nil || p.betterThan(best) {
+			best = p
+		}
+	}
+	return best.packId, nil
+}
+
+func markBattlePackSeen(rc redis.Conn, userIds []int64, packId int64) error {
+	if len(userIds) == 0 {
+		return nil
+	}
+	now := time.Now().Unix()
+	rc.Send("MULTI")
+	for _, userId := range userIds {
+		key := makeZBattlePackSeenKey(userId)
+		rc.Send("ZADD", key, now, packId)
+		rc.Send("ZREMRANGEBYRANK", key, 0, -BATTLE_PACK_SEEN_MAX-1)
+		rc.Send("EXPIRE", key, BATTLE_PACK_SEEN_TTL_SEC)
+	}
+	_, err := rc.Do("EXEC")
+	return err
+}
+
+//the weakest player sets the size, so nobody is dragged into a bigger puzzle than they are used to
+func pickSliderNum(room BattleRoom, conns []*Connection) int {
+	rating := 0
+	found := false
+	for _, c := range conns {
+		if c.isBot || c.playerInfo == nil {
+			continue
+		}
+		r := battleRating(c.playerInfo)
+		if !found || r < rating {
+			rating = r
+			found = true
+		}
+	}
+
+	n := room.SliderNumMin
+	if found && rating > RATING_DEFAULT {
+		n += (rating - RATING_DEFAULT) / BATTLE_SLIDER_RATING_STEP
+	}
+	if n > room.SliderNumMax {
+		n = room.SliderNumMax
+	}
+	return n
+}
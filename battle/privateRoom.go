@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+//friends meet through a short invite code instead of the matchmaking queue.
+//codes live in the hub only, a server restart drops them.
+const (
+	PRIVATE_ROOM_NAME       = "private"
+	PRIVATE_ROOM_CODE_LEN   = 6
+	PRIVATE_ROOM_CODE_CHARS = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" //no 0/O, 1/I
+	PRIVATE_ROOM_CODE_TRIES = 10
+	PRIVATE_ROOM_EXPIRE     = 10 * time.Minute
+	PRIVATE_ROOM_BET_MAX    = 50
+)
+
+type privateRoom struct {
+	code     string
+	host     *Connection
+	hostId   int64
+	betCoin  int
+	expireAt time.Time
+}
+
+func genPrivateRoomCode() string {
+	b := make([]byte, PRIVATE_ROOM_CODE_LEN)
+	for i := range b {
+		b[i] = PRIVATE_ROOM_CODE_CHARS[rand.Intn(len(PRIVATE_ROOM_CODE_CHARS))]
+	}
+	return string(b)
+}
+
+//not in the room catalog, free ones cost a heart like the free room did
+func makePrivateBattleRoom(betCoin int) BattleRoom {
+	room := BattleRoom{
+		Name:         PRIVATE_ROOM_NAME,
+		BetCoin:      betCoin,
+		SliderNumMin: 3,
+		SliderNumMax: 3,
+		PlayerMin:    2,
+		PlayerMax:    2,
+	}
+	if betCoin == 0 {
+		room.HeartCost = 1
+	}
+	return room
+}
+
+func createPrivateRoom(conn *Connection, msg []byte) {
+	if h.isDraining() {
+		conn.sendErr("err_draining")
+		return
+	}
+	if conn.playerInfo != nil && !(conn.battle != nil && conn.battle.state == ONELEFT) {
+		conn.sendErr("err_already_pair")
+		return
+	}
+
+	//in
+	var in MsgCreatePrivateRoom
+	if !decodeMsg(conn, msg, &in) {
+		return
+	}
+	if err := negotiateProtocol(conn, in.Version, in.Encoding); err != nil {
+		conn.sendErr(err.Error())
+		return
+	}
+	if in.BetCoin < 0 || in.BetCoin > PRIVATE_ROOM_BET_MAX {
+		conn.sendErr("err_bet_coin")
+		return
+	}
+
+	//same check as authPair
+	session, err := authPlayer(conn, in.Token)
+	if err != nil {
+		conn.sendErr(err.Error())
+		return
+	}
+	go markBattleDevice(session.Userid, in.DeviceId)
+	if err = checkBattleCost(conn.playerInfo, makePrivateBattleRoom(in.BetCoin)); err != nil {
+		conn.playerInfo = nil
+		conn.sendErr(err.Error())
+		return
+	}
+	conn.safeChat = in.SafeChat
+	conn.mutedFoe = false
+
+	h.call(func() {
+		//one open room per user
+		for code, room := range h.privateRooms {
+			if room.hostId == session.Userid {
+				delete(h.privateRooms, code)
+			}
+		}
+
+		code := ""
+		for i := 0; i < PRIVATE_ROOM_CODE_TRIES; i++ {
+			code = genPrivateRoomCode()
+			if _, exist := h.privateRooms[code]; !exist {
+				break
+			}
+			code = ""
+		}
+		if code == "" {
+			conn.playerInfo = nil
+			conn.sendErr("err_code")
+			return
+		}
+
+		h.privateRooms[code] = &privateRoom{
+			code:     code,
+			host:     conn,
+			hostId:   session.Userid,
+			betCoin:  in.BetCoin,
+			expireAt: time.Now().Add(PRIVATE_ROOM_EXPIRE),
+		}
+		conn.roomName = PRIVATE_ROOM_NAME
+		conn.result = 0
+
+		out := struct {
+			Type      string
+			Code      string
+			BetCoin   int
+			ExpireSec int
+		}{
+			"privateRoomCreated",
+			code,
+			in.BetCoin,
+			int(PRIVATE_ROOM_EXPIRE.Seconds()),
+		}
+		conn.sendMsg(out)
+	})
+}
+
+func joinPrivateRoom(conn *Connection, msg []byte) {
+	if h.isDraining() {
+		conn.sendErr("err_draining")
+		return
+	}
+	if conn.playerInfo != nil && !(conn.battle != nil && conn.battle.state == ONELEFT) {
+		conn.sendErr("err_already_pair")
+		return
+	}
+
+	//in
+	var in MsgJoinPrivateRoom
+	if !decodeMsg(conn, msg, &in) {
+		return
+	}
+	if err := negotiateProtocol(conn, in.Version, in.Encoding); err != nil {
+		conn.sendErr(err.Error())
+		return
+	}
+
+	session, err := authPlayer(conn, in.Token)
+	if err != nil {
+		conn.sendErr(err.Error())
+		return
+	}
+	go markBattleDevice(session.Userid, in.DeviceId)
+	conn.safeChat = in.SafeChat
+	conn.mutedFoe = false
+
+	var room *privateRoom
+	errstr := ""
+	h.callWait(func() {
+		room = h.privateRooms[in.Code]
+		if room == nil || time.Now().After(room.expireAt) {
+			errstr = "err_code"
+			return
+		}
+		if room.hostId == session.Userid {
+			errstr = "err_same_user"
+			return
+		}
+		if err := checkBattleCost(conn.playerInfo, makePrivateBattleRoom(room.betCoin)); err != nil {
+			errstr = err.Error()
+			return
+		}
+		delete(h.privateRooms, in.Code)
+
+		conn.roomName = PRIVATE_ROOM_NAME
+		conn.result = 0
+	})
+	if errstr != "" {
+		conn.playerInfo = nil
+		conn.sendErr(errstr)
+		return
+	}
+
+	//the host gets the room back unless the start failed because of them
+	err = h.startBattle(room.host, conn, makePrivateBattleRoom(room.betCoin))
+	if err != nil {
+		glog.Errorf("startBattle error:%v", err)
+		h.call(func() {
+			h.failStart([]*Connection{room.host, conn}, err, func(c *Connection) bool {
+				if c != room.host || h.privateRooms[room.code] != nil {
+					return false
+				}
+				h.privateRooms[room.code] = room
+				return true
+			})
+		})
+	}
+}
+
+//both players ask for a rematch after the result, the same bet applies
+func battleRematch(conn *Connection, msg []byte) {
+	var battle *Battle
+	var foe *Connection
+	errstr := ""
+	h.callWait(func() {
+		battle = conn.battle
+		foe = conn.foe
+		if battle == nil || battle.state != FINISH || battle.room.Name != PRIVATE_ROOM_NAME {
+			errstr = "err_state"
+			return
+		}
+		if foe == nil {
+			errstr = "err_no_foe"
+			return
+		}
+		if h.isDraining() {
+			errstr = "err_draining"
+			return
+		}
+
+		if battle.rematchConn == nil {
+			battle.rematchConn = conn
+			foe.sendType("rematchRequest")
+			foe = nil
+			return
+		}
+		if battle.rematchConn != foe || battle.rematched {
+			foe = nil
+			return
+		}
+		battle.rematched = true
+	})
+	if errstr != "" {
+		conn.sendErr(errstr)
+		return
+	}
+	if foe == nil {
+		return
+	}
+
+	conns := []*Connection{foe, conn}
+	fail := func(err error) {
+		h.call(func() {
+			h.failStart(conns, err, nil)
+		})
+	}
+
+	//coins and hearts changed with the last result
+	matchdb, err := ssdbMatchPool.Get()
+	if err != nil {
+		fail(fmt.Errorf("err_ssdb_pool"))
+		return
+	}
+	defer matchdb.Close()
+	playerInfos := make([]*PlayerInfo, 0, len(conns))
+	for _, c := range conns {
+		playerInfo, err := getPlayerInfo(matchdb, c.playerInfo.UserId)
+		if err != nil {
+			fail(err)
+			return
+		}
+		playerInfo.UserId = c.playerInfo.UserId
+		if err = checkBattleCost(playerInfo, battle.room); err != nil {
+			fail(&startErr{c, err.Error()})
+			return
+		}
+		playerInfos = append(playerInfos, playerInfo)
+	}
+	h.callWait(func() {
+		for i, c := range conns {
+			c.playerInfo = playerInfos[i]
+			c.result = 0
+		}
+	})
+
+	err = h.startBattle(foe, conn, battle.room)
+	if err != nil {
+		glog.Errorf("startBattle error:%v", err)
+		fail(err)
+	}
+}
+
+func prunePrivateRooms(rooms map[string]*privateRoom, now time.Time) {
+	for code, room := range rooms {
+		if now.After(room.expireAt) {
+			delete(rooms, code)
+			room.host.playerInfo = nil
+			room.host.sendType("privateRoomExpired")
+		}
+	}
+}
+
+func removePrivateRoomsOf(rooms map[string]*privateRoom, conn *Connection) {
+	for code, room := range rooms {
+		if room.host == conn {
+			delete(rooms, code)
+		}
+	}
+}
+
+func regPrivateRoom() {
+	regHandler("createPrivateRoom", MsgHandler(createPrivateRoom))
+	regHandler("joinPrivateRoom", MsgHandler(joinPrivateRoom))
+	regHandler("rematch", MsgHandler(battleRematch))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+//message structs and validators are generated from protocol/protocol.json, see protocol/gen.go.
+//clients say which version they speak in the message that opens a session (authPair, createPrivateRoom, joinPrivateRoom,
+//spectate or resume), those that don't are version 1 and get the old error strings.
+
+type protoMsg interface {
+	validate(version int) string
+}
+
+func (c *Connection) version() int {
+	if c.protoVersion == 0 {
+		return PROTOCOL_VERSION_MIN
+	}
+	return c.protoVersion
+}
+
+//sends the error and returns false if msg isn't a valid in
+func decodeMsg(conn *Connection, msg []byte, in protoMsg) bool {
+	err := json.Unmarshal(msg, in)
+	if err != nil {
+		conn.sendErr("err_json")
+		return false
+	}
+	if e := in.validate(conn.version()); e != "" {
+		conn.sendErr(e)
+		return false
+	}
+	return true
+}
+
+//the client asks for a version and an encoding, it gets the closest the server has
+func negotiateProtocol(c *Connection, version int, encoding string) error {
+	if version == 0 {
+		return nil
+	}
+	if version < PROTOCOL_VERSION_MIN {
+		return fmt.Errorf("err_version")
+	}
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+	if encoding == "" {
+		encoding = "json"
+	}
+	if !PROTOCOL_ENCODINGS[encoding] {
+		return fmt.Errorf("err_encoding")
+	}
+	c.protoVersion = version
+	c.encoding = encoding
+
+	out := struct {
+		Type       string
+		Version    int
+		VersionMin int
+		Encoding   string
+	}{
+		"protocol",
+		version,
+		PROTOCOL_VERSION_MIN,
+		encoding,
+	}
+	c.sendMsg(out)
+	return nil
+}
+
+//str is an error name, optionally followed by ":detail"
+func makeErrMsg(version int, str string) []byte {
+	name := str
+	if i := strings.Index(str, ":"); i >= 0 {
+		name = str[:i]
+	}
+	code, ok := ERROR_CODES[name]
+	if !ok {
+		code = ERR_INTERNAL
+	}
+	if version < 2 {
+		if legacy, ok := ERROR_LEGACY[name]; ok {
+			str = legacy
+		}
+	}
+
+	out := struct {
+		Type   string
+		String string
+		Code   int
+	}{
+		"err",
+		str,
+		code,
+	}
+	js, _ := json.Marshal(out)
+	return js
+}
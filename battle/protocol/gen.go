@@ -0,0 +1,151 @@
+// Generates ../protocol_gen.go from protocol.json:
+// message structs with validators, message versions and error codes.
+//
+//	cd battle/protocol && go run gen.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"strings"
+	"text/template"
+)
+
+type Field struct {
+	Name     string
+	Type     string //string, int, int64, bool
+	Since    int
+	Required bool
+	Min      *int64
+	Max      *int64
+	MaxLen   int
+	Enum     []string
+}
+
+type Message struct {
+	Type   string
+	Since  int
+	Fields []Field
+}
+
+type Error struct {
+	Name   string
+	Code   int
+	Legacy string
+	Desc   string
+}
+
+type Protocol struct {
+	Version        int
+	VersionMin     int
+	MaxMessageSize int
+	Encodings      []string
+	Messages       []Message
+	Errors         []Error
+}
+
+var funcs = template.FuncMap{
+	"structName": func(tp string) string {
+		return "Msg" + strings.ToUpper(tp[:1]) + tp[1:]
+	},
+	"constName": func(name string) string {
+		return strings.ToUpper(name)
+	},
+	"quote": func(s string) string {
+		return fmt.Sprintf("%q", s)
+	},
+	"deref": func(n *int64) int64 {
+		return *n
+	},
+}
+
+var tmpl = template.Must(template.New("protocol").Funcs(funcs).Parse(`// generated by protocol/gen.go from protocol/protocol.json, DO NOT EDIT.
+
+package main
+
+const (
+	PROTOCOL_VERSION          = {{.Version}}
+	PROTOCOL_VERSION_MIN      = {{.VersionMin}}
+	PROTOCOL_MAX_MESSAGE_SIZE = {{.MaxMessageSize}}
+)
+
+var PROTOCOL_ENCODINGS = map[string]bool{
+{{range .Encodings}}	{{quote .}}: true,
+{{end}}}
+
+//message type to the version it came with
+var MSG_SINCE = map[string]int{
+{{range .Messages}}	{{quote .Type}}: {{.Since}},
+{{end}}}
+
+const (
+{{range .Errors}}	{{constName .Name}} = {{.Code}} //{{.Desc}}
+{{end}})
+
+var ERROR_CODES = map[string]int{
+{{range .Errors}}	{{quote .Name}}: {{constName .Name}},
+{{end}}}
+
+//what version 1 clients got instead of the error name
+var ERROR_LEGACY = map[string]string{
+{{range .Errors}}{{if .Legacy}}	{{quote .Name}}: {{quote .Legacy}},
+{{end}}{{end}}}
+{{range .Messages}}{{$msg := .}}
+type {{structName .Type}} struct {
+{{range .Fields}}	{{.Name}} {{.Type}}
+{{end}}}
+
+func (m *{{structName .Type}}) validate(version int) string {
+{{range .Fields}}{{if .Since}}	if version >= {{.Since}} {
+{{end}}{{if .Required}}{{if eq .Type "string"}}	if m.{{.Name}} == "" {
+{{else}}	if m.{{.Name}} == 0 {
+{{end}}		return "err_field_missing:{{.Name}}"
+	}
+{{end}}{{if .Min}}	if m.{{.Name}} < {{deref .Min}} {
+		return "err_field_range:{{.Name}}"
+	}
+{{end}}{{if .Max}}	if m.{{.Name}} > {{deref .Max}} {
+		return "err_field_range:{{.Name}}"
+	}
+{{end}}{{if .MaxLen}}	if len(m.{{.Name}}) > {{.MaxLen}} {
+		return "err_field_len:{{.Name}}"
+	}
+{{end}}{{if .Enum}}	switch m.{{.Name}} {
+	case {{range $i, $v := .Enum}}{{if $i}}, {{end}}{{quote $v}}{{end}}:
+	default:
+		return "err_field_value:{{.Name}}"
+	}
+{{end}}{{if .Since}}	}
+{{end}}{{end}}	return ""
+}
+{{end}}`))
+
+func main() {
+	js, err := ioutil.ReadFile("protocol.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	var proto Protocol
+	err = json.Unmarshal(js, &proto)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, proto)
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatalf("%v\n%s", err, buf.Bytes())
+	}
+	err = ioutil.WriteFile("../protocol_gen.go", src, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
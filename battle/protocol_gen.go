@@ -0,0 +1,421 @@
+// generated by protocol/gen.go from protocol/protocol.json, DO NOT EDIT.
+
+package main
+
+const (
+	PROTOCOL_VERSION          = 2
+	PROTOCOL_VERSION_MIN      = 1
+	PROTOCOL_MAX_MESSAGE_SIZE = 512
+)
+
+var PROTOCOL_ENCODINGS = map[string]bool{
+	"json":    true,
+	"msgpack": true,
+}
+
+// message type to the version it came with
+var MSG_SINCE = map[string]int{
+	"authPair":          1,
+	"ready":             1,
+	"progress":          1,
+	"finish":            1,
+	"talk":              1,
+	"createPrivateRoom": 1,
+	"joinPrivateRoom":   1,
+	"rematch":           1,
+	"spectate":          1,
+	"leaveSpectate":     1,
+	"react":             1,
+	"listLiveBattles":   1,
+	"resume":            1,
+	"muteFoe":           2,
+	"reportFoe":         2,
+}
+
+const (
+	ERR_INTERNAL       = 1    //anything not listed here
+	ERR_JSON           = 1001 //the message can't be decoded
+	ERR_MSG_TYPE       = 1002 //unknown message type
+	ERR_VERSION        = 1003 //protocol version too old, or the message needs a newer one
+	ERR_ENCODING       = 1004 //unsupported encoding
+	ERR_FIELD_MISSING  = 1010 //a required field is missing
+	ERR_FIELD_RANGE    = 1011 //a number is out of range
+	ERR_FIELD_LEN      = 1012 //a string is too long
+	ERR_FIELD_VALUE    = 1013 //a value is not one of the allowed ones
+	ERR_AUTH           = 2001 //bad session token
+	ERR_ALREADY_PAIR   = 2002 //already pairing or in a battle
+	ERR_SAME_USER      = 2003 //the user is already waiting
+	ERR_ROOM_NAME      = 2004 //no such room
+	ERR_HEART          = 2005 //no heart left for a free room
+	ERR_COIN           = 2006 //not enough coins for the bet
+	ERR_BET_COIN       = 2007 //bet out of range
+	ERR_TIMEOUT        = 2008 //not everyone got ready in time
+	ERR_NO_BATTLE_PACK = 2009 //no pack to battle on
+	ERR_PACK           = 2010 //the pack can't be loaded
+	ERR_NODE_DOWN      = 2011 //the node running the battle went away
+	ERR_ROOM_CLOSED    = 2012 //the room is disabled or outside its open hours
+	ERR_DRAINING       = 2013 //the node is shutting down, reconnect to pair on another one
+	ERR_ROOM_DELETED   = 2014 //the room was deleted while waiting in it
+	ERR_NEED_PAIR      = 3001 //not in a battle
+	ERR_STATE          = 3002 //not allowed in the current battle state
+	ERR_CHECKSUM       = 3003 //finish checksum mismatch
+	ERR_RESULT_EXIST   = 3004 //already finished
+	ERR_NO_BATTLE      = 3005 //no such battle
+	ERR_NO_FOE         = 3006 //the foe left
+	ERR_ALREADY_FINISH = 3007 //the battle is over
+	ERR_CODE           = 4001 //bad or expired invite code
+	ERR_RESUME         = 4101 //nothing to resume with this token
+	ERR_BATTLE_OVER    = 4102 //the battle ended before the resume
+	ERR_NOT_SPECTATING = 4201 //not watching a battle
+	ERR_SPECTATOR_FULL = 4202 //too many spectators
+	ERR_REACTION       = 4203 //unknown reaction
+	ERR_NOT_FRIEND     = 4204 //only friends can watch this player or battle
+	ERR_CHAT_BLOCKED   = 4301 //the text hit the chat filter
+	ERR_CHAT_RATE      = 4302 //talking too fast
+	ERR_CHAT_SAFE      = 4303 //only quick chat in safe mode or while chat banned
+	ERR_QUICK_CHAT     = 4304 //unknown quick chat phrase
+	ERR_REPORTED       = 4305 //already reported in this battle
+	ERR_SSDB           = 5001 //ssdb error
+	ERR_SSDB_POOL      = 5002 //no ssdb connection
+	ERR_STRCONV        = 5003 //bad number in the db
+)
+
+var ERROR_CODES = map[string]int{
+	"err_internal":       ERR_INTERNAL,
+	"err_json":           ERR_JSON,
+	"err_msg_type":       ERR_MSG_TYPE,
+	"err_version":        ERR_VERSION,
+	"err_encoding":       ERR_ENCODING,
+	"err_field_missing":  ERR_FIELD_MISSING,
+	"err_field_range":    ERR_FIELD_RANGE,
+	"err_field_len":      ERR_FIELD_LEN,
+	"err_field_value":    ERR_FIELD_VALUE,
+	"err_auth":           ERR_AUTH,
+	"err_already_pair":   ERR_ALREADY_PAIR,
+	"err_same_user":      ERR_SAME_USER,
+	"err_room_name":      ERR_ROOM_NAME,
+	"err_heart":          ERR_HEART,
+	"err_coin":           ERR_COIN,
+	"err_bet_coin":       ERR_BET_COIN,
+	"err_timeout":        ERR_TIMEOUT,
+	"err_no_battle_pack": ERR_NO_BATTLE_PACK,
+	"err_pack":           ERR_PACK,
+	"err_node_down":      ERR_NODE_DOWN,
+	"err_room_closed":    ERR_ROOM_CLOSED,
+	"err_draining":       ERR_DRAINING,
+	"err_room_deleted":   ERR_ROOM_DELETED,
+	"err_need_pair":      ERR_NEED_PAIR,
+	"err_state":          ERR_STATE,
+	"err_checksum":       ERR_CHECKSUM,
+	"err_result_exist":   ERR_RESULT_EXIST,
+	"err_no_battle":      ERR_NO_BATTLE,
+	"err_no_foe":         ERR_NO_FOE,
+	"err_already_finish": ERR_ALREADY_FINISH,
+	"err_code":           ERR_CODE,
+	"err_resume":         ERR_RESUME,
+	"err_battle_over":    ERR_BATTLE_OVER,
+	"err_not_spectating": ERR_NOT_SPECTATING,
+	"err_spectator_full": ERR_SPECTATOR_FULL,
+	"err_reaction":       ERR_REACTION,
+	"err_not_friend":     ERR_NOT_FRIEND,
+	"err_chat_blocked":   ERR_CHAT_BLOCKED,
+	"err_chat_rate":      ERR_CHAT_RATE,
+	"err_chat_safe":      ERR_CHAT_SAFE,
+	"err_quick_chat":     ERR_QUICK_CHAT,
+	"err_reported":       ERR_REPORTED,
+	"err_ssdb":           ERR_SSDB,
+	"err_ssdb_pool":      ERR_SSDB_POOL,
+	"err_strconv":        ERR_STRCONV,
+}
+
+// what version 1 clients got instead of the error name
+var ERROR_LEGACY = map[string]string{
+	"err_json":         "json error",
+	"err_need_pair":    "need pair",
+	"err_state":        "battle state error",
+	"err_result_exist": "result exist",
+}
+
+type MsgAuthPair struct {
+	Token    string
+	RoomName string
+	Version  int
+	Encoding string
+	SafeChat bool
+	DeviceId string
+}
+
+func (m *MsgAuthPair) validate(version int) string {
+	if m.Token == "" {
+		return "err_field_missing:Token"
+	}
+	if len(m.Token) > 64 {
+		return "err_field_len:Token"
+	}
+	if m.RoomName == "" {
+		return "err_field_missing:RoomName"
+	}
+	if len(m.RoomName) > 32 {
+		return "err_field_len:RoomName"
+	}
+	if m.Version < 0 {
+		return "err_field_range:Version"
+	}
+	switch m.Encoding {
+	case "", "json", "msgpack":
+	default:
+		return "err_field_value:Encoding"
+	}
+	if len(m.DeviceId) > 64 {
+		return "err_field_len:DeviceId"
+	}
+	return ""
+}
+
+type MsgReady struct {
+}
+
+func (m *MsgReady) validate(version int) string {
+	return ""
+}
+
+type MsgProgress struct {
+	CompleteNum int
+}
+
+func (m *MsgProgress) validate(version int) string {
+	if m.CompleteNum == 0 {
+		return "err_field_missing:CompleteNum"
+	}
+	if m.CompleteNum < 1 {
+		return "err_field_range:CompleteNum"
+	}
+	return ""
+}
+
+type MsgFinish struct {
+	Msec     int
+	Checksum string
+}
+
+func (m *MsgFinish) validate(version int) string {
+	if m.Msec == 0 {
+		return "err_field_missing:Msec"
+	}
+	if m.Msec < 1 {
+		return "err_field_range:Msec"
+	}
+	if m.Checksum == "" {
+		return "err_field_missing:Checksum"
+	}
+	if len(m.Checksum) > 40 {
+		return "err_field_len:Checksum"
+	}
+	return ""
+}
+
+type MsgTalk struct {
+	Text  string
+	Quick string
+}
+
+func (m *MsgTalk) validate(version int) string {
+	if len(m.Text) > 256 {
+		return "err_field_len:Text"
+	}
+	if len(m.Quick) > 16 {
+		return "err_field_len:Quick"
+	}
+	return ""
+}
+
+type MsgCreatePrivateRoom struct {
+	Token    string
+	Version  int
+	Encoding string
+	BetCoin  int
+	SafeChat bool
+	DeviceId string
+}
+
+func (m *MsgCreatePrivateRoom) validate(version int) string {
+	if m.Token == "" {
+		return "err_field_missing:Token"
+	}
+	if len(m.Token) > 64 {
+		return "err_field_len:Token"
+	}
+	if m.Version < 0 {
+		return "err_field_range:Version"
+	}
+	switch m.Encoding {
+	case "", "json", "msgpack":
+	default:
+		return "err_field_value:Encoding"
+	}
+	if m.BetCoin < 0 {
+		return "err_field_range:BetCoin"
+	}
+	if len(m.DeviceId) > 64 {
+		return "err_field_len:DeviceId"
+	}
+	return ""
+}
+
+type MsgJoinPrivateRoom struct {
+	Token    string
+	Version  int
+	Encoding string
+	Code     string
+	SafeChat bool
+	DeviceId string
+}
+
+func (m *MsgJoinPrivateRoom) validate(version int) string {
+	if m.Token == "" {
+		return "err_field_missing:Token"
+	}
+	if len(m.Token) > 64 {
+		return "err_field_len:Token"
+	}
+	if m.Version < 0 {
+		return "err_field_range:Version"
+	}
+	switch m.Encoding {
+	case "", "json", "msgpack":
+	default:
+		return "err_field_value:Encoding"
+	}
+	if m.Code == "" {
+		return "err_field_missing:Code"
+	}
+	if len(m.Code) > 16 {
+		return "err_field_len:Code"
+	}
+	if len(m.DeviceId) > 64 {
+		return "err_field_len:DeviceId"
+	}
+	return ""
+}
+
+type MsgRematch struct {
+}
+
+func (m *MsgRematch) validate(version int) string {
+	return ""
+}
+
+type MsgSpectate struct {
+	Token    string
+	Version  int
+	Encoding string
+	BattleId string
+	UserId   int64
+}
+
+func (m *MsgSpectate) validate(version int) string {
+	if m.Token == "" {
+		return "err_field_missing:Token"
+	}
+	if len(m.Token) > 64 {
+		return "err_field_len:Token"
+	}
+	if m.Version < 0 {
+		return "err_field_range:Version"
+	}
+	switch m.Encoding {
+	case "", "json", "msgpack":
+	default:
+		return "err_field_value:Encoding"
+	}
+	if len(m.BattleId) > 32 {
+		return "err_field_len:BattleId"
+	}
+	if m.UserId < 0 {
+		return "err_field_range:UserId"
+	}
+	return ""
+}
+
+type MsgLeaveSpectate struct {
+}
+
+func (m *MsgLeaveSpectate) validate(version int) string {
+	return ""
+}
+
+type MsgReact struct {
+	Reaction string
+}
+
+func (m *MsgReact) validate(version int) string {
+	if m.Reaction == "" {
+		return "err_field_missing:Reaction"
+	}
+	if len(m.Reaction) > 16 {
+		return "err_field_len:Reaction"
+	}
+	return ""
+}
+
+type MsgListLiveBattles struct {
+}
+
+func (m *MsgListLiveBattles) validate(version int) string {
+	return ""
+}
+
+type MsgResume struct {
+	Token       string
+	Version     int
+	Encoding    string
+	ResumeToken string
+}
+
+func (m *MsgResume) validate(version int) string {
+	if m.Token == "" {
+		return "err_field_missing:Token"
+	}
+	if len(m.Token) > 64 {
+		return "err_field_len:Token"
+	}
+	if m.Version < 0 {
+		return "err_field_range:Version"
+	}
+	switch m.Encoding {
+	case "", "json", "msgpack":
+	default:
+		return "err_field_value:Encoding"
+	}
+	if m.ResumeToken == "" {
+		return "err_field_missing:ResumeToken"
+	}
+	if len(m.ResumeToken) > 32 {
+		return "err_field_len:ResumeToken"
+	}
+	return ""
+}
+
+type MsgMuteFoe struct {
+	Mute bool
+}
+
+func (m *MsgMuteFoe) validate(version int) string {
+	return ""
+}
+
+type MsgReportFoe struct {
+	Reason string
+}
+
+func (m *MsgReportFoe) validate(version int) string {
+	if m.Reason == "" {
+		return "err_field_missing:Reason"
+	}
+	switch m.Reason {
+	case "abuse", "spam", "cheat", "other":
+	default:
+		return "err_field_value:Reason"
+	}
+	return ""
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/ssdbgo"
+)
+
+//races are battles for PlayerMin..PlayerMax players on the same pack, ranked by finish time.
+//the pot of bets is split among the top half, weighted by rank, so coins are only moved between players.
+//a player who leaves or isn't ready at the start forfeits: ranked after everyone still racing, bet lost.
+//the race ends when everyone still connected has finished, or RACE_FINISH_WAIT after the first finish.
+const (
+	RACE_LOBBY_WAIT      = 30 * time.Second
+	RACE_PREPARE_TIMEOUT = 20 * time.Second
+	RACE_FINISH_WAIT     = 60 * time.Second
+)
+
+type raceLobby struct {
+	conns    []*Connection
+	openedAt time.Time
+}
+
+type RaceRank struct {
+	Rank        int
+	UserId      int64
+	NickName    string
+	Msec        int
+	CompleteNum int
+	Left        bool
+}
+
+type RaceResult struct {
+	Type           string
+	Rank           int
+	PlayerNum      int
+	Ranks          []RaceRank
+	RewardCoin     int
+	TotalCoin      int
+	BattlePointAdd int
+	BattlePoint    int
+	SeasonId       int64
+	SeasonPoint    int
+	PayoutHeld     bool
+}
+
+//kept on the battle, a player released from it may be racing another by the result
+type raceFinishRec struct {
+	msec  int
+	order int
+}
+
+type raceEntry struct {
+	conn        *Connection
+	player      *PlayerInfo //as paired, the player may have left since
+	msec        int
+	completeNum int
+	left        bool
+	order       int
+}
+
+//finishers by time, then those still racing, then those who left
+type ByRaceRank []raceEntry
+
+func (a ByRaceRank) Len() int      { return len(a) }
+func (a ByRaceRank) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByRaceRank) Less(i, j int) bool {
+	fi, fj := a[i].msec > 0, a[j].msec > 0
+	if fi != fj {
+		return fi
+	}
+	if fi {
+		if a[i].msec != a[j].msec {
+			return a[i].msec < a[j].msec
+		}
+		return a[i].order < a[j].order
+	}
+	if a[i].left != a[j].left {
+		return !a[i].left
+	}
+	return a[i].completeNum > a[j].completeNum
+}
+
+func racePaidNum(playerNum int) int {
+	return playerNum / 2
+}
+
+//net coin change by rank, sums to zero
+func calcRaceCoins(betCoin int, playerNum int) []int {
+	coins := make([]int, playerNum)
+	paidNum := racePaidNum(playerNum)
+	pot := betCoin * playerNum
+	weightSum := paidNum * (paidNum + 1) / 2
+	paid := 0
+	for i := 0; i < paidNum; i++ {
+		coins[i] = pot * (paidNum - i) / weightSum
+		paid += coins[i]
+	}
+	coins[0] += pot - paid
+	for i := range coins {
+		coins[i] -= betCoin
+	}
+	return coins
+}
+
+func calcRacePoint(rank int, playerNum int) int {
+	paidNum := racePaidNum(playerNum)
+	if rank > paidNum {
+		return 0
+	}
+	return paidNum - rank + 1
+}
+
+//runs with queueMu held
+func (h *Hub) joinRaceLobby(c *Connection, room BattleRoom) error {
+	lobby := h.lobbies[room.Name]
+	if lobby == nil {
+		lobby = &raceLobby{}
+		h.lobbies[room.Name] = lobby
+	}
+	for _, o := range lobby.conns {
+		if o.playerInfo.UserId == c.playerInfo.UserId {
+			return fmt.Errorf("err_same_user")
+		}
+	}
+	if len(lobby.conns) == 0 {
+		lobby.openedAt = time.Now()
+	}
+	lobby.conns = append(lobby.conns, c)
+
+	sendRaceLobby(lobby, room)
+	return nil
+}
+
+func sendRaceLobby(lobby *raceLobby, room BattleRoom) {
+	waitSec := int(RACE_LOBBY_WAIT.Seconds() - time.Now().Sub(lobby.openedAt).Seconds())
+	if waitSec < 0 {
+		waitSec = 0
+	}
+	out := struct {
+		Type      string
+		PlayerNum int
+		PlayerMin int
+		PlayerMax int
+		WaitSec   int
+	}{
+		"raceLobby",
+		len(lobby.conns),
+		room.PlayerMin,
+		room.PlayerMax,
+		waitSec,
+	}
+	for _, c := range lobby.conns {
+		c.sendMsg(out)
+	}
+}
+
+func removeFromRaceLobby(lobby *raceLobby, c *Connection) bool {
+	for i, o := range lobby.conns {
+		if o == c {
+			lobby.conns = append(lobby.conns[:i], lobby.conns[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+//runs with queueMu held, full lobbies go at once, others once they've waited long enough
+func (h *Hub) takeRaceLobbies(now time.Time) [][]*Connection {
+	races := [][]*Connection{}
+	for roomName, lobby := range h.lobbies {
+		room, exist := getBattleRoom(roomName)
+		if !exist {
+			continue
+		}
+		for len(lobby.conns) >= room.PlayerMax {
+			races = append(races, lobby.conns[:room.PlayerMax])
+			lobby.conns = append([]*Connection{}, lobby.conns[room.PlayerMax:]...)
+			lobby.openedAt = now
+		}
+		if len(lobby.conns) >= room.PlayerMin && now.Sub(lobby.openedAt) >= RACE_LOBBY_WAIT {
+			races = append(races, lobby.conns)
+			lobby.conns = nil
+		}
+	}
+	return races
+}
+
+//like startBattle, the db work runs on the calling goroutine
+func (h *Hub) startRace(conns []*Connection, room BattleRoom) error {
+	//ssdb
+	matchdb, err := ssdbMatchPool.Get()
+	if err != nil {
+		return err
+	}
+	defer matchdb.Close()
+
+	//pack
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	userIds := humanUserIds(conns)
+	sliderNum := pickSliderNum(room, conns)
+	packId, err := pickBattlePackId(rc, matchdb, userIds, sliderNum)
+	if err != nil {
+		return err
+	}
+
+	pack, err := getPack(matchdb, packId)
+	if err != nil {
+		return err
+	}
+
+	if err = markBattlePackSeen(rc, userIds, packId); err != nil {
+		glog.Errorf("markBattlePackSeen error:%v", err)
+	}
+
+	//
+	battle := makeBattle()
+	battle.room = room
+	battle.packId = pack.Id
+	battle.sliderNum = sliderNum
+	battle.imageNum = len(pack.Images)
+
+	//bets, whoever can't pay is dropped while enough are left.
+	//the rollback closes the reserved entries for good, so each try takes a new id
+	for {
+		battle.id = genUUID()
+		battle.players = conns
+		err = reserveBattleBets(matchdb, battle, conns)
+		poor, ok := err.(*startErr)
+		if !ok || len(conns) <= room.PlayerMin {
+			break
+		}
+		conns = removeConn(conns, poor.conn)
+		h.call(func() {
+			if h.connections[poor.conn] {
+				poor.conn.playerInfo = nil
+				poor.conn.sendErr(poor.err)
+			}
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	//attach on the hub, whoever left meanwhile forfeits
+	h.callWait(func() {
+		num := 0
+		for _, c := range conns {
+			if h.connections[c] {
+				num++
+			}
+		}
+		if num < 2 {
+			err = fmt.Errorf("err_no_foe")
+			return
+		}
+		if h.isDraining() {
+			err = fmt.Errorf("err_draining")
+			return
+		}
+		for _, c := range conns {
+			c.battle = battle
+			c.foe = nil
+			c.result = 0
+			if !h.connections[c] {
+				battle.left[c] = true
+			}
+		}
+		h.addLiveBattle(battle)
+	})
+	if err != nil {
+		refundBattleBets(battle)
+		return err
+	}
+
+	players := make([]*PlayerInfo, 0, len(conns))
+	for _, c := range conns {
+		if room.HeartCost > 0 && !battle.left[c] {
+			useBattleHeart(matchdb, c.playerInfo, room.HeartCost)
+		}
+		players = append(players, c.playerInfo)
+	}
+	battle.playerInfos = players
+
+	//out
+	h.call(func() {
+		for _, c := range conns {
+			if battle.left[c] {
+				continue
+			}
+			out := struct {
+				Type          string
+				Pack          *Pack
+				SliderNum     int
+				Players       []*PlayerInfo
+				Secret        string
+				HeartZeroTime int64
+			}{
+				"racePaired",
+				pack,
+				battle.sliderNum,
+				players,
+				battle.secret,
+				c.playerInfo.BattleHeartZeroTime,
+			}
+			c.sendMsg(out)
+		}
+	})
+
+	//timeout, whoever isn't ready forfeits
+	go func() {
+		time.Sleep(RACE_PREPARE_TIMEOUT)
+		h.call(func() {
+			if battle.state != PREPARE {
+				return
+			}
+			readyNum := 0
+			for _, c := range battle.players {
+				if battle.left[c] {
+					continue
+				}
+				if battle.ready[c] {
+					readyNum++
+				} else {
+					battle.left[c] = true
+					releaseRacePlayer(c, battle)
+				}
+			}
+			if readyNum >= 2 {
+				battle.start()
+			} else {
+				for _, c := range battle.players {
+					if !battle.left[c] {
+						releaseRacePlayer(c, battle)
+					}
+				}
+				h.removeLiveBattle(battle)
+				refundBattleBets(battle)
+			}
+		})
+	}()
+
+	return nil
+}
+
+//on the hub goroutine, a player timed out of the race may pair again
+func releaseRacePlayer(c *Connection, battle *Battle) {
+	if c.battle != battle {
+		return
+	}
+	c.battle = nil
+	c.playerInfo = nil
+	c.sendErr("err_timeout")
+}
+
+func removeConn(conns []*Connection, conn *Connection) []*Connection {
+	out := make([]*Connection, 0, len(conns))
+	for _, c := range conns {
+		if c != conn {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func raceProgress(conn *Connection, completeNum int) {
+	battle := conn.battle
+	out := struct {
+		Type        string
+		UserId      int64
+		CompleteNum int
+	}{
+		"progress",
+		conn.playerInfo.UserId,
+		completeNum,
+	}
+	for _, c := range battle.players {
+		if c != conn && !battle.left[c] {
+			c.sendMsg(out)
+		}
+	}
+}
+
+//on the hub goroutine like raceLeave, so the two can't both make the result
+func raceFinish(conn *Connection, msec int) {
+	battle := conn.battle
+	h.call(func() {
+		if battle.state == FINISH || battle.left[conn] {
+			return
+		}
+		if _, ok := battle.finishes[conn]; ok {
+			return
+		}
+		raceFinishOnHub(battle, conn, msec)
+	})
+}
+
+func raceFinishOnHub(battle *Battle, conn *Connection, msec int) {
+	battle.finishNum++
+	battle.finishes[conn] = raceFinishRec{msec, battle.finishNum}
+
+	out := struct {
+		Type   string
+		UserId int64
+		Msec   int
+	}{
+		"playerFinish",
+		conn.playerInfo.UserId,
+		msec,
+	}
+	for _, c := range battle.players {
+		if c != conn && !battle.left[c] {
+			c.sendMsg(out)
+		}
+	}
+
+	if battle.allFinished() {
+		makeRaceResult(battle)
+	} else if battle.finishNum == 1 {
+		go func() {
+			time.Sleep(RACE_FINISH_WAIT)
+			h.call(func() {
+				makeRaceResult(battle)
+			})
+		}()
+	}
+}
+
+//on the hub goroutine, from unregister
+func raceLeave(conn *Connection) {
+	battle := conn.battle
+	if battle.state == FINISH || battle.left[conn] {
+		return
+	}
+	battle.left[conn] = true
+
+	out := struct {
+		Type   string
+		UserId int64
+	}{
+		"playerLeave",
+		conn.playerInfo.UserId,
+	}
+	for _, c := range battle.players {
+		if !battle.left[c] {
+			c.sendMsg(out)
+		}
+	}
+
+	if battle.state == PREPARE {
+		if battle.allReady() && len(battle.ready) >= 2 {
+			battle.start()
+		}
+	} else if battle.state == MATCHING && battle.allFinished() {
+		makeRaceResult(battle)
+	}
+}
+
+func (battle *Battle) allFinished() bool {
+	for _, c := range battle.players {
+		if _, ok := battle.finishes[c]; !battle.left[c] && !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func makeRaceResult(battle *Battle) string {
+	if battle.state == FINISH {
+		return "err_already_finish"
+	}
+	battle.state = FINISH
+
+	//still live while the bets are paid, so the escrow sweeper leaves them alone
+	defer h.removeLiveBattle(battle)
+
+	//ssdb
+	ssdbc, err := ssdbMatchPool.Get()
+	if err != nil {
+		return "err_ssdb_pool"
+	}
+	defer ssdbc.Close()
+
+	seasonId, err := getActiveBattleSeasonId(ssdbc)
+	if err != nil {
+		glog.Errorf("getActiveBattleSeasonId error:%v", err)
+		seasonId = 0
+	}
+
+	//rank
+	playerNum := len(battle.players)
+	entries := make([]raceEntry, 0, playerNum)
+	battle.specMu.Lock()
+	for i, c := range battle.players {
+		f := battle.finishes[c]
+		entries = append(entries, raceEntry{c, battle.playerInfos[i], f.msec, battle.progress[c], battle.left[c], f.order})
+	}
+	battle.specMu.Unlock()
+	sort.Sort(ByRaceRank(entries))
+
+	ranks := make([]RaceRank, 0, playerNum)
+	for i, e := range entries {
+		ranks = append(ranks, RaceRank{i + 1, e.player.UserId, e.player.NickName, e.msec, e.completeNum, e.left && e.msec == 0})
+	}
+
+	//settle
+	coins := calcRaceCoins(battle.room.BetCoin, playerNum)
+	records := make([]BattleRecordPlayer, 0, playerNum)
+	for i, e := range entries {
+		rank := i + 1
+		player := e.player
+
+		out := RaceResult{
+			Type:       "raceResult",
+			Rank:       rank,
+			PlayerNum:  playerNum,
+			Ranks:      ranks,
+			RewardCoin: coins[i],
+			SeasonId:   seasonId,
+		}
+		err := settleRacePlayer(ssdbc, battle, player, rank, playerNum, &out)
+		if err != nil {
+			glog.Errorf("settleRacePlayer error:%v, userId:%d", err, player.UserId)
+			continue
+		}
+
+		if !battle.left[e.conn] {
+			e.conn.sendMsg(out)
+		}
+
+		result := "lose"
+		if rank == 1 {
+			result = "win"
+		}
+		records = append(records, BattleRecordPlayer{
+			UserId:       player.UserId,
+			NickName:     player.NickName,
+			Msec:         e.msec,
+			Result:       result,
+			Rank:         rank,
+			CoinAdd:      out.RewardCoin,
+			PointAdd:     out.BattlePointAdd,
+			Disconnected: e.left,
+		})
+	}
+
+	//history
+	err = saveBattleRecord(ssdbc, battle, records)
+	if err != nil {
+		glog.Errorf("saveBattleRecord error:%v", err)
+	}
+
+	//spectators
+	out := struct {
+		Type  string
+		Ranks []RaceRank
+	}{
+		"specRaceResult",
+		ranks,
+	}
+	battle.sendSpectators(out)
+
+	return ""
+}
+
+func settleRacePlayer(ssdbc *ssdbgo.Client, battle *Battle, player *PlayerInfo, rank int, playerNum int, out *RaceResult) error {
+	key := makePlayerInfoKey(player.UserId)
+	betCoin := battle.room.BetCoin
+
+	//coin, out of escrow
+	var err error
+	out.TotalCoin, out.PayoutHeld, err = settleBet(ssdbc, battle, player.UserId, out.RewardCoin)
+	if err != nil {
+		return err
+	}
+
+	//battle point
+	out.BattlePoint = player.BattlePoint
+	out.BattlePointAdd = calcRacePoint(rank, playerNum)
+	if out.BattlePointAdd > 0 {
+		resp, err := ssdbc.Do("hincr", key, PLAYER_BATTLE_POINT, out.BattlePointAdd)
+		if err != nil || resp[0] != "ok" {
+			return fmt.Errorf("err_ssdb")
+		}
+		out.BattlePoint, err = strconv.Atoi(resp[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	//season
+	if out.SeasonId != 0 {
+		out.SeasonPoint, err = addBattleSeasonPoint(ssdbc, out.SeasonId, player.UserId, out.BattlePointAdd)
+		if err != nil {
+			glog.Errorf("addBattleSeasonPoint error:%v", err)
+		}
+	}
+
+	//achievement and mission
+	isWin := rank == 1
+	if isWin {
+		err = pushAchievementEvent(ssdbc, player.UserId, ACHV_STAT_BATTLE_WIN, 1, false)
+		if err != nil {
+			glog.Errorf("pushAchievementEvent error:%v", err)
+		}
+	}
+	pushBattleMissionEvents(ssdbc, player.UserId, isWin, betCoin)
+
+	return nil
+}
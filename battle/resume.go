@@ -0,0 +1,207 @@
+package main
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+//a player who drops during a battle keeps the seat for a grace period.
+//the foe plays on, the dropped connection's messages go nowhere until a new connection
+//comes back with the resume token from "paired" and takes the seat over.
+//when the grace period runs out the usual disconnect rule applies.
+
+type heldSeat struct {
+	conn  *Connection
+	timer *time.Timer
+}
+
+//runs on the hub goroutine, true if c keeps its seat instead of being dropped
+func (h *Hub) holdSeat(c *Connection) bool {
+	battle := c.battle
+	if *resumeGraceSec <= 0 || c.isBot || c.remoteNodeId != "" || c.resumeToken == "" {
+		return false
+	}
+	if battle == nil || battle.isRace() || battle.state != MATCHING || c.foe == nil {
+		return false
+	}
+
+	//nobody reads the old websocket anymore
+	go func() {
+		for _ = range c.send {
+		}
+	}()
+
+	token := c.resumeToken
+	grace := time.Duration(*resumeGraceSec) * time.Second
+	h.heldSeats[token] = &heldSeat{
+		conn: c,
+		timer: time.AfterFunc(grace, func() {
+			h.call(func() {
+				h.expireSeat(token)
+			})
+		}),
+	}
+
+	out := struct {
+		Type     string
+		GraceSec int
+	}{
+		"foeOffline",
+		*resumeGraceSec,
+	}
+	c.foe.sendMsg(out)
+	return true
+}
+
+func (h *Hub) expireSeat(token string) {
+	seat := h.heldSeats[token]
+	if seat == nil {
+		return
+	}
+	delete(h.heldSeats, token)
+	h.disconnect(seat.conn)
+}
+
+//the new connection takes the place of the old one in the battle
+func takeSeat(conn *Connection, old *Connection) {
+	battle := old.battle
+
+	conn.battle = battle
+	conn.foe = old.foe
+	conn.roomName = old.roomName
+	conn.result = old.result
+	conn.playerInfo = old.playerInfo
+	conn.resumeToken = genUUID()
+	if conn.foe != nil {
+		conn.foe.foe = conn
+	}
+	for i, c := range battle.players {
+		if c == old {
+			battle.players[i] = conn
+		}
+	}
+	if battle.ready[old] {
+		delete(battle.ready, old)
+		battle.ready[conn] = true
+	}
+
+	battle.specMu.Lock()
+	if n, ok := battle.progress[old]; ok {
+		delete(battle.progress, old)
+		battle.progress[conn] = n
+	}
+	battle.specMu.Unlock()
+
+	old.battle = nil
+	old.foe = nil
+}
+
+func battleResume(conn *Connection, msg []byte) {
+	if conn.playerInfo != nil {
+		conn.sendErr("err_already_pair")
+		return
+	}
+
+	//in
+	var in MsgResume
+	if !decodeMsg(conn, msg, &in) {
+		return
+	}
+	if err := negotiateProtocol(conn, in.Version, in.Encoding); err != nil {
+		conn.sendErr(err.Error())
+		return
+	}
+
+	session, err := authPlayer(conn, in.Token)
+	if err != nil {
+		conn.sendErr(err.Error())
+		return
+	}
+
+	h.call(func() {
+		seat := h.heldSeats[in.ResumeToken]
+		if seat == nil || seat.conn.playerInfo.UserId != session.Userid {
+			conn.playerInfo = nil
+			conn.sendErr("err_resume")
+			return
+		}
+		old := seat.conn
+		battle := old.battle
+		if battle == nil || battle.state != MATCHING {
+			conn.playerInfo = nil
+			conn.sendErr("err_battle_over")
+			return
+		}
+		seat.timer.Stop()
+		delete(h.heldSeats, in.ResumeToken)
+
+		takeSeat(conn, old)
+		if _, ok := h.connections[old]; ok {
+			delete(h.connections, old)
+			delete(h.connIds, old.id)
+			close(old.send)
+		}
+
+		//pack
+		matchdb, err := ssdbMatchPool.Get()
+		if err != nil {
+			conn.sendErr("err_ssdb_pool")
+			return
+		}
+		defer matchdb.Close()
+		pack, err := getPack(matchdb, battle.packId)
+		if err != nil {
+			glog.Errorf("getPack error:%v", err)
+			conn.sendErr("err_pack")
+			return
+		}
+
+		//out
+		battle.specMu.Lock()
+		myCompleteNum := battle.progress[conn]
+		foeCompleteNum := battle.progress[conn.foe]
+		battle.specMu.Unlock()
+
+		out := struct {
+			Type           string
+			Pack           *Pack
+			SliderNum      int
+			FoePlayer      *PlayerInfo
+			FoeIsBot       bool
+			Secret         string
+			ResumeToken    string
+			ElapsedMsec    int64
+			MyCompleteNum  int
+			MyMsec         int
+			FoeCompleteNum int
+			FoeMsec        int
+		}{
+			Type:           "resumed",
+			Pack:           pack,
+			SliderNum:      battle.sliderNum,
+			Secret:         battle.secret,
+			ResumeToken:    conn.resumeToken,
+			ElapsedMsec:    int64(time.Now().Sub(battle.startTime) / time.Millisecond),
+			MyCompleteNum:  myCompleteNum,
+			MyMsec:         conn.result,
+			FoeCompleteNum: foeCompleteNum,
+		}
+		if conn.foe != nil {
+			out.FoePlayer = conn.foe.playerInfo
+			out.FoeIsBot = conn.foe.isBot
+			out.FoeMsec = conn.foe.result
+			conn.foe.sendType("foeReconnect")
+		}
+		conn.sendMsg(out)
+
+		//the wait started on the old connection went with it
+		if conn.result != 0 {
+			waitFoeFinish(conn)
+		}
+	})
+}
+
+func regResume() {
+	regHandler("resume", MsgHandler(battleResume))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/glog"
+)
+
+//rooms are edited on the match server and kept in the match ssdb, every node reloads them now and then.
+//each node reports how many players wait and play per room, the match server sums them up for the room list.
+const (
+	H_BATTLE_ROOM       = "H_BATTLE_ROOM"       //subkey:roomName value:battleRoomJson, written by match server
+	H_BATTLE_ROOM_COUNT = "H_BATTLE_ROOM_COUNT" //redis, key:H_BATTLE_ROOM_COUNT/nodeId subkey:roomName/Waiting|Playing value:num
+
+	BATTLE_ROOM_RELOAD_PERIOD = 10 * time.Second
+)
+
+type BattleRoom struct {
+	Name         string
+	Title        string
+	BetCoin      int
+	HeartCost    int
+	SliderNumMin int
+	SliderNumMax int
+	PlayerMin    int
+	PlayerMax    int
+	OpenHour     int //open from OpenHour to CloseHour local time, always open if equal
+	CloseHour    int
+	Disabled     bool
+}
+
+var (
+	battleRooms   = map[string]BattleRoom{}
+	battleRoomsMu sync.RWMutex
+)
+
+func makeHBattleRoomCountKey(node string) string {
+	return fmt.Sprintf("%s/%s", H_BATTLE_ROOM_COUNT, node)
+}
+
+func (room *BattleRoom) isOpen(now time.Time) bool {
+	if room.Disabled {
+		return false
+	}
+	if room.OpenHour == room.CloseHour {
+		return true
+	}
+	hour := now.Hour()
+	if room.OpenHour < room.CloseHour {
+		return hour >= room.OpenHour && hour < room.CloseHour
+	}
+	return hour >= room.OpenHour || hour < room.CloseHour
+}
+
+func getBattleRoom(name string) (BattleRoom, bool) {
+	battleRoomsMu.RLock()
+	defer battleRoomsMu.RUnlock()
+	room, exist := battleRooms[name]
+	return room, exist
+}
+
+func listBattleRooms() []BattleRoom {
+	battleRoomsMu.RLock()
+	defer battleRoomsMu.RUnlock()
+	rooms := make([]BattleRoom, 0, len(battleRooms))
+	for _, room := range battleRooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+func loadBattleRooms() error {
+	ssdbc, err := ssdbMatchPool.Get()
+	if err != nil {
+		return err
+	}
+	defer ssdbc.Close()
+
+	resp, err := ssdbc.Do("hgetall", H_BATTLE_ROOM)
+	if err != nil {
+		return err
+	}
+	resp = resp[1:]
+
+	rooms := make(map[string]BattleRoom, len(resp)/2)
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		var room BattleRoom
+		err = json.Unmarshal([]byte(resp[i*2+1]), &room)
+		if err != nil {
+			glog.Errorf("battle room %s json error:%v", resp[i*2], err)
+			continue
+		}
+		if room.SliderNumMin <= 0 || room.PlayerMin < 2 || room.PlayerMax < room.PlayerMin {
+			glog.Errorf("battle room %s skipped, bad settings", room.Name)
+			continue
+		}
+		rooms[room.Name] = room
+	}
+	if len(rooms) == 0 {
+		glog.Warning("no battle room, run the match server to set them up")
+	}
+
+	battleRoomsMu.Lock()
+	battleRooms = rooms
+	battleRoomsMu.Unlock()
+	return nil
+}
+
+//keeps the last good catalog if ssdb can't be reached, players waiting in a deleted room are let go
+func reloadBattleRooms() {
+	for {
+		time.Sleep(BATTLE_ROOM_RELOAD_PERIOD)
+		before := listBattleRooms()
+		if err := loadBattleRooms(); err != nil {
+			glog.Errorf("loadBattleRooms error:%v", err)
+			continue
+		}
+		for _, room := range before {
+			if _, exist := getBattleRoom(room.Name); !exist {
+				roomName := room.Name
+				h.call(func() {
+					h.flushRoom(roomName)
+				})
+			}
+		}
+	}
+}
+
+//runs on the hub goroutine
+func (h *Hub) flushRoom(roomName string) {
+	h.queueMu.Lock()
+	delete(h.lobbies, roomName)
+	h.queueMu.Unlock()
+
+	for _, c := range h.connIds {
+		if c.roomName != roomName || c.playerInfo == nil || c.hostNodeId != "" {
+			continue
+		}
+		if c.battle != nil && c.battle.state != ONELEFT {
+			continue
+		}
+		dequeueConn(c)
+		c.playerInfo = nil
+		c.sendErr("err_room_deleted")
+	}
+}
+
+//runs on the hub goroutine, proxies count on the node running the battle only
+func (h *Hub) reportRoomCounts(rc redis.Conn) {
+	counts := map[string]int{}
+
+	h.liveMu.Lock()
+	for _, battle := range h.liveBattles {
+		if battle.state == FINISH {
+			continue
+		}
+		for _, c := range battle.players {
+			if !c.isBot && !battle.left[c] {
+				counts[battle.room.Name+"/Playing"]++
+			}
+		}
+	}
+	h.liveMu.Unlock()
+
+	h.queueMu.Lock()
+	for roomName, lobby := range h.lobbies {
+		counts[roomName+"/Waiting"] += len(lobby.conns)
+	}
+	h.queueMu.Unlock()
+
+	key := makeHBattleRoomCountKey(*nodeId)
+	args := make([]interface{}, 0, len(counts)*2+1)
+	args = append(args, key)
+	for k, n := range counts {
+		args = append(args, k, n)
+	}
+
+	rc.Send("MULTI")
+	rc.Send("DEL", key)
+	if len(counts) > 0 {
+		rc.Send("HMSET", args...)
+		rc.Send("EXPIRE", key, NODE_ALIVE_TTL_SEC)
+	}
+	_, err := rc.Do("EXEC")
+	if err != nil {
+		glog.Errorf("reportRoomCounts error:%v", err)
+	}
+}
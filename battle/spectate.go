@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/henyouqian/ssdbgo"
+)
+
+//spectators watch a live battle: both players' progress, finish times and results.
+//they are fed with non-blocking sends, a slow spectator drops messages instead of holding up the players.
+//anyone may watch a listed battle by its id, a player or a private room battle only their friends may watch.
+const (
+	SPECTATOR_MAX          = 50
+	SPECTATOR_REACT_PERIOD = 2 * time.Second
+	LIVE_BATTLE_LIST_LIMIT = 20
+)
+
+var (
+	SPECTATOR_REACTIONS = map[string]bool{
+		"cheer": true,
+		"wow":   true,
+		"laugh": true,
+		"clap":  true,
+		"cry":   true,
+	}
+)
+
+type LiveBattle struct {
+	BattleId     string
+	RoomName     string
+	BetCoin      int
+	Players      []*PlayerInfo
+	IsBot        bool
+	Started      bool
+	SpectatorNum int
+}
+
+//what spectators see of a player's result, coins held are the player's own business
+type SpecBattleResult struct {
+	Result         string
+	MyMsec         int
+	FoeMsec        int
+	RewardCoin     int
+	BattlePointAdd int
+	BattlePoint    int
+	WinStreak      int
+	IsBot          bool
+}
+
+type ByFeatured []LiveBattle
+
+func (a ByFeatured) Len() int      { return len(a) }
+func (a ByFeatured) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByFeatured) Less(i, j int) bool {
+	if a[i].BetCoin != a[j].BetCoin {
+		return a[i].BetCoin > a[j].BetCoin
+	}
+	return a[i].SpectatorNum > a[j].SpectatorNum
+}
+
+func (h *Hub) addLiveBattle(battle *Battle) {
+	h.liveMu.Lock()
+	h.liveBattles[battle.id] = battle
+	h.liveMu.Unlock()
+}
+
+func (h *Hub) removeLiveBattle(battle *Battle) {
+	h.liveMu.Lock()
+	delete(h.liveBattles, battle.id)
+	h.liveMu.Unlock()
+}
+
+//by battle id, or the live battle a player is in
+func (h *Hub) findLiveBattle(battleId string, userId int64) *Battle {
+	h.liveMu.Lock()
+	defer h.liveMu.Unlock()
+
+	if battleId != "" {
+		return h.liveBattles[battleId]
+	}
+	for _, battle := range h.liveBattles {
+		for _, c := range battle.players {
+			if !c.isBot && c.playerInfo != nil && c.playerInfo.UserId == userId {
+				return battle
+			}
+		}
+	}
+	return nil
+}
+
+func (battle *Battle) liveInfo() LiveBattle {
+	battle.specMu.Lock()
+	defer battle.specMu.Unlock()
+
+	info := LiveBattle{
+		BattleId:     battle.id,
+		RoomName:     battle.room.Name,
+		BetCoin:      battle.room.BetCoin,
+		Players:      make([]*PlayerInfo, 0, len(battle.players)),
+		IsBot:        battle.isBot,
+		Started:      battle.state == MATCHING,
+		SpectatorNum: len(battle.spectators),
+	}
+	for i, c := range battle.players {
+		if battle.playerInfos != nil {
+			info.Players = append(info.Players, battle.playerInfos[i])
+		} else {
+			info.Players = append(info.Players, c.playerInfo)
+		}
+	}
+	return info
+}
+
+func (battle *Battle) setProgress(conn *Connection, completeNum int) {
+	battle.specMu.Lock()
+	battle.progress[conn] = completeNum
+	battle.specMu.Unlock()
+}
+
+func (battle *Battle) sendSpectators(msg interface{}) {
+	js, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+
+	battle.specMu.Lock()
+	defer battle.specMu.Unlock()
+	for c := range battle.spectators {
+		trySend(c, js)
+	}
+}
+
+//drops the message when the spectator's buffer is full
+func trySend(c *Connection, js []byte) {
+	select {
+	case c.send <- js:
+	default:
+	}
+}
+
+func (battle *Battle) removeSpectator(c *Connection) {
+	battle.specMu.Lock()
+	delete(battle.spectators, c)
+	battle.specMu.Unlock()
+}
+
+func spectatorProgress(battle *Battle, conn *Connection, completeNum int) {
+	battle.setProgress(conn, completeNum)
+	out := struct {
+		Type        string
+		UserId      int64
+		CompleteNum int
+	}{
+		"specProgress",
+		conn.playerInfo.UserId,
+		completeNum,
+	}
+	battle.sendSpectators(out)
+}
+
+func spectatorFinish(battle *Battle, conn *Connection, msec int) {
+	out := struct {
+		Type   string
+		UserId int64
+		Msec   int
+	}{
+		"specFinish",
+		conn.playerInfo.UserId,
+		msec,
+	}
+	battle.sendSpectators(out)
+}
+
+func spectatorResult(battle *Battle, conn *Connection, result *BattleResult) {
+	out := struct {
+		Type   string
+		UserId int64
+		Result SpecBattleResult
+	}{
+		"specResult",
+		conn.playerInfo.UserId,
+		SpecBattleResult{
+			Result:         result.Result,
+			MyMsec:         result.MyMsec,
+			FoeMsec:        result.FoeMsec,
+			RewardCoin:     result.RewardCoin,
+			BattlePointAdd: result.BattlePointAdd,
+			BattlePoint:    result.BattlePoint,
+			WinStreak:      result.WinStreak,
+			IsBot:          result.IsBot,
+		},
+	}
+	battle.sendSpectators(out)
+}
+
+func spectate(conn *Connection, msg []byte) {
+	if conn.playerInfo != nil || conn.spectating != nil {
+		conn.sendErr("err_already_pair")
+		return
+	}
+
+	//in
+	var in MsgSpectate
+	if !decodeMsg(conn, msg, &in) {
+		return
+	}
+	if err := negotiateProtocol(conn, in.Version, in.Encoding); err != nil {
+		conn.sendErr(err.Error())
+		return
+	}
+
+	session, err := authPlayer(conn, in.Token)
+	if err != nil {
+		conn.sendErr(err.Error())
+		return
+	}
+
+	battle := h.findLiveBattle(in.BattleId, in.UserId)
+	if battle == nil {
+		conn.playerInfo = nil
+		conn.sendErr("err_no_battle")
+		return
+	}
+	if err = checkSpectateFriend(session.Userid, battle, in.BattleId == "", in.UserId); err != nil {
+		conn.playerInfo = nil
+		conn.sendErr(err.Error())
+		return
+	}
+
+	//attach
+	battle.specMu.Lock()
+	if len(battle.spectators) >= SPECTATOR_MAX {
+		battle.specMu.Unlock()
+		conn.playerInfo = nil
+		conn.sendErr("err_spectator_full")
+		return
+	}
+	battle.spectators[conn] = true
+	progress := map[int64]int{}
+	for c, n := range battle.progress {
+		progress[c.playerInfo.UserId] = n
+	}
+	battle.specMu.Unlock()
+	conn.spectating = battle
+
+	//out
+	out := struct {
+		Type     string
+		Battle   LiveBattle
+		Progress map[int64]int
+	}{
+		"spectating",
+		battle.liveInfo(),
+		progress,
+	}
+	conn.sendMsg(out)
+}
+
+//watching a player asks for that player's friendship, a private battle for one of its players'
+func checkSpectateFriend(userId int64, battle *Battle, byUser bool, watchedId int64) error {
+	if !byUser && battle.room.Name != PRIVATE_ROOM_NAME {
+		return nil
+	}
+
+	ssdbc, err := ssdbMatchPool.Get()
+	if err != nil {
+		return fmt.Errorf("err_ssdb_pool")
+	}
+	defer ssdbc.Close()
+
+	for _, c := range battle.players {
+		if c.isBot || c.playerInfo == nil || (byUser && c.playerInfo.UserId != watchedId) {
+			continue
+		}
+		friend, err := isFriend(ssdbc, userId, c.playerInfo.UserId)
+		if err != nil {
+			return fmt.Errorf("err_ssdb")
+		}
+		if friend {
+			return nil
+		}
+	}
+	return fmt.Errorf("err_not_friend")
+}
+
+//follow each other
+func isFriend(ssdbc *ssdbgo.Client, a int64, b int64) (bool, error) {
+	for _, pair := range [][2]int64{{a, b}, {b, a}} {
+		resp, err := ssdbc.Do("zexists", fmt.Sprintf("%s/%d", Z_PLAYER_FOLLOW, pair[0]), pair[1])
+		if err != nil || resp[0] != "ok" {
+			return false, fmt.Errorf("err_ssdb")
+		}
+		if resp[1] != "1" {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func leaveSpectate(conn *Connection, msg []byte) {
+	if conn.spectating == nil {
+		return
+	}
+	conn.spectating.removeSpectator(conn)
+	conn.spectating = nil
+	conn.playerInfo = nil
+	conn.sendType("spectateLeft")
+}
+
+//spectators can only pick from a few reactions, at most one per period
+func spectatorReact(conn *Connection, msg []byte) {
+	battle := conn.spectating
+	if battle == nil {
+		conn.sendErr("err_not_spectating")
+		return
+	}
+
+	var in MsgReact
+	if !decodeMsg(conn, msg, &in) {
+		return
+	}
+	if !SPECTATOR_REACTIONS[in.Reaction] {
+		conn.sendErr("err_reaction")
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(conn.lastReactTime) < SPECTATOR_REACT_PERIOD {
+		return
+	}
+	conn.lastReactTime = now
+
+	out := struct {
+		Type     string
+		Reaction string
+		NickName string
+	}{
+		"reaction",
+		in.Reaction,
+		conn.playerInfo.NickName,
+	}
+	js, err := json.Marshal(out)
+	if err != nil {
+		return
+	}
+	for _, c := range battle.players {
+		if !c.isBot && c.battle == battle {
+			trySend(c, js)
+		}
+	}
+	battle.sendSpectators(out)
+}
+
+//featured battles: biggest bets first, then the most watched. private room battles aren't featured
+func listLiveBattles(conn *Connection, msg []byte) {
+	h.liveMu.Lock()
+	battles := make([]*Battle, 0, len(h.liveBattles))
+	for _, battle := range h.liveBattles {
+		if battle.room.Name != PRIVATE_ROOM_NAME {
+			battles = append(battles, battle)
+		}
+	}
+	h.liveMu.Unlock()
+
+	lives := make([]LiveBattle, 0, len(battles))
+	for _, battle := range battles {
+		lives = append(lives, battle.liveInfo())
+	}
+	sort.Sort(ByFeatured(lives))
+	if len(lives) > LIVE_BATTLE_LIST_LIMIT {
+		lives = lives[:LIVE_BATTLE_LIST_LIMIT]
+	}
+
+	out := struct {
+		Type    string
+		Battles []LiveBattle
+	}{
+		"liveBattles",
+		lives,
+	}
+	conn.sendMsg(out)
+}
+
+func regSpectate() {
+	regHandler("spectate", MsgHandler(spectate))
+	regHandler("leaveSpectate", MsgHandler(leaveSpectate))
+	regHandler("react", MsgHandler(spectatorReact))
+	regHandler("listLiveBattles", MsgHandler(listLiveBattles))
+}
@@ -2,7 +2,9 @@ package main
 
 import (
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -26,6 +28,49 @@ const (
 	SSDB_MATCH_PORT = 9876
 
 	REDIS_HOST = "localhost:6379"
+
+	Q_ACHIEVEMENT_EVENT = "Q_ACHIEVEMENT_EVENT" //value:achievementEventJson, consumed by match server
+
+	ACHV_STAT_BATTLE_WIN        = "BattleWin"
+	ACHV_STAT_BATTLE_WIN_STREAK = "BattleWinStreak"
+
+	Q_MISSION_EVENT = "Q_MISSION_EVENT" //value:missionEventJson, consumed by match server
+
+	MISSION_EVENT_BATTLE_PLAY     = "BattlePlay"
+	MISSION_EVENT_BATTLE_WIN      = "BattleWin"
+	MISSION_EVENT_BATTLE_COIN_WIN = "BattleCoinWin"
+
+	K_BATTLE_SEASON_ACTIVE     = "K_BATTLE_SEASON_ACTIVE" //value:seasonId, set by match server
+	Z_BATTLE_SEASON            = "Z_BATTLE_SEASON"        //subkey:seasonId score:beginTime, kept by match server
+	Z_BATTLE_SEASON_POINT      = "Z_BATTLE_SEASON_POINT"  //key:Z_BATTLE_SEASON_POINT/seasonId subkey:userId score:seasonPoint
+	H_BATTLE_SEASON_CARRY      = "H_BATTLE_SEASON_CARRY"  //key:H_BATTLE_SEASON_CARRY/seasonId subkey:userId value:pointsCarried, written when match server settles
+	PLAYER_BATTLE_SEASON_ID    = "BattleSeasonId"
+	PLAYER_BATTLE_SEASON_POINT = "BattleSeasonPoint"
+
+	Z_PLAYER_FOLLOW = "Z_PLAYER_FOLLOW" //key:Z_PLAYER_FOLLOW/userId subkey:userId score:time, kept by match server
+
+	//same records as the match server keeps, see match/ecoMonitor.go
+	H_ECO_RECORD        = "H_ECO_RECORD" //subkey:ecoRecordId value:ecoRecordJson
+	ECO_RECORD_SERIAL   = "ECO_RECORD_SERIAL"
+	H_SERIAL            = "hSerial"             //subkey:serialName value:lastSerial
+	Z_ECO_PLAYER_MON    = "Z_ECO_PLAYER_MON"    //key:Z_ECO_PLAYER_MON/playerId subkey:ecoRecordId score:time
+	H_ECO_DAILY_COUNTER = "H_ECO_DAILY_COUNTER" //key:H_ECO_DAILY_COUNTER/date subkey:whatCounter value:count*100
+
+	ECO_FORWHAT_BATTLE_BET    = "battle bet coin-"
+	ECO_FORWHAT_BATTLE_PAYOUT = "battle payout coin+"
+	ECO_FORWHAT_BATTLE_REFUND = "battle refund coin+"
+
+	ECO_DAILY_COUNTER_BATTLE_BET    = "ECO_DAILY_COUNTER_BATTLE_BET"
+	ECO_DAILY_COUNTER_BATTLE_PAYOUT = "ECO_DAILY_COUNTER_BATTLE_PAYOUT"
+	ECO_DAILY_COUNTER_BATTLE_REFUND = "ECO_DAILY_COUNTER_BATTLE_REFUND"
+)
+
+var (
+	ECO_DAILY_COUNTERS = map[string]string{
+		ECO_FORWHAT_BATTLE_BET:    ECO_DAILY_COUNTER_BATTLE_BET,
+		ECO_FORWHAT_BATTLE_PAYOUT: ECO_DAILY_COUNTER_BATTLE_PAYOUT,
+		ECO_FORWHAT_BATTLE_REFUND: ECO_DAILY_COUNTER_BATTLE_REFUND,
+	}
 )
 
 var (
@@ -40,15 +85,15 @@ func initRedisAndSsdb() {
 		MaxActive:   0,
 		IdleTimeout: 240 * time.Second,
 		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", REDIS_HOST)
+			c, err := redis.Dial("tcp", *redisAddr)
 			if err != nil {
 				return nil, err
 			}
 			return c, err
 		},
 	}
-	ssdbAuthPool = ssdbgo.NewPool("localhost", SSDB_AUTH_PORT, 10, 60)
-	ssdbMatchPool = ssdbgo.NewPool("localhost", SSDB_MATCH_PORT, 10, 60)
+	ssdbAuthPool = ssdbgo.NewPool("localhost", *ssdbAuthPort, 10, 60)
+	ssdbMatchPool = ssdbgo.NewPool("localhost", *ssdbMatchPort, 10, 60)
 }
 
 func genUUID() string {
@@ -68,3 +113,156 @@ func getBattleHeartNum(playerInfo *PlayerInfo) int {
 	}
 	return heartNum
 }
+
+func pushAchievementEvent(ssdbc *ssdbgo.Client, userId int64, stat string, value int, isMax bool) error {
+	event := struct {
+		UserId int64
+		Stat   string
+		Value  int
+		IsMax  bool
+	}{
+		userId,
+		stat,
+		value,
+		isMax,
+	}
+	js, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = ssdbc.Do("qpush_back", Q_ACHIEVEMENT_EVENT, js)
+	return err
+}
+
+func pushMissionEvent(ssdbc *ssdbgo.Client, userId int64, event string, count int) error {
+	ev := struct {
+		UserId int64
+		Event  string
+		Count  int
+	}{
+		userId,
+		event,
+		count,
+	}
+	js, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = ssdbc.Do("qpush_back", Q_MISSION_EVENT, js)
+	return err
+}
+
+//0 if no season is running
+func getActiveBattleSeasonId(ssdbc *ssdbgo.Client) (int64, error) {
+	resp, err := ssdbc.Do("get", K_BATTLE_SEASON_ACTIVE)
+	if err != nil {
+		return 0, err
+	}
+	if resp[0] != "ok" {
+		return 0, nil
+	}
+	return strconv.ParseInt(resp[1], 10, 64)
+}
+
+//a player's first points in a season start from what the season before carried over for them,
+//nothing is carried past a season they skipped
+func addBattleSeasonPoint(ssdbc *ssdbgo.Client, seasonId int64, userId int64, add int) (int, error) {
+	key := makePlayerInfoKey(userId)
+	resp, err := ssdbc.Do("hget", key, PLAYER_BATTLE_SEASON_ID)
+	if err != nil {
+		return 0, err
+	}
+	if resp[0] != "ok" || resp[1] != strconv.FormatInt(seasonId, 10) {
+		carry, err := getBattleSeasonCarry(ssdbc, seasonId, userId)
+		if err != nil {
+			return 0, err
+		}
+		resp, err = ssdbc.Do("multi_hset", key, PLAYER_BATTLE_SEASON_ID, seasonId, PLAYER_BATTLE_SEASON_POINT, carry)
+		if err != nil || resp[0] != "ok" {
+			return 0, fmt.Errorf("multi_hset error:%v", err)
+		}
+	}
+
+	resp, err = ssdbc.Do("hincr", key, PLAYER_BATTLE_SEASON_POINT, add)
+	if err != nil || resp[0] != "ok" {
+		return 0, fmt.Errorf("hincr error:%v", err)
+	}
+	point, err := strconv.Atoi(resp[1])
+	if err != nil {
+		return 0, err
+	}
+
+	zKey := fmt.Sprintf("%s/%d", Z_BATTLE_SEASON_POINT, seasonId)
+	resp, err = ssdbc.Do("zset", zKey, userId, point)
+	if err != nil || resp[0] != "ok" {
+		return 0, fmt.Errorf("zset error:%v", err)
+	}
+	return point, nil
+}
+
+//the points the season that began just before seasonId carried over for the player, 0 if none
+func getBattleSeasonCarry(ssdbc *ssdbgo.Client, seasonId int64, userId int64) (int, error) {
+	resp, err := ssdbc.Do("zget", Z_BATTLE_SEASON, seasonId)
+	if err != nil {
+		return 0, err
+	}
+	if resp[0] != "ok" {
+		return 0, nil
+	}
+	resp, err = ssdbc.Do("zrscan", Z_BATTLE_SEASON, seasonId, resp[1], "", 1)
+	if err != nil {
+		return 0, err
+	}
+	if resp[0] != "ok" || len(resp) < 3 {
+		return 0, nil
+	}
+
+	resp, err = ssdbc.Do("hget", fmt.Sprintf("%s/%s", H_BATTLE_SEASON_CARRY, resp[1]), userId)
+	if err != nil {
+		return 0, err
+	}
+	if resp[0] != "ok" {
+		return 0, nil
+	}
+	return strconv.Atoi(resp[1])
+}
+
+func addEcoRecord(ssdbc *ssdbgo.Client, userId int64, count int, forWhat string) error {
+	resp, err := ssdbc.Do("hincr", H_SERIAL, ECO_RECORD_SERIAL, 1)
+	if err != nil || resp[0] != "ok" {
+		return fmt.Errorf("hincr error:%v", err)
+	}
+	id := resp[1]
+	now := time.Now()
+
+	record := struct {
+		UserId  int64
+		Count   int
+		ForWhat string
+		Time    int64
+	}{
+		userId,
+		count,
+		forWhat,
+		now.Unix(),
+	}
+	js, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	_, err = ssdbc.Do("hset", H_ECO_RECORD, id, js)
+	if err != nil {
+		return err
+	}
+	_, err = ssdbc.Do("zset", fmt.Sprintf("%s/%d", Z_ECO_PLAYER_MON, userId), id, record.Time)
+	if err != nil {
+		return err
+	}
+
+	if counter, ok := ECO_DAILY_COUNTERS[forWhat]; ok {
+		key := fmt.Sprintf("%s/%s", H_ECO_DAILY_COUNTER, now.Format("2006-01-02"))
+		_, err = ssdbc.Do("hincr", key, counter, count*100)
+	}
+	return err
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"./ssdb"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+const (
+	H_ACHIEVEMENT_STAT   = "H_ACHIEVEMENT_STAT"   //key:H_ACHIEVEMENT_STAT/userId subkey:stat value:count
+	H_ACHIEVEMENT_UNLOCK = "H_ACHIEVEMENT_UNLOCK" //key:H_ACHIEVEMENT_UNLOCK/userId subkey:achievementId value:unlockCount
+	Z_ACHIEVEMENT        = "Z_ACHIEVEMENT"        //key:Z_ACHIEVEMENT/userId subkey:achievementId score:unlockTime
+	Q_ACHIEVEMENT_EVENT  = "Q_ACHIEVEMENT_EVENT"  //value:achievementEventJson, pushed by battle server
+
+	ACHIEVEMENT_EVENT_BATCH = 100
+	ACHIEVEMENT_LIST_LIMIT  = 1000
+)
+
+//achievement stats
+const (
+	ACHV_STAT_FINISH            = "Finish"
+	ACHV_STAT_FIRST_PLACE       = "FirstPlace"
+	ACHV_STAT_PUBLISH           = "Publish"
+	ACHV_STAT_BATTLE_WIN        = "BattleWin"
+	ACHV_STAT_BATTLE_WIN_STREAK = "BattleWinStreak"
+	ACHV_STAT_PLAY_DAY_STREAK   = "PlayDayStreak"
+
+	//bookkeeping for PlayDayStreak
+	ACHV_STAT_LAST_PLAY_DAY    = "LastPlayDay"
+	ACHV_STAT_CURR_PLAY_STREAK = "CurrPlayDayStreak"
+)
+
+//loaded from conf
+type AchievementDef struct {
+	Id         string
+	Title      string
+	Text       string
+	Icon       string
+	Stat       string
+	Goal       int
+	RewardCoin int
+}
+
+type AchievementEvent struct {
+	UserId int64
+	Stat   string
+	Value  int
+	IsMax  bool //stat = max(stat, Value), otherwise stat += Value
+}
+
+type PlayerAchievement struct {
+	AchievementDef
+	Progress   int
+	Unlocked   bool
+	UnlockTime int64
+}
+
+func _glogAchievement() {
+	glog.Info("")
+}
+
+func makeHAchievementStatKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", H_ACHIEVEMENT_STAT, userId)
+}
+
+func makeHAchievementUnlockKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", H_ACHIEVEMENT_UNLOCK, userId)
+}
+
+func makeZAchievementKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", Z_ACHIEVEMENT, userId)
+}
+
+func addAchievementStat(ssdbc *ssdb.Client, userId int64, stat string, n int) {
+	key := makeHAchievementStatKey(userId)
+	resp, err := ssdbc.Do("hincr", key, stat, n)
+	lwutil.CheckSsdbError(resp, err)
+	value, err := strconv.Atoi(resp[1])
+	lwutil.CheckError(err, "err_strconv")
+
+	checkAchievements(ssdbc, userId, stat, value)
+}
+
+func setAchievementStatMax(ssdbc *ssdb.Client, userId int64, stat string, value int) {
+	key := makeHAchievementStatKey(userId)
+	resp, err := ssdbc.Do("hget", key, stat)
+	lwutil.CheckError(err, "")
+	if resp[0] == "ok" {
+		old, err := strconv.Atoi(resp[1])
+		lwutil.CheckError(err, "err_strconv")
+		if old >= value {
+			return
+		}
+	}
+
+	resp, err = ssdbc.Do("hset", key, stat, value)
+	lwutil.CheckSsdbError(resp, err)
+
+	checkAchievements(ssdbc, userId, stat, value)
+}
+
+//days played in a row, counted on the server calendar
+func addAchievementPlayDay(ssdbc *ssdb.Client, userId int64) {
+	today := makeDayIndex(lwutil.GetRedisTimeUnix(), SERVER_TZ_OFFSET_SEC)
+
+	key := makeHAchievementStatKey(userId)
+	resp, err := ssdbc.Do("multi_hget", key, ACHV_STAT_LAST_PLAY_DAY, ACHV_STAT_CURR_PLAY_STREAK)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	lastDay := int64(0)
+	streak := 0
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		if resp[i*2] == ACHV_STAT_LAST_PLAY_DAY {
+			lastDay, err = strconv.ParseInt(resp[i*2+1], 10, 64)
+		} else if resp[i*2] == ACHV_STAT_CURR_PLAY_STREAK {
+			streak, err = strconv.Atoi(resp[i*2+1])
+		}
+		lwutil.CheckError(err, "err_strconv")
+	}
+
+	if lastDay == today {
+		return
+	} else if lastDay == today-1 {
+		streak++
+	} else {
+		streak = 1
+	}
+
+	resp, err = ssdbc.Do("multi_hset", key, ACHV_STAT_LAST_PLAY_DAY, today, ACHV_STAT_CURR_PLAY_STREAK, streak)
+	lwutil.CheckSsdbError(resp, err)
+
+	setAchievementStatMax(ssdbc, userId, ACHV_STAT_PLAY_DAY_STREAK, streak)
+}
+
+func checkAchievements(ssdbc *ssdb.Client, userId int64, stat string, value int) {
+	for _, def := range _conf.Achievements {
+		if def.Stat == stat && value >= def.Goal {
+			unlockAchievement(ssdbc, userId, &def)
+		}
+	}
+}
+
+//safe to call repeatedly, only the first call unlocks and rewards
+func unlockAchievement(ssdbc *ssdb.Client, userId int64, def *AchievementDef) {
+	key := makeHAchievementUnlockKey(userId)
+	resp, err := ssdbc.Do("hincr", key, def.Id, 1)
+	lwutil.CheckSsdbError(resp, err)
+	if resp[1] != "1" {
+		return
+	}
+
+	now := lwutil.GetRedisTimeUnix()
+	key = makeZAchievementKey(userId)
+	resp, err = ssdbc.Do("zset", key, def.Id, now)
+	lwutil.CheckSsdbError(resp, err)
+
+	if def.RewardCoin > 0 {
+		playerKey := makePlayerInfoKey(userId)
+		addPlayerGoldCoin(ssdbc, playerKey, def.RewardCoin)
+		addEcoRecord(ssdbc, userId, def.RewardCoin, ECO_FORWHAT_ACHIEVEMENT)
+	}
+}
+
+func listUnlockedAchievementIds(ssdbc *ssdb.Client, userId int64) []string {
+	key := makeZAchievementKey(userId)
+	resp, err := ssdbc.Do("zscan", key, "", "", "", ACHIEVEMENT_LIST_LIMIT)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	ids := make([]string, 0, num)
+	for i := 0; i < num; i++ {
+		ids = append(ids, resp[i*2])
+	}
+	return ids
+}
+
+//events from other servers
+func achievementCron() {
+	defer handleError()
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	checkError(err)
+	defer ssdbc.Close()
+
+	for true {
+		if applyAchievementEvents(ssdbc) < ACHIEVEMENT_EVENT_BATCH {
+			break
+		}
+	}
+}
+
+//applies a batch from the front of the queue, whatever was applied is trimmed even if an event fails
+func applyAchievementEvents(ssdbc *ssdb.Client) int {
+	resp, err := ssdbc.Do("qrange", Q_ACHIEVEMENT_EVENT, 0, ACHIEVEMENT_EVENT_BATCH)
+	checkError(err)
+	if resp[0] != "ok" {
+		return 0
+	}
+	resp = resp[1:]
+
+	applied := 0
+	defer func() {
+		if applied > 0 {
+			_, err := ssdbc.Do("qtrim_front", Q_ACHIEVEMENT_EVENT, applied)
+			if err != nil {
+				glog.Errorf("qtrim_front Q_ACHIEVEMENT_EVENT error:%v", err)
+			}
+		}
+	}()
+
+	for _, v := range resp {
+		var event AchievementEvent
+		err = json.Unmarshal([]byte(v), &event)
+		if err != nil {
+			glog.Errorf("bad achievement event:%s", v)
+			applied++
+			continue
+		}
+		if event.IsMax {
+			setAchievementStatMax(ssdbc, event.UserId, event.Stat, event.Value)
+		} else {
+			addAchievementStat(ssdbc, event.UserId, event.Stat, event.Value)
+		}
+		applied++
+	}
+	return len(resp)
+}
+
+func apiPlayerListAchievement(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		UserId int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.UserId == 0 {
+		in.UserId = session.Userid
+	}
+
+	//stats
+	stats := map[string]int{}
+	key := makeHAchievementStatKey(in.UserId)
+	resp, err := ssdbc.Do("hgetall", key)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		stats[resp[i*2]], err = strconv.Atoi(resp[i*2+1])
+		lwutil.CheckError(err, "err_strconv")
+	}
+
+	//unlocks
+	unlockTimes := map[string]int64{}
+	key = makeZAchievementKey(in.UserId)
+	resp, err = ssdbc.Do("zscan", key, "", "", "", ACHIEVEMENT_LIST_LIMIT)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+	num = len(resp) / 2
+	for i := 0; i < num; i++ {
+		unlockTimes[resp[i*2]], err = strconv.ParseInt(resp[i*2+1], 10, 64)
+		lwutil.CheckError(err, "err_strconv")
+	}
+
+	//out
+	achievements := make([]PlayerAchievement, 0, len(_conf.Achievements))
+	for _, def := range _conf.Achievements {
+		var achievement PlayerAchievement
+		achievement.AchievementDef = def
+		achievement.Progress = stats[def.Stat]
+		achievement.UnlockTime, achievement.Unlocked = unlockTimes[def.Id]
+		if achievement.Progress > def.Goal || achievement.Unlocked {
+			achievement.Progress = def.Goal
+		}
+		achievements = append(achievements, achievement)
+	}
+
+	lwutil.WriteResponse(w, achievements)
+}
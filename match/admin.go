@@ -311,6 +311,9 @@ func apiAdminDelMatch(w http.ResponseWriter, r *http.Request) {
 	resp, err = ssdbc.Do("zdel", Z_HOT_MATCH, in.MatchId)
 	lwutil.CheckSsdbError(resp, err)
 
+	resp, err = ssdbc.Do("zdel", Z_MATCH_DIFFICULTY, in.MatchId)
+	lwutil.CheckSsdbError(resp, err)
+
 	key := makeZPlayerMatchKey(match.OwnerId)
 	resp, err = ssdbc.Do("zdel", key, in.MatchId)
 	lwutil.CheckSsdbError(resp, err)
@@ -1,67 +1,327 @@
 package main
 
 import (
-	"github.com/golang/glog"
-	"github.com/henyouqian/lwutil"
+	"./ssdb"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
 )
 
 func battleGlog() {
 	glog.Info("")
 }
 
+//the room catalog is kept here and read by every battle node.
+//battle nodes report how many players wait and play in each room, with the 1v1 queues in redis.
 const (
 	BATTLE_PACK_USER  = "uuid/9DA924BB-6327-4C8A-BA4D-B010765478CD"
-	BATTLE_PACKID_SET = "BATTLE_PACKID_SET"
+	BATTLE_PACKID_SET = "BATTLE_PACKID_SET" //redis, members:packId, the battle pool
+
+	H_BATTLE_ROOM       = "H_BATTLE_ROOM"       //subkey:roomName value:battleRoomJson
+	BATTLE_NODE_SET     = "BATTLE_NODE_SET"     //redis, members:nodeId, kept by battle nodes
+	H_BATTLE_ROOM_COUNT = "H_BATTLE_ROOM_COUNT" //redis, key:H_BATTLE_ROOM_COUNT/nodeId subkey:roomName/Waiting|Playing value:num
+	H_BATTLE_QUEUE      = "H_BATTLE_QUEUE"      //redis, key:H_BATTLE_QUEUE/roomName subkey:userId
+
+	BATTLE_ROOM_NAME_MAX   = 32
+	BATTLE_ROOM_PRIVATE    = "private" //battle nodes use it for invite code rooms
+	BATTLE_ROOM_PLAYER_MAX = 8         //2 is a 1v1 room, 3 up to this a race
 )
 
 type BattleRoom struct {
-	Name      string
-	Title     string
-	BetCoin   int
-	PlayerNum int
+	Name         string
+	Title        string
+	BetCoin      int
+	PlayerNum    int //waiting and playing, filled in roomList
+	HeartCost    int
+	SliderNumMin int
+	SliderNumMax int
+	PlayerMin    int
+	PlayerMax    int
+	OpenHour     int //open from OpenHour to CloseHour local time, always open if equal
+	CloseHour    int
+	Order        int
+	Disabled     bool
+	WaitingNum   int
+	PlayingNum   int
+	IsOpen       bool
 }
 
 var (
-	BATTLE_ROOM_LIST = []BattleRoom{
-		// {"free", "不毛之地", 0, 0},
-		// {"coin1", "苏堤春晓", 1, 0},
-		// {"coin2", "曲院风荷", 2, 0},
-		// {"coin5", "平湖秋月", 5, 0},
-		// {"coin10", "断桥残雪", 10, 0},
-		// {"coin20", "柳浪闻莺", 20, 0},
-		{"free", "无座", 0, 0},
-		{"coin1", "硬座", 1, 0},
-		{"coin2", "软座", 2, 0},
-		{"coin5", "硬卧", 5, 0},
-		{"coin10", "软卧", 10, 0},
-		{"coin20", "高级软卧", 20, 0},
+	DEFAULT_BATTLE_ROOMS = []BattleRoom{
+		{Name: "free", Title: "无座", HeartCost: 1},
+		{Name: "coin1", Title: "硬座", BetCoin: 1},
+		{Name: "coin2", Title: "软座", BetCoin: 2},
+		{Name: "coin5", Title: "硬卧", BetCoin: 5},
+		{Name: "coin10", Title: "软卧", BetCoin: 10},
+		{Name: "coin20", Title: "高级软卧", BetCoin: 20},
+		{Name: "race0", Title: "拼车", HeartCost: 1, PlayerMin: 3, PlayerMax: 8},
+		{Name: "race2", Title: "大巴", BetCoin: 2, PlayerMin: 3, PlayerMax: 8},
+		{Name: "race5", Title: "专列", BetCoin: 5, PlayerMin: 3, PlayerMax: 8},
 	}
 )
 
+type ByRoomOrder []BattleRoom
+
+func (a ByRoomOrder) Len() int      { return len(a) }
+func (a ByRoomOrder) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a ByRoomOrder) Less(i, j int) bool {
+	if a[i].Order != a[j].Order {
+		return a[i].Order < a[j].Order
+	}
+	return a[i].Name < a[j].Name
+}
+
+func (room *BattleRoom) fillDefaults() {
+	if room.SliderNumMin <= 0 {
+		room.SliderNumMin = 3
+	}
+	if room.SliderNumMax < room.SliderNumMin {
+		room.SliderNumMax = room.SliderNumMin
+	}
+	if room.PlayerMin < 2 {
+		room.PlayerMin = 2
+	}
+	if room.PlayerMax < room.PlayerMin {
+		room.PlayerMax = room.PlayerMin
+	}
+}
+
+func (room *BattleRoom) isOpen(now time.Time) bool {
+	if room.Disabled {
+		return false
+	}
+	if room.OpenHour == room.CloseHour {
+		return true
+	}
+	hour := now.Hour()
+	if room.OpenHour < room.CloseHour {
+		return hour >= room.OpenHour && hour < room.CloseHour
+	}
+	return hour >= room.OpenHour || hour < room.CloseHour
+}
+
+func initBattleRooms() {
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	resp, err := ssdbc.Do("hsize", H_BATTLE_ROOM)
+	lwutil.CheckSsdbError(resp, err)
+	if resp[1] != "0" {
+		return
+	}
+
+	for i, room := range DEFAULT_BATTLE_ROOMS {
+		room.Order = i
+		room.fillDefaults()
+		saveBattleRoom(ssdbc, &room)
+	}
+}
+
+func saveBattleRoom(ssdbc *ssdb.Client, room *BattleRoom) {
+	room.PlayerNum, room.WaitingNum, room.PlayingNum, room.IsOpen = 0, 0, 0, false
+	js, err := json.Marshal(room)
+	lwutil.CheckError(err, "err_json")
+	resp, err := ssdbc.Do("hset", H_BATTLE_ROOM, room.Name, js)
+	lwutil.CheckSsdbError(resp, err)
+}
+
+func getBattleRooms(ssdbc *ssdb.Client) []BattleRoom {
+	resp, err := ssdbc.Do("hgetall", H_BATTLE_ROOM)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	rooms := make([]BattleRoom, 0, num)
+	for i := 0; i < num; i++ {
+		var room BattleRoom
+		err = json.Unmarshal([]byte(resp[i*2+1]), &room)
+		lwutil.CheckError(err, "err_json")
+		rooms = append(rooms, room)
+	}
+	sort.Sort(ByRoomOrder(rooms))
+	return rooms
+}
+
+//summed over the live battle nodes, 1v1 waiting players are counted from the shared queues
+func fillBattleRoomCounts(rooms []BattleRoom) {
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	waiting := map[string]int{}
+	playing := map[string]int{}
+
+	nodes, err := redis.Strings(rc.Do("SMEMBERS", BATTLE_NODE_SET))
+	lwutil.CheckError(err, "")
+	for _, node := range nodes {
+		strs, err := redis.Strings(rc.Do("HGETALL", fmt.Sprintf("%s/%s", H_BATTLE_ROOM_COUNT, node)))
+		lwutil.CheckError(err, "")
+		for i := 0; i+1 < len(strs); i += 2 {
+			n, err := strconv.Atoi(strs[i+1])
+			if err != nil {
+				continue
+			}
+			if strings.HasSuffix(strs[i], "/Waiting") {
+				waiting[strings.TrimSuffix(strs[i], "/Waiting")] += n
+			} else if strings.HasSuffix(strs[i], "/Playing") {
+				playing[strings.TrimSuffix(strs[i], "/Playing")] += n
+			}
+		}
+	}
+
+	now := time.Now()
+	for i := range rooms {
+		room := &rooms[i]
+		room.WaitingNum = waiting[room.Name]
+		if room.PlayerMax <= 2 {
+			n, err := redis.Int(rc.Do("HLEN", fmt.Sprintf("%s/%s", H_BATTLE_QUEUE, room.Name)))
+			lwutil.CheckError(err, "")
+			room.WaitingNum += n
+		}
+		room.PlayingNum = playing[room.Name]
+		room.PlayerNum = room.WaitingNum + room.PlayingNum
+		room.IsOpen = room.isOpen(now)
+	}
+}
+
 func apiBattleRoomList(w http.ResponseWriter, r *http.Request) {
 	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
 
 	//session
-	_, err := findSession(w, r, nil)
+	_, err = findSession(w, r, nil)
 	lwutil.CheckError(err, "err_auth")
 
+	//
+	rooms := getBattleRooms(ssdbc)
+	out := make([]BattleRoom, 0, len(rooms))
+	for _, room := range rooms {
+		if !room.Disabled {
+			out = append(out, room)
+		}
+	}
+	fillBattleRoomCounts(out)
+
 	//out
-	lwutil.WriteResponse(w, BATTLE_ROOM_LIST)
+	lwutil.WriteResponse(w, out)
 }
 
-func updateBattleRoomPlayerNumTask() {
-	for true {
-		time.Sleep(1 * time.Minute)
-		idxMap := make(map[string]int)
-		for i, v := range BATTLE_ROOM_LIST {
-			idxMap[v.Name] = i
-		}
+//disabled rooms included
+func apiBattleListAllRooms(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//
+	rooms := getBattleRooms(ssdbc)
+	fillBattleRoomCounts(rooms)
+
+	//out
+	lwutil.WriteResponse(w, rooms)
+}
+
+//adds or replaces a room, battle nodes pick it up on their next reload
+func apiBattleSetRoom(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in BattleRoom
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.Name == "" || len(in.Name) > BATTLE_ROOM_NAME_MAX || strings.Contains(in.Name, "/") || in.Name == BATTLE_ROOM_PRIVATE {
+		lwutil.SendError("err_name", "")
+	}
+	if in.BetCoin < 0 || in.HeartCost < 0 {
+		lwutil.SendError("err_cost", "")
+	}
+	if in.OpenHour < 0 || in.OpenHour > 23 || in.CloseHour < 0 || in.CloseHour > 23 {
+		lwutil.SendError("err_hour", "")
 	}
+	in.fillDefaults()
+	if in.PlayerMax > BATTLE_ROOM_PLAYER_MAX {
+		lwutil.SendError("err_player_num", fmt.Sprintf("PlayerMax 3-%d for races", BATTLE_ROOM_PLAYER_MAX))
+	}
+
+	saveBattleRoom(ssdbc, &in)
+
+	//out
+	lwutil.WriteResponse(w, in)
+}
+
+func apiBattleDelRoom(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		Name string
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	resp, err := ssdbc.Do("hdel", H_BATTLE_ROOM, in.Name)
+	lwutil.CheckSsdbError(resp, err)
+
+	//battle nodes tell their waiting players at the next room reload, records of gone players go now
+	rc := redisPool.Get()
+	defer rc.Close()
+	_, err = rc.Do("DEL", fmt.Sprintf("%s/%s", H_BATTLE_QUEUE, in.Name))
+	lwutil.CheckError(err, "err_redis")
+
+	//out
+	lwutil.WriteResponse(w, in)
 }
 
 func regBattle() {
 	http.Handle("/battle/roomList", lwutil.ReqHandler(apiBattleRoomList))
-	//go updateBattleRoomPlayerNumTask()
+	http.Handle("/battle/listAllRooms", lwutil.ReqHandler(apiBattleListAllRooms))
+	http.Handle("/battle/setRoom", lwutil.ReqHandler(apiBattleSetRoom))
+	http.Handle("/battle/delRoom", lwutil.ReqHandler(apiBattleDelRoom))
 }
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+//battle nodes filter talk with the blocklist kept here and file reports of abusive foes with the transcript.
+//reports stay in the open list until an admin dismisses them or bans the reported player from free text chat.
+const (
+	K_BATTLE_CHAT_FILTER = "K_BATTLE_CHAT_FILTER" //value:chatFilterJson
+	H_BATTLE_CHAT        = "H_BATTLE_CHAT"        //subkey:battleId value:chatLinesJson, written by battle nodes
+	H_BATTLE_CHAT_REPORT = "H_BATTLE_CHAT_REPORT" //subkey:reportId value:chatReportJson, written by battle nodes
+	Z_BATTLE_CHAT_REPORT = "Z_BATTLE_CHAT_REPORT" //subkey:reportId score:time, open reports only
+
+	PLAYER_BATTLE_CHAT_BAN_UNTIL = "BattleChatBanUntil" //in H_PLAYER_INFO, unix time
+
+	BATTLE_CHAT_REPORT_LIST_LIMIT = 50
+	BATTLE_CHAT_BAN_HOURS_MAX     = 24 * 365
+)
+
+type BattleChatFilter struct {
+	Words    []string
+	Patterns []string
+	Variants map[string]string //single runes, variant to canonical
+}
+
+type BattleChatLine struct {
+	UserId int64
+	Text   string
+	Quick  string `json:",omitempty"`
+	Note   string `json:",omitempty"`
+	Time   int64
+}
+
+type BattleChatReport struct {
+	Id         int64
+	BattleId   string
+	UserId     int64
+	FoeUserId  int64
+	Reason     string
+	Time       int64
+	Transcript []BattleChatLine
+	Resolution string `json:",omitempty"` //dismiss, ban
+	BanUntil   int64  `json:",omitempty"`
+	ResolvedBy int64  `json:",omitempty"`
+}
+
+func _glogBattleChat() {
+	glog.Info("")
+}
+
+func apiBattleGetChatFilter(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//
+	filter := BattleChatFilter{
+		Words:    []string{},
+		Patterns: []string{},
+		Variants: map[string]string{},
+	}
+	resp, err := ssdbc.Do("get", K_BATTLE_CHAT_FILTER)
+	lwutil.CheckError(err, "")
+	if resp[0] == "ok" {
+		err = json.Unmarshal([]byte(resp[1]), &filter)
+		lwutil.CheckError(err, "err_json")
+	}
+
+	//out
+	lwutil.WriteResponse(w, filter)
+}
+
+//battle nodes pick it up within half a minute
+func apiBattleSetChatFilter(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in BattleChatFilter
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//a broken filter would be kept out by every node, catch it here
+	for _, pattern := range in.Patterns {
+		if _, err = regexp.Compile(pattern); err != nil {
+			lwutil.SendError("err_pattern", pattern)
+		}
+	}
+	for k, v := range in.Variants {
+		if utf8.RuneCountInString(k) != 1 || utf8.RuneCountInString(v) != 1 {
+			lwutil.SendError("err_variant", fmt.Sprintf("%s:%s", k, v))
+		}
+	}
+
+	js, err := json.Marshal(in)
+	lwutil.CheckError(err, "err_json")
+	resp, err := ssdbc.Do("set", K_BATTLE_CHAT_FILTER, js)
+	lwutil.CheckSsdbError(resp, err)
+
+	//out
+	lwutil.WriteResponse(w, in)
+}
+
+//oldest first, so reports are handled in order
+func apiBattleListChatReports(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		StartId  string
+		LastTime int64
+		Limit    int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.Limit <= 0 || in.Limit > BATTLE_CHAT_REPORT_LIST_LIMIT {
+		in.Limit = BATTLE_CHAT_REPORT_LIST_LIMIT
+	}
+	startScore := ""
+	if in.StartId != "" {
+		startScore = fmt.Sprint(in.LastTime)
+	}
+
+	resp, err := ssdbc.Do("zscan", Z_BATTLE_CHAT_REPORT, in.StartId, startScore, "", in.Limit)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	out := struct {
+		Reports  []BattleChatReport
+		LastTime int64
+	}{
+		[]BattleChatReport{},
+		0,
+	}
+
+	if len(resp) > 0 {
+		num := len(resp) / 2
+		args := make([]interface{}, 2, num+2)
+		args[0] = "multi_hget"
+		args[1] = H_BATTLE_CHAT_REPORT
+		for i := 0; i < num; i++ {
+			args = append(args, resp[i*2])
+			if i == num-1 {
+				out.LastTime, err = strconv.ParseInt(resp[i*2+1], 10, 64)
+				lwutil.CheckError(err, "err_strconv")
+			}
+		}
+		resp, err = ssdbc.Do(args...)
+		lwutil.CheckSsdbError(resp, err)
+		resp = resp[1:]
+
+		num = len(resp) / 2
+		for i := 0; i < num; i++ {
+			var report BattleChatReport
+			err = json.Unmarshal([]byte(resp[i*2+1]), &report)
+			lwutil.CheckError(err, "err_json")
+			out.Reports = append(out.Reports, report)
+		}
+	}
+
+	//out
+	lwutil.WriteResponse(w, out)
+}
+
+//a ban leaves quick chat phrases only, a longer ban already in place is kept
+func apiBattleResolveChatReport(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		ReportId int64
+		Action   string //dismiss, ban
+		BanHours int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.Action != "dismiss" && in.Action != "ban" {
+		lwutil.SendError("err_action", "")
+	}
+	if in.Action == "ban" && (in.BanHours <= 0 || in.BanHours > BATTLE_CHAT_BAN_HOURS_MAX) {
+		lwutil.SendError("err_ban_hours", "")
+	}
+
+	resp, err := ssdbc.Do("hget", H_BATTLE_CHAT_REPORT, in.ReportId)
+	lwutil.CheckSsdbError(resp, err)
+	var report BattleChatReport
+	err = json.Unmarshal([]byte(resp[1]), &report)
+	lwutil.CheckError(err, "err_json")
+	if report.Resolution != "" {
+		lwutil.SendError("err_resolved", "")
+	}
+
+	if in.Action == "ban" {
+		playerKey := makePlayerInfoKey(report.FoeUserId)
+		resp, err = ssdbc.Do("hget", playerKey, PLAYER_BATTLE_CHAT_BAN_UNTIL)
+		lwutil.CheckError(err, "")
+		var banUntil int64
+		if resp[0] == "ok" {
+			banUntil, _ = strconv.ParseInt(resp[1], 10, 64)
+		}
+		report.BanUntil = time.Now().Add(time.Duration(in.BanHours) * time.Hour).Unix()
+		if banUntil > report.BanUntil {
+			report.BanUntil = banUntil
+		}
+		resp, err = ssdbc.Do("hset", playerKey, PLAYER_BATTLE_CHAT_BAN_UNTIL, report.BanUntil)
+		lwutil.CheckSsdbError(resp, err)
+	}
+
+	report.Resolution = in.Action
+	report.ResolvedBy = session.Userid
+	js, err := json.Marshal(report)
+	lwutil.CheckError(err, "err_json")
+	resp, err = ssdbc.Do("hset", H_BATTLE_CHAT_REPORT, report.Id, js)
+	lwutil.CheckSsdbError(resp, err)
+	resp, err = ssdbc.Do("zdel", Z_BATTLE_CHAT_REPORT, report.Id)
+	lwutil.CheckSsdbError(resp, err)
+
+	//out
+	lwutil.WriteResponse(w, report)
+}
+
+func apiBattleGetChatTranscript(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		BattleId string
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	lines := []BattleChatLine{}
+	resp, err := ssdbc.Do("hget", H_BATTLE_CHAT, in.BattleId)
+	lwutil.CheckError(err, "")
+	if resp[0] == "ok" {
+		err = json.Unmarshal([]byte(resp[1]), &lines)
+		lwutil.CheckError(err, "err_json")
+	}
+
+	//out
+	lwutil.WriteResponse(w, lines)
+}
+
+func regBattleChat() {
+	http.Handle("/battle/getChatFilter", lwutil.ReqHandler(apiBattleGetChatFilter))
+	http.Handle("/battle/setChatFilter", lwutil.ReqHandler(apiBattleSetChatFilter))
+	http.Handle("/battle/listChatReports", lwutil.ReqHandler(apiBattleListChatReports))
+	http.Handle("/battle/resolveChatReport", lwutil.ReqHandler(apiBattleResolveChatReport))
+	http.Handle("/battle/getChatTranscript", lwutil.ReqHandler(apiBattleGetChatTranscript))
+}
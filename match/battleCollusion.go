@@ -0,0 +1,728 @@
+package main
+
+import (
+	"./ssdb"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+//coin battles are looked over for win trading: two accounts feeding each other bets and streak bonuses.
+//each new coin battle between two players has their recent battles against each other scored for
+//repeated pairings, wins going one way, lopsided finish times, instant forfeits and shared devices.
+//pairs scoring high enough open a case in the review queue. an admin clears the case or holds both players'
+//payouts, held payouts wait on the battle server side until an admin pays or voids them.
+const (
+	Z_BATTLE_COIN_RECORD   = "Z_BATTLE_COIN_RECORD"   //subkey:battleId score:time, written by battle nodes
+	Z_PLAYER_BATTLE_DEVICE = "Z_PLAYER_BATTLE_DEVICE" //key:Z_PLAYER_BATTLE_DEVICE/userId subkey:deviceId score:time, written by battle nodes
+	H_BATTLE_PAYOUT_HOLD   = "H_BATTLE_PAYOUT_HOLD"   //subkey:userId value:caseId
+	H_BATTLE_HELD_PAYOUT   = "H_BATTLE_HELD_PAYOUT"   //subkey:battleId/userId value:escrowJson, written by battle nodes
+	Z_BATTLE_HELD_PAYOUT   = "Z_BATTLE_HELD_PAYOUT"   //subkey:battleId/userId score:time
+
+	K_BATTLE_COLLUSION_CURSOR  = "K_BATTLE_COLLUSION_CURSOR"  //value:collusionCursorJson
+	H_BATTLE_COLLUSION_CASE    = "H_BATTLE_COLLUSION_CASE"    //subkey:lowUserId/highUserId value:collusionCaseJson
+	Z_BATTLE_COLLUSION_CASE    = "Z_BATTLE_COLLUSION_CASE"    //subkey:lowUserId/highUserId score:time, open cases only
+	K_BATTLE_HELD_PAYOUT_CLAIM = "K_BATTLE_HELD_PAYOUT_CLAIM" //redis, key:K_BATTLE_HELD_PAYOUT_CLAIM/battleId/userId
+
+	COLLUSION_CASE_OPEN    = "open"
+	COLLUSION_CASE_HELD    = "held"
+	COLLUSION_CASE_CLEARED = "cleared"
+
+	COLLUSION_BATCH          = 200
+	COLLUSION_WINDOW_SEC     = 7 * 24 * 3600
+	COLLUSION_HISTORY_LIMIT  = 200 //records of one player looked at per pair
+	COLLUSION_PAIRING_MIN    = 6
+	COLLUSION_ONE_WAY_RATE   = 0.8
+	COLLUSION_LOPSIDED_RATIO = 3 //loser took this many times the winner's time
+	COLLUSION_LOPSIDED_MIN   = 3
+	COLLUSION_FORFEIT_MSEC   = 15000
+	COLLUSION_FORFEIT_MIN    = 2
+	COLLUSION_FLAG_SCORE     = 3
+	COLLUSION_EVIDENCE_MAX   = 20
+	COLLUSION_LIST_LIMIT     = 50
+	HELD_PAYOUT_CLAIM_TTL    = 24 * 3600
+)
+
+type CollusionSignals struct {
+	Pairings      int
+	OneWayWins    int //wins of whoever won more
+	Lopsided      int
+	Forfeits      int
+	SharedDevices []string
+}
+
+type CollusionCase struct {
+	Id         string
+	UserIds    [2]int64
+	Signals    CollusionSignals
+	Score      int
+	CoinFlow   int //coins won by UserIds[0] from UserIds[1], negative the other way
+	BattleIds  []string
+	FirstTime  int64
+	Time       int64
+	Status     string
+	ReviewedBy int64 `json:",omitempty"`
+	ReviewedAt int64 `json:",omitempty"`
+}
+
+type collusionCursor struct {
+	Id   string
+	Time int64
+}
+
+type heldPayout struct {
+	BattleId string
+	UserId   int64
+	Coin     int
+	NodeId   string
+	Time     int64
+}
+
+func _glogBattleCollusion() {
+	glog.Info("")
+}
+
+func makeCollusionCaseId(userId1, userId2 int64) (string, int64, int64) {
+	if userId1 > userId2 {
+		userId1, userId2 = userId2, userId1
+	}
+	return fmt.Sprintf("%d/%d", userId1, userId2), userId1, userId2
+}
+
+func (s *CollusionSignals) score() int {
+	score := 0
+	if s.Pairings >= COLLUSION_PAIRING_MIN {
+		score += 2
+		if float32(s.OneWayWins) >= float32(s.Pairings)*COLLUSION_ONE_WAY_RATE {
+			score++
+		}
+	}
+	if s.Lopsided >= COLLUSION_LOPSIDED_MIN {
+		score += 2
+	}
+	if s.Forfeits >= COLLUSION_FORFEIT_MIN {
+		score += 2
+	}
+	if len(s.SharedDevices) > 0 {
+		score += 3
+	}
+	return score
+}
+
+func getCollusionCase(ssdbc *ssdb.Client, caseId string) *CollusionCase {
+	resp, err := ssdbc.Do("hget", H_BATTLE_COLLUSION_CASE, caseId)
+	checkError(err)
+	if resp[0] != "ok" {
+		return nil
+	}
+	var c CollusionCase
+	err = json.Unmarshal([]byte(resp[1]), &c)
+	checkError(err)
+	return &c
+}
+
+func saveCollusionCase(ssdbc *ssdb.Client, c *CollusionCase) {
+	js, err := json.Marshal(c)
+	checkError(err)
+	resp, err := ssdbc.Do("hset", H_BATTLE_COLLUSION_CASE, c.Id, js)
+	checkSsdbError(resp, err)
+	if c.Status == COLLUSION_CASE_OPEN {
+		resp, err = ssdbc.Do("zset", Z_BATTLE_COLLUSION_CASE, c.Id, c.Time)
+	} else {
+		resp, err = ssdbc.Do("zdel", Z_BATTLE_COLLUSION_CASE, c.Id)
+	}
+	checkSsdbError(resp, err)
+}
+
+func getBattleRecords(ssdbc *ssdb.Client, battleIds []string) []BattleRecord {
+	records := make([]BattleRecord, 0, len(battleIds))
+	if len(battleIds) == 0 {
+		return records
+	}
+	args := make([]interface{}, 2, len(battleIds)+2)
+	args[0] = "multi_hget"
+	args[1] = H_BATTLE_RECORD
+	for _, battleId := range battleIds {
+		args = append(args, battleId)
+	}
+	resp, err := ssdbc.Do(args...)
+	checkSsdbError(resp, err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		var record BattleRecord
+		err = json.Unmarshal([]byte(resp[i*2+1]), &record)
+		if err != nil {
+			glog.Errorf("battle record %s json error:%v", resp[i*2], err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func getBattleDevices(ssdbc *ssdb.Client, userId int64) map[string]bool {
+	key := fmt.Sprintf("%s/%d", Z_PLAYER_BATTLE_DEVICE, userId)
+	resp, err := ssdbc.Do("zscan", key, "", "", "", 100)
+	checkSsdbError(resp, err)
+	resp = resp[1:]
+
+	devices := map[string]bool{}
+	for i := 0; i < len(resp)/2; i++ {
+		devices[resp[i*2]] = true
+	}
+	return devices
+}
+
+//the two players' coin battles against each other since a time, newest first
+func scoreCollusionPair(ssdbc *ssdb.Client, c *CollusionCase, since int64) {
+	resp, err := ssdbc.Do("zrscan", makeZPlayerBattleRecordKey(c.UserIds[0]), "", "", since, COLLUSION_HISTORY_LIMIT)
+	checkSsdbError(resp, err)
+	resp = resp[1:]
+	battleIds := make([]string, 0, len(resp)/2)
+	for i := 0; i < len(resp)/2; i++ {
+		battleIds = append(battleIds, resp[i*2])
+	}
+
+	var signals CollusionSignals
+	wins := [2]int{}
+	c.CoinFlow = 0
+	c.BattleIds = []string{}
+	for _, record := range getBattleRecords(ssdbc, battleIds) {
+		if record.BetCoin == 0 || record.IsBot || len(record.Players) != 2 {
+			continue
+		}
+		players := record.Players
+		if players[0].UserId != c.UserIds[0] {
+			players[0], players[1] = players[1], players[0]
+		}
+		if players[0].UserId != c.UserIds[0] || players[1].UserId != c.UserIds[1] {
+			continue
+		}
+
+		signals.Pairings++
+		if len(c.BattleIds) < COLLUSION_EVIDENCE_MAX {
+			c.BattleIds = append(c.BattleIds, record.Id)
+		}
+		if c.FirstTime == 0 || record.Time < c.FirstTime {
+			c.FirstTime = record.Time
+		}
+		c.CoinFlow += players[0].CoinAdd
+
+		var winner, loser *BattleRecordPlayer
+		if players[0].Result == "win" {
+			wins[0]++
+			winner, loser = &players[0], &players[1]
+		} else if players[1].Result == "win" {
+			wins[1]++
+			winner, loser = &players[1], &players[0]
+		} else {
+			continue
+		}
+
+		//giving up right away
+		if loser.Disconnected && record.PlayMsec > 0 && record.PlayMsec < COLLUSION_FORFEIT_MSEC {
+			signals.Forfeits++
+		} else if winner.Msec > 0 && loser.Msec > winner.Msec*COLLUSION_LOPSIDED_RATIO {
+			signals.Lopsided++
+		}
+	}
+	signals.OneWayWins = wins[0]
+	if wins[1] > wins[0] {
+		signals.OneWayWins = wins[1]
+	}
+
+	//devices matter only between players who battle each other
+	if signals.Pairings > 0 {
+		devices := getBattleDevices(ssdbc, c.UserIds[0])
+		if len(devices) > 0 {
+			for deviceId := range getBattleDevices(ssdbc, c.UserIds[1]) {
+				if devices[deviceId] {
+					signals.SharedDevices = append(signals.SharedDevices, deviceId)
+				}
+			}
+		}
+	}
+
+	c.Signals = signals
+	c.Score = signals.score()
+}
+
+//a cleared pair is looked at again with battles after the review only
+func reviewCollusionPair(ssdbc *ssdb.Client, userId1, userId2 int64, now int64) {
+	caseId, low, high := makeCollusionCaseId(userId1, userId2)
+	c := getCollusionCase(ssdbc, caseId)
+
+	since := now - COLLUSION_WINDOW_SEC
+	flagged := false
+	if c == nil {
+		c = &CollusionCase{Id: caseId, UserIds: [2]int64{low, high}, Status: COLLUSION_CASE_OPEN}
+		flagged = true
+	} else if c.Status == COLLUSION_CASE_CLEARED {
+		if c.ReviewedAt > since {
+			since = c.ReviewedAt
+		}
+		flagged = true
+	}
+
+	scored := *c
+	scored.FirstTime = 0
+	scoreCollusionPair(ssdbc, &scored, since)
+	if scored.Score < COLLUSION_FLAG_SCORE {
+		return
+	}
+
+	//open and held cases keep their place in the queue, the evidence is refreshed
+	if flagged {
+		scored.Status = COLLUSION_CASE_OPEN
+		scored.Time = now
+		scored.ReviewedBy = 0
+		scored.ReviewedAt = 0
+		glog.Infof("collusion case opened: %s score:%d", caseId, scored.Score)
+	}
+	saveCollusionCase(ssdbc, &scored)
+}
+
+func battleCollusionCron() {
+	defer handleError()
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	checkError(err)
+	defer ssdbc.Close()
+
+	//cursor
+	var cursor collusionCursor
+	resp, err := ssdbc.Do("get", K_BATTLE_COLLUSION_CURSOR)
+	checkError(err)
+	if resp[0] == "ok" {
+		err = json.Unmarshal([]byte(resp[1]), &cursor)
+		checkError(err)
+	}
+	startScore := ""
+	if cursor.Id != "" {
+		startScore = strconv.FormatInt(cursor.Time, 10)
+	}
+
+	resp, err = ssdbc.Do("zscan", Z_BATTLE_COIN_RECORD, cursor.Id, startScore, "", COLLUSION_BATCH)
+	checkSsdbError(resp, err)
+	resp = resp[1:]
+	num := len(resp) / 2
+	if num == 0 {
+		return
+	}
+
+	battleIds := make([]string, 0, num)
+	for i := 0; i < num; i++ {
+		battleIds = append(battleIds, resp[i*2])
+	}
+	cursor.Id = resp[(num-1)*2]
+	cursor.Time, err = strconv.ParseInt(resp[(num-1)*2+1], 10, 64)
+	checkError(err)
+
+	//each pair once per batch
+	now := lwutil.GetRedisTimeUnix()
+	pairs := map[string]bool{}
+	for _, record := range getBattleRecords(ssdbc, battleIds) {
+		if len(record.Players) != 2 || record.Players[0].UserId == 0 || record.Players[1].UserId == 0 {
+			continue
+		}
+		caseId, low, high := makeCollusionCaseId(record.Players[0].UserId, record.Players[1].UserId)
+		if pairs[caseId] {
+			continue
+		}
+		pairs[caseId] = true
+		reviewCollusionPair(ssdbc, low, high, now)
+	}
+
+	js, err := json.Marshal(cursor)
+	checkError(err)
+	resp, err = ssdbc.Do("set", K_BATTLE_COLLUSION_CURSOR, js)
+	checkSsdbError(resp, err)
+}
+
+//oldest first
+func apiBattleListCollusionCases(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		StartId  string
+		LastTime int64
+		Limit    int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.Limit <= 0 || in.Limit > COLLUSION_LIST_LIMIT {
+		in.Limit = COLLUSION_LIST_LIMIT
+	}
+	startScore := ""
+	if in.StartId != "" {
+		startScore = fmt.Sprint(in.LastTime)
+	}
+
+	resp, err := ssdbc.Do("zscan", Z_BATTLE_COLLUSION_CASE, in.StartId, startScore, "", in.Limit)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	out := struct {
+		Cases    []CollusionCase
+		LastTime int64
+	}{
+		[]CollusionCase{},
+		0,
+	}
+
+	if len(resp) > 0 {
+		num := len(resp) / 2
+		args := make([]interface{}, 2, num+2)
+		args[0] = "multi_hget"
+		args[1] = H_BATTLE_COLLUSION_CASE
+		for i := 0; i < num; i++ {
+			args = append(args, resp[i*2])
+			if i == num-1 {
+				out.LastTime, err = strconv.ParseInt(resp[i*2+1], 10, 64)
+				lwutil.CheckError(err, "err_strconv")
+			}
+		}
+		resp, err = ssdbc.Do(args...)
+		lwutil.CheckSsdbError(resp, err)
+		resp = resp[1:]
+
+		num = len(resp) / 2
+		for i := 0; i < num; i++ {
+			var c CollusionCase
+			err = json.Unmarshal([]byte(resp[i*2+1]), &c)
+			lwutil.CheckError(err, "err_json")
+			out.Cases = append(out.Cases, c)
+		}
+	}
+
+	//out
+	lwutil.WriteResponse(w, out)
+}
+
+func apiBattleGetCollusionCase(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		UserId    int64
+		FoeUserId int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	caseId, _, _ := makeCollusionCaseId(in.UserId, in.FoeUserId)
+	c := getCollusionCase(ssdbc, caseId)
+	if c == nil {
+		lwutil.SendError("err_not_found", "")
+	}
+
+	//out
+	out := struct {
+		Case    *CollusionCase
+		Records []BattleRecord
+	}{
+		c,
+		getBattleRecords(ssdbc, c.BattleIds),
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+//clear closes the case and lifts the holds it put, hold stops both players' payouts until cleared
+func apiBattleResolveCollusionCase(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		Id     string
+		Action string //clear, hold
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	c := getCollusionCase(ssdbc, in.Id)
+	if c == nil {
+		lwutil.SendError("err_not_found", "")
+	}
+
+	if in.Action == "hold" {
+		for _, userId := range c.UserIds {
+			resp, err := ssdbc.Do("hset", H_BATTLE_PAYOUT_HOLD, userId, c.Id)
+			lwutil.CheckSsdbError(resp, err)
+		}
+		c.Status = COLLUSION_CASE_HELD
+	} else if in.Action == "clear" {
+		for _, userId := range c.UserIds {
+			resp, err := ssdbc.Do("hget", H_BATTLE_PAYOUT_HOLD, userId)
+			lwutil.CheckError(err, "")
+			if resp[0] == "ok" && resp[1] == c.Id {
+				resp, err = ssdbc.Do("hdel", H_BATTLE_PAYOUT_HOLD, userId)
+				lwutil.CheckSsdbError(resp, err)
+			}
+		}
+		c.Status = COLLUSION_CASE_CLEARED
+	} else {
+		lwutil.SendError("err_action", "")
+	}
+
+	c.ReviewedBy = session.Userid
+	c.ReviewedAt = lwutil.GetRedisTimeUnix()
+	saveCollusionCase(ssdbc, c)
+
+	//out
+	lwutil.WriteResponse(w, c)
+}
+
+//for holds outside the review queue
+func apiBattleSetPayoutHold(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		UserId int64
+		Hold   bool
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.UserId == 0 {
+		lwutil.SendError("err_user_id", "")
+	}
+
+	var resp []string
+	if in.Hold {
+		resp, err = ssdbc.Do("hset", H_BATTLE_PAYOUT_HOLD, in.UserId, "admin")
+	} else {
+		resp, err = ssdbc.Do("hdel", H_BATTLE_PAYOUT_HOLD, in.UserId)
+	}
+	lwutil.CheckSsdbError(resp, err)
+
+	//out
+	lwutil.WriteResponse(w, in)
+}
+
+func apiBattleListHeldPayouts(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		StartId  string
+		LastTime int64
+		Limit    int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.Limit <= 0 || in.Limit > COLLUSION_LIST_LIMIT {
+		in.Limit = COLLUSION_LIST_LIMIT
+	}
+	startScore := ""
+	if in.StartId != "" {
+		startScore = fmt.Sprint(in.LastTime)
+	}
+
+	resp, err := ssdbc.Do("zscan", Z_BATTLE_HELD_PAYOUT, in.StartId, startScore, "", in.Limit)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	out := struct {
+		Payouts  []heldPayout
+		LastTime int64
+	}{
+		[]heldPayout{},
+		0,
+	}
+
+	if len(resp) > 0 {
+		num := len(resp) / 2
+		args := make([]interface{}, 2, num+2)
+		args[0] = "multi_hget"
+		args[1] = H_BATTLE_HELD_PAYOUT
+		for i := 0; i < num; i++ {
+			args = append(args, resp[i*2])
+			if i == num-1 {
+				out.LastTime, err = strconv.ParseInt(resp[i*2+1], 10, 64)
+				lwutil.CheckError(err, "err_strconv")
+			}
+		}
+		resp, err = ssdbc.Do(args...)
+		lwutil.CheckSsdbError(resp, err)
+		resp = resp[1:]
+
+		num = len(resp) / 2
+		for i := 0; i < num; i++ {
+			var p heldPayout
+			err = json.Unmarshal([]byte(resp[i*2+1]), &p)
+			lwutil.CheckError(err, "err_json")
+			out.Payouts = append(out.Payouts, p)
+		}
+	}
+
+	//out
+	lwutil.WriteResponse(w, out)
+}
+
+//pays the held coins to the player or voids them, each payout once
+func apiBattleSettleHeldPayout(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//redis
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		BattleId string
+		UserId   int64
+		Pay      bool
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	key := fmt.Sprintf("%s/%d", in.BattleId, in.UserId)
+	if in.BattleId == "" || strings.Contains(in.BattleId, "/") {
+		lwutil.SendError("err_battle_id", "")
+	}
+
+	//claim, drop the entry, then pay: a failed pay puts the entry back and gives up the claim
+	claimKey := fmt.Sprintf("%s/%s", K_BATTLE_HELD_PAYOUT_CLAIM, key)
+	ok, err := rc.Do("SET", claimKey, session.Userid, "NX", "EX", HELD_PAYOUT_CLAIM_TTL)
+	lwutil.CheckError(err, "")
+	if ok == nil {
+		lwutil.SendError("err_settled", "")
+	}
+
+	resp, err := ssdbc.Do("hget", H_BATTLE_HELD_PAYOUT, key)
+	if err != nil || resp[0] != "ok" {
+		rc.Do("DEL", claimKey)
+		lwutil.CheckError(err, "")
+		if resp[0] == "not_found" {
+			lwutil.SendError("err_settled", "")
+		}
+		lwutil.CheckSsdbError(resp, err)
+	}
+	js := resp[1]
+	var p heldPayout
+	err = json.Unmarshal([]byte(js), &p)
+	if err != nil || p.BattleId != in.BattleId || p.UserId != in.UserId || p.Coin < 0 {
+		rc.Do("DEL", claimKey)
+		lwutil.CheckError(err, "err_json")
+		lwutil.SendError("err_payout", "")
+	}
+
+	resp, err = ssdbc.Do("hdel", H_BATTLE_HELD_PAYOUT, key)
+	if err != nil || resp[0] != "ok" {
+		rc.Do("DEL", claimKey)
+		lwutil.CheckSsdbError(resp, err)
+	}
+	ssdbc.Do("zdel", Z_BATTLE_HELD_PAYOUT, key)
+
+	if in.Pay && p.Coin > 0 {
+		resp, err = ssdbc.Do("hincr", makePlayerInfoKey(p.UserId), PLAYER_GOLD_COIN, p.Coin)
+		if err != nil || resp[0] != "ok" {
+			ssdbc.Do("hset", H_BATTLE_HELD_PAYOUT, key, js)
+			ssdbc.Do("zset", Z_BATTLE_HELD_PAYOUT, key, p.Time)
+			rc.Do("DEL", claimKey)
+			lwutil.CheckSsdbError(resp, err)
+		}
+		err = addEcoRecord(ssdbc, p.UserId, p.Coin, ECO_FORWHAT_BATTLE_PAYOUT)
+		if err != nil {
+			glog.Errorf("addEcoRecord error:%v", err)
+		}
+	}
+
+	glog.Infof("held payout settled: battleId:%s userId:%d coin:%d pay:%v by:%d", p.BattleId, p.UserId, p.Coin, in.Pay, session.Userid)
+
+	//out
+	lwutil.WriteResponse(w, p)
+}
+
+func regBattleCollusion() {
+	http.Handle("/battle/listCollusionCases", lwutil.ReqHandler(apiBattleListCollusionCases))
+	http.Handle("/battle/getCollusionCase", lwutil.ReqHandler(apiBattleGetCollusionCase))
+	http.Handle("/battle/resolveCollusionCase", lwutil.ReqHandler(apiBattleResolveCollusionCase))
+	http.Handle("/battle/setPayoutHold", lwutil.ReqHandler(apiBattleSetPayoutHold))
+	http.Handle("/battle/listHeldPayouts", lwutil.ReqHandler(apiBattleListHeldPayouts))
+	http.Handle("/battle/settleHeldPayout", lwutil.ReqHandler(apiBattleSettleHeldPayout))
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+//battle records and stats are written by the battle server when a battle ends, read only here.
+const (
+	H_BATTLE_RECORD        = "H_BATTLE_RECORD"        //subkey:battleId value:battleRecordJson
+	Z_PLAYER_BATTLE_RECORD = "Z_PLAYER_BATTLE_RECORD" //key:Z_PLAYER_BATTLE_RECORD/userId subkey:battleId score:time
+	H_PLAYER_BATTLE_STAT   = "H_PLAYER_BATTLE_STAT"   //key:H_PLAYER_BATTLE_STAT/userId subkey:roomName/stat value:count
+	H_PLAYER_BATTLE_VS     = "H_PLAYER_BATTLE_VS"     //key:H_PLAYER_BATTLE_VS/userId subkey:foeUserId/result value:count
+
+	BATTLE_HISTORY_LIST_LIMIT = 50
+)
+
+type BattleRecordPlayer struct {
+	UserId       int64 //0 for bots
+	NickName     string
+	Msec         int //0 if not finished
+	Result       string
+	Rank         int //races only
+	CoinAdd      int
+	PointAdd     int
+	Disconnected bool
+}
+
+type BattleRecord struct {
+	Id        string
+	RoomName  string
+	BetCoin   int
+	PackId    int64
+	SliderNum int
+	IsBot     bool
+	Time      int64
+	PlayMsec  int //from start to the result, 0 if it never started
+	Players   []BattleRecordPlayer
+}
+
+type BattleRoomStat struct {
+	RoomName   string
+	Play       int
+	Win        int
+	Draw       int
+	Finish     int
+	MsecSum    int64
+	Disconnect int
+	WinRate    float32
+	AvgMsec    int
+}
+
+func _glogBattleHistory() {
+	glog.Info("")
+}
+
+func makeZPlayerBattleRecordKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", Z_PLAYER_BATTLE_RECORD, userId)
+}
+
+func makeHPlayerBattleStatKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", H_PLAYER_BATTLE_STAT, userId)
+}
+
+func makeHPlayerBattleVsKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", H_PLAYER_BATTLE_VS, userId)
+}
+
+func (stat *BattleRoomStat) add(name string, value int64) {
+	switch name {
+	case "Play":
+		stat.Play += int(value)
+	case "Win":
+		stat.Win += int(value)
+	case "Draw":
+		stat.Draw += int(value)
+	case "Finish":
+		stat.Finish += int(value)
+	case "MsecSum":
+		stat.MsecSum += value
+	case "Disconnect":
+		stat.Disconnect += int(value)
+	}
+}
+
+func (stat *BattleRoomStat) calc() {
+	if stat.Play > 0 {
+		stat.WinRate = float32(stat.Win) / float32(stat.Play)
+	}
+	if stat.Finish > 0 {
+		stat.AvgMsec = int(stat.MsecSum / int64(stat.Finish))
+	}
+}
+
+func apiBattleListHistory(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		UserId   int64
+		StartId  string
+		LastTime int64
+		Limit    int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.UserId == 0 {
+		in.UserId = session.Userid
+	}
+	if in.Limit <= 0 || in.Limit > BATTLE_HISTORY_LIST_LIMIT {
+		in.Limit = BATTLE_HISTORY_LIST_LIMIT
+	}
+
+	startScore := ""
+	if in.StartId != "" {
+		startScore = fmt.Sprint(in.LastTime)
+	}
+
+	//newest first
+	resp, err := ssdbc.Do("zrscan", makeZPlayerBattleRecordKey(in.UserId), in.StartId, startScore, "", in.Limit)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	out := struct {
+		Records  []BattleRecord
+		LastTime int64
+	}{
+		[]BattleRecord{},
+		0,
+	}
+
+	if len(resp) > 0 {
+		num := len(resp) / 2
+		args := make([]interface{}, 2, num+2)
+		args[0] = "multi_hget"
+		args[1] = H_BATTLE_RECORD
+		for i := 0; i < num; i++ {
+			args = append(args, resp[i*2])
+			if i == num-1 {
+				out.LastTime, err = strconv.ParseInt(resp[i*2+1], 10, 64)
+				lwutil.CheckError(err, "err_strconv")
+			}
+		}
+		resp, err = ssdbc.Do(args...)
+		lwutil.CheckSsdbError(resp, err)
+		resp = resp[1:]
+
+		num = len(resp) / 2
+		for i := 0; i < num; i++ {
+			var record BattleRecord
+			err = json.Unmarshal([]byte(resp[i*2+1]), &record)
+			lwutil.CheckError(err, "err_json")
+			out.Records = append(out.Records, record)
+		}
+	}
+
+	//out
+	lwutil.WriteResponse(w, out)
+}
+
+func apiBattleGetStats(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		UserId int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.UserId == 0 {
+		in.UserId = session.Userid
+	}
+
+	//
+	resp, err := ssdbc.Do("hgetall", makeHPlayerBattleStatKey(in.UserId))
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	statMap := map[string]*BattleRoomStat{}
+	total := BattleRoomStat{}
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		strs := strings.Split(resp[i*2], "/")
+		if len(strs) != 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(resp[i*2+1], 10, 64)
+		lwutil.CheckError(err, "err_strconv")
+
+		stat := statMap[strs[0]]
+		if stat == nil {
+			stat = &BattleRoomStat{RoomName: strs[0]}
+			statMap[strs[0]] = stat
+		}
+		stat.add(strs[1], value)
+		total.add(strs[1], value)
+	}
+
+	//in room list order
+	rooms := make([]BattleRoomStat, 0, len(statMap))
+	for _, room := range getBattleRooms(ssdbc) {
+		if stat := statMap[room.Name]; stat != nil {
+			stat.calc()
+			rooms = append(rooms, *stat)
+			delete(statMap, room.Name)
+		}
+	}
+	for _, stat := range statMap {
+		stat.calc()
+		rooms = append(rooms, *stat)
+	}
+	total.calc()
+
+	//out
+	out := struct {
+		Rooms []BattleRoomStat
+		Total BattleRoomStat
+	}{
+		rooms,
+		total,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiBattleHeadToHead(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		UserId    int64
+		FoeUserId int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.UserId == 0 {
+		in.UserId = session.Userid
+	}
+	if in.FoeUserId == 0 || in.FoeUserId == in.UserId {
+		lwutil.SendError("err_foe_user_id", "")
+	}
+
+	//
+	resp, err := ssdbc.Do("multi_hget", makeHPlayerBattleVsKey(in.UserId),
+		fmt.Sprintf("%d/win", in.FoeUserId),
+		fmt.Sprintf("%d/lose", in.FoeUserId),
+		fmt.Sprintf("%d/draw", in.FoeUserId))
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	out := struct {
+		UserId    int64
+		FoeUserId int64
+		Win       int
+		Lose      int
+		Draw      int
+	}{
+		UserId:    in.UserId,
+		FoeUserId: in.FoeUserId,
+	}
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		value, err := strconv.Atoi(resp[i*2+1])
+		lwutil.CheckError(err, "err_strconv")
+		switch {
+		case strings.HasSuffix(resp[i*2], "/win"):
+			out.Win = value
+		case strings.HasSuffix(resp[i*2], "/lose"):
+			out.Lose = value
+		case strings.HasSuffix(resp[i*2], "/draw"):
+			out.Draw = value
+		}
+	}
+
+	//out
+	lwutil.WriteResponse(w, out)
+}
+
+func apiBattleGetRecord(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		BattleId string
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//
+	resp, err := ssdbc.Do("hget", H_BATTLE_RECORD, in.BattleId)
+	lwutil.CheckError(err, "")
+	if resp[0] == "not_found" {
+		lwutil.SendError("err_not_found", "")
+	}
+	lwutil.CheckSsdbError(resp, err)
+
+	var record BattleRecord
+	err = json.Unmarshal([]byte(resp[1]), &record)
+	lwutil.CheckError(err, "err_json")
+
+	//out
+	lwutil.WriteResponse(w, record)
+}
+
+func regBattleHistory() {
+	http.Handle("/battle/listHistory", lwutil.ReqHandler(apiBattleListHistory))
+	http.Handle("/battle/getStats", lwutil.ReqHandler(apiBattleGetStats))
+	http.Handle("/battle/headToHead", lwutil.ReqHandler(apiBattleHeadToHead))
+	http.Handle("/battle/getRecord", lwutil.ReqHandler(apiBattleGetRecord))
+}
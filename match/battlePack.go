@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+//the battle pool is the set of packs battles are played on, battle nodes pick from it.
+//packs without a measured difficulty are fine, they are picked only when nothing measured fits.
+const (
+	BATTLE_POOL_IMAGE_MIN  = 2
+	BATTLE_POOL_EDIT_LIMIT = 100
+)
+
+type BattlePoolPack struct {
+	PackId     int64
+	Title      string
+	Thumb      string
+	ImageNum   int
+	Difficulty int //msec per image at DIFFICULTY_SLIDER_BASE sliders, 0 if not measured yet
+}
+
+type ByPoolPackId []BattlePoolPack
+
+func (a ByPoolPackId) Len() int           { return len(a) }
+func (a ByPoolPackId) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a ByPoolPackId) Less(i, j int) bool { return a[i].PackId < a[j].PackId }
+
+func _glogBattlePack() {
+	glog.Info("")
+}
+
+func apiBattleListPool(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//redis
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//
+	packIds, err := redis.Strings(rc.Do("SMEMBERS", BATTLE_PACKID_SET))
+	lwutil.CheckError(err, "")
+
+	packs := make([]BattlePoolPack, 0, len(packIds))
+	if len(packIds) > 0 {
+		packMap := map[string]*BattlePoolPack{}
+		args := make([]interface{}, 2, len(packIds)+2)
+		args[0] = "multi_hget"
+		args[1] = H_PACK
+		for _, packId := range packIds {
+			args = append(args, packId)
+		}
+		resp, err := ssdbc.Do(args...)
+		lwutil.CheckSsdbError(resp, err)
+		resp = resp[1:]
+
+		num := len(resp) / 2
+		for i := 0; i < num; i++ {
+			var pack Pack
+			err = json.Unmarshal([]byte(resp[i*2+1]), &pack)
+			lwutil.CheckError(err, "err_json")
+			packMap[resp[i*2]] = &BattlePoolPack{
+				PackId:   pack.Id,
+				Title:    pack.Title,
+				Thumb:    pack.Thumb,
+				ImageNum: len(pack.Images),
+			}
+		}
+
+		//difficulty
+		args[0] = "multi_zget"
+		args[1] = Z_PACK_DIFFICULTY
+		resp, err = ssdbc.Do(args...)
+		lwutil.CheckSsdbError(resp, err)
+		resp = resp[1:]
+
+		num = len(resp) / 2
+		for i := 0; i < num; i++ {
+			if pack := packMap[resp[i*2]]; pack != nil {
+				pack.Difficulty, _ = strconv.Atoi(resp[i*2+1])
+			}
+		}
+
+		//deleted packs show up with the id only, so they can be removed
+		for _, str := range packIds {
+			if pack := packMap[str]; pack != nil {
+				packs = append(packs, *pack)
+			} else {
+				packId, err := strconv.ParseInt(str, 10, 64)
+				lwutil.CheckError(err, "err_strconv")
+				packs = append(packs, BattlePoolPack{PackId: packId})
+			}
+		}
+		sort.Sort(ByPoolPackId(packs))
+	}
+
+	//out
+	lwutil.WriteResponse(w, packs)
+}
+
+func apiBattleAddToPool(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//redis
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		PackIds []int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if len(in.PackIds) == 0 || len(in.PackIds) > BATTLE_POOL_EDIT_LIMIT {
+		lwutil.SendError("err_pack_ids", "")
+	}
+
+	//all or nothing
+	args := make([]interface{}, 1, len(in.PackIds)+1)
+	args[0] = BATTLE_PACKID_SET
+	for _, packId := range in.PackIds {
+		pack, err := getPack(ssdbc, packId)
+		lwutil.CheckError(err, "err_pack")
+		if len(pack.Images) < BATTLE_POOL_IMAGE_MIN {
+			lwutil.SendError("err_image_num", "")
+		}
+		args = append(args, packId)
+	}
+	addNum, err := redis.Int(rc.Do("SADD", args...))
+	lwutil.CheckError(err, "")
+
+	//out
+	out := struct {
+		AddNum int
+	}{
+		addNum,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiBattleRemoveFromPool(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//redis
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		PackIds []int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if len(in.PackIds) == 0 || len(in.PackIds) > BATTLE_POOL_EDIT_LIMIT {
+		lwutil.SendError("err_pack_ids", "")
+	}
+
+	args := make([]interface{}, 1, len(in.PackIds)+1)
+	args[0] = BATTLE_PACKID_SET
+	for _, packId := range in.PackIds {
+		args = append(args, packId)
+	}
+	removeNum, err := redis.Int(rc.Do("SREM", args...))
+	lwutil.CheckError(err, "")
+
+	//out
+	out := struct {
+		RemoveNum int
+	}{
+		removeNum,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func regBattlePack() {
+	http.Handle("/battle/listPool", lwutil.ReqHandler(apiBattleListPool))
+	http.Handle("/battle/addToPool", lwutil.ReqHandler(apiBattleAddToPool))
+	http.Handle("/battle/removeFromPool", lwutil.ReqHandler(apiBattleRemoveFromPool))
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"./ssdb"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+//season points live beside the lifetime BattlePoint.
+//the battle server adds to the season in K_BATTLE_SEASON_ACTIVE, the match cron opens and settles seasons.
+const (
+	BATTLE_SEASON_SERIAL   = "BATTLE_SEASON_SERIAL"
+	H_BATTLE_SEASON        = "H_BATTLE_SEASON"        //subkey:seasonId value:seasonJson
+	Z_BATTLE_SEASON        = "Z_BATTLE_SEASON"        //subkey:seasonId score:beginTime
+	Z_OPEN_BATTLE_SEASON   = "Z_OPEN_BATTLE_SEASON"   //subkey:seasonId score:endTime
+	K_BATTLE_SEASON_ACTIVE = "K_BATTLE_SEASON_ACTIVE" //value:seasonId, read by battle server
+	Z_BATTLE_SEASON_POINT  = "Z_BATTLE_SEASON_POINT"  //key:Z_BATTLE_SEASON_POINT/seasonId subkey:userId score:seasonPoint
+	H_BATTLE_SEASON_RESULT = "H_BATTLE_SEASON_RESULT" //key:H_BATTLE_SEASON_RESULT/seasonId subkey:userId value:seasonResultJson
+	H_BATTLE_SEASON_CARRY  = "H_BATTLE_SEASON_CARRY"  //key:H_BATTLE_SEASON_CARRY/seasonId subkey:userId value:pointsCarried, read by battle server
+	Z_PLAYER_BATTLE_SEASON = "Z_PLAYER_BATTLE_SEASON" //key:Z_PLAYER_BATTLE_SEASON/userId subkey:seasonId score:finalRank
+
+	BATTLE_SEASON_LIST_LIMIT         = 50
+	BATTLE_SEASON_SOFT_RESET_DEFAULT = 0.5
+)
+
+type BattleSeasonRewardTier struct {
+	RankMax int //ranks up to RankMax, tiers sorted by RankMax
+	Coin    int
+	Prize   int
+}
+
+type BattleSeason struct {
+	Id             int64
+	Title          string
+	Thumb          string
+	BeginTime      int64
+	BeginTimeStr   string
+	EndTime        int64
+	EndTimeStr     string
+	RewardTiers    []BattleSeasonRewardTier
+	SoftResetRatio float32 //points carried into the next season
+	HasResult      bool
+}
+
+type BattleSeasonResult struct {
+	SeasonId int64
+	Rank     int
+	Point    int
+	Coin     int
+	Prize    int
+}
+
+func _glogBattleSeason() {
+	glog.Info("")
+}
+
+func makeZBattleSeasonPointKey(seasonId int64) string {
+	return fmt.Sprintf("%s/%d", Z_BATTLE_SEASON_POINT, seasonId)
+}
+
+func makeHBattleSeasonResultKey(seasonId int64) string {
+	return fmt.Sprintf("%s/%d", H_BATTLE_SEASON_RESULT, seasonId)
+}
+
+func makeHBattleSeasonCarryKey(seasonId int64) string {
+	return fmt.Sprintf("%s/%d", H_BATTLE_SEASON_CARRY, seasonId)
+}
+
+func makeZPlayerBattleSeasonKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", Z_PLAYER_BATTLE_SEASON, userId)
+}
+
+func getBattleSeason(ssdbc *ssdb.Client, seasonId int64) *BattleSeason {
+	resp, err := ssdbc.Do("hget", H_BATTLE_SEASON, seasonId)
+	lwutil.CheckSsdbError(resp, err)
+
+	season := BattleSeason{}
+	err = json.Unmarshal([]byte(resp[1]), &season)
+	lwutil.CheckError(err, "err_json")
+	return &season
+}
+
+func saveBattleSeason(ssdbc *ssdb.Client, season *BattleSeason) {
+	js, err := json.Marshal(season)
+	lwutil.CheckError(err, "err_json")
+	resp, err := ssdbc.Do("hset", H_BATTLE_SEASON, season.Id, js)
+	lwutil.CheckSsdbError(resp, err)
+}
+
+//0 if no season is running
+func getActiveBattleSeasonId(ssdbc *ssdb.Client) int64 {
+	resp, err := ssdbc.Do("get", K_BATTLE_SEASON_ACTIVE)
+	lwutil.CheckError(err, "")
+	if resp[0] != "ok" {
+		return 0
+	}
+	seasonId, err := strconv.ParseInt(resp[1], 10, 64)
+	lwutil.CheckError(err, "err_strconv")
+	return seasonId
+}
+
+func getBattleSeasonReward(season *BattleSeason, rank int) (coin, prize int) {
+	for _, tier := range season.RewardTiers {
+		if rank <= tier.RankMax {
+			return tier.Coin, tier.Prize
+		}
+	}
+	return 0, 0
+}
+
+func apiBattleSeasonNew(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in BattleSeason
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	stringLimit(&in.Title, 100)
+
+	beginTime, err := time.ParseInLocation("2006-01-02T15:04:05", in.BeginTimeStr, time.Local)
+	lwutil.CheckError(err, "err_time")
+	endTime, err := time.ParseInLocation("2006-01-02T15:04:05", in.EndTimeStr, time.Local)
+	lwutil.CheckError(err, "err_time")
+	in.BeginTime = beginTime.Unix()
+	in.EndTime = endTime.Unix()
+	if in.EndTime <= in.BeginTime || in.EndTime <= lwutil.GetRedisTimeUnix() {
+		lwutil.SendError("err_time", "bad time")
+	}
+
+	//check tiers
+	lastRankMax := 0
+	for i, tier := range in.RewardTiers {
+		if tier.RankMax <= lastRankMax {
+			lwutil.SendError("err_reward_tiers", fmt.Sprintf("tier %d: RankMax must increase", i))
+		}
+		if tier.Coin < 0 || tier.Prize < 0 {
+			lwutil.SendError("err_reward_tiers", fmt.Sprintf("tier %d: Coin < 0 || Prize < 0", i))
+		}
+		lastRankMax = tier.RankMax
+	}
+
+	if in.SoftResetRatio < 0 || in.SoftResetRatio > 1 {
+		lwutil.SendError("err_soft_reset", "SoftResetRatio out of [0, 1]")
+	}
+	if in.SoftResetRatio == 0 {
+		in.SoftResetRatio = BATTLE_SEASON_SOFT_RESET_DEFAULT
+	}
+
+	//seasons can't overlap, only one can be active
+	resp, err := ssdbc.Do("zscan", Z_OPEN_BATTLE_SEASON, "", "", "", BATTLE_SEASON_LIST_LIMIT)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		seasonId, err := strconv.ParseInt(resp[i*2], 10, 64)
+		lwutil.CheckError(err, "err_strconv")
+		season := getBattleSeason(ssdbc, seasonId)
+		if in.BeginTime < season.EndTime && season.BeginTime < in.EndTime {
+			lwutil.SendError("err_overlap", fmt.Sprintf("overlaps with season %d", seasonId))
+		}
+	}
+
+	//new
+	in.Id = GenSerial(ssdbc, BATTLE_SEASON_SERIAL)
+	in.HasResult = false
+	saveBattleSeason(ssdbc, &in)
+
+	resp, err = ssdbc.Do("zset", Z_BATTLE_SEASON, in.Id, in.BeginTime)
+	lwutil.CheckSsdbError(resp, err)
+
+	resp, err = ssdbc.Do("zset", Z_OPEN_BATTLE_SEASON, in.Id, in.EndTime)
+	lwutil.CheckSsdbError(resp, err)
+
+	//out
+	lwutil.WriteResponse(w, in)
+}
+
+func apiBattleSeasonList(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	_, err = findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		StartId   int64
+		BeginTime int64
+		Limit     int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.Limit <= 0 || in.Limit > BATTLE_SEASON_LIST_LIMIT {
+		in.Limit = BATTLE_SEASON_LIST_LIMIT
+	}
+
+	startId := ""
+	startScore := ""
+	if in.StartId != 0 {
+		startId = fmt.Sprint(in.StartId)
+		startScore = fmt.Sprint(in.BeginTime)
+	}
+
+	//newest first
+	resp, err := ssdbc.Do("zrscan", Z_BATTLE_SEASON, startId, startScore, "", in.Limit)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	seasons := make([]BattleSeason, 0, len(resp)/2)
+	if len(resp) > 0 {
+		num := len(resp) / 2
+		args := make([]interface{}, 2, num+2)
+		args[0] = "multi_hget"
+		args[1] = H_BATTLE_SEASON
+		for i := 0; i < num; i++ {
+			args = append(args, resp[i*2])
+		}
+		resp, err = ssdbc.Do(args...)
+		lwutil.CheckSsdbError(resp, err)
+		resp = resp[1:]
+
+		num = len(resp) / 2
+		for i := 0; i < num; i++ {
+			var season BattleSeason
+			err = json.Unmarshal([]byte(resp[i*2+1]), &season)
+			lwutil.CheckError(err, "err_json")
+			seasons = append(seasons, season)
+		}
+	}
+
+	//out
+	out := struct {
+		ActiveSeasonId int64
+		Seasons        []BattleSeason
+	}{
+		getActiveBattleSeasonId(ssdbc),
+		seasons,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiBattleSeasonGetRanks(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		SeasonId int64 //0 for the active season
+		Offset   int
+		Limit    int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.SeasonId == 0 {
+		in.SeasonId = getActiveBattleSeasonId(ssdbc)
+		if in.SeasonId == 0 {
+			lwutil.SendError("err_no_season", "no active season")
+		}
+	}
+	if in.Limit <= 0 || in.Limit > BATTLE_SEASON_LIST_LIMIT {
+		in.Limit = BATTLE_SEASON_LIST_LIMIT
+	}
+	if in.Offset < 0 {
+		in.Offset = 0
+	}
+
+	season := getBattleSeason(ssdbc, in.SeasonId)
+
+	type SeasonRank struct {
+		Rank   int
+		Point  int
+		Player *PlayerInfoLite
+	}
+
+	out := struct {
+		Season   *BattleSeason
+		MyRank   int
+		MyPoint  int
+		MyResult *BattleSeasonResult
+		RankNum  int
+		Ranks    []SeasonRank
+	}{}
+	out.Season = season
+	out.Ranks = []SeasonRank{}
+
+	zKey := makeZBattleSeasonPointKey(in.SeasonId)
+
+	//my rank
+	resp, err := ssdbc.Do("zrrank", zKey, session.Userid)
+	lwutil.CheckError(err, "")
+	if resp[0] == "ok" {
+		out.MyRank, err = strconv.Atoi(resp[1])
+		lwutil.CheckError(err, "")
+		out.MyRank++
+
+		resp, err = ssdbc.Do("zget", zKey, session.Userid)
+		lwutil.CheckSsdbError(resp, err)
+		out.MyPoint, err = strconv.Atoi(resp[1])
+		lwutil.CheckError(err, "")
+	}
+
+	//my result
+	if season.HasResult {
+		resp, err = ssdbc.Do("hget", makeHBattleSeasonResultKey(in.SeasonId), session.Userid)
+		lwutil.CheckError(err, "")
+		if resp[0] == "ok" {
+			out.MyResult = &BattleSeasonResult{}
+			err = json.Unmarshal([]byte(resp[1]), out.MyResult)
+			lwutil.CheckError(err, "err_json")
+		}
+	}
+
+	resp, err = ssdbc.Do("zsize", zKey)
+	lwutil.CheckSsdbError(resp, err)
+	out.RankNum, err = strconv.Atoi(resp[1])
+	lwutil.CheckError(err, "")
+
+	//ranks
+	resp, err = ssdbc.Do("zrrange", zKey, in.Offset, in.Limit)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		userId, err := strconv.ParseInt(resp[i*2], 10, 64)
+		lwutil.CheckError(err, "")
+		point, err := strconv.Atoi(resp[i*2+1])
+		lwutil.CheckError(err, "")
+		player, err := getPlayerInfoLite(ssdbc, userId, nil)
+		if err != nil {
+			glog.Errorf("getPlayerInfoLite error:%v, userId:%d", err, userId)
+			continue
+		}
+		out.Ranks = append(out.Ranks, SeasonRank{in.Offset + i + 1, point, player})
+	}
+
+	//out
+	lwutil.WriteResponse(w, out)
+}
+
+func apiBattleSeasonListMyResult(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		UserId int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.UserId == 0 {
+		in.UserId = session.Userid
+	}
+
+	//
+	resp, err := ssdbc.Do("zrscan", makeZPlayerBattleSeasonKey(in.UserId), "", "", "", BATTLE_SEASON_LIST_LIMIT)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	results := make([]BattleSeasonResult, 0, num)
+	for i := 0; i < num; i++ {
+		seasonId, err := strconv.ParseInt(resp[i*2], 10, 64)
+		lwutil.CheckError(err, "err_strconv")
+
+		rsp, err := ssdbc.Do("hget", makeHBattleSeasonResultKey(seasonId), in.UserId)
+		lwutil.CheckError(err, "")
+		if rsp[0] != "ok" {
+			continue
+		}
+		var result BattleSeasonResult
+		err = json.Unmarshal([]byte(rsp[1]), &result)
+		lwutil.CheckError(err, "err_json")
+		results = append(results, result)
+	}
+
+	//out
+	lwutil.WriteResponse(w, results)
+}
+
+func battleSeasonCron() {
+	defer handleError()
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	checkError(err)
+	defer ssdbc.Close()
+
+	now := lwutil.GetRedisTimeUnix()
+	activeId := getActiveBattleSeasonId(ssdbc)
+
+	resp, err := ssdbc.Do("zscan", Z_OPEN_BATTLE_SEASON, "", "", "", BATTLE_SEASON_LIST_LIMIT)
+	checkSsdbError(resp, err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		seasonId, err := strconv.ParseInt(resp[i*2], 10, 64)
+		checkError(err)
+		season := getBattleSeason(ssdbc, seasonId)
+
+		if season.EndTime <= now {
+			//stop the battle server writing before settling
+			if activeId == seasonId {
+				r, err := ssdbc.Do("del", K_BATTLE_SEASON_ACTIVE)
+				checkSsdbError(r, err)
+				activeId = 0
+			}
+			settleBattleSeason(ssdbc, season)
+		} else if season.BeginTime <= now && activeId != seasonId {
+			r, err := ssdbc.Do("set", K_BATTLE_SEASON_ACTIVE, seasonId)
+			checkSsdbError(r, err)
+			activeId = seasonId
+			glog.Infof("battle season begin: seasonId=%d", seasonId)
+		}
+	}
+}
+
+func settleBattleSeason(ssdbc *ssdb.Client, season *BattleSeason) {
+	zKey := makeZBattleSeasonPointKey(season.Id)
+	hResultKey := makeHBattleSeasonResultKey(season.Id)
+	hCarryKey := makeHBattleSeasonCarryKey(season.Id)
+	numPerBatch := 1000
+	currRank := 1
+
+	//for each rank batch
+	for true {
+		resp, err := ssdbc.Do("zrrange", zKey, currRank-1, numPerBatch)
+		checkSsdbError(resp, err)
+		resp = resp[1:]
+
+		num := len(resp) / 2
+		if num == 0 {
+			break
+		}
+
+		//for each rank
+		for i := 0; i < num; i++ {
+			rank := currRank
+			currRank++
+			userId, err := strconv.ParseInt(resp[i*2], 10, 64)
+			checkError(err)
+			point, err := strconv.Atoi(resp[i*2+1])
+			checkError(err)
+
+			//the result is written last, a run stopped midway settles the rest next time
+			r, err := ssdbc.Do("hexists", hResultKey, userId)
+			checkSsdbError(r, err)
+			if ssdbCheckExists(r) {
+				continue
+			}
+
+			//reward
+			result := BattleSeasonResult{
+				SeasonId: season.Id,
+				Rank:     rank,
+				Point:    point,
+			}
+			result.Coin, result.Prize = getBattleSeasonReward(season, rank)
+			if result.Coin > 0 {
+				playerKey := makePlayerInfoKey(userId)
+				addPlayerGoldCoin(ssdbc, playerKey, result.Coin)
+				addEcoRecord(ssdbc, userId, result.Coin, ECO_FORWHAT_BATTLE_SEASON_COIN)
+			}
+			if result.Prize > 0 {
+				addPrizeToCache(ssdbc, userId, 0, season.Thumb, result.Prize, PRIZE_REASON_BATTLE_SEASON, rank)
+				addEcoRecord(ssdbc, userId, result.Prize, ECO_FORWHAT_BATTLE_SEASON_PRIZE)
+			}
+
+			//soft reset, the battle server starts the player there in the season right after
+			r, err = ssdbc.Do("hset", hCarryKey, userId, int(float32(point)*season.SoftResetRatio))
+			checkSsdbError(r, err)
+
+			//archive
+			r, err = ssdbc.Do("zset", makeZPlayerBattleSeasonKey(userId), season.Id, rank)
+			checkSsdbError(r, err)
+
+			js, err := json.Marshal(result)
+			checkError(err)
+			r, err = ssdbc.Do("hset", hResultKey, userId, js)
+			checkSsdbError(r, err)
+		}
+
+		if num < numPerBatch {
+			break
+		}
+	}
+
+	//finish
+	season.HasResult = true
+	saveBattleSeason(ssdbc, season)
+
+	r, err := ssdbc.Do("zdel", Z_OPEN_BATTLE_SEASON, season.Id)
+	checkSsdbError(r, err)
+
+	glog.Infof("battle season settled: seasonId=%d, rankNum=%d", season.Id, currRank-1)
+}
+
+func regBattleSeason() {
+	http.Handle("/battleSeason/new", lwutil.ReqHandler(apiBattleSeasonNew))
+	http.Handle("/battleSeason/list", lwutil.ReqHandler(apiBattleSeasonList))
+	http.Handle("/battleSeason/getRanks", lwutil.ReqHandler(apiBattleSeasonGetRanks))
+	http.Handle("/battleSeason/listMyResult", lwutil.ReqHandler(apiBattleSeasonListMyResult))
+}
@@ -453,7 +453,8 @@ func apiChannelListMatch(w http.ResponseWriter, r *http.Request) {
 	for _, match := range out.Matches {
 		playTimesKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_PLAY_TIMES)
 		likeNumKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_LIKE_NUM)
-		cmds = append(cmds, playTimesKey, likeNumKey)
+		difficultyKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_DIFFICULTY)
+		cmds = append(cmds, playTimesKey, likeNumKey, difficultyKey)
 	}
 	resp, err = ssdbc.Do(cmds...)
 	lwutil.CheckSsdbError(resp, err)
@@ -479,6 +480,9 @@ func apiChannelListMatch(w http.ResponseWriter, r *http.Request) {
 		} else if fieldKey == MATCH_EXTRA_LIKE_NUM {
 			matchEx.LikeNum, err = strconv.Atoi(resp[i*2+1])
 			lwutil.CheckError(err, "")
+		} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+			matchEx.Difficulty, err = strconv.Atoi(resp[i*2+1])
+			lwutil.CheckError(err, "")
 		}
 		out.MatchExMap[matchIdStr] = matchEx
 	}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"./ssdb"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+//the timezone a player checks in by is pinned: a new one is taken at most once per CHECKIN_TZ_COOLDOWN_SEC,
+//since every switch can make a day start again.
+const (
+	H_CHECKIN       = "H_CHECKIN"       //key:H_CHECKIN/userId subkey:fieldKey value
+	Z_CHECKIN_DAY   = "Z_CHECKIN_DAY"   //key:Z_CHECKIN_DAY/userId subkey:dayIndex score:dayIndex
+	K_CHECKIN_CLAIM = "K_CHECKIN_CLAIM" //redis, key:K_CHECKIN_CLAIM/userId/dayIndex
+
+	CHECKIN_LAST_DAY  = "LastDay"
+	CHECKIN_STREAK    = "Streak"
+	CHECKIN_TZ_OFFSET = "TzOffset" //seconds east of utc
+	CHECKIN_TZ_TIME   = "TzTime"   //when TzOffset was last changed
+
+	CHECKIN_TZ_OFFSET_MIN   = -12 * 60 * 60
+	CHECKIN_TZ_OFFSET_MAX   = 14 * 60 * 60
+	CHECKIN_TZ_COOLDOWN_SEC = 7 * 24 * 60 * 60
+	CHECKIN_CLAIM_TTL_SEC   = 3 * 24 * 60 * 60
+	CHECKIN_CALENDAR_DAYS   = 31
+	CHECKIN_STREAK_SCAN_MAX = 366
+)
+
+//loaded from conf, the calendar cycles with the streak
+type CheckinReward struct {
+	Coin    int
+	Heart   int
+	FreeTry int
+}
+
+//loaded from conf
+type CheckinMakeup struct {
+	Coin int //cost per day
+	Days int //how many days back can be made up
+}
+
+type CheckinState struct {
+	Today    int64
+	LastDay  int64
+	Streak   int
+	TzOffset int
+
+	tzSaved   bool
+	tzTime    int64
+	tzChanged bool //to be saved with the next checkin
+}
+
+func _glogCheckin() {
+	glog.Info("")
+}
+
+func makeHCheckinKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", H_CHECKIN, userId)
+}
+
+func makeZCheckinDayKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", Z_CHECKIN_DAY, userId)
+}
+
+func clampTzOffset(tzOffset int) int {
+	if tzOffset < CHECKIN_TZ_OFFSET_MIN {
+		return CHECKIN_TZ_OFFSET_MIN
+	} else if tzOffset > CHECKIN_TZ_OFFSET_MAX {
+		return CHECKIN_TZ_OFFSET_MAX
+	}
+	return tzOffset
+}
+
+//tzOffset == nil means use the saved one, a new one is taken if the saved one is past its cooldown
+func getCheckinState(ssdbc *ssdb.Client, userId int64, tzOffset *int) *CheckinState {
+	state := CheckinState{
+		TzOffset: SERVER_TZ_OFFSET_SEC,
+	}
+
+	key := makeHCheckinKey(userId)
+	resp, err := ssdbc.Do("multi_hget", key, CHECKIN_LAST_DAY, CHECKIN_STREAK, CHECKIN_TZ_OFFSET, CHECKIN_TZ_TIME)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		k := resp[i*2]
+		v := resp[i*2+1]
+		if k == CHECKIN_LAST_DAY {
+			state.LastDay, err = strconv.ParseInt(v, 10, 64)
+		} else if k == CHECKIN_STREAK {
+			state.Streak, err = strconv.Atoi(v)
+		} else if k == CHECKIN_TZ_OFFSET {
+			state.TzOffset, err = strconv.Atoi(v)
+			state.tzSaved = true
+		} else if k == CHECKIN_TZ_TIME {
+			state.tzTime, err = strconv.ParseInt(v, 10, 64)
+		}
+		lwutil.CheckError(err, "err_strconv")
+	}
+
+	now := lwutil.GetRedisTimeUnix()
+	if tzOffset != nil {
+		offset := clampTzOffset(*tzOffset)
+		if offset != state.TzOffset && (!state.tzSaved || now-state.tzTime >= CHECKIN_TZ_COOLDOWN_SEC) {
+			state.TzOffset = offset
+			state.tzTime = now
+			state.tzChanged = true
+		}
+	}
+	state.Today = makeDayIndex(now, state.TzOffset)
+
+	//streak is broken if yesterday is missed
+	if state.LastDay < state.Today-1 {
+		state.Streak = 0
+	}
+	return &state
+}
+
+//length of the checked run ending at day
+func calcCheckinStreak(ssdbc *ssdb.Client, userId int64, day int64) int {
+	key := makeZCheckinDayKey(userId)
+	resp, err := ssdbc.Do("zrscan", key, "", day, "", CHECKIN_STREAK_SCAN_MAX)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	streak := 0
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		d, err := strconv.ParseInt(resp[i*2], 10, 64)
+		lwutil.CheckError(err, "err_strconv")
+		if d != day-int64(streak) {
+			break
+		}
+		streak++
+	}
+	return streak
+}
+
+func useBonusFreeTry(ssdbc *ssdb.Client, playerKey string) bool {
+	resp, err := ssdbc.Do("hget", playerKey, PLAYER_BONUS_FREE_TRIES)
+	lwutil.CheckError(err, "")
+	if resp[0] != "ok" || resp[1] == "0" {
+		return false
+	}
+
+	resp, err = ssdbc.Do("hincr", playerKey, PLAYER_BONUS_FREE_TRIES, -1)
+	lwutil.CheckSsdbError(resp, err)
+	n, err := strconv.Atoi(resp[1])
+	lwutil.CheckError(err, "err_strconv")
+	if n < 0 {
+		resp, err = ssdbc.Do("hincr", playerKey, PLAYER_BONUS_FREE_TRIES, 1)
+		lwutil.CheckSsdbError(resp, err)
+		return false
+	}
+	return true
+}
+
+func addBattleHearts(ssdbc *ssdb.Client, userId int64, n int) {
+	playerInfo, err := getPlayerInfo(ssdbc, userId)
+	lwutil.CheckError(err, "err_player_info")
+
+	now := lwutil.GetRedisTimeUnix()
+	heartNum := getBattleHeartNum(playerInfo) + n
+	if heartNum > BATTLE_HEART_TOTAL {
+		heartNum = BATTLE_HEART_TOTAL
+	}
+	zeroTime := now - int64(heartNum*BATTLE_HEART_ADD_SEC)
+
+	playerKey := makePlayerInfoKey(userId)
+	resp, err := ssdbc.Do("hset", playerKey, PLAYER_BATTLE_HEART_ZERO_TIME, zeroTime)
+	lwutil.CheckSsdbError(resp, err)
+}
+
+func getCheckinReward(streak int) *CheckinReward {
+	num := len(_conf.CheckinRewards)
+	if num == 0 || streak <= 0 {
+		return nil
+	}
+	return &_conf.CheckinRewards[(streak-1)%num]
+}
+
+func listCheckinDays(ssdbc *ssdb.Client, userId int64, today int64) []int64 {
+	key := makeZCheckinDayKey(userId)
+	resp, err := ssdbc.Do("zrscan", key, "", today, today-CHECKIN_CALENDAR_DAYS+1, CHECKIN_CALENDAR_DAYS)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	days := make([]int64, 0, num)
+	for i := 0; i < num; i++ {
+		d, err := strconv.ParseInt(resp[i*2], 10, 64)
+		lwutil.CheckError(err, "err_strconv")
+		days = append(days, d)
+	}
+	return days
+}
+
+func apiCheckinGet(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		TzOffset *int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//
+	state := getCheckinState(ssdbc, session.Userid, in.TzOffset)
+
+	//out
+	out := struct {
+		CheckinState
+		CheckedToday bool
+		Days         []int64
+		Rewards      []CheckinReward
+		Makeup       CheckinMakeup
+	}{
+		*state,
+		state.LastDay >= state.Today,
+		listCheckinDays(ssdbc, session.Userid, state.Today),
+		_conf.CheckinRewards,
+		_conf.CheckinMakeup,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiCheckinCheckin(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		TzOffset *int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//check, LastDay only moves forward so switching timezone can't check in twice a day
+	state := getCheckinState(ssdbc, session.Userid, in.TzOffset)
+	if state.LastDay >= state.Today {
+		lwutil.SendError("err_already_checkin", "")
+	}
+
+	//requests at the same time all pass the check above, only one claims the day
+	rc := redisPool.Get()
+	defer rc.Close()
+	claimKey := fmt.Sprintf("%s/%d/%d", K_CHECKIN_CLAIM, session.Userid, state.Today)
+	ok, err := rc.Do("SET", claimKey, 1, "NX", "EX", CHECKIN_CLAIM_TTL_SEC)
+	lwutil.CheckError(err, "")
+	if ok == nil {
+		lwutil.SendError("err_already_checkin", "")
+	}
+
+	//checkin
+	key := makeZCheckinDayKey(session.Userid)
+	resp, err := ssdbc.Do("zset", key, state.Today, state.Today)
+	lwutil.CheckSsdbError(resp, err)
+
+	state.Streak = calcCheckinStreak(ssdbc, session.Userid, state.Today)
+	state.LastDay = state.Today
+
+	args := []interface{}{"multi_hset", makeHCheckinKey(session.Userid),
+		CHECKIN_LAST_DAY, state.LastDay,
+		CHECKIN_STREAK, state.Streak,
+	}
+	if state.tzChanged {
+		args = append(args, CHECKIN_TZ_OFFSET, state.TzOffset, CHECKIN_TZ_TIME, state.tzTime)
+	}
+	resp, err = ssdbc.Do(args...)
+	lwutil.CheckSsdbError(resp, err)
+
+	//reward
+	reward := getCheckinReward(state.Streak)
+	if reward != nil {
+		playerKey := makePlayerInfoKey(session.Userid)
+		if reward.Coin > 0 {
+			addPlayerGoldCoin(ssdbc, playerKey, reward.Coin)
+			err = addEcoRecord(ssdbc, session.Userid, reward.Coin, ECO_FORWHAT_CHECKIN)
+			lwutil.CheckError(err, "err_eco_record")
+		}
+		if reward.Heart > 0 {
+			addBattleHearts(ssdbc, session.Userid, reward.Heart)
+		}
+		if reward.FreeTry > 0 {
+			resp, err = ssdbc.Do("hincr", playerKey, PLAYER_BONUS_FREE_TRIES, reward.FreeTry)
+			lwutil.CheckSsdbError(resp, err)
+		}
+	}
+
+	//out
+	playerInfo, err := getPlayerInfo(ssdbc, session.Userid)
+	lwutil.CheckError(err, "err_player_info")
+
+	out := struct {
+		CheckinState
+		Reward              *CheckinReward
+		GoldCoin            int
+		BattleHeartZeroTime int64
+		BonusFreeTries      int
+	}{
+		*state,
+		reward,
+		playerInfo.GoldCoin,
+		playerInfo.BattleHeartZeroTime,
+		playerInfo.BonusFreeTries,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiCheckinMakeup(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		Day int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//check
+	makeup := _conf.CheckinMakeup
+	if makeup.Days <= 0 {
+		lwutil.SendError("err_makeup_disabled", "")
+	}
+
+	state := getCheckinState(ssdbc, session.Userid, nil)
+	if in.Day >= state.Today || in.Day < state.Today-int64(makeup.Days) {
+		lwutil.SendError("err_day", "day out of range")
+	}
+
+	key := makeZCheckinDayKey(session.Userid)
+	resp, err := ssdbc.Do("zexists", key, in.Day)
+	lwutil.CheckSsdbError(resp, err)
+	if ssdbCheckExists(resp) {
+		lwutil.SendError("err_already_checkin", "")
+	}
+
+	//claimed like a checkin, so makeups at the same time charge once
+	rc := redisPool.Get()
+	defer rc.Close()
+	claimKey := fmt.Sprintf("%s/%d/%d", K_CHECKIN_CLAIM, session.Userid, in.Day)
+	ok, err := rc.Do("SET", claimKey, 1, "NX", "EX", CHECKIN_CLAIM_TTL_SEC)
+	lwutil.CheckError(err, "")
+	if ok == nil {
+		lwutil.SendError("err_already_checkin", "")
+	}
+
+	//coin, charged in one step and given back if it went below 0
+	playerKey := makePlayerInfoKey(session.Userid)
+	goldCoin := 0
+	if makeup.Coin > 0 {
+		resp, err = ssdbc.Do("hincr", playerKey, PLAYER_GOLD_COIN, -makeup.Coin)
+		if err != nil || resp[0] != "ok" {
+			rc.Do("DEL", claimKey)
+			lwutil.CheckSsdbError(resp, err)
+		}
+		goldCoin, err = strconv.Atoi(resp[1])
+		if err != nil || goldCoin < 0 {
+			ssdbc.Do("hincr", playerKey, PLAYER_GOLD_COIN, makeup.Coin)
+			rc.Do("DEL", claimKey)
+			lwutil.SendError("err_gold_coin", "no coin")
+		}
+		err = addEcoRecord(ssdbc, session.Userid, makeup.Coin, ECO_FORWHAT_CHECKIN_MAKEUP)
+		lwutil.CheckError(err, "err_eco_record")
+	} else {
+		goldCoin = getPlayerGoldCoin(ssdbc, playerKey)
+	}
+
+	//makeup, no reward, only the streak is restored
+	resp, err = ssdbc.Do("zset", key, in.Day, in.Day)
+	if err != nil || resp[0] != "ok" {
+		if makeup.Coin > 0 {
+			ssdbc.Do("hincr", playerKey, PLAYER_GOLD_COIN, makeup.Coin)
+		}
+		rc.Do("DEL", claimKey)
+		lwutil.CheckSsdbError(resp, err)
+	}
+
+	if in.Day > state.LastDay {
+		state.LastDay = in.Day
+	}
+	streakEnd := state.Today - 1
+	if state.LastDay >= state.Today {
+		streakEnd = state.Today
+	}
+	state.Streak = calcCheckinStreak(ssdbc, session.Userid, streakEnd)
+
+	key = makeHCheckinKey(session.Userid)
+	resp, err = ssdbc.Do("multi_hset", key,
+		CHECKIN_LAST_DAY, state.LastDay,
+		CHECKIN_STREAK, state.Streak)
+	lwutil.CheckSsdbError(resp, err)
+
+	//out
+	out := struct {
+		CheckinState
+		GoldCoin int
+	}{
+		*state,
+		goldCoin,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func regCheckin() {
+	http.Handle("/checkin/get", lwutil.ReqHandler(apiCheckinGet))
+	http.Handle("/checkin/checkin", lwutil.ReqHandler(apiCheckinCheckin))
+	http.Handle("/checkin/makeup", lwutil.ReqHandler(apiCheckinMakeup))
+}
@@ -35,6 +35,9 @@ type Conf struct {
 	// EventPublishInfoes    []EventPublishInfo
 	// PickSidePublishInfoes []EventPublishInfo
 	ChallengeRewards []int
+	Achievements     []AchievementDef
+	CheckinRewards   []CheckinReward
+	CheckinMakeup    CheckinMakeup
 }
 
 var (
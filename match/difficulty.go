@@ -0,0 +1,243 @@
+package main
+
+import (
+	"./ssdb"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+//difficulty is the geometric mean of first finish times, in msec per image.
+//first finishes are used since personal bests shrink as players memorize the images.
+//a pack is played in matches of different slider counts, so its difficulty gathers the samples of all of them
+//scaled to DIFFICULTY_SLIDER_BASE sliders, taking the time to solve an image as linear in the slider count.
+const (
+	Z_MATCH_DIFFICULTY = "Z_MATCH_DIFFICULTY" //subkey:matchId score:difficulty
+	Z_PACK_DIFFICULTY  = "Z_PACK_DIFFICULTY"  //subkey:packId score:difficulty at DIFFICULTY_SLIDER_BASE sliders
+	H_PACK_DIFFICULTY  = "H_PACK_DIFFICULTY"  //subkey:packId/DiffSampleNum|DiffLogSum value:num
+
+	MATCH_EXTRA_DIFF_SAMPLE_NUM = "DiffSampleNum"
+	MATCH_EXTRA_DIFF_LOG_SUM    = "DiffLogSum" //sum of ln(msecPerImage)*DIFFICULTY_LOG_SCALE
+
+	DIFFICULTY_MIN_SAMPLE     = 5
+	DIFFICULTY_LOG_SCALE      = 1000
+	DIFFICULTY_MSEC_MIN       = 1000
+	DIFFICULTY_MSEC_MAX       = 10 * 60 * 1000
+	DIFFICULTY_SLIDER_BASE    = 5
+	DIFFICULTY_LIST_LIMIT_MAX = 50
+	DIFFICULTY_LIST_LIMIT_DEF = 20
+)
+
+func _glogDifficulty() {
+	glog.Info("")
+}
+
+func makeHPackDifficultySubkey(packId int64, fieldKey string) string {
+	return fmt.Sprintf("%d/%s", packId, fieldKey)
+}
+
+//adds one sample to the sums under numKey and sumKey of hkey, returns the new difficulty or 0 if too few samples
+func addDifficultySample(ssdbc *ssdb.Client, hkey string, numKey string, sumKey string, msecPerImage int) int {
+	logMsec := int64(math.Log(float64(msecPerImage)) * DIFFICULTY_LOG_SCALE)
+
+	//incr
+	resp, err := ssdbc.Do("hincr", hkey, numKey, 1)
+	lwutil.CheckSsdbError(resp, err)
+	sampleNum, err := strconv.ParseInt(resp[1], 10, 64)
+	lwutil.CheckError(err, "")
+
+	resp, err = ssdbc.Do("hincr", hkey, sumKey, logMsec)
+	lwutil.CheckSsdbError(resp, err)
+	logSum, err := strconv.ParseInt(resp[1], 10, 64)
+	lwutil.CheckError(err, "")
+
+	if sampleNum < DIFFICULTY_MIN_SAMPLE {
+		return 0
+	}
+	mean := float64(logSum) / float64(sampleNum) / DIFFICULTY_LOG_SCALE
+	return int(math.Exp(mean))
+}
+
+func addMatchDifficultySample(ssdbc *ssdb.Client, match *Match, msec int) {
+	if match.ImageNum <= 0 {
+		return
+	}
+
+	//per image, clipped so one afk player can't skew the mean
+	msecPerImage := msec / match.ImageNum
+	if msecPerImage < DIFFICULTY_MSEC_MIN {
+		msecPerImage = DIFFICULTY_MSEC_MIN
+	} else if msecPerImage > DIFFICULTY_MSEC_MAX {
+		msecPerImage = DIFFICULTY_MSEC_MAX
+	}
+
+	//match
+	numKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_DIFF_SAMPLE_NUM)
+	sumKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_DIFF_LOG_SUM)
+	difficulty := addDifficultySample(ssdbc, H_MATCH_EXTRA, numKey, sumKey, msecPerImage)
+	if difficulty > 0 {
+		diffKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_DIFFICULTY)
+		resp, err := ssdbc.Do("hset", H_MATCH_EXTRA, diffKey, difficulty)
+		lwutil.CheckSsdbError(resp, err)
+
+		if !match.Private && !match.Deleted {
+			resp, err = ssdbc.Do("zset", Z_MATCH_DIFFICULTY, match.Id, difficulty)
+			lwutil.CheckSsdbError(resp, err)
+		}
+	}
+
+	//pack, at the base slider count
+	if match.PackId > 0 && match.SliderNum > 0 {
+		packMsec := msecPerImage * DIFFICULTY_SLIDER_BASE / match.SliderNum
+		numKey = makeHPackDifficultySubkey(match.PackId, MATCH_EXTRA_DIFF_SAMPLE_NUM)
+		sumKey = makeHPackDifficultySubkey(match.PackId, MATCH_EXTRA_DIFF_LOG_SUM)
+		difficulty = addDifficultySample(ssdbc, H_PACK_DIFFICULTY, numKey, sumKey, packMsec)
+		if difficulty > 0 {
+			resp, err := ssdbc.Do("zset", Z_PACK_DIFFICULTY, match.PackId, difficulty)
+			lwutil.CheckSsdbError(resp, err)
+		}
+	}
+}
+
+func apiMatchListByDifficulty(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	_, err = findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		MinDifficulty   int
+		MaxDifficulty   int
+		StartId         int64
+		StartDifficulty int
+		Limit           int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.Limit <= 0 {
+		in.Limit = DIFFICULTY_LIST_LIMIT_DEF
+	} else if in.Limit > DIFFICULTY_LIST_LIMIT_MAX {
+		in.Limit = DIFFICULTY_LIST_LIMIT_MAX
+	}
+
+	startId := ""
+	startScore := interface{}(in.MinDifficulty)
+	if in.StartId != 0 {
+		startId = fmt.Sprint(in.StartId)
+		startScore = in.StartDifficulty
+	}
+	endScore := interface{}("")
+	if in.MaxDifficulty > 0 {
+		endScore = in.MaxDifficulty
+	}
+
+	//out struct
+	type OutMatch struct {
+		Match
+		MatchExtra
+	}
+
+	type Out struct {
+		Matches []OutMatch
+	}
+	out := Out{
+		[]OutMatch{},
+	}
+
+	//get keys
+	resp, err := ssdbc.Do("zscan", Z_MATCH_DIFFICULTY, startId, startScore, endScore, in.Limit)
+	lwutil.CheckSsdbError(resp, err)
+
+	if len(resp) == 1 {
+		lwutil.WriteResponse(w, out)
+		return
+	}
+	resp = resp[1:]
+
+	//get matches
+	num := len(resp) / 2
+	args := make([]interface{}, 2, num+2)
+	args[0] = "multi_hget"
+	args[1] = H_MATCH
+	for i := 0; i < num; i++ {
+		args = append(args, resp[i*2])
+	}
+	resp, err = ssdbc.Do(args...)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	matches := make([]OutMatch, len(resp)/2)
+	m := make(map[int64]int) //key:matchId, value:index
+	for i, _ := range matches {
+		packjs := resp[i*2+1]
+		err = json.Unmarshal([]byte(packjs), &matches[i])
+		lwutil.CheckError(err, "")
+		m[matches[i].Id] = i
+	}
+
+	//match extra
+	if len(matches) > 0 {
+		args = make([]interface{}, 2, len(matches)*4+2)
+		args[0] = "multi_hget"
+		args[1] = H_MATCH_EXTRA
+		for _, v := range matches {
+			playTimesKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PLAY_TIMES)
+			prizeKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PRIZE)
+			likeNumKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_LIKE_NUM)
+			difficultyKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_DIFFICULTY)
+			args = append(args, playTimesKey, prizeKey, likeNumKey, difficultyKey)
+		}
+		resp, err = ssdbc.Do(args...)
+		lwutil.CheckSsdbError(resp, err)
+		resp = resp[1:]
+
+		num := len(resp) / 2
+		for i := 0; i < num; i++ {
+			key := resp[i*2]
+			var matchId int64
+			var fieldKey string
+			_, err = fmt.Sscanf(key, "%d/%s", &matchId, &fieldKey)
+			lwutil.CheckError(err, "")
+
+			idx := m[matchId]
+			if fieldKey == MATCH_EXTRA_PLAY_TIMES {
+				playTimes, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].PlayTimes = playTimes
+			} else if fieldKey == MATCH_EXTRA_PRIZE {
+				extraPrize, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].ExtraPrize = extraPrize
+			} else if fieldKey == MATCH_EXTRA_LIKE_NUM {
+				likeNum, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].LikeNum = likeNum
+			} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+				difficulty, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].Difficulty = difficulty
+			}
+		}
+	}
+
+	//out
+	out = Out{
+		matches,
+	}
+
+	lwutil.WriteResponse(w, out)
+}
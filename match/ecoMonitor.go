@@ -20,22 +20,46 @@ const (
 	Z_ECO_DAILY_MON     = "Z_ECO_DAILY_MON"     //key:Z_ECO_DAILY_MON/date subkey:goldCoinRecordId score:time
 	H_ECO_DAILY_COUNTER = "H_ECO_DAILY_COUNTER" //key:H_ECO_DAILY_COUNTER/date subkey:whatCounter value:count
 
-	ECO_FORWHAT_IAP          = "iap coin+"
-	ECO_FORWHAT_MATCHBEGIN   = "match begin coin-"
-	ECO_FORWHAT_MATCHPRIZE   = "match prize+"
-	ECO_FORWHAT_PUBLISHPRIZE = "publish prize+"
-	ECO_FORWHAT_BUYECARD     = "buy ecard prize-"
-	ECO_FORWHAT_ADMIN_COIN   = "admin coin+"
-	ECO_FORWHAT_ADMIN_PRIZE  = "admin prize+"
+	ECO_FORWHAT_IAP                 = "iap coin+"
+	ECO_FORWHAT_MATCHBEGIN          = "match begin coin-"
+	ECO_FORWHAT_MATCHPRIZE          = "match prize+"
+	ECO_FORWHAT_PUBLISHPRIZE        = "publish prize+"
+	ECO_FORWHAT_BUYECARD            = "buy ecard prize-"
+	ECO_FORWHAT_ADMIN_COIN          = "admin coin+"
+	ECO_FORWHAT_ADMIN_PRIZE         = "admin prize+"
+	ECO_FORWHAT_TOURNAMENT_FEE      = "tournament fee coin-"
+	ECO_FORWHAT_TOURNAMENT_PRIZE    = "tournament prize+"
+	ECO_FORWHAT_ACHIEVEMENT         = "achievement coin+"
+	ECO_FORWHAT_CHECKIN             = "checkin coin+"
+	ECO_FORWHAT_CHECKIN_MAKEUP      = "checkin makeup coin-"
+	ECO_FORWHAT_MISSION_COIN        = "mission coin+"
+	ECO_FORWHAT_MISSION_PRIZE       = "mission prize+"
+	ECO_FORWHAT_BATTLE_SEASON_COIN  = "battle season coin+"
+	ECO_FORWHAT_BATTLE_SEASON_PRIZE = "battle season prize+"
+	ECO_FORWHAT_BATTLE_BET          = "battle bet coin-"    //written by battle server
+	ECO_FORWHAT_BATTLE_PAYOUT       = "battle payout coin+" //written by battle server
+	ECO_FORWHAT_BATTLE_REFUND       = "battle refund coin+" //written by battle server
 
 	//whatCounter
-	ECO_DAILY_COUNTER_IAP          = "ECO_DAILY_COUNTER_IAP"          //count:goldCoin
-	ECO_DAILY_COUNTER_MATCHBEGIN   = "ECO_DAILY_COUNTER_MATCHBEGIN"   //count:goldCoin
-	ECO_DAILY_COUNTER_MATCHPRIZE   = "ECO_DAILY_COUNTER_MATCHPRIZE"   //count:prize
-	ECO_DAILY_COUNTER_PUBLISHPRIZE = "ECO_DAILY_COUNTER_PUBLISHPRIZE" //count:prize
-	ECO_DAILY_COUNTER_BUYECARD     = "ECO_DAILY_COUNTER_BUYECARD"     //count:prize
-	ECO_DAILY_COUNTER_ADMIN_COIN   = "ECO_DAILY_COUNTER_ADMIN_COIN"   //count:goldCoin
-	ECO_DAILY_COUNTER_ADMIN_PRIZE  = "ECO_DAILY_COUNTER_ADMIN_PRIZE"  //count:prize
+	ECO_DAILY_COUNTER_IAP                 = "ECO_DAILY_COUNTER_IAP"                 //count:goldCoin
+	ECO_DAILY_COUNTER_MATCHBEGIN          = "ECO_DAILY_COUNTER_MATCHBEGIN"          //count:goldCoin
+	ECO_DAILY_COUNTER_MATCHPRIZE          = "ECO_DAILY_COUNTER_MATCHPRIZE"          //count:prize
+	ECO_DAILY_COUNTER_PUBLISHPRIZE        = "ECO_DAILY_COUNTER_PUBLISHPRIZE"        //count:prize
+	ECO_DAILY_COUNTER_BUYECARD            = "ECO_DAILY_COUNTER_BUYECARD"            //count:prize
+	ECO_DAILY_COUNTER_ADMIN_COIN          = "ECO_DAILY_COUNTER_ADMIN_COIN"          //count:goldCoin
+	ECO_DAILY_COUNTER_ADMIN_PRIZE         = "ECO_DAILY_COUNTER_ADMIN_PRIZE"         //count:prize
+	ECO_DAILY_COUNTER_TOURNAMENT_FEE      = "ECO_DAILY_COUNTER_TOURNAMENT_FEE"      //count:goldCoin
+	ECO_DAILY_COUNTER_TOURNAMENT_PRIZE    = "ECO_DAILY_COUNTER_TOURNAMENT_PRIZE"    //count:prize
+	ECO_DAILY_COUNTER_ACHIEVEMENT         = "ECO_DAILY_COUNTER_ACHIEVEMENT"         //count:goldCoin
+	ECO_DAILY_COUNTER_CHECKIN             = "ECO_DAILY_COUNTER_CHECKIN"             //count:goldCoin
+	ECO_DAILY_COUNTER_CHECKIN_MAKEUP      = "ECO_DAILY_COUNTER_CHECKIN_MAKEUP"      //count:goldCoin
+	ECO_DAILY_COUNTER_MISSION_COIN        = "ECO_DAILY_COUNTER_MISSION_COIN"        //count:goldCoin
+	ECO_DAILY_COUNTER_MISSION_PRIZE       = "ECO_DAILY_COUNTER_MISSION_PRIZE"       //count:prize
+	ECO_DAILY_COUNTER_BATTLE_SEASON_COIN  = "ECO_DAILY_COUNTER_BATTLE_SEASON_COIN"  //count:goldCoin
+	ECO_DAILY_COUNTER_BATTLE_SEASON_PRIZE = "ECO_DAILY_COUNTER_BATTLE_SEASON_PRIZE" //count:prize
+	ECO_DAILY_COUNTER_BATTLE_BET          = "ECO_DAILY_COUNTER_BATTLE_BET"          //count:goldCoin
+	ECO_DAILY_COUNTER_BATTLE_PAYOUT       = "ECO_DAILY_COUNTER_BATTLE_PAYOUT"       //count:goldCoin
+	ECO_DAILY_COUNTER_BATTLE_REFUND       = "ECO_DAILY_COUNTER_BATTLE_REFUND"       //count:goldCoin
 )
 
 type EcoRecord struct {
@@ -122,6 +146,30 @@ func addEcoRecord(ssdbc *ssdb.Client, userId int64, count int, forWhat string) (
 		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_ADMIN_COIN, count)
 	} else if forWhat == ECO_FORWHAT_ADMIN_PRIZE {
 		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_ADMIN_PRIZE, count)
+	} else if forWhat == ECO_FORWHAT_TOURNAMENT_FEE {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_TOURNAMENT_FEE, count)
+	} else if forWhat == ECO_FORWHAT_TOURNAMENT_PRIZE {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_TOURNAMENT_PRIZE, count)
+	} else if forWhat == ECO_FORWHAT_ACHIEVEMENT {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_ACHIEVEMENT, count)
+	} else if forWhat == ECO_FORWHAT_CHECKIN {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_CHECKIN, count)
+	} else if forWhat == ECO_FORWHAT_CHECKIN_MAKEUP {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_CHECKIN_MAKEUP, count)
+	} else if forWhat == ECO_FORWHAT_MISSION_COIN {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_MISSION_COIN, count)
+	} else if forWhat == ECO_FORWHAT_MISSION_PRIZE {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_MISSION_PRIZE, count)
+	} else if forWhat == ECO_FORWHAT_BATTLE_SEASON_COIN {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_BATTLE_SEASON_COIN, count)
+	} else if forWhat == ECO_FORWHAT_BATTLE_SEASON_PRIZE {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_BATTLE_SEASON_PRIZE, count)
+	} else if forWhat == ECO_FORWHAT_BATTLE_BET {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_BATTLE_BET, count)
+	} else if forWhat == ECO_FORWHAT_BATTLE_PAYOUT {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_BATTLE_PAYOUT, count)
+	} else if forWhat == ECO_FORWHAT_BATTLE_REFUND {
+		_, err = ssdbc.Do("hincr", key, ECO_DAILY_COUNTER_BATTLE_REFUND, count)
 	}
 
 	return err
@@ -52,9 +52,10 @@ func main() {
 	// initPickSide()
 	initAdmin()
 	initStore()
+	initBattleRooms()
 
 	if isReleaseServer() {
-		_cron.AddFunc("0 19 3 * * *", backupTask)
+		_cron.AddFunc("0 19 3 * * *", cronTask(backupTask))
 	}
 
 	_cron.Start()
@@ -76,6 +77,14 @@ func main() {
 	regBattle()
 	regTumblr()
 	regChannel()
+	regTournament()
+	regCheckin()
+	regMission()
+	regBattleSeason()
+	regBattleHistory()
+	regBattlePack()
+	regBattleChat()
+	regBattleCollusion()
 	// regEvent()
 	// regChallenge()
 	// regUserPack()
@@ -87,5 +96,5 @@ func main() {
 	runMatchCron()
 	// backupTask()
 
-	glog.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", _conf.Port), nil))
+	serveUntilSignal(fmt.Sprintf(":%d", _conf.Port))
 }
@@ -39,6 +39,9 @@ const (
 	RDS_Z_MATCH_LEADERBOARD = "RDS_Z_MATCH_LEADERBOARD" //key:RDS_Z_MATCH_LEADERBOARD/matchId
 	Z_MATCH_LIKER           = "Z_MATCH_LIKER"           //key:Z_MATCH_LIKER/matchId subkey:userId score:time
 	Q_MATCH_ACTIVITY        = "Q_MATCH_ACTIVITY"        //key:Q_MATCH_ACTIVITY/matchId subkey:userId score:time
+	H_MATCH_GHOST_STAT      = "H_MATCH_GHOST_STAT"      //key:H_MATCH_GHOST_STAT/matchId subkey:ghostUserId/fieldKey value:count
+	H_MATCH_GHOST_RACE      = "H_MATCH_GHOST_RACE"      //key:H_MATCH_GHOST_RACE subkey:matchId/userId/ghostUserId value:ghostRaceJson
+	GHOST_SECRET            = "GHOST_SECRET"            //key:GHOST_SECRET/secret value:ghostInfoJson, expires
 	Q_MATCH_DEL_LIMIT       = 50
 
 	PRIZE_NUM_PER_COIN         = 100
@@ -84,12 +87,19 @@ type MatchExtra struct {
 	PlayTimes  int
 	ExtraPrize int
 	LikeNum    int
+	Difficulty int
 }
 
 const (
 	MATCH_EXTRA_PLAY_TIMES = "PlayTimes"
 	MATCH_EXTRA_PRIZE      = "ExtraPrize"
 	MATCH_EXTRA_LIKE_NUM   = "LikeNum"
+	MATCH_EXTRA_DIFFICULTY = "Difficulty"
+)
+
+const (
+	GHOST_STAT_RACES = "Races"
+	GHOST_STAT_BEATS = "Beats"
 )
 
 type MatchPlay struct {
@@ -104,11 +114,26 @@ type MatchPlay struct {
 	Team             string
 	Secret           string
 	SecretExpire     int64
+	ShuffleSeed      int64 //deals the slider shuffle of the current try
 	LuckyNums        []int64
 	Prize            int
 	Like             bool
 	Played           bool
 	PrivateLike      bool
+	HasReplay        bool
+}
+
+type GhostRace struct {
+	Msec      int
+	GhostMsec int
+	Win       bool
+	Time      int64
+}
+
+type GhostStat struct {
+	GhostUserId int64
+	Races       int
+	Beats       int
 }
 
 type MatchActivity struct {
@@ -199,6 +224,22 @@ func makeZTimelineMatchKey(userId int64) string {
 	return fmt.Sprintf("%s/%d", Z_MATCH_TIMELINE, userId)
 }
 
+func makeGhostSecretKey(secret string) string {
+	return fmt.Sprintf("%s/%s", GHOST_SECRET, secret)
+}
+
+func makeHMatchGhostStatKey(matchId int64) string {
+	return fmt.Sprintf("%s/%d", H_MATCH_GHOST_STAT, matchId)
+}
+
+func makeHMatchGhostStatSubkey(ghostUserId int64, fieldKey string) string {
+	return fmt.Sprintf("%d/%s", ghostUserId, fieldKey)
+}
+
+func makeMatchGhostRaceSubkey(matchId int64, userId int64, ghostUserId int64) string {
+	return fmt.Sprintf("%d/%d/%d", matchId, userId, ghostUserId)
+}
+
 func makePlayerMatchInfo(matchPlay *MatchPlay) *PlayerMatchInfo {
 	if matchPlay == nil {
 		return nil
@@ -616,6 +657,9 @@ func apiMatchNew(w http.ResponseWriter, r *http.Request) {
 		addPlayerGoldCoin(ssdbc, playerKey, -in.GoldCoinForPrize)
 	}
 
+	//achievement
+	addAchievementStat(ssdbc, session.Userid, ACHV_STAT_PUBLISH, 1)
+
 	//fanout
 	go fanout(&match)
 
@@ -668,6 +712,9 @@ func apiMatchDel(w http.ResponseWriter, r *http.Request) {
 	resp, err = ssdbc.Do("zdel", Z_HOT_MATCH, in.MatchId)
 	lwutil.CheckSsdbError(resp, err)
 
+	resp, err = ssdbc.Do("zdel", Z_MATCH_DIFFICULTY, in.MatchId)
+	lwutil.CheckSsdbError(resp, err)
+
 	key := makeZPlayerMatchKey(session.Userid)
 	resp, err = ssdbc.Do("zdel", key, in.MatchId)
 	lwutil.CheckSsdbError(resp, err)
@@ -751,12 +798,24 @@ func apiMatchMod(w http.ResponseWriter, r *http.Request) {
 
 			resp, err = ssdbc.Do("zdel", Z_HOT_MATCH, in.MatchId)
 			lwutil.CheckSsdbError(resp, err)
+
+			resp, err = ssdbc.Do("zdel", Z_MATCH_DIFFICULTY, in.MatchId)
+			lwutil.CheckSsdbError(resp, err)
 		} else {
 			if !match.Deleted {
 				//add to Z_MATCH
 				resp, err := ssdbc.Do("zset", Z_MATCH, match.Id, match.BeginTime)
 				lwutil.CheckSsdbError(resp, err)
 
+				//Z_MATCH_DIFFICULTY
+				diffKey := makeHMatchExtraSubkey(in.MatchId, MATCH_EXTRA_DIFFICULTY)
+				resp, err = ssdbc.Do("hget", H_MATCH_EXTRA, diffKey)
+				lwutil.CheckError(err, "")
+				if resp[0] == "ok" {
+					resp, err = ssdbc.Do("zset", Z_MATCH_DIFFICULTY, in.MatchId, resp[1])
+					lwutil.CheckSsdbError(resp, err)
+				}
+
 				if !match.HasResult {
 					//Z_HOT_MATCH
 					prizeKey := makeHMatchExtraSubkey(in.MatchId, MATCH_EXTRA_PRIZE)
@@ -903,7 +962,8 @@ func apiMatchList(w http.ResponseWriter, r *http.Request) {
 			playTimesKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PLAY_TIMES)
 			prizeKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PRIZE)
 			likeNumKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_LIKE_NUM)
-			args = append(args, playTimesKey, prizeKey, likeNumKey)
+			difficultyKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_DIFFICULTY)
+			args = append(args, playTimesKey, prizeKey, likeNumKey, difficultyKey)
 		}
 		resp, err = ssdbc.Do(args...)
 		lwutil.CheckSsdbError(resp, err)
@@ -930,6 +990,10 @@ func apiMatchList(w http.ResponseWriter, r *http.Request) {
 				likeNum, err := strconv.Atoi(resp[i*2+1])
 				lwutil.CheckError(err, "")
 				matches[idx].LikeNum = likeNum
+			} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+				difficulty, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].Difficulty = difficulty
 			}
 		}
 	}
@@ -1019,7 +1083,8 @@ func apiMatchListMine(w http.ResponseWriter, r *http.Request) {
 			playTimesKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PLAY_TIMES)
 			prizeKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PRIZE)
 			likeNumKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_LIKE_NUM)
-			args = append(args, playTimesKey, prizeKey, likeNumKey)
+			difficultyKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_DIFFICULTY)
+			args = append(args, playTimesKey, prizeKey, likeNumKey, difficultyKey)
 		}
 		resp, err = ssdbc.Do(args...)
 		lwutil.CheckSsdbError(resp, err)
@@ -1046,6 +1111,10 @@ func apiMatchListMine(w http.ResponseWriter, r *http.Request) {
 				likeNum, err := strconv.Atoi(resp[i*2+1])
 				lwutil.CheckError(err, "")
 				matches[idx].LikeNum = likeNum
+			} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+				difficulty, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].Difficulty = difficulty
 			}
 		}
 	}
@@ -1158,7 +1227,8 @@ func apiMatchListOriginal(w http.ResponseWriter, r *http.Request) {
 			playTimesKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PLAY_TIMES)
 			prizeKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PRIZE)
 			likeNumKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_LIKE_NUM)
-			args = append(args, playTimesKey, prizeKey, likeNumKey)
+			difficultyKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_DIFFICULTY)
+			args = append(args, playTimesKey, prizeKey, likeNumKey, difficultyKey)
 		}
 		resp, err = ssdbc.Do(args...)
 		lwutil.CheckSsdbError(resp, err)
@@ -1185,6 +1255,10 @@ func apiMatchListOriginal(w http.ResponseWriter, r *http.Request) {
 				likeNum, err := strconv.Atoi(resp[i*2+1])
 				lwutil.CheckError(err, "")
 				matches[idx].LikeNum = likeNum
+			} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+				difficulty, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].Difficulty = difficulty
 			}
 		}
 	}
@@ -1302,7 +1376,8 @@ func apiMatchListPlayedMatch(w http.ResponseWriter, r *http.Request) {
 			playTimesKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PLAY_TIMES)
 			prizeKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PRIZE)
 			likeNumKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_LIKE_NUM)
-			args = append(args, playTimesKey, prizeKey, likeNumKey)
+			difficultyKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_DIFFICULTY)
+			args = append(args, playTimesKey, prizeKey, likeNumKey, difficultyKey)
 		}
 		resp, err = ssdbc.Do(args...)
 		lwutil.CheckSsdbError(resp, err)
@@ -1329,6 +1404,10 @@ func apiMatchListPlayedMatch(w http.ResponseWriter, r *http.Request) {
 				likeNum, err := strconv.Atoi(resp[i*2+1])
 				lwutil.CheckError(err, "")
 				matches[idx].LikeNum = likeNum
+			} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+				difficulty, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].Difficulty = difficulty
 			}
 		}
 	}
@@ -1444,7 +1523,8 @@ func apiMatchListPlayedAll(w http.ResponseWriter, r *http.Request) {
 			playTimesKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PLAY_TIMES)
 			prizeKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PRIZE)
 			likeNumKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_LIKE_NUM)
-			args = append(args, playTimesKey, prizeKey, likeNumKey)
+			difficultyKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_DIFFICULTY)
+			args = append(args, playTimesKey, prizeKey, likeNumKey, difficultyKey)
 		}
 		resp, err = ssdbc.Do(args...)
 		lwutil.CheckSsdbError(resp, err)
@@ -1471,6 +1551,10 @@ func apiMatchListPlayedAll(w http.ResponseWriter, r *http.Request) {
 				likeNum, err := strconv.Atoi(resp[i*2+1])
 				lwutil.CheckError(err, "")
 				matches[idx].LikeNum = likeNum
+			} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+				difficulty, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].Difficulty = difficulty
 			}
 		}
 	}
@@ -1601,7 +1685,8 @@ func apiMatchListTimeline(w http.ResponseWriter, r *http.Request) {
 	for _, match := range out.Matches {
 		playTimesKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_PLAY_TIMES)
 		likeNumKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_LIKE_NUM)
-		cmds = append(cmds, playTimesKey, likeNumKey)
+		difficultyKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_DIFFICULTY)
+		cmds = append(cmds, playTimesKey, likeNumKey, difficultyKey)
 	}
 	resp, err = ssdbc.Do(cmds...)
 	lwutil.CheckSsdbError(resp, err)
@@ -1627,6 +1712,9 @@ func apiMatchListTimeline(w http.ResponseWriter, r *http.Request) {
 		} else if fieldKey == MATCH_EXTRA_LIKE_NUM {
 			matchEx.LikeNum, err = strconv.Atoi(resp[i*2+1])
 			lwutil.CheckError(err, "")
+		} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+			matchEx.Difficulty, err = strconv.Atoi(resp[i*2+1])
+			lwutil.CheckError(err, "")
 		}
 		out.MatchExMap[matchIdStr] = matchEx
 	}
@@ -1730,7 +1818,8 @@ func apiMatchListMyPlayed(w http.ResponseWriter, r *http.Request) {
 			playTimesKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PLAY_TIMES)
 			prizeKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PRIZE)
 			likeNumKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PRIZE)
-			args = append(args, playTimesKey, prizeKey, likeNumKey)
+			difficultyKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_DIFFICULTY)
+			args = append(args, playTimesKey, prizeKey, likeNumKey, difficultyKey)
 		}
 		resp, err = ssdbc.Do(args...)
 		lwutil.CheckSsdbError(resp, err)
@@ -1757,6 +1846,10 @@ func apiMatchListMyPlayed(w http.ResponseWriter, r *http.Request) {
 				likeNum, err := strconv.Atoi(resp[i*2+1])
 				lwutil.CheckError(err, "")
 				matches[idx].LikeNum = likeNum
+			} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+				difficulty, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].Difficulty = difficulty
 			}
 		}
 	}
@@ -1859,7 +1952,8 @@ func apiMatchListHot(w http.ResponseWriter, r *http.Request) {
 			playTimesKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PLAY_TIMES)
 			prizeKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PRIZE)
 			likeNumKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_LIKE_NUM)
-			args = append(args, playTimesKey, prizeKey, likeNumKey)
+			difficultyKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_DIFFICULTY)
+			args = append(args, playTimesKey, prizeKey, likeNumKey, difficultyKey)
 		}
 		resp, err = ssdbc.Do(args...)
 		lwutil.CheckSsdbError(resp, err)
@@ -1886,6 +1980,10 @@ func apiMatchListHot(w http.ResponseWriter, r *http.Request) {
 				likeNum, err := strconv.Atoi(resp[i*2+1])
 				lwutil.CheckError(err, "")
 				matches[idx].LikeNum = likeNum
+			} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+				difficulty, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].Difficulty = difficulty
 			}
 		}
 	}
@@ -2002,7 +2100,8 @@ func apiMatchListLike(w http.ResponseWriter, r *http.Request) {
 			playTimesKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PLAY_TIMES)
 			prizeKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_PRIZE)
 			likeNumKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_LIKE_NUM)
-			args = append(args, playTimesKey, prizeKey, likeNumKey)
+			difficultyKey := makeHMatchExtraSubkey(v.Id, MATCH_EXTRA_DIFFICULTY)
+			args = append(args, playTimesKey, prizeKey, likeNumKey, difficultyKey)
 		}
 		resp, err = ssdbc.Do(args...)
 		lwutil.CheckSsdbError(resp, err)
@@ -2029,6 +2128,10 @@ func apiMatchListLike(w http.ResponseWriter, r *http.Request) {
 				likeNum, err := strconv.Atoi(resp[i*2+1])
 				lwutil.CheckError(err, "")
 				matches[idx].LikeNum = likeNum
+			} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+				difficulty, err := strconv.Atoi(resp[i*2+1])
+				lwutil.CheckError(err, "")
+				matches[idx].Difficulty = difficulty
 			}
 		}
 	}
@@ -2278,7 +2381,8 @@ func apiMatchListUserWebQ(w http.ResponseWriter, r *http.Request) {
 	for _, match := range matches {
 		playTimesKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_PLAY_TIMES)
 		likeNumKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_LIKE_NUM)
-		args = append(args, playTimesKey, likeNumKey)
+		difficultyKey := makeHMatchExtraSubkey(match.Id, MATCH_EXTRA_DIFFICULTY)
+		args = append(args, playTimesKey, likeNumKey, difficultyKey)
 	}
 	resp, err = ssdbc.Do(args...)
 	lwutil.CheckSsdbError(resp, err)
@@ -2304,6 +2408,9 @@ func apiMatchListUserWebQ(w http.ResponseWriter, r *http.Request) {
 		} else if fieldKey == MATCH_EXTRA_LIKE_NUM {
 			matchEx.LikeNum, err = strconv.Atoi(resp[i*2+1])
 			lwutil.CheckError(err, "")
+		} else if fieldKey == MATCH_EXTRA_DIFFICULTY {
+			matchEx.Difficulty, err = strconv.Atoi(resp[i*2+1])
+			lwutil.CheckError(err, "")
 		}
 		out.MatchExMap[matchIdStr] = matchEx
 	}
@@ -2376,7 +2483,8 @@ func apiMatchGetDynamicData(w http.ResponseWriter, r *http.Request) {
 	playTimesKey := makeHMatchExtraSubkey(in.MatchId, MATCH_EXTRA_PLAY_TIMES)
 	prizeKey := makeHMatchExtraSubkey(in.MatchId, MATCH_EXTRA_PRIZE)
 	likeNumKey := makeHMatchExtraSubkey(in.MatchId, MATCH_EXTRA_LIKE_NUM)
-	args = append(args, playTimesKey, prizeKey, likeNumKey)
+	difficultyKey := makeHMatchExtraSubkey(in.MatchId, MATCH_EXTRA_DIFFICULTY)
+	args = append(args, playTimesKey, prizeKey, likeNumKey, difficultyKey)
 	resp, err := ssdbc.Do(args...)
 	lwutil.CheckSsdbError(resp, err)
 	resp = resp[1:]
@@ -2384,6 +2492,7 @@ func apiMatchGetDynamicData(w http.ResponseWriter, r *http.Request) {
 	var playTimes int
 	var extraPrize int
 	var likeNum int
+	var difficulty int
 	num := len(resp) / 2
 	for i := 0; i < num; i++ {
 		if resp[i*2] == playTimesKey {
@@ -2395,6 +2504,9 @@ func apiMatchGetDynamicData(w http.ResponseWriter, r *http.Request) {
 		} else if resp[i*2] == likeNumKey {
 			likeNum, err = strconv.Atoi(resp[i*2+1])
 			lwutil.CheckError(err, "")
+		} else if resp[i*2] == difficultyKey {
+			difficulty, err = strconv.Atoi(resp[i*2+1])
+			lwutil.CheckError(err, "")
 		}
 	}
 
@@ -2446,6 +2558,7 @@ func apiMatchGetDynamicData(w http.ResponseWriter, r *http.Request) {
 		PlayTimes  int
 		ExtraPrize int
 		LikeNum    int
+		Difficulty int
 		MyRank     int
 		RankNum    int
 		MatchPlay
@@ -2453,6 +2566,7 @@ func apiMatchGetDynamicData(w http.ResponseWriter, r *http.Request) {
 		playTimes,
 		extraPrize,
 		likeNum,
+		difficulty,
 		myRank,
 		rankNum,
 		*play,
@@ -2515,6 +2629,8 @@ func apiMatchPlayBegin(w http.ResponseWriter, r *http.Request) {
 	autoPaging := false
 	if play.FreeTries > 0 {
 		play.FreeTries--
+	} else if useBonusFreeTry(ssdbc, playerKey) {
+		//free try from checkin
 	} else {
 		if goldCoin > 0 {
 			addPlayerGoldCoin(ssdbc, playerKey, -1)
@@ -2551,6 +2667,8 @@ func apiMatchPlayBegin(w http.ResponseWriter, r *http.Request) {
 	play.Secret = lwutil.GenUUID()
 	play.SecretExpire = lwutil.GetRedisTimeUnix() + MATCH_TRY_EXPIRE_SECONDS
 
+	play.ShuffleSeed = genShuffleSeed()
+
 	secretKey := makeSecretKey(play.Secret)
 	resp, err = ssdbc.Do("setx", secretKey, in.MatchId, MATCH_TRY_EXPIRE_SECONDS)
 	lwutil.CheckSsdbError(resp, err)
@@ -2575,6 +2693,7 @@ func apiMatchPlayBegin(w http.ResponseWriter, r *http.Request) {
 	out := map[string]interface{}{
 		"Secret":       play.Secret,
 		"SecretExpire": play.SecretExpire,
+		"ShuffleSeed":  play.ShuffleSeed,
 		"LuckyNum":     luckyNum,
 		"GoldCoin":     goldCoin,
 		"FreeTries":    play.FreeTries,
@@ -2603,6 +2722,7 @@ func apiMatchPlayEnd(w http.ResponseWriter, r *http.Request) {
 		Secret   string
 		Score    int
 		Checksum string
+		Replay   *Replay
 	}
 	err = lwutil.DecodeRequestBody(r, &in)
 	lwutil.CheckError(err, "err_decode_body")
@@ -2649,15 +2769,35 @@ func apiMatchPlayEnd(w http.ResponseWriter, r *http.Request) {
 		lwutil.SendError("err_expired", "secret expired")
 	}
 
+	//get match
+	match := getMatch(ssdbc, in.MatchId)
+
+	//check replay
+	if in.Replay != nil && matchPlay.ShuffleSeed == 0 {
+		//the try began before seeds were issued, there's no shuffle to check it against
+		in.Replay = nil
+	}
+	if in.Replay != nil {
+		inits := makeReplayInits(matchPlay.ShuffleSeed, match.SliderNum, match.ImageNum)
+		err = checkReplay(in.Replay, inits, match.SliderNum, -in.Score)
+		if err != nil {
+			glog.Errorf("invalid replay:%v, userId:%d, userName:%s", err, session.Userid, session.Username)
+			lwutil.SendError("err_replay", err.Error())
+		}
+	}
+
 	//clear secret
 	matchPlay.SecretExpire = 0
+	matchPlay.ShuffleSeed = 0
 
 	//update score
 	scoreUpdate := false
+	firstFinish := false
 	if matchPlay.HighScore == 0 {
 		matchPlay.HighScore = in.Score
 		matchPlay.HighScoreTime = now
 		scoreUpdate = true
+		firstFinish = true
 	} else {
 		if in.Score > matchPlay.HighScore {
 			matchPlay.HighScore = in.Score
@@ -2666,6 +2806,22 @@ func apiMatchPlayEnd(w http.ResponseWriter, r *http.Request) {
 	}
 	matchPlay.Played = true
 
+	//difficulty, sampled on first finish only
+	if firstFinish {
+		addMatchDifficultySample(ssdbc, match, -in.Score)
+	}
+
+	//save replay of personal best
+	if scoreUpdate {
+		if in.Replay != nil {
+			saveReplay(ssdbc, in.MatchId, session.Userid, in.Replay)
+			matchPlay.HasReplay = true
+		} else if matchPlay.HasReplay {
+			delReplay(ssdbc, in.MatchId, session.Userid)
+			matchPlay.HasReplay = false
+		}
+	}
+
 	//save match play
 	js, err := json.Marshal(matchPlay)
 	resp, err = ssdbc.Do("hset", H_MATCH_PLAY, matchPlayKey, js)
@@ -2703,6 +2859,11 @@ func apiMatchPlayEnd(w http.ResponseWriter, r *http.Request) {
 	text := fmt.Sprintf("进行了一场比赛，用时%s", t)
 	addMatchActivity(ssdbc, in.MatchId, session.Userid, text)
 
+	//achievement and mission
+	addAchievementStat(ssdbc, session.Userid, ACHV_STAT_FINISH, 1)
+	addAchievementPlayDay(ssdbc, session.Userid)
+	addMissionProgress(ssdbc, session.Userid, MISSION_EVENT_MATCH_PLAY, 1)
+
 	//out
 	out := struct {
 		MyRank  uint32
@@ -2802,6 +2963,263 @@ func apiMatchFreePlay(w http.ResponseWriter, r *http.Request) {
 	lwutil.WriteResponse(w, in)
 }
 
+func apiMatchGhostBegin(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		MatchId     int64
+		GhostUserId int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//get match
+	match := getMatch(ssdbc, in.MatchId)
+	if match.Deleted {
+		lwutil.SendError("err_deleted", "match deleted")
+	}
+
+	//get ghost
+	replay, err := getReplay(ssdbc, in.MatchId, in.GhostUserId)
+	lwutil.CheckError(err, "err_replay")
+	if replay == nil {
+		lwutil.SendError("err_not_found", "ghost not found")
+	}
+	ghostPlayer, err := getPlayerInfoLite(ssdbc, in.GhostUserId, nil)
+	lwutil.CheckError(err, "err_player")
+
+	//gen secret
+	secret := lwutil.GenUUID()
+	secretExpire := lwutil.GetRedisTimeUnix() + MATCH_TRY_EXPIRE_SECONDS
+
+	ghostInfo := struct {
+		MatchId     int64
+		UserId      int64
+		GhostUserId int64
+		GhostMsec   int
+	}{
+		in.MatchId,
+		session.Userid,
+		in.GhostUserId,
+		replay.Msec,
+	}
+	js, err := json.Marshal(ghostInfo)
+	lwutil.CheckError(err, "")
+
+	secretKey := makeGhostSecretKey(secret)
+	resp, err := ssdbc.Do("setx", secretKey, js, MATCH_TRY_EXPIRE_SECONDS)
+	lwutil.CheckSsdbError(resp, err)
+
+	//out
+	out := struct {
+		Secret       string
+		SecretExpire int64
+		SliderNum    int
+		GhostPlayer  *PlayerInfoLite
+		Ghost        *Replay
+	}{
+		secret,
+		secretExpire,
+		match.SliderNum,
+		ghostPlayer,
+		replay,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiMatchGhostEnd(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		Secret   string
+		Score    int
+		Checksum string
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//check score
+	if in.Score > -2000 {
+		lwutil.SendError("err_score", "invalid score")
+	}
+
+	//secret
+	secretKey := makeGhostSecretKey(in.Secret)
+	resp, err := ssdbc.Do("get", secretKey)
+	lwutil.CheckError(err, "")
+	if resp[0] != "ok" {
+		lwutil.SendError("err_expired", "secret expired")
+	}
+	var ghostInfo struct {
+		MatchId     int64
+		UserId      int64
+		GhostUserId int64
+		GhostMsec   int
+	}
+	err = json.Unmarshal([]byte(resp[1]), &ghostInfo)
+	lwutil.CheckError(err, "")
+	if ghostInfo.UserId != session.Userid {
+		lwutil.SendError("err_not_match", "Secret not match")
+	}
+
+	//checksum
+	checksum := fmt.Sprintf("%s+%d9d7a", in.Secret, in.Score+8703)
+	hasher := sha1.New()
+	hasher.Write([]byte(checksum))
+	checksum = hex.EncodeToString(hasher.Sum(nil))
+	if in.Checksum != checksum {
+		lwutil.SendError("err_checksum", "")
+	}
+
+	//clear secret
+	resp, err = ssdbc.Do("del", secretKey)
+	lwutil.CheckSsdbError(resp, err)
+
+	//result
+	now := lwutil.GetRedisTimeUnix()
+	race := GhostRace{
+		Msec:      -in.Score,
+		GhostMsec: ghostInfo.GhostMsec,
+		Win:       -in.Score < ghostInfo.GhostMsec,
+		Time:      now,
+	}
+	js, err := json.Marshal(race)
+	lwutil.CheckError(err, "")
+	raceSubkey := makeMatchGhostRaceSubkey(ghostInfo.MatchId, session.Userid, ghostInfo.GhostUserId)
+	resp, err = ssdbc.Do("hset", H_MATCH_GHOST_RACE, raceSubkey, js)
+	lwutil.CheckSsdbError(resp, err)
+
+	//ghost stat
+	statKey := makeHMatchGhostStatKey(ghostInfo.MatchId)
+	subkey := makeHMatchGhostStatSubkey(ghostInfo.GhostUserId, GHOST_STAT_RACES)
+	resp, err = ssdbc.Do("hincr", statKey, subkey, 1)
+	lwutil.CheckSsdbError(resp, err)
+	if race.Win {
+		subkey = makeHMatchGhostStatSubkey(ghostInfo.GhostUserId, GHOST_STAT_BEATS)
+		resp, err = ssdbc.Do("hincr", statKey, subkey, 1)
+		lwutil.CheckSsdbError(resp, err)
+	}
+
+	playNumKey := makeHMatchExtraSubkey(ghostInfo.MatchId, MATCH_EXTRA_PLAY_TIMES)
+	resp, err = ssdbc.Do("hincr", H_MATCH_EXTRA, playNumKey, 1)
+	lwutil.CheckSsdbError(resp, err)
+
+	//activity
+	ghostPlayer, err := getPlayerInfoLite(ssdbc, ghostInfo.GhostUserId, nil)
+	lwutil.CheckError(err, "err_player")
+	resultText := "输了"
+	if race.Win {
+		resultText = "赢了"
+	}
+	text := fmt.Sprintf("挑战%s的影子，用时%s，%s", ghostPlayer.NickName, formateMsec(race.Msec), resultText)
+	addMatchActivity(ssdbc, ghostInfo.MatchId, session.Userid, text)
+
+	//
+	key := makeZPlayedAllKey(session.Userid)
+	resp, err = ssdbc.Do("zset", key, ghostInfo.MatchId, now)
+	lwutil.CheckSsdbError(resp, err)
+
+	//out
+	out := struct {
+		MatchId     int64
+		GhostUserId int64
+		GhostRace
+	}{
+		ghostInfo.MatchId,
+		ghostInfo.GhostUserId,
+		race,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiMatchListGhostStat(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		MatchId int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//check owner
+	match := getMatch(ssdbc, in.MatchId)
+	if match.OwnerId != session.Userid && !isAdmin(session.Username) {
+		lwutil.SendError("err_owner", "not the match's owner")
+	}
+
+	//
+	statKey := makeHMatchGhostStatKey(in.MatchId)
+	resp, err := ssdbc.Do("hgetall", statKey)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	statMap := make(map[int64]*GhostStat)
+	ghostUserIds := make([]int64, 0, 16)
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		strs := strings.Split(resp[i*2], "/")
+		if len(strs) != 2 {
+			continue
+		}
+		ghostUserId, err := strconv.ParseInt(strs[0], 10, 64)
+		lwutil.CheckError(err, "err_strconv")
+		count, err := strconv.Atoi(resp[i*2+1])
+		lwutil.CheckError(err, "err_strconv")
+
+		stat := statMap[ghostUserId]
+		if stat == nil {
+			stat = &GhostStat{GhostUserId: ghostUserId}
+			statMap[ghostUserId] = stat
+			ghostUserIds = append(ghostUserIds, ghostUserId)
+		}
+		if strs[1] == GHOST_STAT_RACES {
+			stat.Races = count
+		} else if strs[1] == GHOST_STAT_BEATS {
+			stat.Beats = count
+		}
+	}
+
+	//out
+	out := make([]*GhostStat, 0, len(ghostUserIds))
+	for _, ghostUserId := range ghostUserIds {
+		out = append(out, statMap[ghostUserId])
+	}
+	lwutil.WriteResponse(w, out)
+}
+
 func apiMatchListActivity(w http.ResponseWriter, r *http.Request) {
 	var err error
 	lwutil.CheckMathod(r, "POST")
@@ -2880,6 +3298,7 @@ func apiMatchGetRanks(w http.ResponseWriter, r *http.Request) {
 		Score           int
 		Time            int64
 		Tries           int
+		HasReplay       bool
 	}
 
 	type Out struct {
@@ -3008,6 +3427,7 @@ func apiMatchGetRanks(w http.ResponseWriter, r *http.Request) {
 		ranks[i].TeamName = play.Team
 		ranks[i].GravatarKey = play.GravatarKey
 		ranks[i].CustomAvatarKey = play.CustomAvartarKey
+		ranks[i].HasReplay = play.HasReplay
 	}
 
 	//out
@@ -3110,8 +3530,12 @@ func apiMatchLike(w http.ResponseWriter, r *http.Request) {
 	resp, err = ssdbc.Do("qpush_back", key, newMatch.RepostId)
 	lwutil.CheckSsdbError(resp, err)
 
-	//update matchLiker list
+	//update matchLiker list, liking again only reposts
 	key = makeZMatchLikerKey(newMatch.Id)
+	resp, err = ssdbc.Do("zexists", key, session.Userid)
+	lwutil.CheckSsdbError(resp, err)
+	newLike := !ssdbCheckExists(resp)
+
 	resp, err = ssdbc.Do("zset", key, session.Userid, nowUnix)
 	lwutil.CheckSsdbError(resp, err)
 
@@ -3131,6 +3555,11 @@ func apiMatchLike(w http.ResponseWriter, r *http.Request) {
 	text := "❤️转发了这组拼图"
 	addMatchActivity(ssdbc, newMatch.Id, session.Userid, text)
 
+	//mission
+	if newLike {
+		addMissionProgress(ssdbc, session.Userid, MISSION_EVENT_MATCH_LIKE, 1)
+	}
+
 	//
 	go fanout(newMatch)
 
@@ -3422,11 +3851,16 @@ func regMatch() {
 	http.Handle("/match/listPlayedMatch", lwutil.ReqHandler(apiMatchListPlayedMatch))
 	http.Handle("/match/listPlayedAll", lwutil.ReqHandler(apiMatchListPlayedAll))
 	http.Handle("/match/listTimeline", lwutil.ReqHandler(apiMatchListTimeline))
+	http.Handle("/match/listByDifficulty", lwutil.ReqHandler(apiMatchListByDifficulty))
 
 	http.Handle("/match/playBegin", lwutil.ReqHandler(apiMatchPlayBegin))
 	http.Handle("/match/playEnd", lwutil.ReqHandler(apiMatchPlayEnd))
 	http.Handle("/match/freePlay", lwutil.ReqHandler(apiMatchFreePlay))
+	http.Handle("/match/ghostBegin", lwutil.ReqHandler(apiMatchGhostBegin))
+	http.Handle("/match/ghostEnd", lwutil.ReqHandler(apiMatchGhostEnd))
+	http.Handle("/match/listGhostStat", lwutil.ReqHandler(apiMatchListGhostStat))
 	http.Handle("/match/listActivity", lwutil.ReqHandler(apiMatchListActivity))
+	http.Handle("/match/getReplay", lwutil.ReqHandler(apiMatchGetReplay))
 
 	http.Handle("/match/getDynamicData", lwutil.ReqHandler(apiMatchGetDynamicData))
 	http.Handle("/match/getRanks", lwutil.ReqHandler(apiMatchGetRanks))
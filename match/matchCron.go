@@ -18,31 +18,45 @@ func runMatchCron() {
 	// _cron.AddFunc("0 * * * * *", matchCron)
 
 	go func() {
-		for true {
+		for beginCron() {
 			matchCron()
+			tournamentCron()
+			achievementCron()
+			missionCron()
+			battleSeasonCron()
+			battleCollusionCron()
+			cronDone()
 
 			now := lwutil.GetRedisTime()
 			s := 60 - now.Second() + 1
 			if s < 10 {
 				s += 60
 			}
-			time.Sleep(time.Duration(s) * time.Second)
-
+			if !cronSleep(time.Duration(s) * time.Second) {
+				return
+			}
 		}
 	}()
 
 }
 
 func calcRankPrize(match *Match, prizeSum int, rank int) int {
+	return calcProportionRankPrize(match.RankPrizeProportions, match.MinPrizeProportion, prizeSum, rank)
+}
+
+func calcProportionRankPrize(rankPrizeProportions []float32, minPrizeProportion float32, prizeSum int, rank int) int {
 	rankIdx := rank - 1
-	fixPrizeNum := len(match.RankPrizeProportions)
+	fixPrizeNum := len(rankPrizeProportions)
 	if rankIdx < fixPrizeNum {
-		return int(match.RankPrizeProportions[rankIdx] * float32(prizeSum))
+		return int(rankPrizeProportions[rankIdx] * float32(prizeSum))
 	}
 
-	minPrizeNum := int(float32(prizeSum) * match.MinPrizeProportion / float32(MIN_PRIZE))
-	propNum := len(match.RankPrizeProportions)
-	lastPrize := float32(prizeSum) * match.RankPrizeProportions[propNum-1]
+	minPrizeNum := int(float32(prizeSum) * minPrizeProportion / float32(MIN_PRIZE))
+	propNum := len(rankPrizeProportions)
+	if propNum == 0 {
+		return 0
+	}
+	lastPrize := float32(prizeSum) * rankPrizeProportions[propNum-1]
 	if (lastPrize > MIN_PRIZE) && (rankIdx < (fixPrizeNum + minPrizeNum)) {
 		return MIN_PRIZE
 	}
@@ -105,6 +119,7 @@ func matchCron() {
 				checkError(err)
 				numPerBatch := 1000
 				currRank := 1
+				rankUserIds := make([]int64, 0, rankNum)
 
 				//for each rank batch
 				for iBatch := 0; iBatch < rankNum/numPerBatch+1; iBatch++ {
@@ -135,10 +150,17 @@ func matchCron() {
 							continue
 						}
 						play.FinalRank = rank
+						rankUserIds = append(rankUserIds, userId)
 
 						///get reward sum
 						play.Prize = calcRankPrize(match, prizeSum, rank)
 
+						//only keep replays of top ranks
+						if play.HasReplay && rank > MATCH_REPLAY_KEEP_RANK {
+							delReplay(ssdbc, matchId, userId)
+							play.HasReplay = false
+						}
+
 						js, err := json.Marshal(play)
 						checkError(err)
 
@@ -156,9 +178,17 @@ func matchCron() {
 
 						//
 						addEcoRecord(ssdbc, userId, play.Prize, ECO_FORWHAT_MATCHPRIZE)
+
+						//achievement
+						if rank == 1 {
+							addAchievementStat(ssdbc, userId, ACHV_STAT_FIRST_PLACE, 1)
+						}
 					}
 				}
 
+				//rating
+				updateMatchRatings(ssdbc, matchId, rankUserIds)
+
 				//owner prize
 				ownerPrize := int(match.OwnerPrizeProportion * float32(prizeSum))
 				if ownerPrize > 0 {
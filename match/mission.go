@@ -0,0 +1,469 @@
+package main
+
+import (
+	"./ssdb"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+const (
+	H_MISSION           = "H_MISSION"          //subkey:missionId value:missionDefJson
+	H_MISSION_PROGRESS  = "H_MISSION_PROGRESS" //key:H_MISSION_PROGRESS/userId subkey:missionId value:missionProgressJson
+	K_MISSION_CLAIM     = "K_MISSION_CLAIM"    //key:K_MISSION_CLAIM/userId/missionId/periodIndex value:1, expires
+	Q_MISSION_EVENT     = "Q_MISSION_EVENT"    //value:missionEventJson, pushed by battle server
+	MISSION_EVENT_BATCH = 100
+
+	MISSION_PERIOD_DAILY  = "daily"
+	MISSION_PERIOD_WEEKLY = "weekly"
+
+	MISSION_CLAIM_EXPIRE_SEC = DAY_SEC * 8
+)
+
+//mission events
+const (
+	MISSION_EVENT_MATCH_PLAY      = "MatchPlay"
+	MISSION_EVENT_MATCH_LIKE      = "MatchLike"
+	MISSION_EVENT_FOLLOW          = "Follow"
+	MISSION_EVENT_BATTLE_PLAY     = "BattlePlay"
+	MISSION_EVENT_BATTLE_WIN      = "BattleWin"
+	MISSION_EVENT_BATTLE_COIN_WIN = "BattleCoinWin"
+)
+
+//published by admin, see apiMissionAdminSet
+type MissionDef struct {
+	Id          string
+	Period      string
+	Title       string
+	Text        string
+	Event       string
+	Goal        int
+	RewardCoin  int
+	RewardPrize int
+	Disabled    bool
+}
+
+type MissionProgress struct {
+	PeriodIndex int64
+	Count       int
+	Claimed     bool
+}
+
+type MissionEvent struct {
+	UserId int64
+	Event  string
+	Count  int
+}
+
+var (
+	_missionDefs   []MissionDef
+	_missionDefsMu sync.RWMutex
+)
+
+func _glogMission() {
+	glog.Info("")
+}
+
+func makeHMissionProgressKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", H_MISSION_PROGRESS, userId)
+}
+
+func makeMissionClaimKey(userId int64, missionId string, periodIndex int64) string {
+	return fmt.Sprintf("%s/%d/%s/%d", K_MISSION_CLAIM, userId, missionId, periodIndex)
+}
+
+//day or week index, weeks start on monday
+func getMissionPeriodIndex(period string, now int64) int64 {
+	day := makeDayIndex(now, SERVER_TZ_OFFSET_SEC)
+	if period == MISSION_PERIOD_WEEKLY {
+		return (day + 3) / 7 //1970-01-01 is thursday
+	}
+	return day
+}
+
+func getMissionPeriodEnd(period string, periodIndex int64) int64 {
+	endDay := periodIndex + 1
+	if period == MISSION_PERIOD_WEEKLY {
+		endDay = (periodIndex+1)*7 - 3
+	}
+	return endDay*DAY_SEC - SERVER_TZ_OFFSET_SEC
+}
+
+func loadMissionDefs(ssdbc *ssdb.Client) {
+	resp, err := ssdbc.Do("hgetall", H_MISSION)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	defs := make([]MissionDef, 0, num)
+	for i := 0; i < num; i++ {
+		var def MissionDef
+		err = json.Unmarshal([]byte(resp[i*2+1]), &def)
+		if err != nil {
+			glog.Errorf("bad mission def:%s", resp[i*2+1])
+			continue
+		}
+		defs = append(defs, def)
+	}
+
+	_missionDefsMu.Lock()
+	_missionDefs = defs
+	_missionDefsMu.Unlock()
+}
+
+func getMissionDefs() []MissionDef {
+	_missionDefsMu.RLock()
+	defer _missionDefsMu.RUnlock()
+	return _missionDefs
+}
+
+func getMissionProgresses(ssdbc *ssdb.Client, userId int64) map[string]*MissionProgress {
+	key := makeHMissionProgressKey(userId)
+	resp, err := ssdbc.Do("hgetall", key)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	progresses := map[string]*MissionProgress{}
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		var progress MissionProgress
+		err = json.Unmarshal([]byte(resp[i*2+1]), &progress)
+		lwutil.CheckError(err, "err_json")
+		progresses[resp[i*2]] = &progress
+	}
+	return progresses
+}
+
+func saveMissionProgress(ssdbc *ssdb.Client, userId int64, missionId string, progress *MissionProgress) {
+	js, err := json.Marshal(progress)
+	lwutil.CheckError(err, "err_json")
+
+	key := makeHMissionProgressKey(userId)
+	resp, err := ssdbc.Do("hset", key, missionId, js)
+	lwutil.CheckSsdbError(resp, err)
+}
+
+//progress from an earlier period counts as zero, which is the rollover
+func getCurrMissionProgress(progresses map[string]*MissionProgress, def *MissionDef, now int64) *MissionProgress {
+	periodIndex := getMissionPeriodIndex(def.Period, now)
+	progress := progresses[def.Id]
+	if progress == nil || progress.PeriodIndex != periodIndex {
+		progress = &MissionProgress{PeriodIndex: periodIndex}
+	}
+	return progress
+}
+
+func addMissionProgress(ssdbc *ssdb.Client, userId int64, event string, n int) {
+	defs := getMissionDefs()
+	var progresses map[string]*MissionProgress
+	now := lwutil.GetRedisTimeUnix()
+	for i := range defs {
+		def := &defs[i]
+		if def.Disabled || def.Event != event {
+			continue
+		}
+		if progresses == nil {
+			progresses = getMissionProgresses(ssdbc, userId)
+		}
+
+		progress := getCurrMissionProgress(progresses, def, now)
+		if progress.Count >= def.Goal {
+			continue
+		}
+		progress.Count += n
+		if progress.Count > def.Goal {
+			progress.Count = def.Goal
+		}
+		saveMissionProgress(ssdbc, userId, def.Id, progress)
+	}
+}
+
+//reload defs and consume events from other servers
+func missionCron() {
+	defer handleError()
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	checkError(err)
+	defer ssdbc.Close()
+
+	loadMissionDefs(ssdbc)
+
+	for true {
+		if applyMissionEvents(ssdbc) < MISSION_EVENT_BATCH {
+			break
+		}
+	}
+}
+
+//applies a batch from the front of the queue, whatever was applied is trimmed even if an event fails
+func applyMissionEvents(ssdbc *ssdb.Client) int {
+	resp, err := ssdbc.Do("qrange", Q_MISSION_EVENT, 0, MISSION_EVENT_BATCH)
+	checkError(err)
+	if resp[0] != "ok" {
+		return 0
+	}
+	resp = resp[1:]
+
+	applied := 0
+	defer func() {
+		if applied > 0 {
+			_, err := ssdbc.Do("qtrim_front", Q_MISSION_EVENT, applied)
+			if err != nil {
+				glog.Errorf("qtrim_front Q_MISSION_EVENT error:%v", err)
+			}
+		}
+	}()
+
+	for _, v := range resp {
+		var event MissionEvent
+		err = json.Unmarshal([]byte(v), &event)
+		if err != nil {
+			glog.Errorf("bad mission event:%s", v)
+			applied++
+			continue
+		}
+		addMissionProgress(ssdbc, event.UserId, event.Event, event.Count)
+		applied++
+	}
+	return len(resp)
+}
+
+func apiMissionList(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//
+	type OutMission struct {
+		MissionDef
+		MissionProgress
+		EndTime int64
+	}
+
+	defs := getMissionDefs()
+	progresses := getMissionProgresses(ssdbc, session.Userid)
+	now := lwutil.GetRedisTimeUnix()
+	missions := make([]OutMission, 0, len(defs))
+	for i := range defs {
+		def := &defs[i]
+		if def.Disabled {
+			continue
+		}
+		progress := getCurrMissionProgress(progresses, def, now)
+		missions = append(missions, OutMission{
+			*def,
+			*progress,
+			getMissionPeriodEnd(def.Period, progress.PeriodIndex),
+		})
+	}
+
+	//out
+	lwutil.WriteResponse(w, missions)
+}
+
+func apiMissionClaim(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		MissionId string
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//def
+	var def *MissionDef
+	defs := getMissionDefs()
+	for i := range defs {
+		if defs[i].Id == in.MissionId && !defs[i].Disabled {
+			def = &defs[i]
+			break
+		}
+	}
+	if def == nil {
+		lwutil.SendError("err_not_found", "mission not found")
+	}
+
+	//progress
+	now := lwutil.GetRedisTimeUnix()
+	progresses := getMissionProgresses(ssdbc, session.Userid)
+	progress := getCurrMissionProgress(progresses, def, now)
+	if progress.Count < def.Goal {
+		lwutil.SendError("err_not_complete", "")
+	}
+	if progress.Claimed {
+		lwutil.SendError("err_claimed", "")
+	}
+
+	//claim once per period
+	claimKey := makeMissionClaimKey(session.Userid, def.Id, progress.PeriodIndex)
+	resp, err := ssdbc.Do("setnx", claimKey, 1)
+	lwutil.CheckSsdbError(resp, err)
+	if resp[1] != "1" {
+		lwutil.SendError("err_claimed", "")
+	}
+	resp, err = ssdbc.Do("expire", claimKey, MISSION_CLAIM_EXPIRE_SEC)
+	lwutil.CheckSsdbError(resp, err)
+
+	progress.Claimed = true
+	saveMissionProgress(ssdbc, session.Userid, def.Id, progress)
+
+	//reward
+	playerKey := makePlayerInfoKey(session.Userid)
+	if def.RewardCoin > 0 {
+		addPlayerGoldCoin(ssdbc, playerKey, def.RewardCoin)
+		err = addEcoRecord(ssdbc, session.Userid, def.RewardCoin, ECO_FORWHAT_MISSION_COIN)
+		lwutil.CheckError(err, "err_eco_record")
+	}
+	if def.RewardPrize > 0 {
+		addPrizeToCache(ssdbc, session.Userid, 0, "", def.RewardPrize, PRIZE_REASON_MISSION, 0)
+		err = addEcoRecord(ssdbc, session.Userid, def.RewardPrize, ECO_FORWHAT_MISSION_PRIZE)
+		lwutil.CheckError(err, "err_eco_record")
+	}
+
+	//out
+	playerInfo, err := getPlayerInfo(ssdbc, session.Userid)
+	lwutil.CheckError(err, "err_player_info")
+
+	out := struct {
+		MissionId  string
+		GoldCoin   int
+		PrizeCache int
+	}{
+		def.Id,
+		playerInfo.GoldCoin,
+		playerInfo.PrizeCache,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiMissionAdminList(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+	checkAdmin(session)
+
+	//
+	loadMissionDefs(ssdbc)
+	defs := getMissionDefs()
+
+	//out
+	lwutil.WriteResponse(w, defs)
+}
+
+func apiMissionAdminSet(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		Missions []MissionDef
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//check
+	for _, def := range in.Missions {
+		if def.Id == "" {
+			lwutil.SendError("err_id", "")
+		}
+		if def.Period != MISSION_PERIOD_DAILY && def.Period != MISSION_PERIOD_WEEKLY {
+			lwutil.SendError("err_period", def.Id)
+		}
+		if def.Goal <= 0 {
+			lwutil.SendError("err_goal", def.Id)
+		}
+	}
+
+	//save
+	for _, def := range in.Missions {
+		js, err := json.Marshal(def)
+		lwutil.CheckError(err, "err_json")
+		resp, err := ssdbc.Do("hset", H_MISSION, def.Id, js)
+		lwutil.CheckSsdbError(resp, err)
+	}
+	loadMissionDefs(ssdbc)
+
+	//out
+	defs := getMissionDefs()
+	lwutil.WriteResponse(w, defs)
+}
+
+func apiMissionAdminDel(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		MissionId string
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//
+	resp, err := ssdbc.Do("hdel", H_MISSION, in.MissionId)
+	lwutil.CheckSsdbError(resp, err)
+	loadMissionDefs(ssdbc)
+
+	//out
+	lwutil.WriteResponse(w, in)
+}
+
+func regMission() {
+	http.Handle("/mission/list", lwutil.ReqHandler(apiMissionList))
+	http.Handle("/mission/claim", lwutil.ReqHandler(apiMissionClaim))
+	http.Handle("/mission/admin/list", lwutil.ReqHandler(apiMissionAdminList))
+	http.Handle("/mission/admin/set", lwutil.ReqHandler(apiMissionAdminSet))
+	http.Handle("/mission/admin/del", lwutil.ReqHandler(apiMissionAdminDel))
+}
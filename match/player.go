@@ -64,6 +64,13 @@ type PlayerInfo struct {
 	BattleHeartZeroTime int64
 	FanNum              int
 	FollowNum           int
+	Rating              float64
+	RatingRd            float64
+	RatingVol           float64
+	RatedMatchNum       int
+	BonusFreeTries      int
+	BattleSeasonId      int64
+	BattleSeasonPoint   int
 }
 
 //player property
@@ -80,6 +87,13 @@ const (
 	PLAYER_BATTLE_HEART_ZERO_TIME = "BattleHeartZeroTime"
 	PLAYER_FAN_NUM                = "FanNum"
 	PLAYER_FOLLOW_NUM             = "FollowNum"
+	PLAYER_RATING                 = "Rating"
+	PLAYER_RATING_RD              = "RatingRd"
+	PLAYER_RATING_VOL             = "RatingVol"
+	PLAYER_RATED_MATCH_NUM        = "RatedMatchNum"
+	PLAYER_BONUS_FREE_TRIES       = "BonusFreeTries"
+	PLAYER_BATTLE_SEASON_ID       = "BattleSeasonId"
+	PLAYER_BATTLE_SEASON_POINT    = "BattleSeasonPoint"
 )
 
 type PlayerBattleLevel struct {
@@ -165,9 +179,12 @@ var (
 )
 
 const (
-	PRIZE_REASON_RANK  = "排名奖励"
-	PRIZE_REASON_LUCK  = "幸运大奖"
-	PRIZE_REASON_OWNER = "发布分成"
+	PRIZE_REASON_RANK          = "排名奖励"
+	PRIZE_REASON_LUCK          = "幸运大奖"
+	PRIZE_REASON_OWNER         = "发布分成"
+	PRIZE_REASON_TOURNAMENT    = "锦标赛奖励"
+	PRIZE_REASON_MISSION       = "任务奖励"
+	PRIZE_REASON_BATTLE_SEASON = "赛季奖励"
 )
 
 type PrizeRecord struct {
@@ -258,6 +275,13 @@ func getPlayerInfo(ssdb *ssdb.Client, userId int64) (*PlayerInfo, error) {
 
 	playerInfo.UserId = userId
 
+	//not rated yet
+	if playerInfo.RatedMatchNum == 0 {
+		playerInfo.Rating = RATING_DEFAULT
+		playerInfo.RatingRd = RATING_RD_DEFAULT
+		playerInfo.RatingVol = RATING_VOL_DEFAULT
+	}
+
 	return &playerInfo, err
 }
 
@@ -613,6 +637,7 @@ func apiGetPlayerInfo(w http.ResponseWriter, r *http.Request) {
 		BattleHelpText       string
 		BattleHeartAddSec    int
 		Followed             bool
+		Achievements         []string
 	}{
 		playerInfo,
 		_adsConf,
@@ -622,6 +647,7 @@ func apiGetPlayerInfo(w http.ResponseWriter, r *http.Request) {
 		BATTLE_HELP_TEXT,
 		BATTLE_HEART_ADD_SEC,
 		followed,
+		listUnlockedAchievementIds(ssdb, in.UserId),
 	}
 	lwutil.WriteResponse(w, out)
 }
@@ -1311,6 +1337,9 @@ func apiPlayerFollow(w http.ResponseWriter, r *http.Request) {
 
 	followNum, fanNum := doFollow(ssdbc, session.Userid, in.UserId)
 
+	//mission, the follows made at registration don't count
+	addMissionProgress(ssdbc, session.Userid, MISSION_EVENT_FOLLOW, 1)
+
 	//getPlayerInfoLite
 	playerInfoLite, err := getPlayerInfoLite(ssdbc, in.UserId, nil)
 	lwutil.CheckError(err, "err_player_info_lite")
@@ -1453,12 +1482,14 @@ func apiPlayerGetPlayerInfoWeb(w http.ResponseWriter, r *http.Request) {
 	//out
 	out := struct {
 		*PlayerInfo
-		MatchNum int
-		Followed bool
+		MatchNum     int
+		Followed     bool
+		Achievements []string
 	}{
 		playerInfo,
 		matchNum,
 		followed,
+		listUnlockedAchievementIds(ssdbc, in.UserId),
 	}
 	lwutil.WriteResponse(w, out)
 }
@@ -1534,6 +1565,9 @@ func regPlayer() {
 	http.Handle("/player/follow", lwutil.ReqHandler(apiPlayerFollow))
 	http.Handle("/player/unfollow", lwutil.ReqHandler(apiPlayerUnfollow))
 	http.Handle("/player/searchUser", lwutil.ReqHandler(apiPlayerSearchUser))
+	http.Handle("/player/listRating", lwutil.ReqHandler(apiPlayerListRating))
+	http.Handle("/player/listRatingHistory", lwutil.ReqHandler(apiPlayerListRatingHistory))
+	http.Handle("/player/listAchievement", lwutil.ReqHandler(apiPlayerListAchievement))
 
 	http.Handle("/player/web/getInfo", lwutil.ReqHandler(apiPlayerGetPlayerInfoWeb))
 }
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"./ssdb"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+//Glicko-2, each settled match is one rating period.
+//a match is split into pairwise games between entrants ranked near each other.
+const (
+	Z_PLAYER_RATING         = "Z_PLAYER_RATING"         //subkey:userId score:rating
+	Q_PLAYER_RATING_HISTORY = "Q_PLAYER_RATING_HISTORY" //key:Q_PLAYER_RATING_HISTORY/userId value:ratingHistoryJson
+
+	RATING_DEFAULT     = 1500.0
+	RATING_RD_DEFAULT  = 350.0
+	RATING_RD_MIN      = 30.0
+	RATING_VOL_DEFAULT = 0.06
+	RATING_TAU         = 0.5
+	RATING_SCALE       = 173.7178
+	RATING_EPSILON     = 0.000001
+
+	RATING_MIN_PLAYER_NUM       = 3
+	RATING_OPPONENT_WINDOW      = 16 //opponents ranked right above and below
+	RATING_LEADERBOARD_MIN_RATE = 5  //rated matches needed to get on the leaderboard
+	RATING_HISTORY_LIMIT        = 100
+)
+
+type RatingHistory struct {
+	MatchId   int64
+	Rank      int
+	PlayerNum int
+	Rating    float64
+	RatingRd  float64
+	Delta     float64
+	Time      int64
+}
+
+type playerRating struct {
+	userId    int64
+	rating    float64
+	rd        float64
+	vol       float64
+	ratedNum  int
+	newRating float64
+	newRd     float64
+	newVol    float64
+}
+
+func _glogRating() {
+	glog.Info("")
+}
+
+func makeQPlayerRatingHistoryKey(userId int64) string {
+	return fmt.Sprintf("%s/%d", Q_PLAYER_RATING_HISTORY, userId)
+}
+
+func glickoG(phi float64) float64 {
+	return 1.0 / math.Sqrt(1.0+3.0*phi*phi/(math.Pi*math.Pi))
+}
+
+func glickoE(mu, muj, phij float64) float64 {
+	return 1.0 / (1.0 + math.Exp(-glickoG(phij)*(mu-muj)))
+}
+
+func glickoVolatility(phi, vol, v, delta float64) float64 {
+	a := math.Log(vol * vol)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		d := phi*phi + v + ex
+		return ex*(delta*delta-phi*phi-v-ex)/(2.0*d*d) - (x-a)/(RATING_TAU*RATING_TAU)
+	}
+
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*RATING_TAU) < 0 {
+			k += 1.0
+		}
+		B = a - k*RATING_TAU
+	}
+
+	fA := f(A)
+	fB := f(B)
+	for math.Abs(B-A) > RATING_EPSILON {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A = B
+			fA = fB
+		} else {
+			fA = fA / 2.0
+		}
+		B = C
+		fB = fC
+	}
+
+	return math.Exp(A / 2.0)
+}
+
+//players must be sorted by final rank
+func calcMatchRatings(players []*playerRating) {
+	num := len(players)
+	for i, p := range players {
+		mu := (p.rating - RATING_DEFAULT) / RATING_SCALE
+		phi := p.rd / RATING_SCALE
+
+		from := i - RATING_OPPONENT_WINDOW
+		if from < 0 {
+			from = 0
+		}
+		to := i + RATING_OPPONENT_WINDOW
+		if to > num-1 {
+			to = num - 1
+		}
+
+		vInv := 0.0
+		sum := 0.0
+		for j := from; j <= to; j++ {
+			if j == i {
+				continue
+			}
+			o := players[j]
+			muj := (o.rating - RATING_DEFAULT) / RATING_SCALE
+			phij := o.rd / RATING_SCALE
+			g := glickoG(phij)
+			e := glickoE(mu, muj, phij)
+			s := 0.0
+			if j > i {
+				s = 1.0
+			}
+			vInv += g * g * e * (1.0 - e)
+			sum += g * (s - e)
+		}
+		if vInv == 0 {
+			p.newRating, p.newRd, p.newVol = p.rating, p.rd, p.vol
+			continue
+		}
+
+		v := 1.0 / vInv
+		delta := v * sum
+		vol := glickoVolatility(phi, p.vol, v, delta)
+		phiStar := math.Sqrt(phi*phi + vol*vol)
+		newPhi := 1.0 / math.Sqrt(1.0/(phiStar*phiStar)+1.0/v)
+		newMu := mu + newPhi*newPhi*sum
+
+		p.newRating = newMu*RATING_SCALE + RATING_DEFAULT
+		p.newRd = math.Max(newPhi*RATING_SCALE, RATING_RD_MIN)
+		p.newVol = vol
+	}
+}
+
+func getPlayerRating(ssdbc *ssdb.Client, userId int64) *playerRating {
+	p := &playerRating{
+		userId: userId,
+		rating: RATING_DEFAULT,
+		rd:     RATING_RD_DEFAULT,
+		vol:    RATING_VOL_DEFAULT,
+	}
+
+	key := makePlayerInfoKey(userId)
+	resp, err := ssdbc.Do("multi_hget", key, PLAYER_RATING, PLAYER_RATING_RD, PLAYER_RATING_VOL, PLAYER_RATED_MATCH_NUM)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		k := resp[i*2]
+		v := resp[i*2+1]
+		if k == PLAYER_RATING {
+			p.rating, err = strconv.ParseFloat(v, 64)
+		} else if k == PLAYER_RATING_RD {
+			p.rd, err = strconv.ParseFloat(v, 64)
+		} else if k == PLAYER_RATING_VOL {
+			p.vol, err = strconv.ParseFloat(v, 64)
+		} else if k == PLAYER_RATED_MATCH_NUM {
+			p.ratedNum, err = strconv.Atoi(v)
+		}
+		lwutil.CheckError(err, "err_strconv")
+	}
+	return p
+}
+
+//userIds sorted by final rank
+func updateMatchRatings(ssdbc *ssdb.Client, matchId int64, userIds []int64) {
+	num := len(userIds)
+	if num < RATING_MIN_PLAYER_NUM {
+		return
+	}
+
+	players := make([]*playerRating, num)
+	for i, userId := range userIds {
+		players[i] = getPlayerRating(ssdbc, userId)
+	}
+
+	calcMatchRatings(players)
+
+	now := lwutil.GetRedisTimeUnix()
+	for i, p := range players {
+		//player
+		key := makePlayerInfoKey(p.userId)
+		p.ratedNum++
+		resp, err := ssdbc.Do("multi_hset", key,
+			PLAYER_RATING, p.newRating,
+			PLAYER_RATING_RD, p.newRd,
+			PLAYER_RATING_VOL, p.newVol,
+			PLAYER_RATED_MATCH_NUM, p.ratedNum)
+		lwutil.CheckSsdbError(resp, err)
+
+		//leaderboard
+		if p.ratedNum >= RATING_LEADERBOARD_MIN_RATE {
+			resp, err = ssdbc.Do("zset", Z_PLAYER_RATING, p.userId, int64(p.newRating))
+			lwutil.CheckSsdbError(resp, err)
+		}
+
+		//history
+		history := RatingHistory{
+			MatchId:   matchId,
+			Rank:      i + 1,
+			PlayerNum: num,
+			Rating:    p.newRating,
+			RatingRd:  p.newRd,
+			Delta:     p.newRating - p.rating,
+			Time:      now,
+		}
+		js, err := json.Marshal(history)
+		lwutil.CheckError(err, "err_json")
+
+		qKey := makeQPlayerRatingHistoryKey(p.userId)
+		resp, err = ssdbc.Do("qpush_front", qKey, js)
+		lwutil.CheckSsdbError(resp, err)
+		qSize, err := strconv.Atoi(resp[1])
+		lwutil.CheckError(err, "err_strconv")
+		if qSize > RATING_HISTORY_LIMIT {
+			resp, err = ssdbc.Do("qtrim_back", qKey, qSize-RATING_HISTORY_LIMIT)
+			lwutil.CheckSsdbError(resp, err)
+		}
+	}
+}
+
+func apiPlayerListRating(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		Offset int
+		Limit  int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.Limit <= 0 || in.Limit > 50 {
+		in.Limit = 50
+	}
+	if in.Offset < 0 {
+		in.Offset = 0
+	}
+
+	type RatingRank struct {
+		Rank   int
+		Rating int
+		Player *PlayerInfoLite
+	}
+
+	out := struct {
+		MyRank   int
+		MyRating int
+		RankNum  int
+		Ranks    []RatingRank
+	}{}
+	out.Ranks = []RatingRank{}
+
+	//my rank
+	resp, err := ssdbc.Do("zrrank", Z_PLAYER_RATING, session.Userid)
+	lwutil.CheckError(err, "")
+	if resp[0] == "ok" {
+		out.MyRank, err = strconv.Atoi(resp[1])
+		lwutil.CheckError(err, "")
+		out.MyRank++
+
+		resp, err = ssdbc.Do("zget", Z_PLAYER_RATING, session.Userid)
+		lwutil.CheckSsdbError(resp, err)
+		out.MyRating, err = strconv.Atoi(resp[1])
+		lwutil.CheckError(err, "")
+	}
+
+	resp, err = ssdbc.Do("zsize", Z_PLAYER_RATING)
+	lwutil.CheckSsdbError(resp, err)
+	out.RankNum, err = strconv.Atoi(resp[1])
+	lwutil.CheckError(err, "")
+
+	//ranks
+	resp, err = ssdbc.Do("zrrange", Z_PLAYER_RATING, in.Offset, in.Limit)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		userId, err := strconv.ParseInt(resp[i*2], 10, 64)
+		lwutil.CheckError(err, "")
+		rating, err := strconv.Atoi(resp[i*2+1])
+		lwutil.CheckError(err, "")
+		player, err := getPlayerInfoLite(ssdbc, userId, nil)
+		if err != nil {
+			glog.Errorf("getPlayerInfoLite error:%v, userId:%d", err, userId)
+			continue
+		}
+		out.Ranks = append(out.Ranks, RatingRank{in.Offset + i + 1, rating, player})
+	}
+
+	//out
+	lwutil.WriteResponse(w, out)
+}
+
+func apiPlayerListRatingHistory(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		UserId int64
+		Offset int
+		Limit  int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.UserId == 0 {
+		in.UserId = session.Userid
+	}
+	if in.Limit <= 0 || in.Limit > RATING_HISTORY_LIMIT {
+		in.Limit = RATING_HISTORY_LIMIT
+	}
+
+	//
+	key := makeQPlayerRatingHistoryKey(in.UserId)
+	resp, err := ssdbc.Do("qrange", key, in.Offset, in.Limit)
+	lwutil.CheckSsdbError(resp, err)
+	resp = resp[1:]
+
+	histories := make([]RatingHistory, 0, len(resp))
+	for _, v := range resp {
+		var history RatingHistory
+		err = json.Unmarshal([]byte(v), &history)
+		lwutil.CheckError(err, "err_json")
+		histories = append(histories, history)
+	}
+
+	//out
+	lwutil.WriteResponse(w, histories)
+}
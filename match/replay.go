@@ -0,0 +1,249 @@
+package main
+
+import (
+	"./ssdb"
+	"bytes"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+const (
+	H_MATCH_REPLAY = "H_MATCH_REPLAY" //subkey:matchId/userId value:zlib(replayJson)
+
+	MATCH_REPLAY_KEEP_RANK      = 100 //replays of ranks after this are dropped at settlement
+	MATCH_REPLAY_MOVE_MAX       = 1000
+	MATCH_REPLAY_IMAGE_MOVE_MAX = 300
+)
+
+type ReplayImage struct {
+	Init  []int //shuffled slider order, as makeReplayInits deals it
+	Moves []int //flat [msec, from, to] triples, msec counts from the start of the play
+}
+
+type Replay struct {
+	SliderNum int
+	Msec      int
+	Images    []ReplayImage
+}
+
+func _glogReplay() {
+	glog.Info("")
+}
+
+//the shuffle of a play is dealt from the seed playBegin issues, clients shuffle the same way:
+//a 32 bit xorshift drives a Fisher-Yates per image, an image that comes out solved gets its first two sliders swapped.
+func makeReplayInits(seed int64, sliderNum int, imageNum int) [][]int {
+	x := uint32(seed)
+	if x == 0 {
+		x = 1
+	}
+	inits := make([][]int, imageNum)
+	for iImage := range inits {
+		init := make([]int, sliderNum)
+		for i := range init {
+			init[i] = i
+		}
+		for i := sliderNum - 1; i > 0; i-- {
+			x ^= x << 13
+			x ^= x >> 17
+			x ^= x << 5
+			j := int(x % uint32(i+1))
+			init[i], init[j] = init[j], init[i]
+		}
+		if sliderNum > 1 {
+			solved := true
+			for i, v := range init {
+				if i != v {
+					solved = false
+					break
+				}
+			}
+			if solved {
+				init[0], init[1] = init[1], init[0]
+			}
+		}
+		inits[iImage] = init
+	}
+	return inits
+}
+
+//seeds fit in a js number
+func genShuffleSeed() int64 {
+	return rand.Int63n(1<<31) + 1
+}
+
+func checkReplay(replay *Replay, inits [][]int, sliderNum int, msec int) error {
+	if replay.SliderNum != sliderNum {
+		return fmt.Errorf("sliderNum not match")
+	}
+	if replay.Msec != msec {
+		return fmt.Errorf("msec not match")
+	}
+	if len(replay.Images) != len(inits) {
+		return fmt.Errorf("imageNum not match")
+	}
+
+	lastMsec := 0
+	moveNum := 0
+	for iImage, image := range replay.Images {
+		//init must be the one dealt
+		if len(image.Init) != sliderNum {
+			return fmt.Errorf("image %d: bad init", iImage)
+		}
+		sliders := make([]int, sliderNum)
+		for i, v := range image.Init {
+			if v != inits[iImage][i] {
+				return fmt.Errorf("image %d: init not match", iImage)
+			}
+			sliders[i] = v
+		}
+
+		//moves
+		if len(image.Moves)%3 != 0 {
+			return fmt.Errorf("image %d: bad moves", iImage)
+		}
+		num := len(image.Moves) / 3
+		if num > MATCH_REPLAY_IMAGE_MOVE_MAX {
+			return fmt.Errorf("image %d: too many moves", iImage)
+		}
+		moveNum += num
+		if moveNum > MATCH_REPLAY_MOVE_MAX {
+			return fmt.Errorf("too many moves")
+		}
+		for i := 0; i < num; i++ {
+			t := image.Moves[i*3]
+			from := image.Moves[i*3+1]
+			to := image.Moves[i*3+2]
+			if t < lastMsec || t > msec {
+				return fmt.Errorf("image %d: bad move time", iImage)
+			}
+			if from < 0 || from >= sliderNum || to < 0 || to >= sliderNum || from == to {
+				return fmt.Errorf("image %d: bad move", iImage)
+			}
+			lastMsec = t
+			sliders[from], sliders[to] = sliders[to], sliders[from]
+		}
+
+		//solved?
+		for i, v := range sliders {
+			if i != v {
+				return fmt.Errorf("image %d: not solved", iImage)
+			}
+		}
+	}
+	return nil
+}
+
+func encodeReplay(replay *Replay) ([]byte, error) {
+	js, err := json.Marshal(replay)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	_, err = zw.Write(js)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeReplay(data []byte) (*Replay, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	js, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+
+	var replay Replay
+	err = json.Unmarshal(js, &replay)
+	if err != nil {
+		return nil, err
+	}
+	return &replay, nil
+}
+
+func saveReplay(ssdbc *ssdb.Client, matchId int64, userId int64, replay *Replay) {
+	data, err := encodeReplay(replay)
+	lwutil.CheckError(err, "err_replay_encode")
+
+	subkey := makeMatchPlaySubkey(matchId, userId)
+	resp, err := ssdbc.Do("hset", H_MATCH_REPLAY, subkey, data)
+	lwutil.CheckSsdbError(resp, err)
+}
+
+func getReplay(ssdbc *ssdb.Client, matchId int64, userId int64) (*Replay, error) {
+	subkey := makeMatchPlaySubkey(matchId, userId)
+	resp, err := ssdbc.Do("hget", H_MATCH_REPLAY, subkey)
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] == ssdb.NOT_FOUND {
+		return nil, nil
+	}
+	return decodeReplay([]byte(resp[1]))
+}
+
+func delReplay(ssdbc *ssdb.Client, matchId int64, userId int64) {
+	subkey := makeMatchPlaySubkey(matchId, userId)
+	resp, err := ssdbc.Do("hdel", H_MATCH_REPLAY, subkey)
+	lwutil.CheckSsdbError(resp, err)
+}
+
+func apiMatchGetReplay(w http.ResponseWriter, r *http.Request) {
+	var err error
+	lwutil.CheckMathod(r, "POST")
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	_, err = findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		MatchId int64
+		UserId  int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//
+	replay, err := getReplay(ssdbc, in.MatchId, in.UserId)
+	lwutil.CheckError(err, "err_replay")
+	if replay == nil {
+		lwutil.SendError("err_not_found", "replay not found")
+	}
+
+	//out
+	out := struct {
+		MatchId int64
+		UserId  int64
+		*Replay
+	}{
+		in.MatchId,
+		in.UserId,
+		replay,
+	}
+	lwutil.WriteResponse(w, out)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+//on SIGINT or SIGTERM the server stops taking new work: the listener closes and cron runs not started yet are skipped.
+//requests being served and cron work under way, like a half done matchCron or backupTask, finish before the exit.
+const (
+	SHUTDOWN_HTTP_WAIT = 60 * time.Second
+)
+
+var (
+	_cronMu      sync.Mutex
+	_cronWg      sync.WaitGroup
+	_cronStopped bool
+	_cronStop    = make(chan struct{})
+)
+
+//false once shutting down, cronDone must follow a true
+func beginCron() bool {
+	_cronMu.Lock()
+	defer _cronMu.Unlock()
+	if _cronStopped {
+		return false
+	}
+	_cronWg.Add(1)
+	return true
+}
+
+func cronDone() {
+	_cronWg.Done()
+}
+
+//for jobs on _cron
+func cronTask(f func()) func() {
+	return func() {
+		if !beginCron() {
+			return
+		}
+		defer cronDone()
+		f()
+	}
+}
+
+//sleeps d, false if shutting down meanwhile
+func cronSleep(d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-_cronStop:
+		return false
+	}
+}
+
+//no cron run starts after this
+func haltCron() {
+	_cronMu.Lock()
+	defer _cronMu.Unlock()
+	if !_cronStopped {
+		_cronStopped = true
+		close(_cronStop)
+	}
+}
+
+//returns when the runs under way are done
+func stopCron() {
+	haltCron()
+	_cron.Stop()
+	_cronWg.Wait()
+}
+
+func serveUntilSignal(addr string) {
+	server := &http.Server{Addr: addr}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			glog.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	glog.Infof("shutting down on %v", <-sig)
+
+	haltCron()
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_HTTP_WAIT)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		glog.Errorf("server.Shutdown error:%v", err)
+	}
+
+	glog.Info("waiting for cron work")
+	stopCron()
+	glog.Info("shut down")
+	glog.Flush()
+}
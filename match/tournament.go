@@ -0,0 +1,927 @@
+package main
+
+import (
+	"./ssdb"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/golang/glog"
+	"github.com/henyouqian/lwutil"
+)
+
+const (
+	TOURNAMENT_SERIAL         = "TOURNAMENT_SERIAL"
+	H_TOURNAMENT              = "H_TOURNAMENT"              //subkey:tournamentId value:tournamentJson
+	H_TOURNAMENT_EXTRA        = "H_TOURNAMENT_EXTRA"        //subkey:tournamentId/fieldKey value:fieldValue
+	H_TOURNAMENT_PLAYER       = "H_TOURNAMENT_PLAYER"       //key:H_TOURNAMENT_PLAYER/tournamentId subkey:userId value:tournamentPlayerJson
+	H_TOURNAMENT_ROUND_RANK   = "H_TOURNAMENT_ROUND_RANK"   //key:H_TOURNAMENT_ROUND_RANK/tournamentId/round subkey:rank value:userId
+	Z_TOURNAMENT              = "Z_TOURNAMENT"              //subkey:tournamentId score:beginTime
+	Z_OPEN_TOURNAMENT         = "Z_OPEN_TOURNAMENT"         //subkey:tournamentId score:currRoundEndTime
+	RDS_Z_TOURNAMENT_ROUND_LB = "RDS_Z_TOURNAMENT_ROUND_LB" //key:RDS_Z_TOURNAMENT_ROUND_LB/tournamentId/round
+
+	TOURNAMENT_EXTRA_PRIZE      = "Prize"
+	TOURNAMENT_EXTRA_PLAYER_NUM = "PlayerNum"
+
+	TOURNAMENT_ROUND_MAX = 8
+	TOURNAMENT_PACK_MAX  = 10
+)
+
+var (
+	TOURNAMENT_RANK_PRIZE_PROPORTIONS = []float32{
+		0.30, 0.20, 0.10, 0.08, 0.07, 0.06, 0.05, 0.04, 0.03, 0.02,
+	}
+	TOURNAMENT_MIN_PRIZE_PROPORTION = float32(0.05)
+)
+
+type TournamentRound struct {
+	PackIds      []int64
+	SliderNum    int
+	AdvanceNum   int //top AdvanceNum by cumulative time go to next round, ignored in the last round
+	BeginTime    int64
+	BeginTimeStr string
+	EndTime      int64
+	EndTimeStr   string
+}
+
+type Tournament struct {
+	Id                   int64
+	Title                string
+	Thumb                string
+	EntryFee             int //goldCoin
+	Prize                int
+	Rounds               []TournamentRound
+	CurrRound            int
+	BeginTime            int64
+	EndTime              int64
+	HasResult            bool
+	RankPrizeProportions []float32
+	MinPrizeProportion   float32
+}
+
+type TournamentPlayer struct {
+	UserId           int64
+	PlayerName       string
+	GravatarKey      string
+	CustomAvartarKey string
+	AllowRound       int     //the round this player is allowed to play
+	PackMsecs        [][]int //[round][packIdx]best msec, 0 for not finished
+	RoundRanks       []int
+	RoundMsecs       []int //cumulative msec at the end of each round
+	TotalMsec        int   //cumulative msec of settled rounds
+	FinalRank        int
+	Prize            int
+}
+
+type TournamentRankInfo struct {
+	Rank            int
+	UserId          int64
+	NickName        string
+	GravatarKey     string
+	CustomAvatarKey string
+	Msec            int
+	Advanced        bool
+}
+
+func _glogTournament() {
+	glog.Info("")
+}
+
+func makeHTournamentExtraSubkey(tournamentId int64, fieldKey string) string {
+	return fmt.Sprintf("%d/%s", tournamentId, fieldKey)
+}
+
+func makeHTournamentPlayerKey(tournamentId int64) string {
+	return fmt.Sprintf("%s/%d", H_TOURNAMENT_PLAYER, tournamentId)
+}
+
+func makeHTournamentRoundRankKey(tournamentId int64, round int) string {
+	return fmt.Sprintf("%s/%d/%d", H_TOURNAMENT_ROUND_RANK, tournamentId, round)
+}
+
+func makeTournamentRoundLeaderboardRdsKey(tournamentId int64, round int) string {
+	return fmt.Sprintf("%s/%d/%d", RDS_Z_TOURNAMENT_ROUND_LB, tournamentId, round)
+}
+
+func makeTournamentSecretKey(secret string) string {
+	return fmt.Sprintf("%s/%s", "TOURNAMENT_SECRET", secret)
+}
+
+func getTournament(ssdbc *ssdb.Client, tournamentId int64) *Tournament {
+	resp, err := ssdbc.Do("hget", H_TOURNAMENT, tournamentId)
+	lwutil.CheckError(err, "")
+	if resp[0] != "ok" {
+		lwutil.SendError("err_not_found", "tournament not found")
+	}
+	var tournament Tournament
+	err = json.Unmarshal([]byte(resp[1]), &tournament)
+	lwutil.CheckError(err, "")
+	return &tournament
+}
+
+func saveTournament(ssdbc *ssdb.Client, tournament *Tournament) {
+	js, err := json.Marshal(tournament)
+	lwutil.CheckError(err, "")
+	resp, err := ssdbc.Do("hset", H_TOURNAMENT, tournament.Id, js)
+	lwutil.CheckSsdbError(resp, err)
+}
+
+func getTournamentPrize(ssdbc *ssdb.Client, tournament *Tournament) int {
+	subkey := makeHTournamentExtraSubkey(tournament.Id, TOURNAMENT_EXTRA_PRIZE)
+	resp, err := ssdbc.Do("hget", H_TOURNAMENT_EXTRA, subkey)
+	lwutil.CheckError(err, "")
+	extraPrize := 0
+	if resp[0] == "ok" {
+		extraPrize, err = strconv.Atoi(resp[1])
+		lwutil.CheckError(err, "")
+	}
+	return tournament.Prize + extraPrize
+}
+
+func getTournamentPlayer(ssdbc *ssdb.Client, tournamentId int64, userId int64) (*TournamentPlayer, error) {
+	key := makeHTournamentPlayerKey(tournamentId)
+	resp, err := ssdbc.Do("hget", key, userId)
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] == ssdb.NOT_FOUND {
+		return nil, nil
+	}
+	var player TournamentPlayer
+	err = json.Unmarshal([]byte(resp[1]), &player)
+	if err != nil {
+		return nil, err
+	}
+	return &player, nil
+}
+
+func saveTournamentPlayer(ssdbc *ssdb.Client, tournamentId int64, player *TournamentPlayer) {
+	js, err := json.Marshal(player)
+	lwutil.CheckError(err, "")
+	key := makeHTournamentPlayerKey(tournamentId)
+	resp, err := ssdbc.Do("hset", key, player.UserId, js)
+	lwutil.CheckSsdbError(resp, err)
+}
+
+func calcTournamentRankPrize(tournament *Tournament, prizeSum int, rank int) int {
+	return calcProportionRankPrize(tournament.RankPrizeProportions, tournament.MinPrizeProportion, prizeSum, rank)
+}
+
+func apiTournamentNew(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	checkAdmin(session)
+
+	//in
+	var in struct {
+		Title            string
+		Thumb            string
+		EntryFee         int
+		GoldCoinForPrize int
+		Rounds           []TournamentRound
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	stringLimit(&in.Title, 100)
+
+	//check rounds
+	roundNum := len(in.Rounds)
+	if roundNum == 0 || roundNum > TOURNAMENT_ROUND_MAX {
+		lwutil.SendError("err_rounds", "bad round num")
+	}
+	if in.EntryFee < 0 || in.GoldCoinForPrize < 0 {
+		lwutil.SendError("err_prize", "EntryFee < 0 || GoldCoinForPrize < 0")
+	}
+	lastEndTime := lwutil.GetRedisTimeUnix()
+	for i := range in.Rounds {
+		round := &in.Rounds[i]
+		packNum := len(round.PackIds)
+		if packNum == 0 || packNum > TOURNAMENT_PACK_MAX {
+			lwutil.SendError("err_packs", fmt.Sprintf("round %d: bad pack num", i))
+		}
+		for _, packId := range round.PackIds {
+			_, err = getPack(ssdbc, packId)
+			lwutil.CheckError(err, "err_pack")
+		}
+
+		if round.SliderNum < 3 {
+			round.SliderNum = 3
+		} else if round.SliderNum > 9 {
+			round.SliderNum = 9
+		}
+
+		if i < roundNum-1 && round.AdvanceNum <= 0 {
+			lwutil.SendError("err_advance_num", fmt.Sprintf("round %d: AdvanceNum <= 0", i))
+		}
+
+		beginTime, err := time.ParseInLocation("2006-01-02T15:04:05", round.BeginTimeStr, time.Local)
+		lwutil.CheckError(err, "err_time")
+		endTime, err := time.ParseInLocation("2006-01-02T15:04:05", round.EndTimeStr, time.Local)
+		lwutil.CheckError(err, "err_time")
+		round.BeginTime = beginTime.Unix()
+		round.EndTime = endTime.Unix()
+		if round.BeginTime < lastEndTime || round.EndTime <= round.BeginTime {
+			lwutil.SendError("err_time", fmt.Sprintf("round %d: bad time", i))
+		}
+		lastEndTime = round.EndTime
+	}
+
+	//new
+	tournament := Tournament{
+		Id:                   GenSerial(ssdbc, TOURNAMENT_SERIAL),
+		Title:                in.Title,
+		Thumb:                in.Thumb,
+		EntryFee:             in.EntryFee,
+		Prize:                in.GoldCoinForPrize * PRIZE_NUM_PER_COIN,
+		Rounds:               in.Rounds,
+		CurrRound:            0,
+		BeginTime:            in.Rounds[0].BeginTime,
+		EndTime:              in.Rounds[roundNum-1].EndTime,
+		HasResult:            false,
+		RankPrizeProportions: TOURNAMENT_RANK_PRIZE_PROPORTIONS,
+		MinPrizeProportion:   TOURNAMENT_MIN_PRIZE_PROPORTION,
+	}
+	saveTournament(ssdbc, &tournament)
+
+	resp, err := ssdbc.Do("zset", Z_TOURNAMENT, tournament.Id, tournament.BeginTime)
+	lwutil.CheckSsdbError(resp, err)
+
+	resp, err = ssdbc.Do("zset", Z_OPEN_TOURNAMENT, tournament.Id, tournament.Rounds[0].EndTime)
+	lwutil.CheckSsdbError(resp, err)
+
+	//out
+	lwutil.WriteResponse(w, tournament)
+}
+
+func apiTournamentList(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	_, err = findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		StartId   int64
+		BeginTime int64
+		Limit     int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.Limit <= 0 || in.Limit > 50 {
+		in.Limit = 50
+	}
+	if in.BeginTime == 0 {
+		in.BeginTime = math.MaxInt64
+	}
+
+	//
+	vals, err := zrscanGet(ssdbc, Z_TOURNAMENT, in.StartId, in.BeginTime, in.Limit, H_TOURNAMENT)
+	lwutil.CheckError(err, "")
+
+	type OutTournament struct {
+		*Tournament
+		PrizeSum int
+	}
+	out := struct {
+		Tournaments []OutTournament
+		LastKey     int64
+		LastScore   int64
+	}{}
+	out.Tournaments = make([]OutTournament, 0, len(vals)/2)
+
+	num := len(vals) / 2
+	for i := 0; i < num; i++ {
+		var tournament Tournament
+		err = json.Unmarshal([]byte(vals[i*2+1]), &tournament)
+		lwutil.CheckError(err, "")
+		out.Tournaments = append(out.Tournaments, OutTournament{&tournament, getTournamentPrize(ssdbc, &tournament)})
+		if i == num-1 {
+			out.LastKey = tournament.Id
+			out.LastScore = tournament.BeginTime
+		}
+	}
+
+	lwutil.WriteResponse(w, out)
+}
+
+func apiTournamentGet(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		TournamentId int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//
+	tournament := getTournament(ssdbc, in.TournamentId)
+	player, err := getTournamentPlayer(ssdbc, in.TournamentId, session.Userid)
+	lwutil.CheckError(err, "err_tournament_player")
+
+	playerNumKey := makeHTournamentExtraSubkey(in.TournamentId, TOURNAMENT_EXTRA_PLAYER_NUM)
+	resp, err := ssdbc.Do("hget", H_TOURNAMENT_EXTRA, playerNumKey)
+	lwutil.CheckError(err, "")
+	playerNum := 0
+	if resp[0] == "ok" {
+		playerNum, err = strconv.Atoi(resp[1])
+		lwutil.CheckError(err, "")
+	}
+
+	//out
+	out := struct {
+		*Tournament
+		PrizeSum  int
+		PlayerNum int
+		Me        *TournamentPlayer
+	}{
+		tournament,
+		getTournamentPrize(ssdbc, tournament),
+		playerNum,
+		player,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiTournamentJoin(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		TournamentId int64
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//check time
+	tournament := getTournament(ssdbc, in.TournamentId)
+	now := lwutil.GetRedisTimeUnix()
+	if tournament.HasResult || tournament.CurrRound != 0 || now >= tournament.Rounds[0].EndTime-MATCH_CLOSE_BEFORE_END_SEC {
+		lwutil.SendError("err_time", "tournament entry closed")
+	}
+
+	//check joined
+	player, err := getTournamentPlayer(ssdbc, in.TournamentId, session.Userid)
+	lwutil.CheckError(err, "err_tournament_player")
+	if player != nil {
+		lwutil.SendError("err_joined", "joined already")
+	}
+
+	//entry fee
+	playerKey := makePlayerInfoKey(session.Userid)
+	goldCoin := getPlayerGoldCoin(ssdbc, playerKey)
+	if tournament.EntryFee > 0 {
+		if goldCoin < tournament.EntryFee {
+			lwutil.SendError("err_gold_coin", "no coin")
+		}
+		goldCoin = addPlayerGoldCoin(ssdbc, playerKey, -tournament.EntryFee)
+		err = addEcoRecord(ssdbc, session.Userid, tournament.EntryFee, ECO_FORWHAT_TOURNAMENT_FEE)
+		lwutil.CheckError(err, "")
+
+		prizeKey := makeHTournamentExtraSubkey(in.TournamentId, TOURNAMENT_EXTRA_PRIZE)
+		resp, err := ssdbc.Do("hincr", H_TOURNAMENT_EXTRA, prizeKey, tournament.EntryFee*PRIZE_NUM_PER_COIN)
+		lwutil.CheckSsdbError(resp, err)
+	}
+
+	//new player
+	playerInfo, err := getPlayerInfo(ssdbc, session.Userid)
+	lwutil.CheckError(err, "")
+
+	player = &TournamentPlayer{
+		UserId:           session.Userid,
+		PlayerName:       playerInfo.NickName,
+		GravatarKey:      playerInfo.GravatarKey,
+		CustomAvartarKey: playerInfo.CustomAvatarKey,
+		AllowRound:       0,
+		PackMsecs:        make([][]int, len(tournament.Rounds)),
+		RoundRanks:       make([]int, len(tournament.Rounds)),
+		RoundMsecs:       make([]int, len(tournament.Rounds)),
+	}
+	for i, round := range tournament.Rounds {
+		player.PackMsecs[i] = make([]int, len(round.PackIds))
+	}
+	saveTournamentPlayer(ssdbc, in.TournamentId, player)
+
+	playerNumKey := makeHTournamentExtraSubkey(in.TournamentId, TOURNAMENT_EXTRA_PLAYER_NUM)
+	resp, err := ssdbc.Do("hincr", H_TOURNAMENT_EXTRA, playerNumKey, 1)
+	lwutil.CheckSsdbError(resp, err)
+
+	//out
+	out := struct {
+		Me       *TournamentPlayer
+		GoldCoin int
+		PrizeSum int
+	}{
+		player,
+		goldCoin,
+		getTournamentPrize(ssdbc, tournament),
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiTournamentPlayBegin(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		TournamentId int64
+		PackIdx      int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//check time
+	tournament := getTournament(ssdbc, in.TournamentId)
+	if tournament.HasResult {
+		lwutil.SendError("err_time", "tournament finished")
+	}
+	round := tournament.Rounds[tournament.CurrRound]
+	now := lwutil.GetRedisTimeUnix()
+	if now < round.BeginTime || now >= round.EndTime-MATCH_CLOSE_BEFORE_END_SEC {
+		lwutil.SendError("err_time", "round out of time")
+	}
+	if in.PackIdx < 0 || in.PackIdx >= len(round.PackIds) {
+		lwutil.SendError("err_pack_idx", "bad PackIdx")
+	}
+
+	//check player
+	player, err := getTournamentPlayer(ssdbc, in.TournamentId, session.Userid)
+	lwutil.CheckError(err, "err_tournament_player")
+	if player == nil {
+		lwutil.SendError("err_not_joined", "not joined")
+	}
+	if player.AllowRound != tournament.CurrRound {
+		lwutil.SendError("err_eliminated", "eliminated")
+	}
+
+	//gen secret
+	secret := lwutil.GenUUID()
+	secretExpire := now + MATCH_TRY_EXPIRE_SECONDS
+	playInfo := struct {
+		TournamentId int64
+		UserId       int64
+		Round        int
+		PackIdx      int
+	}{
+		in.TournamentId,
+		session.Userid,
+		tournament.CurrRound,
+		in.PackIdx,
+	}
+	js, err := json.Marshal(playInfo)
+	lwutil.CheckError(err, "")
+
+	secretKey := makeTournamentSecretKey(secret)
+	resp, err := ssdbc.Do("setx", secretKey, js, MATCH_TRY_EXPIRE_SECONDS)
+	lwutil.CheckSsdbError(resp, err)
+
+	pack, err := getPack(ssdbc, round.PackIds[in.PackIdx])
+	lwutil.CheckError(err, "err_pack")
+
+	//out
+	out := struct {
+		Secret       string
+		SecretExpire int64
+		SliderNum    int
+		Pack         *Pack
+	}{
+		secret,
+		secretExpire,
+		round.SliderNum,
+		pack,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiTournamentPlayEnd(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	session, err := findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		Secret   string
+		Score    int
+		Checksum string
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	//check score
+	if in.Score > -2000 {
+		glog.Errorf("invalid score:%d, userId:%d, userName:%s", in.Score, session.Userid, session.Username)
+		lwutil.SendError("err_score", "invalid score")
+	}
+
+	//secret
+	secretKey := makeTournamentSecretKey(in.Secret)
+	resp, err := ssdbc.Do("get", secretKey)
+	lwutil.CheckError(err, "")
+	if resp[0] != "ok" {
+		lwutil.SendError("err_expired", "secret expired")
+	}
+	var playInfo struct {
+		TournamentId int64
+		UserId       int64
+		Round        int
+		PackIdx      int
+	}
+	err = json.Unmarshal([]byte(resp[1]), &playInfo)
+	lwutil.CheckError(err, "")
+	if playInfo.UserId != session.Userid {
+		lwutil.SendError("err_not_match", "Secret not match")
+	}
+
+	//checksum
+	checksum := fmt.Sprintf("%s+%d9d7a", in.Secret, in.Score+8703)
+	hasher := sha1.New()
+	hasher.Write([]byte(checksum))
+	checksum = hex.EncodeToString(hasher.Sum(nil))
+	if in.Checksum != checksum {
+		lwutil.SendError("err_checksum", "")
+	}
+
+	//clear secret
+	resp, err = ssdbc.Do("del", secretKey)
+	lwutil.CheckSsdbError(resp, err)
+
+	//check round
+	tournament := getTournament(ssdbc, playInfo.TournamentId)
+	if tournament.HasResult || tournament.CurrRound != playInfo.Round {
+		lwutil.SendError("err_time", "round finished")
+	}
+
+	//update pack msec
+	player, err := getTournamentPlayer(ssdbc, playInfo.TournamentId, session.Userid)
+	lwutil.CheckError(err, "err_tournament_player")
+	if player == nil {
+		lwutil.SendError("err_not_joined", "not joined")
+	}
+
+	msec := -in.Score
+	packMsecs := player.PackMsecs[playInfo.Round]
+	if packMsecs[playInfo.PackIdx] == 0 || msec < packMsecs[playInfo.PackIdx] {
+		packMsecs[playInfo.PackIdx] = msec
+	}
+	saveTournamentPlayer(ssdbc, playInfo.TournamentId, player)
+
+	//round finished, update leaderboard
+	roundMsec := 0
+	for _, v := range packMsecs {
+		if v == 0 {
+			roundMsec = 0
+			break
+		}
+		roundMsec += v
+	}
+
+	myRank := 0
+	rankNum := 0
+	if roundMsec > 0 {
+		rc := redisPool.Get()
+		defer rc.Close()
+
+		lbKey := makeTournamentRoundLeaderboardRdsKey(playInfo.TournamentId, playInfo.Round)
+		_, err = rc.Do("ZADD", lbKey, -(player.TotalMsec + roundMsec), session.Userid)
+		lwutil.CheckError(err, "")
+
+		rc.Send("ZREVRANK", lbKey, session.Userid)
+		rc.Send("ZCARD", lbKey)
+		err = rc.Flush()
+		lwutil.CheckError(err, "")
+		myRank, err = redis.Int(rc.Receive())
+		lwutil.CheckError(err, "")
+		myRank += 1
+		rankNum, err = redis.Int(rc.Receive())
+		lwutil.CheckError(err, "")
+	}
+
+	//out
+	out := struct {
+		Me        *TournamentPlayer
+		RoundMsec int
+		TotalMsec int
+		MyRank    int
+		RankNum   int
+	}{
+		player,
+		roundMsec,
+		player.TotalMsec + roundMsec,
+		myRank,
+		rankNum,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+func apiTournamentGetStandings(w http.ResponseWriter, r *http.Request) {
+	lwutil.CheckMathod(r, "POST")
+	var err error
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	lwutil.CheckError(err, "")
+	defer ssdbc.Close()
+
+	//session
+	_, err = findSession(w, r, nil)
+	lwutil.CheckError(err, "err_auth")
+
+	//in
+	var in struct {
+		TournamentId int64
+		Round        int
+		Offset       int
+		Limit        int
+	}
+	err = lwutil.DecodeRequestBody(r, &in)
+	lwutil.CheckError(err, "err_decode_body")
+
+	if in.Limit <= 0 || in.Limit > 50 {
+		in.Limit = 50
+	}
+
+	tournament := getTournament(ssdbc, in.TournamentId)
+	if in.Round < 0 || in.Round > tournament.CurrRound {
+		lwutil.SendError("err_round", "bad round")
+	}
+
+	//get ranks
+	ranks := make([]TournamentRankInfo, 0, in.Limit)
+	rankNum := 0
+	settled := in.Round < tournament.CurrRound || tournament.HasResult
+	if settled {
+		hRankKey := makeHTournamentRoundRankKey(in.TournamentId, in.Round)
+		cmds := make([]interface{}, 2, in.Limit+2)
+		cmds[0] = "multi_hget"
+		cmds[1] = hRankKey
+		for i := 0; i < in.Limit; i++ {
+			cmds = append(cmds, in.Offset+i+1)
+		}
+		resp, err := ssdbc.Do(cmds...)
+		lwutil.CheckSsdbError(resp, err)
+		resp = resp[1:]
+
+		num := len(resp) / 2
+		for i := 0; i < num; i++ {
+			var rank TournamentRankInfo
+			rank.Rank, err = strconv.Atoi(resp[i*2])
+			lwutil.CheckError(err, "")
+			rank.UserId, err = strconv.ParseInt(resp[i*2+1], 10, 64)
+			lwutil.CheckError(err, "")
+			ranks = append(ranks, rank)
+		}
+
+		resp, err = ssdbc.Do("hsize", hRankKey)
+		lwutil.CheckSsdbError(resp, err)
+		rankNum, err = strconv.Atoi(resp[1])
+		lwutil.CheckError(err, "")
+	} else {
+		rc := redisPool.Get()
+		defer rc.Close()
+
+		lbKey := makeTournamentRoundLeaderboardRdsKey(in.TournamentId, in.Round)
+		values, err := redis.Values(rc.Do("ZREVRANGE", lbKey, in.Offset, in.Offset+in.Limit-1))
+		lwutil.CheckError(err, "")
+		for i, v := range values {
+			var rank TournamentRankInfo
+			rank.Rank = in.Offset + i + 1
+			rank.UserId, err = redisInt64(v, nil)
+			lwutil.CheckError(err, "")
+			ranks = append(ranks, rank)
+		}
+
+		rankNum, err = redis.Int(rc.Do("ZCARD", lbKey))
+		lwutil.CheckError(err, "")
+	}
+
+	//get players
+	num := len(ranks)
+	if num > 0 {
+		cmds := make([]interface{}, 2, num+2)
+		cmds[0] = "multi_hget"
+		cmds[1] = makeHTournamentPlayerKey(in.TournamentId)
+		for _, rank := range ranks {
+			cmds = append(cmds, rank.UserId)
+		}
+		resp, err := ssdbc.Do(cmds...)
+		lwutil.CheckSsdbError(resp, err)
+		resp = resp[1:]
+
+		if num*2 != len(resp) {
+			lwutil.SendError("err_data_missing", "")
+		}
+		isLastRound := in.Round == len(tournament.Rounds)-1
+		for i := range ranks {
+			var player TournamentPlayer
+			err = json.Unmarshal([]byte(resp[i*2+1]), &player)
+			lwutil.CheckError(err, "")
+			ranks[i].NickName = player.PlayerName
+			ranks[i].GravatarKey = player.GravatarKey
+			ranks[i].CustomAvatarKey = player.CustomAvartarKey
+			if settled {
+				ranks[i].Msec = player.RoundMsecs[in.Round]
+				ranks[i].Advanced = !isLastRound && player.AllowRound > in.Round
+			} else {
+				ranks[i].Msec = player.TotalMsec
+				for _, v := range player.PackMsecs[in.Round] {
+					ranks[i].Msec += v
+				}
+			}
+		}
+	}
+
+	//out
+	out := struct {
+		TournamentId int64
+		Round        int
+		Ranks        []TournamentRankInfo
+		RankNum      int
+	}{
+		in.TournamentId,
+		in.Round,
+		ranks,
+		rankNum,
+	}
+	lwutil.WriteResponse(w, out)
+}
+
+//settle the round of each tournament whose current round is over
+func tournamentCron() {
+	defer handleError()
+
+	//ssdb
+	ssdbc, err := ssdbPool.Get()
+	checkError(err)
+	defer ssdbc.Close()
+
+	//redis
+	rc := redisPool.Get()
+	defer rc.Close()
+
+	now := lwutil.GetRedisTimeUnix()
+	resp, err := ssdbc.Do("zscan", Z_OPEN_TOURNAMENT, "", "", now, 100)
+	checkError(err)
+	resp = resp[1:]
+
+	num := len(resp) / 2
+	for i := 0; i < num; i++ {
+		tournamentId, err := strconv.ParseInt(resp[i*2], 10, 64)
+		checkError(err)
+		settleTournamentRound(ssdbc, rc, tournamentId)
+	}
+}
+
+func settleTournamentRound(ssdbc *ssdb.Client, rc redis.Conn, tournamentId int64) {
+	tournament := getTournament(ssdbc, tournamentId)
+	roundIdx := tournament.CurrRound
+	round := tournament.Rounds[roundIdx]
+	isLastRound := roundIdx == len(tournament.Rounds)-1
+	prizeSum := getTournamentPrize(ssdbc, tournament)
+
+	lbKey := makeTournamentRoundLeaderboardRdsKey(tournamentId, roundIdx)
+	rankNum, err := redis.Int(rc.Do("ZCARD", lbKey))
+	checkError(err)
+
+	hRankKey := makeHTournamentRoundRankKey(tournamentId, roundIdx)
+	numPerBatch := 1000
+	currRank := 1
+
+	//for each rank batch
+	for iBatch := 0; iBatch < rankNum/numPerBatch+1; iBatch++ {
+		offset := iBatch * numPerBatch
+		values, err := redis.Values(rc.Do("ZREVRANGE", lbKey, offset, offset+numPerBatch-1, "WITHSCORES"))
+		checkError(err)
+
+		num := len(values) / 2
+		if num == 0 {
+			break
+		}
+
+		//for each rank
+		for i := 0; i < num; i++ {
+			rank := currRank
+			currRank++
+			userId, err := redis.Int64(values[i*2], nil)
+			checkError(err)
+			score, err := redis.Int(values[i*2+1], nil)
+			checkError(err)
+
+			player, err := getTournamentPlayer(ssdbc, tournamentId, userId)
+			checkError(err)
+			if player == nil {
+				glog.Error("no tournament player")
+				continue
+			}
+			player.TotalMsec = -score
+			player.RoundMsecs[roundIdx] = -score
+			player.RoundRanks[roundIdx] = rank
+
+			if isLastRound {
+				player.FinalRank = rank
+				player.Prize = calcTournamentRankPrize(tournament, prizeSum, rank)
+				addPrizeToCache(ssdbc, userId, 0, tournament.Thumb, player.Prize, PRIZE_REASON_TOURNAMENT, rank)
+				if player.Prize > 0 {
+					addEcoRecord(ssdbc, userId, player.Prize, ECO_FORWHAT_TOURNAMENT_PRIZE)
+				}
+			} else if rank <= round.AdvanceNum {
+				player.AllowRound = roundIdx + 1
+			}
+			saveTournamentPlayer(ssdbc, tournamentId, player)
+
+			r, err := ssdbc.Do("hset", hRankKey, rank, userId)
+			checkSsdbError(r, err)
+		}
+	}
+
+	//del leaderboard redis
+	_, err = rc.Do("DEL", lbKey)
+	checkError(err)
+
+	//next round or finish
+	if isLastRound || currRank == 1 {
+		tournament.HasResult = true
+		r, err := ssdbc.Do("zdel", Z_OPEN_TOURNAMENT, tournamentId)
+		checkSsdbError(r, err)
+	} else {
+		tournament.CurrRound++
+		nextRound := tournament.Rounds[tournament.CurrRound]
+		r, err := ssdbc.Do("zset", Z_OPEN_TOURNAMENT, tournamentId, nextRound.EndTime)
+		checkSsdbError(r, err)
+	}
+	saveTournament(ssdbc, tournament)
+
+	glog.Infof("tournament round settled: tournamentId=%d, round=%d, rankNum=%d", tournamentId, roundIdx, rankNum)
+}
+
+func regTournament() {
+	http.Handle("/tournament/new", lwutil.ReqHandler(apiTournamentNew))
+	http.Handle("/tournament/list", lwutil.ReqHandler(apiTournamentList))
+	http.Handle("/tournament/get", lwutil.ReqHandler(apiTournamentGet))
+	http.Handle("/tournament/join", lwutil.ReqHandler(apiTournamentJoin))
+	http.Handle("/tournament/playBegin", lwutil.ReqHandler(apiTournamentPlayBegin))
+	http.Handle("/tournament/playEnd", lwutil.ReqHandler(apiTournamentPlayEnd))
+	http.Handle("/tournament/getStandings", lwutil.ReqHandler(apiTournamentGetStandings))
+}
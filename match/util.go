@@ -18,6 +18,9 @@ import (
 const (
 	SSDB_OK        = "ok"
 	SSDB_NOT_FOUND = "not_found"
+
+	DAY_SEC              = 60 * 60 * 24
+	SERVER_TZ_OFFSET_SEC = 60 * 60 * 8 //beijing time, independent of the process timezone
 )
 
 func stringLimit(str *string, limit uint) {
@@ -132,3 +135,13 @@ func formateMsec(msec int) string {
 func parseInt64(str string) (int64, error) {
 	return strconv.ParseInt(str, 10, 64)
 }
+
+//days since epoch at the given utc offset
+func makeDayIndex(t int64, tzOffsetSec int) int64 {
+	t += int64(tzOffsetSec)
+	day := t / DAY_SEC
+	if t < 0 && t%DAY_SEC != 0 {
+		day--
+	}
+	return day
+}